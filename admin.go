@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// ============================================================================
+// ADMIN ENDPOINTS
+// ============================================================================
+
+var (
+	// Bearer token for /admin/*. Empty leaves the read-only ones open (e.g.
+	// on a private network) and refuses the ones that change data, routing
+	// or tenants.
+	ADMIN_TOKEN = getEnv("ADMIN_TOKEN", "")
+)
+
+func setupAdminHandlers() {
+	// GET /admin/workers - Per-worker counters and current state
+	http.HandleFunc("/admin/workers", requireAdmin(handleAdminWorkers))
+
+	// GET/PUT /admin/routing - Routing score components and live tuning
+	http.HandleFunc("/admin/routing", requireAdminToken(handleAdminRouting))
+
+	// GET /admin/queue-stats - Full-queue episodes and arrival rates
+	http.HandleFunc("/admin/queue-stats", requireAdmin(handleAdminQueueStats))
+
+	// POST /admin/purge-payments - Delete the gateway's payment data only
+	http.HandleFunc("/admin/purge-payments", requireAdminToken(handleAdminPurge))
+
+	// GET/POST /admin/maintenance - Pause /payments for a while
+	http.HandleFunc("/admin/maintenance", requireAdminToken(handleAdminMaintenance))
+
+	// GET /admin/startup - What recovery did at boot
+	http.HandleFunc("/admin/startup", requireAdmin(handleAdminStartup))
+
+	if !redisBacked() {
+		return
+	}
+
+	// POST /admin/corrections - Void or re-amount a recorded payment (audited)
+	http.HandleFunc("/admin/corrections", requireAdminToken(handleAdminCorrections))
+
+	// GET /admin/dlq - Payments rejected by both processors
+	http.HandleFunc("/admin/dlq", requireAdmin(handleAdminDLQ))
+
+	// POST /admin/dlq/replay - Re-enqueue all or selected dead letters
+	http.HandleFunc("/admin/dlq/replay", requireAdminToken(handleAdminDLQReplay))
+
+	// GET /admin/replication - Warm standby state (INSTANCE_ROLE)
+	http.HandleFunc("/admin/replication", requireAdmin(handleAdminReplication))
+
+	// GET /admin/tenants, GET/PUT/DELETE /admin/tenants/{name} - Tenant settings
+	http.HandleFunc("/admin/tenants", requireAdminToken(handleAdminTenants))
+	http.HandleFunc("/admin/tenants/", requireAdminToken(handleAdminTenant))
+
+	// GET /admin/ledger, /admin/ledger/balances - Journal and reconciliation
+	if ledgerEnabled() {
+		http.HandleFunc("/admin/ledger", requireAdmin(handleAdminLedger))
+		http.HandleFunc("/admin/ledger/balances", requireAdmin(handleAdminLedgerBalances))
+	}
+}
+
+// Rejects requests without the admin token when one is configured
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ADMIN_TOKEN != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(ADMIN_TOKEN)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// requireAdmin for the endpoints that change state (or expose tenant keys):
+// refused outright when no ADMIN_TOKEN is configured
+func requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if ADMIN_TOKEN == "" {
+			writeJSONError(w, http.StatusForbidden, "admin_token_required", "set ADMIN_TOKEN to enable "+r.URL.Path)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func handleAdminWorkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(workerSnapshots())
+}
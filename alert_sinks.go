@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// ALERT SINKS (webhook, Slack, SMTP, SNS)
+// ============================================================================
+
+var (
+	// Mail relay for smtp: sinks, host:port; STARTTLS is used when offered
+	ALERT_SMTP_ADDR     = getEnv("ALERT_SMTP_ADDR", "localhost:25")
+	ALERT_SMTP_FROM     = getEnv("ALERT_SMTP_FROM", "gateway@localhost")
+	ALERT_SMTP_USER     = getEnv("ALERT_SMTP_USER", "")
+	ALERT_SMTP_PASSWORD = getEnv("ALERT_SMTP_PASSWORD", "")
+
+	// SNS API endpoint; the topic must live in AWS_REGION
+	ALERT_SNS_ENDPOINT = getEnv("ALERT_SNS_ENDPOINT", "https://sns."+AWS_REGION+".amazonaws.com/")
+)
+
+// "slack:https://hooks.slack.com/..." -> slack sink
+func parseAlertSink(spec string) (alertSink, error) {
+	kind, target, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "webhook", "slack":
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("not an http(s) URL")
+		}
+		if kind == "slack" {
+			return slackSink{url: target}, nil
+		}
+		return webhookSink{url: target}, nil
+	case "smtp":
+		if !strings.Contains(target, "@") {
+			return nil, errors.New("not an email address")
+		}
+		return smtpSink{to: target}, nil
+	case "sns":
+		if !strings.HasPrefix(target, "arn:aws:sns:") {
+			return nil, errors.New("not an SNS topic ARN")
+		}
+		return snsSink{topic: target}, nil
+	}
+	return nil, errors.New("sinks must be webhook:, slack:, smtp: or sns:")
+}
+
+// Plain-text rendering for the human channels: message, then sorted details
+func alertText(a alert) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s: %s", a.Type, a.Instance, a.Message)
+	keys := make([]string, 0, len(a.Details))
+	for k := range a.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\n%s: %v", k, a.Details[k])
+	}
+	return b.String()
+}
+
+func postJSON(ctx context.Context, target string, body []byte, sign bool) error {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if sign {
+		signWebhook(req, body)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Webhook: the alert as JSON, signed like the event webhooks
+// ----------------------------------------------------------------------------
+
+type webhookSink struct{ url string }
+
+func (s webhookSink) name() string { return "webhook:" + s.url }
+
+func (s webhookSink) deliver(ctx context.Context, a alert) error {
+	body, err := jsonFast.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.url, body, true)
+}
+
+// ----------------------------------------------------------------------------
+// Slack incoming webhook
+// ----------------------------------------------------------------------------
+
+type slackSink struct{ url string }
+
+func (s slackSink) name() string { return "slack:" + s.url }
+
+func (s slackSink) deliver(ctx context.Context, a alert) error {
+	body, err := jsonFast.Marshal(map[string]string{"text": alertText(a)})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.url, body, false)
+}
+
+// ----------------------------------------------------------------------------
+// Email through ALERT_SMTP_ADDR
+// ----------------------------------------------------------------------------
+
+type smtpSink struct{ to string }
+
+func (s smtpSink) name() string { return "smtp:" + s.to }
+
+func (s smtpSink) deliver(ctx context.Context, a alert) error {
+	host, _, err := net.SplitHostPort(ALERT_SMTP_ADDR)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", ALERT_SMTP_ADDR)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// net/smtp knows nothing of contexts; the deadline bounds the dialogue
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if ALERT_SMTP_USER != "" {
+		if err := c.Auth(smtp.PlainAuth("", ALERT_SMTP_USER, ALERT_SMTP_PASSWORD, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(ALERT_SMTP_FROM); err != nil {
+		return err
+	}
+	if err := c.Rcpt(s.to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	msg := "From: " + ALERT_SMTP_FROM + "\r\n" +
+		"To: " + s.to + "\r\n" +
+		"Subject: [" + SERVICE_NAME + "] " + a.Type + " on " + a.Instance + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.ReplaceAll(alertText(a), "\n", "\r\n") + "\r\n"
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// ----------------------------------------------------------------------------
+// SNS Publish, signed with the AWS_* credentials
+// ----------------------------------------------------------------------------
+
+type snsSink struct{ topic string }
+
+func (s snsSink) name() string { return "sns:" + s.topic }
+
+func (s snsSink) deliver(ctx context.Context, a alert) error {
+	message, err := jsonFast.MarshalToString(a)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {s.topic},
+		// SNS caps subjects at 100 characters
+		"Subject": {truncate(a.Type+" on "+a.Instance, 100)},
+		"Message": {message},
+	}
+	body := []byte(form.Encode())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, ALERT_SNS_ENDPOINT, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signAWSRequest(req, body, "sns")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// ALERTS
+// ============================================================================
+
+var (
+	// Set from Config.AlertRoutes at startup
+	alertRoutes []alertRoute
+
+	metricAlertFailures = newCounterVec("gateway_alert_delivery_failures_total", "Alerts a sink failed to deliver.", "sink")
+
+	alertLog = componentLogger("alerts")
+)
+
+// Alert delivered to the sinks
+type alert struct {
+	Type     string                 `json:"type"`
+	Instance string                 `json:"instance"`
+	Message  string                 `json:"message"`
+	Time     string                 `json:"time"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+}
+
+// Delivery channel for alerts
+type alertSink interface {
+	// Kind and destination, for logs and metrics
+	name() string
+	deliver(ctx context.Context, a alert) error
+}
+
+// Sink receiving the alert types in types (every type when nil)
+type alertRoute struct {
+	types map[string]bool
+	sink  alertSink
+}
+
+// ALERT_SINKS is whitespace-separated [<types>=]<sink>, where types is a
+// comma list of alert types (all of them when omitted) and sink one of
+// webhook:<url>, slack:<incoming webhook url>, smtp:<address> or
+// sns:<topic arn>, e.g.
+// "worker_stall,brownout=slack:https://hooks.slack.com/services/T/B/X smtp:oncall@example.com".
+// ALERT_WEBHOOK_URL, which receives a JSON POST for every alert, is
+// shorthand for an entry webhook:<url>.
+func loadAlertRoutes(env *envParser) []alertRoute {
+	var routes []alertRoute
+	if webhookURL := os.Getenv("ALERT_WEBHOOK_URL"); webhookURL != "" {
+		sink, err := parseAlertSink("webhook:" + webhookURL)
+		env.check("ALERT_WEBHOOK_URL", webhookURL, err)
+		routes = append(routes, alertRoute{sink: sink})
+	}
+	for _, entry := range strings.Fields(os.Getenv("ALERT_SINKS")) {
+		route := alertRoute{}
+		// A types prefix has no colon; URLs and ARNs always do
+		spec := entry
+		if types, sink, ok := strings.Cut(entry, "="); ok && !strings.Contains(types, ":") {
+			route.types = splitSet(types)
+			spec = sink
+		}
+		var err error
+		if route.sink, err = parseAlertSink(spec); err != nil {
+			env.fail("ALERT_SINKS", entry, err.Error())
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// Sinks the alert of type kind goes to
+func alertSinksFor(kind string) []alertSink {
+	var sinks []alertSink
+	for _, route := range alertRoutes {
+		if route.types == nil || route.types[kind] {
+			sinks = append(sinks, route.sink)
+		}
+	}
+	return sinks
+}
+
+// Fires an alert in the background; delivery failures are only printed
+func sendAlert(kind, message string, details map[string]interface{}) {
+	a, sinks := buildAlert(kind, message, details)
+	if len(sinks) == 0 {
+		return
+	}
+	if !spawn("alert", func() { deliverAlert(a, sinks) }) {
+		alertLog.Error("alert delivery skipped, over the resource budget", "alert", kind)
+	}
+}
+
+// Like sendAlert, but delivers on the caller's goroutine: for alerts about
+// the budget itself, which spawn would refuse
+func sendAlertSync(kind, message string, details map[string]interface{}) {
+	if a, sinks := buildAlert(kind, message, details); len(sinks) > 0 {
+		deliverAlert(a, sinks)
+	}
+}
+
+// Logs the alert and picks its sinks; none when nothing is configured for
+// its type
+func buildAlert(kind, message string, details map[string]interface{}) (alert, []alertSink) {
+	alertLog.Warn(message, "alert", kind)
+	return alert{
+		Type:     kind,
+		Instance: INSTANCE_ID,
+		Message:  message,
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Details:  details,
+	}, alertSinksFor(kind)
+}
+
+// One sink after the other, each with its own timeout
+func deliverAlert(a alert, sinks []alertSink) {
+	for _, sink := range sinks {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := sink.deliver(ctx, a); err != nil {
+			metricAlertFailures.Inc(strings.SplitN(sink.name(), ":", 2)[0])
+			alertLog.Error("alert delivery failed", "alert", a.Type, "sink", sink.name(), "err", err)
+		}
+		cancel()
+	}
+}
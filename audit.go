@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// ASYNC AUDIT LOG
+// ============================================================================
+
+// Entries appended to the audit log off the ingest path (shed or rejected
+// payments); nil until a feature that audits starts it
+var auditQueue chan []interface{}
+
+var auditLog = componentLogger("audit")
+
+// Starts the writer once, for the redis store only
+func startAuditWriter() {
+	if auditQueue != nil || !redisBacked() {
+		return
+	}
+	auditQueue = make(chan []interface{}, 10000)
+	go writeAudit()
+}
+
+// Queues one entry (XADD field/value pairs) without blocking; a full buffer
+// drops it
+func queueAudit(values []interface{}) {
+	if auditQueue == nil {
+		return
+	}
+	select {
+	case auditQueue <- values:
+	default:
+		auditLog.Warn("audit buffer full, entry dropped", "action", values[1])
+	}
+}
+
+// Appends queued entries in pipelines of up to 100
+func writeAudit() {
+	ctx := context.Background()
+	for values := range auditQueue {
+		pipe := redisClient.Pipeline()
+		for n := 0; ; n++ {
+			pipe.XAdd(ctx, &redis.XAddArgs{Stream: auditKey, Values: values})
+			if n == 99 || len(auditQueue) == 0 {
+				break
+			}
+			values = <-auditQueue
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			auditLog.Warn("audit write failed", "err", err)
+		}
+	}
+}
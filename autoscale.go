@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// WORKER AUTOSCALING (WORKERS_MIN / WORKERS_MAX)
+// ============================================================================
+
+var (
+	// Processing time of finished jobs since the last tick
+	jobsFinished atomic.Int64
+	jobNanos     atomic.Int64
+
+	// Processor response time of forwards since the last tick
+	forwardsDone atomic.Int64
+	forwardNanos atomic.Int64
+
+	metricWorkerScaling = newCounterVec("gateway_worker_scaling_total", "Autoscaler decisions: resizes (up, down) and growth held back by slow processors (held).", "direction")
+
+	autoscaleLog = componentLogger("autoscale")
+)
+
+type AutoscaleConfig struct {
+	// How often the pool size is reconsidered
+	Interval time.Duration
+	// Grow while the queued payments would take longer than this to clear
+	// at the current pool size and average processing time
+	TargetDrain time.Duration
+	// Shrink only after the queue has been empty, with at most half the
+	// workers busy, for this long
+	Cooldown time.Duration
+	// Don't grow while forwards take longer than this on average (0 never
+	// holds): the processors are the bottleneck then, and more workers only
+	// deepen their backlog
+	MaxLatency time.Duration
+}
+
+func loadAutoscaleConfig(env *envParser) AutoscaleConfig {
+	return AutoscaleConfig{
+		Interval:    env.duration("AUTOSCALE_INTERVAL", time.Second),
+		TargetDrain: env.duration("AUTOSCALE_TARGET_DRAIN", 500*time.Millisecond),
+		Cooldown:    env.durationOrZero("AUTOSCALE_COOLDOWN", 30*time.Second),
+		MaxLatency:  env.durationOrZero("AUTOSCALE_MAX_LATENCY", 0),
+	}
+}
+
+func recordJobTime(d time.Duration) {
+	jobsFinished.Add(1)
+	jobNanos.Add(int64(d))
+}
+
+func recordForwardTime(d time.Duration) {
+	forwardsDone.Add(1)
+	forwardNanos.Add(int64(d))
+}
+
+// Folds the samples since the last tick into a moving average
+func smoothed(avg time.Duration, count, nanos *atomic.Int64) time.Duration {
+	n := count.Swap(0)
+	if n == 0 {
+		return avg
+	}
+	sample := time.Duration(nanos.Swap(0) / n)
+	if avg == 0 {
+		return sample
+	}
+	return (avg*3 + sample) / 4
+}
+
+func startAutoscaler(minWorkers, maxWorkers int, cfg AutoscaleConfig) {
+	if minWorkers == maxWorkers {
+		return
+	}
+	go autoscale(minWorkers, maxWorkers, cfg)
+}
+
+func autoscale(minWorkers, maxWorkers int, cfg AutoscaleConfig) {
+	quietSince := time.Now()
+	avg := time.Duration(0)     // Smoothed processing time per payment
+	latency := time.Duration(0) // Smoothed processor response time
+	held := false
+	for range time.Tick(cfg.Interval) {
+		if draining.Load() {
+			return
+		}
+		avg = smoothed(avg, &jobsFinished, &jobNanos)
+		latency = smoothed(latency, &forwardsDone, &forwardNanos)
+
+		size, depth := workerCount(), len(paymentQueue)
+		busy := int(busyWorkers.Load())
+		if depth > 0 || busy*2 > size {
+			quietSince = time.Now()
+		}
+
+		backlogged := depth > 0 && size < maxWorkers && avg > 0 && avg*time.Duration(depth)/time.Duration(size) > cfg.TargetDrain
+		holding := backlogged && cfg.MaxLatency > 0 && latency > cfg.MaxLatency
+		if holding && !held {
+			metricWorkerScaling.Inc("held")
+			autoscaleLog.Warn("processors slow, holding worker pool", "workers", size, "queueDepth", depth, "processorLatency", latency)
+		}
+		held = holding
+
+		switch {
+		case holding:
+		case backlogged:
+			// Enough workers to clear the backlog within the target, at most
+			// doubling per tick so one slow sample can't max the pool out
+			want := int(avg * time.Duration(depth) / cfg.TargetDrain)
+			grow := min(max(want-size, 1), size, maxWorkers-size)
+			for i := 0; i < grow; i++ {
+				startWorker()
+			}
+			metricWorkerScaling.Inc("up")
+			autoscaleLog.Info("growing worker pool", "workers", size+grow, "queueDepth", depth, "avgProcessing", avg, "processorLatency", latency)
+		case size > minWorkers && time.Since(quietSince) >= cfg.Cooldown:
+			// A quarter at a time, so a lull between bursts isn't overcorrected
+			removed := stopWorkers(max((size-minWorkers)/4, 1), minWorkers)
+			quietSince = time.Now()
+			metricWorkerScaling.Inc("down")
+			autoscaleLog.Info("shrinking worker pool", "workers", size-removed)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// BATCH INGESTION (POST /payments/batch)
+// ============================================================================
+
+// Per-payment answer: what POST /payments would have said for it
+type batchItemResult struct {
+	Index         int             `json:"index"`
+	Status        int             `json:"status"`
+	CorrelationId string          `json:"correlationId,omitempty"`
+	Body          json.RawMessage `json:"body,omitempty"`
+}
+
+type batchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []batchItemResult `json:"results"`
+}
+
+// POST /payments/batch - a JSON array of payments, or one per line with
+// Content-Type: application/x-ndjson. Each is validated, claimed and queued
+// exactly like a POST /payments, and always queued (no waiting, even with
+// SUBMIT_MODE=sync): outcomes come from GET /payments/{id} or POST
+// /payments/status. Answers 200 with one result per payment, in order;
+// only a malformed or oversized batch as a whole gets a 4xx.
+func handlePaymentBatch(maxItems int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if paused := checkMaintenance(); paused != nil {
+			paused.write(w)
+			return
+		}
+		items, err := readBatch(r, maxItems)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_batch", err.Error())
+			return
+		}
+
+		apiKey, traceparent, client := r.Header.Get("X-API-Key"), r.Header.Get("traceparent"), clientIP(r)
+		priority := r.Header.Get("X-Payment-Priority")
+		namespace := r.Header.Get(NAMESPACE_HEADER)
+		resp := batchResponse{Results: make([]batchItemResult, len(items))}
+		for i, item := range items {
+			job, ingest, answer := admitPayment(ingestRequest{ctx: r.Context(), body: item, apiKey: apiKey, clientIP: client, traceparent: traceparent, priority: priority, namespace: namespace})
+			if answer == nil {
+				answer = enqueuePayment(job, ingest)
+			}
+			result := batchItemResult{Index: i, Status: answer.status, CorrelationId: job.CorrelationId}
+			if answer.body != nil {
+				result.Body = bytes.TrimSpace(answer.body)
+			}
+			if answer.status/100 == 2 {
+				resp.Accepted++
+			} else {
+				resp.Rejected++
+			}
+			resp.Results[i] = result
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = jsonFast.NewEncoder(w).Encode(resp)
+	}
+}
+
+// At most maxItems (PAYMENTS_BATCH_MAX) payments
+func readBatch(r *http.Request, maxItems int) ([]json.RawMessage, error) {
+	tooLarge := errors.New("a batch holds at most " + strconv.Itoa(maxItems) + " payments")
+	var items []json.RawMessage
+	if strings.Contains(r.Header.Get("Content-Type"), "ndjson") {
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if len(items) == maxItems {
+				return nil, tooLarge
+			}
+			items = append(items, append(json.RawMessage(nil), line...))
+		}
+		if scanner.Err() != nil {
+			return nil, errors.New("unreadable NDJSON body: " + scanner.Err().Error())
+		}
+	} else if err := jsonFast.NewDecoder(r.Body).Decode(&items); err != nil {
+		return nil, errors.New("body must be a JSON array of payments, or NDJSON with Content-Type: application/x-ndjson")
+	}
+	if len(items) == 0 {
+		return nil, errors.New("the batch is empty")
+	}
+	if len(items) > maxItems {
+		return nil, tooLarge
+	}
+	return items, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// CIRCUIT BREAKER
+// ============================================================================
+
+type BreakerConfig struct {
+	FailureThreshold int // Consecutive failures that open the breaker
+	HalfOpenProbes   int // Trial calls let through while half-open
+	// Time an open breaker rejects calls before letting probes through
+	Cooldown time.Duration
+}
+
+func loadBreakerConfig(env *envParser) BreakerConfig {
+	return BreakerConfig{
+		FailureThreshold: env.int("BREAKER_FAILURE_THRESHOLD", 5, 1),
+		HalfOpenProbes:   env.int("BREAKER_HALF_OPEN_PROBES", 1, 1),
+		Cooldown:         env.duration("BREAKER_COOLDOWN", 5*time.Second),
+	}
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	maxProbes int
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  int
+}
+
+func newCircuitBreaker(cfg BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: cfg.FailureThreshold,
+		cooldown:  cfg.Cooldown,
+		maxProbes: cfg.HalfOpenProbes,
+	}
+}
+
+// Allow reports whether a call may go out; every allowed call must be
+// followed by Success or Failure
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state, b.probing = breakerHalfOpen, 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing >= b.maxProbes {
+			return false
+		}
+		b.probing++
+	}
+	return true
+}
+
+// Open reports whether calls are currently short-circuited
+func (b *circuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen && time.Since(b.openedAt) < b.cooldown
+}
+
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state, b.failures, b.probing = breakerClosed, 0, 0
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state, b.openedAt, b.probing = breakerOpen, time.Now(), 0
+	}
+}
+
+// Releases a probe slot without judging the processor (e.g. cancelled call)
+func (b *circuitBreaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen && b.probing > 0 {
+		b.probing--
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// BROWNOUT
+// ============================================================================
+
+var (
+	brownedOut   atomic.Bool
+	brownoutShed map[string]bool // Set by startBrownout
+
+	metricBrownouts = newCounterVec("gateway_brownouts_total", "Times the instance entered brownout.", "")
+
+	brownoutLog = componentLogger("brownout")
+)
+
+type BrownoutConfig struct {
+	// auto (queue watermarks), on (forced, e.g. ahead of a known peak) or off
+	Mode string
+	// Queue fill percentages: in auto mode, enter above Enter and leave
+	// below Exit
+	Enter, Exit int
+	// Work skipped while browned out: tracing, events (SSE and webhooks),
+	// status (the intermediate queued/processing states) and profiling.
+	// Acceptance, forwarding and summaries always run.
+	Shed []string
+}
+
+func loadBrownoutConfig(env *envParser) BrownoutConfig {
+	c := BrownoutConfig{
+		Mode:  env.oneOf("BROWNOUT", "auto", "auto", "on", "off"),
+		Enter: env.int("BROWNOUT_ENTER", 75, 0),
+		Exit:  env.int("BROWNOUT_EXIT", 25, 0),
+		Shed:  env.subset("BROWNOUT_SHED", "tracing,events,status,profiling", "tracing", "events", "status", "profiling"),
+	}
+	if c.Mode == "auto" && (c.Exit >= c.Enter || c.Enter > 100) {
+		env.fail("BROWNOUT_EXIT", strconv.Itoa(c.Exit), "must be below BROWNOUT_ENTER, both between 0 and 100")
+	}
+	return c
+}
+
+// Whether a non-essential feature is being shed right now
+func shedding(feature string) bool {
+	return brownedOut.Load() && brownoutShed[feature]
+}
+
+func startBrownout(cfg BrownoutConfig) {
+	brownoutShed = make(map[string]bool)
+	for _, feature := range cfg.Shed {
+		brownoutShed[feature] = true
+	}
+	switch cfg.Mode {
+	case "on":
+		brownedOut.Store(true)
+		metricBrownouts.Inc("")
+	case "auto":
+		go watchBrownout(cfg.Enter, cfg.Exit, strings.Join(cfg.Shed, ","))
+	}
+}
+
+// Watches queue fill with hysteresis so a queue hovering around one
+// threshold doesn't flap
+func watchBrownout(enter, exit int, shed string) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		fill := queueFillPercent()
+		switch {
+		case !brownedOut.Load() && fill >= enter:
+			brownedOut.Store(true)
+			metricBrownouts.Inc("")
+			sendAlert("brownout", "queue at "+strconv.Itoa(fill)+"% of capacity, shedding "+shed,
+				map[string]interface{}{"queueFillPercent": fill})
+		case brownedOut.Load() && fill <= exit:
+			brownedOut.Store(false)
+			brownoutLog.Info("brownout over", "queueFillPercent", fill)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// GOROUTINE AND FILE DESCRIPTOR BUDGETS
+// ============================================================================
+
+var (
+	// Goroutines (GOROUTINE_BUDGET) and open descriptors (FD_BUDGET) beyond
+	// which optional async work, alerts and anything else started through
+	// spawn, is refused instead of started; 0 disables
+	goroutineBudget, fdBudget int
+
+	// Last sample; counting descriptors walks a directory, so spawn reads
+	// this rather than counting on every call
+	openFDCount atomic.Int64
+
+	metricSpawnRefused = newCounterVec("gateway_spawn_refused_total", "Async work refused for being over the goroutine or FD budget.", "kind")
+
+	budgetLog = componentLogger("budget")
+)
+
+// An fds of 0 is 90% of the soft RLIMIT_NOFILE where the platform reports one
+func startBudgets(goroutines, fds int) {
+	goroutineBudget, fdBudget = goroutines, fds
+	if limit := fdLimit(); fdBudget == 0 && limit > 0 {
+		fdBudget = limit * 9 / 10
+	}
+	openFDCount.Store(int64(openFDs()))
+	go watchBudgets()
+}
+
+// Samples the descriptor count and alerts once per excursion over a budget
+func watchBudgets() {
+	over := false
+	for range time.Tick(time.Second) {
+		fds := openFDs()
+		openFDCount.Store(int64(fds))
+		exceeded := overBudget()
+		if exceeded && !over {
+			budgetLog.Warn("resource budget exceeded, refusing async work",
+				"goroutines", runtime.NumGoroutine(), "goroutineBudget", goroutineBudget, "fds", fds, "fdBudget", fdBudget)
+			sendAlertSync("resource_budget", "goroutine or file descriptor budget exceeded", map[string]interface{}{
+				"goroutines": runtime.NumGoroutine(),
+				"fds":        fds,
+			})
+		}
+		over = exceeded
+	}
+}
+
+func overBudget() bool {
+	if goroutineBudget > 0 && runtime.NumGoroutine() >= goroutineBudget {
+		return true
+	}
+	return fdBudget > 0 && int(openFDCount.Load()) >= fdBudget
+}
+
+// Runs fn on its own goroutine unless a budget is exhausted. Every
+// fire-and-forget path goes through here, so a leak or a flood degrades
+// that work instead of ending in OOM or EMFILE. Returns whether fn was
+// started.
+func spawn(kind string, fn func()) bool {
+	if overBudget() {
+		metricSpawnRefused.Inc(kind)
+		return false
+	}
+	go fn()
+	return true
+}
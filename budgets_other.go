@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+// No descriptor accounting here: only the goroutine budget applies
+func fdLimit() int { return 0 }
+
+func openFDs() int { return -1 }
@@ -0,0 +1,29 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Soft RLIMIT_NOFILE, 0 when unknown
+func fdLimit() int {
+	var rl unix.Rlimit
+	if unix.Getrlimit(unix.RLIMIT_NOFILE, &rl) != nil || rl.Cur > 1<<31 {
+		return 0
+	}
+	return int(rl.Cur)
+}
+
+// Descriptors open in this process, -1 when they can't be listed
+func openFDs() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			// Minus the descriptor ReadDir itself held open
+			return len(entries) - 1
+		}
+	}
+	return -1
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// COMPLETION CALLBACKS
+// ============================================================================
+
+var (
+	// Pending callbacks, by due time (redis store)
+	callbackKey = "payments:callbacks"
+
+	callbacks       callbackQueue
+	callbackSetting CallbackConfig // Set by startCallbacks
+
+	metricCallbacks = newCounterVec("gateway_callbacks_total", "Completion callback attempts by outcome (delivered, retried, dropped).", "outcome")
+
+	callbackLog = componentLogger("callbacks")
+)
+
+type CallbackConfig struct {
+	// Receives a signed POST when any payment is processed or fails
+	URL string
+	// Accept a per-payment "callbackUrl" in POST /payments, used instead of
+	// URL. Off by default: the gateway would POST to any URL a client names.
+	PerPayment bool
+	// Backoff between attempts, doubling from Backoff up to MaxBackoff
+	Backoff, MaxBackoff time.Duration
+	MaxAttempts         int
+	Workers             int
+}
+
+func loadCallbackConfig(env *envParser) CallbackConfig {
+	c := CallbackConfig{
+		URL:         env.str("PAYMENT_CALLBACK_URL", ""),
+		PerPayment:  env.bool("PAYMENT_CALLBACK_PER_PAYMENT", false),
+		Backoff:     env.duration("CALLBACK_BACKOFF", time.Second),
+		MaxBackoff:  env.duration("CALLBACK_MAX_BACKOFF", 5*time.Minute),
+		MaxAttempts: env.int("CALLBACK_MAX_ATTEMPTS", 8, 1),
+		Workers:     env.int("CALLBACK_WORKERS", 4, 1),
+	}
+	if c.URL != "" && !validCallbackURL(c.URL) {
+		env.fail("PAYMENT_CALLBACK_URL", c.URL, "must be an http(s) URL")
+	}
+	if c.MaxBackoff < c.Backoff {
+		env.fail("CALLBACK_MAX_BACKOFF", c.MaxBackoff.String(), "must be at least CALLBACK_BACKOFF")
+	}
+	return c
+}
+
+// One pending POST. The id is the Webhook-Id of every attempt, so the
+// receiver can drop repeats.
+type callbackDelivery struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Body    string `json:"body"`
+	Attempt int    `json:"attempt"`
+}
+
+// Retry queue shared by the deliveries; redis-backed queues survive
+// restarts and are drained by every instance
+type callbackQueue interface {
+	push(ctx context.Context, d callbackDelivery, due time.Time) error
+	// Removes and returns up to n deliveries due by now
+	popDue(ctx context.Context, now time.Time, n int) ([]callbackDelivery, error)
+}
+
+func callbacksEnabled() bool {
+	return callbacks != nil
+}
+
+func perPaymentCallbacks() bool {
+	return callbackSetting.PerPayment
+}
+
+// Makes up to MaxAttempts attempts per callback, Workers at a time
+func startCallbacks(cfg CallbackConfig) {
+	if cfg.URL == "" && !cfg.PerPayment {
+		return
+	}
+	callbackSetting = cfg
+	if redisBacked() {
+		callbacks = redisCallbackQueue{}
+	} else {
+		callbacks = &memoryCallbackQueue{}
+	}
+
+	due := make(chan callbackDelivery, cfg.Workers)
+	go pollCallbacks(due)
+	for i := 0; i < cfg.Workers; i++ {
+		go func() {
+			for d := range due {
+				attemptCallback(d)
+			}
+		}()
+	}
+}
+
+func validCallbackURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Queues the callback of a final outcome; processor is "" for failures
+func notifyCompletion(payment PostPayments, processor string) {
+	if !callbacksEnabled() {
+		return
+	}
+	target := payment.callbackURL
+	if target == "" {
+		target = callbackSetting.URL
+	}
+	if target == "" {
+		return
+	}
+	body, err := jsonFast.MarshalToString(outcomeEvent(payment, processor))
+	if err != nil {
+		return
+	}
+	d := callbackDelivery{ID: newUUIDv7(), URL: target, Body: body}
+	if err := callbacks.push(context.Background(), d, time.Now()); err != nil {
+		metricCallbacks.Inc("dropped")
+		callbackLog.Error("callback not queued", "correlationId", payment.CorrelationId, "err", err)
+	}
+}
+
+// Hands due deliveries to the workers, never more than they can take
+func pollCallbacks(due chan<- callbackDelivery) {
+	ctx := context.Background()
+	for {
+		room := cap(due) - len(due)
+		if room == 0 {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		batch, err := callbacks.popDue(ctx, time.Now(), room)
+		if err != nil {
+			callbackLog.Error("callback queue read failed", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if len(batch) == 0 {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		for _, d := range batch {
+			due <- d
+		}
+	}
+}
+
+func attemptCallback(d callbackDelivery) {
+	d.Attempt++
+	if err := postCallback(d); err == nil {
+		metricCallbacks.Inc("delivered")
+		return
+	} else if d.Attempt >= callbackSetting.MaxAttempts {
+		metricCallbacks.Inc("dropped")
+		callbackLog.Warn("callback dropped after the last attempt", "id", d.ID, "url", d.URL, "attempts", d.Attempt, "err", err)
+		return
+	}
+	delay := callbackSetting.MaxBackoff
+	if d.Attempt < 30 {
+		delay = min(callbackSetting.Backoff<<(d.Attempt-1), callbackSetting.MaxBackoff)
+	}
+	metricCallbacks.Inc("retried")
+	if err := callbacks.push(context.Background(), d, time.Now().Add(jittered(delay))); err != nil {
+		metricCallbacks.Inc("dropped")
+		callbackLog.Error("callback retry not queued", "id", d.ID, "err", err)
+	}
+}
+
+func postCallback(d callbackDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	body := []byte(d.Body)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	signWebhookID(req, d.ID, body)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &callbackStatusError{resp.StatusCode}
+	}
+	return nil
+}
+
+type callbackStatusError struct{ status int }
+
+func (e *callbackStatusError) Error() string {
+	return "callback answered " + http.StatusText(e.status)
+}
+
+// ----------------------------------------------------------------------------
+// Queues
+// ----------------------------------------------------------------------------
+
+// Pops due members atomically, so two instances never take the same one
+var popCallbacksScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+if #due > 0 then
+  redis.call('ZREM', KEYS[1], unpack(due))
+end
+return due
+`)
+
+// Sorted set of encoded deliveries scored by due time (ms). A delivery
+// popped by an instance that dies before retrying it is lost.
+type redisCallbackQueue struct{}
+
+func (redisCallbackQueue) push(ctx context.Context, d callbackDelivery, due time.Time) error {
+	data, err := jsonFast.MarshalToString(d)
+	if err != nil {
+		return err
+	}
+	return redisClient.ZAdd(ctx, callbackKey, redis.Z{Score: float64(due.UnixMilli()), Member: data}).Err()
+}
+
+func (redisCallbackQueue) popDue(ctx context.Context, now time.Time, n int) ([]callbackDelivery, error) {
+	raw, err := popCallbacksScript.Run(ctx, redisClient, []string{callbackKey}, now.UnixMilli(), n).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]callbackDelivery, 0, len(raw))
+	for _, data := range raw {
+		var d callbackDelivery
+		if jsonFast.UnmarshalFromString(data, &d) == nil {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// In-process queue for STORE=memory; pending callbacks die with the process
+type memoryCallbackQueue struct {
+	mu      sync.Mutex
+	pending []memoryCallback // By due time
+}
+
+type memoryCallback struct {
+	due time.Time
+	d   callbackDelivery
+}
+
+func (q *memoryCallbackQueue) push(_ context.Context, d callbackDelivery, due time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := sort.Search(len(q.pending), func(i int) bool { return q.pending[i].due.After(due) })
+	q.pending = append(q.pending, memoryCallback{})
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = memoryCallback{due: due, d: d}
+	return nil
+}
+
+func (q *memoryCallbackQueue) popDue(_ context.Context, now time.Time, n int) ([]callbackDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []callbackDelivery
+	for len(out) < n && len(q.pending) > 0 && !q.pending[0].due.After(now) {
+		out = append(out, q.pending[0].d)
+		q.pending = q.pending[1:]
+	}
+	return out, nil
+}
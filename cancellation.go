@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// CANCELLATION (DELETE /payments/{correlationId})
+// ============================================================================
+
+// What a worker gets back from processPayment for a payment cancelled while
+// it was queued
+const paymentCancelled = "-cancelled"
+
+var metricPaymentsCancelled = newCounterVec("gateway_payments_cancelled_total", "Queued payments cancelled before they were forwarded.", "")
+
+// The queue itself can't give a payment back, so a cancellation only marks
+// its status; the worker that dequeues it sees the mark and drops it. Both
+// run atomically on the status, so a payment is either cancelled or
+// forwarded, never both, whichever instance holds it.
+var cancelPaymentScript = redis.NewScript(`
+local state = redis.call('HGET', KEYS[1], 'state')
+if state == 'received' or state == 'queued' then
+  redis.call('HSET', KEYS[1], 'state', 'cancelled', 'cancelledAt', ARGV[1], 'cancelledBy', ARGV[2])
+end
+return state or ''
+`)
+
+func cancelPayment(ctx context.Context, correlationId string) (string, error) {
+	defer metricRedisLatency.Since("status_cancel", time.Now())
+	return cancelPaymentScript.Run(ctx, redisClient,
+		[]string{"status:" + correlationId},
+		time.Now().UTC().Format(time.RFC3339Nano),
+		INSTANCE_ID,
+	).Text()
+}
+
+// Moves a dequeued payment to processing; false when it was cancelled. This
+// is also the cancellation check, so unlike the other intermediate states
+// it is written during a brownout too.
+func startProcessing(ctx context.Context, payment PostPayments) bool {
+	if !store.AdvanceStatus(ctx, payment, "processing") {
+		return true
+	}
+	metricPaymentsCancelled.Inc("")
+	publishLifecycle("cancelled", payment, "")
+	return false
+}
+
+// DELETE /payments/{correlationId} - Cancels a payment not yet forwarded
+func handleCancelPayment(w http.ResponseWriter, r *http.Request, correlationId string) {
+	state, err := store.Cancel(r.Context(), correlationId)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case state == "":
+		writeJSONError(w, http.StatusNotFound, "not_found", "no payment with this correlationId")
+	case state == "received", state == "queued", state == "cancelled":
+		w.Header().Set("Content-Type", "application/json")
+		_ = jsonFast.NewEncoder(w).Encode(map[string]string{"correlationId": correlationId, "state": "cancelled"})
+	case strings.HasPrefix(state, "processed-"), state == "failed":
+		writeJSONError(w, http.StatusConflict, "already_processed", "payment already has an outcome ("+state+")")
+	default:
+		writeJSONError(w, http.StatusConflict, "in_flight", "payment is being forwarded ("+state+")")
+	}
+}
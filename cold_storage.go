@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// COLD STORAGE TIERING
+// ============================================================================
+
+var (
+	COLD_DIR         = getEnv("COLD_DIR", "./cold")
+	COLD_S3_ENDPOINT = getEnv("COLD_S3_ENDPOINT", "")
+	COLD_S3_BUCKET   = getEnv("COLD_S3_BUCKET", "")
+	COLD_S3_PREFIX   = getEnv("COLD_S3_PREFIX", "payments")
+
+	coldStore ColdStore
+
+	tieringLog = componentLogger("tiering")
+)
+
+// Detailed payment record as kept in cold storage
+type coldRecord struct {
+	CorrelationId string `json:"correlationId"`
+	Amount        Cents  `json:"amount"`
+	RequestedAt   string `json:"requestedAt"`
+	Processor     string `json:"processor"`
+	State         string `json:"state"`
+	Instance      string `json:"instance,omitempty"`
+	// Set outside DEFAULT_CURRENCY, as in the status
+	Currency string `json:"currency,omitempty"`
+}
+
+// Destination for tiered-out payment records
+type ColdStore interface {
+	Archive(ctx context.Context, records []coldRecord) error
+	Lookup(ctx context.Context, correlationId string) (coldRecord, bool, error)
+}
+
+func newColdStore(backend string) (ColdStore, error) {
+	switch backend {
+	case "":
+		return nil, nil
+	case "file":
+		return &fileColdStore{dir: COLD_DIR}, nil
+	case "s3":
+		if COLD_S3_BUCKET == "" {
+			return nil, fmt.Errorf("the s3 cold backend needs COLD_S3_BUCKET")
+		}
+		endpoint := COLD_S3_ENDPOINT
+		if endpoint == "" {
+			endpoint = "https://s3." + AWS_REGION + ".amazonaws.com"
+		}
+		return &s3ColdStore{
+			endpoint: strings.TrimSuffix(endpoint, "/"),
+			bucket:   COLD_S3_BUCKET,
+			prefix:   strings.Trim(COLD_S3_PREFIX, "/"),
+		}, nil
+	}
+	return nil, fmt.Errorf("must be empty, file or s3")
+}
+
+type TieringConfig struct {
+	// Records older than this leave Redis (0 disables tiering)
+	Retention time.Duration
+	Interval  time.Duration
+	// Cold backend: "" (delete outright), "file" or "s3"
+	Backend string
+}
+
+func loadTieringConfig(env *envParser, redis bool) TieringConfig {
+	c := TieringConfig{
+		Retention: env.optionalDuration("RETENTION"),
+		Interval:  env.duration("TIERING_INTERVAL", time.Minute),
+		Backend:   env.str("COLD_BACKEND", ""),
+	}
+	if c.Retention > 0 && !redis {
+		env.fail("RETENTION", c.Retention.String(), "needs the redis store")
+	}
+	_, err := newColdStore(c.Backend)
+	env.check("COLD_BACKEND", c.Backend, err)
+	return c
+}
+
+// Starts the background tiering loop when a retention is set
+func startTiering(cfg TieringConfig) {
+	if cfg.Retention == 0 {
+		return
+	}
+	// Checked by loadConfig
+	coldStore, _ = newColdStore(cfg.Backend)
+
+	go func() {
+		time.Sleep(initialJitter(cfg.Interval))
+		for {
+			time.Sleep(jittered(cfg.Interval))
+			cutoff := time.Now().Add(-cfg.Retention)
+			for _, p := range processors {
+				for _, bucket := range currencyBuckets(context.Background(), p.Name) {
+					for shard := 0; shard < max(historyShards, 1); shard++ {
+						for tierShard(p.Name, bucket, shard, cutoff) {
+						}
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Moves one batch of expired records of a processor's currencyBucket out of
+// Redis; reports whether more remain
+func tierShard(processor, bucket string, shard int, cutoff time.Time) bool {
+	const batchSize = 500
+	ctx := context.Background()
+	historyKey := summaryKey(bucket, "history", shard)
+	dataKey := summaryKey(bucket, "data", shard)
+	idsKey := summaryKey(bucket, "ids", shard)
+
+	keys, err := redisClient.ZRangeByScore(ctx, historyKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(cutoff.UnixMilli(), 10),
+		Count: batchSize,
+	}).Result()
+	if err != nil || len(keys) == 0 {
+		return false
+	}
+	ids, err := correlationIDs(ctx, idsKey, keys)
+	if err != nil {
+		return false
+	}
+
+	if coldStore != nil {
+		pipe := redisClient.Pipeline()
+		statuses := make([]*redis.MapStringStringCmd, len(ids))
+		for i, id := range ids {
+			statuses[i] = pipe.HGetAll(ctx, "status:"+id)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return false
+		}
+
+		records := make([]coldRecord, 0, len(ids))
+		for i, id := range ids {
+			status := statuses[i].Val()
+			amount, _ := parseCents(status["amount"])
+			records = append(records, coldRecord{
+				CorrelationId: id,
+				Amount:        amount,
+				RequestedAt:   status["requestedAt"],
+				Processor:     processor,
+				State:         status["state"],
+				Instance:      status["instance"],
+				Currency:      status["currency"],
+			})
+		}
+		// Keep the hot copy if archiving fails; the next tick retries
+		if err := coldStore.Archive(ctx, records); err != nil {
+			tieringLog.Error("cold storage archive failed", "bucket", bucket, "shard", shard, "err", err)
+			return false
+		}
+	}
+
+	pipe := redisClient.Pipeline()
+	members := make([]interface{}, len(keys))
+	for i, key := range keys {
+		members[i] = key
+		pipe.Del(ctx, "status:"+ids[i])
+	}
+	pipe.ZRem(ctx, historyKey, members...)
+	pipe.HDel(ctx, dataKey, keys...)
+	pipe.HDel(ctx, idsKey, keys...)
+	_, _ = pipe.Exec(ctx)
+
+	return len(keys) == batchSize
+}
+
+// Resolves history record keys to correlationIds; members written before
+// record keys existed are correlationIds already
+func correlationIDs(ctx context.Context, idsKey string, keys []string) ([]string, error) {
+	vals, err := redisClient.HMGet(ctx, idsKey, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(keys))
+	for i, val := range vals {
+		if id, ok := val.(string); ok {
+			ids[i] = id
+		} else {
+			ids[i] = keys[i]
+		}
+	}
+	return ids, nil
+}
+
+// Status lookup that falls back to cold storage once the hot record is gone
+func lookupStatus(ctx context.Context, correlationId string) (map[string]string, error) {
+	status, err := store.Status(ctx, correlationId)
+	if err != nil || len(status) > 0 || coldStore == nil {
+		return status, err
+	}
+	record, found, err := coldStore.Lookup(ctx, correlationId)
+	if err != nil || !found {
+		return status, err
+	}
+	status = map[string]string{
+		"state":       record.State,
+		"processor":   record.Processor,
+		"amount":      record.Amount.String(),
+		"requestedAt": record.RequestedAt,
+		"instance":    record.Instance,
+	}
+	if record.Currency != "" {
+		status["currency"] = record.Currency
+	}
+	return status, nil
+}
+
+// ----------------------------------------------------------------------------
+// File backend: one NDJSON file per day of requestedAt
+// ----------------------------------------------------------------------------
+
+type fileColdStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (s *fileColdStore) Archive(ctx context.Context, records []coldRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	byDay := make(map[string][]coldRecord)
+	for _, record := range records {
+		day := "unknown"
+		if len(record.RequestedAt) >= 10 {
+			day = record.RequestedAt[:10]
+		}
+		byDay[day] = append(byDay[day], record)
+	}
+
+	for day, batch := range byDay {
+		f, err := os.OpenFile(filepath.Join(s.dir, day+".ndjson"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		enc := jsonFast.NewEncoder(w)
+		for _, record := range batch {
+			if err = enc.Encode(record); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scans every archive file; meant for audits, not the hot path
+func (s *fileColdStore) Lookup(ctx context.Context, correlationId string) (coldRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.ndjson"))
+	if err != nil {
+		return coldRecord{}, false, err
+	}
+	needle := []byte(`"` + correlationId + `"`)
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return coldRecord{}, false, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if !bytes.Contains(line, needle) {
+				continue
+			}
+			var record coldRecord
+			if jsonFast.Unmarshal(line, &record) == nil && record.CorrelationId == correlationId {
+				f.Close()
+				return record, true, nil
+			}
+		}
+		f.Close()
+	}
+	return coldRecord{}, false, nil
+}
+
+// ----------------------------------------------------------------------------
+// S3 backend: one object per payment, keyed by correlationId
+// ----------------------------------------------------------------------------
+
+type s3ColdStore struct {
+	endpoint string
+	bucket   string
+	prefix   string
+}
+
+func (s *s3ColdStore) objectURL(correlationId string) string {
+	return s.endpoint + "/" + s.bucket + "/" + s.prefix + "/" + correlationId + ".json"
+}
+
+func (s *s3ColdStore) Archive(ctx context.Context, records []coldRecord) error {
+	const parallelism = 8
+	sem := make(chan struct{}, parallelism)
+	errs := make(chan error, len(records))
+	var wg sync.WaitGroup
+
+	for _, record := range records {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(record coldRecord) {
+			defer func() { <-sem; wg.Done() }()
+			body, err := jsonFast.Marshal(record)
+			if err == nil {
+				err = s.do(ctx, http.MethodPut, s.objectURL(record.CorrelationId), body, nil)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(record)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func (s *s3ColdStore) Lookup(ctx context.Context, correlationId string) (coldRecord, bool, error) {
+	var record coldRecord
+	var body []byte
+	err := s.do(ctx, http.MethodGet, s.objectURL(correlationId), nil, &body)
+	if err == errNotFound {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+	return record, true, jsonFast.Unmarshal(body, &record)
+}
+
+var errNotFound = fmt.Errorf("not found")
+
+func (s *s3ColdStore) do(ctx context.Context, method, url string, body []byte, out *[]byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	signAWSRequest(req, body, "s3")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("s3 %s %s: %s", method, url, resp.Status)
+	}
+	if out != nil {
+		*out, err = io.ReadAll(resp.Body)
+	}
+	return err
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// CONFIGURATION
+// ============================================================================
+
+// Server settings, parsed and validated once at startup and handed to the
+// pieces that need them. Numeric subsystem limits are here too (Limits);
+// the subsystems' string knobs stay next to the code they tune.
+type Config struct {
+	Port    string // ":<port>" or "unix:<path>"
+	Workers int    // Starting pool size
+	// Bounds for the autoscaler; equal bounds (the default) keep WORKERS fixed
+	WorkersMin     int
+	WorkersMax     int
+	QueueSize      int
+	MaxConcurrency int // Processor requests in flight, per processor unless overridden
+	// Payments allowed in a retry loop against one processor at once; 0 is
+	// half of that processor's concurrency
+	MaxRetries int
+	// /payments-summary requests running at once, and how long one may wait
+	// for a slot before it gets a 503
+	SummaryConcurrency int
+	SummaryWait        time.Duration
+	SubmitMode         string // async or sync
+	Engine             string // HTTP server: nethttp or fasthttp
+	HistoryShards      int
+	FlushOnStart       bool
+
+	ProcessorTimeout time.Duration // Forwards and health checks, unless overridden
+	HTTPTimeout      time.Duration // Webhooks, alerts, discovery, exporters
+	// Processor defaults, overridable per processor: IP family, and the
+	// User-Agent of forwards and health checks (empty keeps Go's)
+	ProcessorIPFamily  string
+	ProcessorUserAgent string
+	// Upper bound for one processor connection attempt, and the head start of
+	// the preferred family before the other is raced against it (Go's own
+	// default is 300ms)
+	ProcessorDialTimeout   time.Duration
+	ProcessorFallbackDelay time.Duration
+
+	Default  ProcessorConfig
+	Fallback ProcessorConfig
+	// Sandbox pair, nil unless PAYMENT_PROCESSOR_SANDBOX_{DEFAULT,FALLBACK}_URL
+	// are set
+	SandboxDefault, SandboxFallback *ProcessorConfig
+
+	Server   ServerConfig
+	Listener ListenerConfig
+	TLS      TLSConfig
+	Redis    RedisConfig
+	Limits   LimitsConfig
+
+	Store            StoreConfig
+	StrictDurability bool // Write every accepted payment to the WAL first (redis store only)
+	SharedQueue      SharedQueueConfig
+	SummaryWriter    SummaryWriterConfig
+	QueueEncoding    string // json or msgpack
+	Ledger           bool
+	Idempotency      bool
+
+	Retry     RetryConfig
+	Breaker   BreakerConfig
+	Limiter   LimiterConfig
+	Health    HealthConfig
+	Routing   routingTuning
+	Autoscale AutoscaleConfig
+	Brownout  BrownoutConfig
+	Shed      ShedConfig
+	Watchdog  WatchdogConfig
+	RateLimit RateLimitConfig
+
+	FeeSchedules     map[string][]feePeriod
+	CostAwareRouting bool // Lowest fee in effect first when both processors are available
+
+	Callbacks     CallbackConfig
+	EventBus      EventBusConfig
+	EventWebhooks []eventWebhook `json:"-"`
+	AlertRoutes   []alertRoute   `json:"-"`
+	Ingest        IngestConfig
+	Tracing       TracingConfig
+	Profiling     ProfilingConfig
+	Replication   ReplicationConfig
+	Tiering       TieringConfig
+	Tenants       TenantConfig
+	Discovery     string // CONFIG_DISCOVERY: "", consul or etcd
+	// CONSUL_REGISTER: register this instance with the local Consul agent
+	ConsulRegister bool
+	DebugPort      string // ":<port>", "" disables
+
+	Currency       CurrencyConfig
+	Namespaces     NamespaceConfig
+	Environments   EnvironmentConfig
+	SummaryAliases map[string]string
+	IDs            IDConfig
+	RequestedAt    RequestedAtConfig
+	Amounts        AmountConfig
+	Search         SearchConfig
+	LongPoll       SummaryWaitConfig
+	Jitter         JitterConfig
+	// How long POST /admin/maintenance lasts when the request names no duration
+	MaintenanceDuration time.Duration
+}
+
+// Request size and resource limits not owned by one subsystem
+type LimitsConfig struct {
+	// Items per request
+	BatchMax      int // POST /payments/batch
+	StatusBulkMax int // POST /payments/status
+	ListMax       int // GET /payments limit
+
+	ReadyQueueWatermark int // Queue fill percentage
+
+	GoroutineBudget int // 0 disables
+	FDBudget        int // 0 is 90% of RLIMIT_NOFILE
+
+	QueueStatsEpisodes int
+}
+
+// Inbound connection limits for either engine. Streaming endpoints (SSE,
+// the summary long-poll) lift the write deadline for themselves.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// How long shutdown waits for in-flight requests before cutting them
+	ShutdownTimeout time.Duration
+	// Maximum time spent draining the payment queue after SIGTERM
+	DrainTimeout time.Duration
+}
+
+// One processor's endpoint and its own client: a slow fallback holds its
+// slots and connections, never the default's
+type ProcessorConfig struct {
+	URL             string
+	Weight          int
+	Timeout         time.Duration
+	MaxConcurrency  int
+	MaxRetries      int // Payments past their first attempt, within MaxConcurrency
+	MaxConns        int // Per host, 0 is unlimited
+	MaxIdleConns    int // Per host
+	IdleConnTimeout time.Duration
+
+	IPFamily                   string
+	DialTimeout, FallbackDelay time.Duration
+	Proxy                      string      // A proxy URL, "direct", or "" for HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+	Headers                    http.Header // Static headers, User-Agent included
+	SigningSecret              string      `json:"-"`
+	SignatureHeader            string
+	Zone, Region               string // Labels for zone-affine routing
+}
+
+type RedisConfig struct {
+	Addr      string
+	Topology  redisTopology // Parsed from Addr (REDIS_URL)
+	ReadAddrs []string      // Replicas for summary queries
+	Password  string
+	DB        int
+	PoolSize  int // 0 keeps go-redis' default (10 per CPU)
+	// Connections per summary client (replica, or the primary without
+	// replicas), apart from the pool ingest and the workers use
+	SummaryPoolSize int
+	DialTimeout     time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+}
+
+// Reads the environment; every invalid value is reported, not just the first
+func loadConfig() (Config, error) {
+	var env envParser
+	cfg := Config{
+		Port:           env.port("PORT", ":9999"),
+		Workers:        env.int("WORKERS", 30, 1),
+		QueueSize:      env.int("QUEUE_SIZE", 100_000, 1),
+		MaxConcurrency: env.int("MAX_CONCURRENCY", 30, 1),
+		MaxRetries:     env.int("RETRY_MAX_IN_FLIGHT", 0, 0),
+
+		SummaryConcurrency: env.int("SUMMARY_MAX_CONCURRENCY", 8, 1),
+		SummaryWait:        env.duration("SUMMARY_QUEUE_TIMEOUT", time.Second),
+
+		SubmitMode:    env.oneOf("SUBMIT_MODE", "async", "async", "sync"),
+		Engine:        env.oneOf("SERVER_ENGINE", "nethttp", "nethttp", "fasthttp"),
+		HistoryShards: env.int("HISTORY_SHARDS", 1, 1),
+
+		ProcessorTimeout: env.duration("PROCESSOR_TIMEOUT", 5*time.Second),
+		HTTPTimeout:      env.duration("HTTP_TIMEOUT", 5*time.Second),
+
+		ProcessorIPFamily:      env.oneOf("PROCESSOR_IP_FAMILY", "any", ipFamilies...),
+		ProcessorUserAgent:     env.str("PROCESSOR_USER_AGENT", ""),
+		ProcessorDialTimeout:   env.duration("PROCESSOR_DIAL_TIMEOUT", 2*time.Second),
+		ProcessorFallbackDelay: env.duration("PROCESSOR_FALLBACK_DELAY", 100*time.Millisecond),
+
+		Server: ServerConfig{
+			ReadHeaderTimeout: env.duration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+			ReadTimeout:       env.duration("SERVER_READ_TIMEOUT", 10*time.Second),
+			WriteTimeout:      env.duration("SERVER_WRITE_TIMEOUT", 30*time.Second),
+			IdleTimeout:       env.duration("SERVER_IDLE_TIMEOUT", 60*time.Second),
+			ShutdownTimeout:   env.duration("SERVER_SHUTDOWN_TIMEOUT", 10*time.Second),
+			DrainTimeout:      env.duration("SHUTDOWN_DRAIN_TIMEOUT", 10*time.Second),
+		},
+
+		Redis: RedisConfig{
+			Addr:            env.str("REDIS_URL", "127.0.0.1:6379"),
+			ReadAddrs:       env.list("REDIS_READ_URLS"),
+			Password:        env.str("REDIS_PASSWORD", ""),
+			DB:              env.int("REDIS_DB", 0, 0),
+			PoolSize:        env.int("REDIS_POOL_SIZE", 0, 0),
+			SummaryPoolSize: env.int("REDIS_SUMMARY_POOL_SIZE", 8, 1),
+			DialTimeout:     env.duration("REDIS_DIAL_TIMEOUT", 5*time.Second),
+			ReadTimeout:     env.duration("REDIS_READ_TIMEOUT", 3*time.Second),
+			WriteTimeout:    env.duration("REDIS_WRITE_TIMEOUT", 3*time.Second),
+		},
+
+		Limits: LimitsConfig{
+			BatchMax:      env.int("PAYMENTS_BATCH_MAX", 1000, 1),
+			StatusBulkMax: env.int("STATUS_BULK_MAX", 1000, 1),
+			ListMax:       env.int("PAYMENTS_LIST_MAX", 500, 1),
+
+			ReadyQueueWatermark: env.int("READY_QUEUE_WATERMARK", 90, 1),
+
+			GoroutineBudget: env.int("GOROUTINE_BUDGET", 20000, 0),
+			FDBudget:        env.int("FD_BUDGET", 0, 0),
+
+			QueueStatsEpisodes: env.int("QUEUE_STATS_EPISODES", 50, 0),
+		},
+
+		Listener: loadListenerConfig(&env),
+		TLS:      loadTLSConfig(&env),
+
+		Store:         loadStoreConfig(&env),
+		QueueEncoding: env.oneOf("QUEUE_ENCODING", "json", "json", "msgpack"),
+		Idempotency:   env.bool("IDEMPOTENCY", true),
+
+		Retry:     loadRetryConfig(&env),
+		Breaker:   loadBreakerConfig(&env),
+		Limiter:   loadLimiterConfig(&env),
+		Health:    loadHealthConfig(&env),
+		Routing:   loadRoutingTuning(&env),
+		Autoscale: loadAutoscaleConfig(&env),
+		Brownout:  loadBrownoutConfig(&env),
+		Shed:      loadShedConfig(&env),
+		Watchdog:  loadWatchdogConfig(&env),
+		RateLimit: loadRateLimitConfig(&env),
+
+		CostAwareRouting: env.bool("COST_AWARE_ROUTING", false),
+
+		Callbacks:      loadCallbackConfig(&env),
+		EventWebhooks:  loadEventWebhooks(&env),
+		AlertRoutes:    loadAlertRoutes(&env),
+		Ingest:         loadIngestConfig(&env),
+		Tracing:        loadTracingConfig(&env),
+		Profiling:      loadProfilingConfig(&env),
+		Tenants:        loadTenantConfig(&env),
+		Discovery:      env.oneOf("CONFIG_DISCOVERY", "", "", "consul", "etcd"),
+		ConsulRegister: env.bool("CONSUL_REGISTER", false),
+
+		Currency:            loadCurrencyConfig(&env),
+		Namespaces:          loadNamespaceConfig(&env),
+		SummaryAliases:      loadSummaryAliases(&env),
+		IDs:                 loadIDConfig(&env),
+		RequestedAt:         loadRequestedAtConfig(&env),
+		Amounts:             loadAmountConfig(&env),
+		Search:              loadSearchConfig(&env),
+		LongPoll:            loadSummaryWaitConfig(&env),
+		Jitter:              loadJitterConfig(&env),
+		MaintenanceDuration: env.duration("MAINTENANCE_DURATION", 15*time.Minute),
+	}
+	checkLogSettings(&env)
+	if w := cfg.Limits.ReadyQueueWatermark; w > 100 {
+		env.fail("READY_QUEUE_WATERMARK", strconv.Itoa(w), "must be at most 100")
+	}
+	if t, err := parseRedisURL(cfg.Redis.Addr); err != nil {
+		env.fail("REDIS_URL", cfg.Redis.Addr, err.Error())
+	} else {
+		cfg.Redis.Topology = t
+		if t.Mode != "standalone" && len(cfg.Redis.ReadAddrs) > 0 {
+			env.fail("REDIS_READ_URLS", strings.Join(cfg.Redis.ReadAddrs, ","), "only applies to a standalone REDIS_URL")
+		}
+	}
+	// Settings that only work on Redis, or depend on another one
+	redisStore := cfg.Store.Kind == "redis"
+	if cfg.StrictDurability = env.bool("STRICT_DURABILITY", false); cfg.StrictDurability && !redisStore {
+		env.fail("STRICT_DURABILITY", "true", "needs the redis store")
+	}
+	// Never by default under strict durability: it would wipe the WAL
+	cfg.FlushOnStart = env.bool("FLUSH_ON_START", !cfg.StrictDurability)
+	cfg.SharedQueue = loadSharedQueueConfig(&env, redisStore, cfg.SubmitMode)
+	cfg.SummaryWriter = loadSummaryWriterConfig(&env)
+	cfg.Ledger = loadLedger(&env, redisStore, cfg.Redis.Topology.Mode == "cluster")
+	cfg.EventBus = loadEventBusConfig(&env, redisStore)
+	cfg.Replication = loadReplicationConfig(&env, redisStore)
+	cfg.Tiering = loadTieringConfig(&env, redisStore)
+	if raw := os.Getenv("FEE_SCHEDULE"); raw != "" {
+		var err error
+		cfg.FeeSchedules, err = parseFeeSchedule(raw)
+		env.check("FEE_SCHEDULE", raw, err)
+	}
+	if os.Getenv("DEBUG_PORT") != "" {
+		if cfg.DebugPort = env.port("DEBUG_PORT", ""); cfg.DebugPort == cfg.Port || strings.HasPrefix(cfg.DebugPort, "unix:") {
+			env.fail("DEBUG_PORT", os.Getenv("DEBUG_PORT"), "must be a TCP port other than PORT")
+			cfg.DebugPort = ""
+		}
+	}
+	cfg.WorkersMin = env.int("WORKERS_MIN", cfg.Workers, 1)
+	cfg.WorkersMax = env.int("WORKERS_MAX", cfg.Workers, 1)
+	if cfg.WorkersMin > cfg.Workers || cfg.Workers > cfg.WorkersMax {
+		env.fail("WORKERS", strconv.Itoa(cfg.Workers), "must lie within WORKERS_MIN and WORKERS_MAX")
+	}
+	cfg.Default = env.processor("DEFAULT", "http://localhost:8001", 100, cfg)
+	cfg.Fallback = env.processor("FALLBACK", "http://localhost:8002", 0, cfg)
+	if cfg.Default.Weight+cfg.Fallback.Weight == 0 {
+		env.fail("PAYMENT_PROCESSOR_DEFAULT_WEIGHT", "0", "at least one processor weight must be positive")
+	}
+	if os.Getenv("PAYMENT_PROCESSOR_SANDBOX_DEFAULT_URL") != "" || os.Getenv("PAYMENT_PROCESSOR_SANDBOX_FALLBACK_URL") != "" {
+		sd := env.processor("SANDBOX_DEFAULT", "", 100, cfg)
+		sf := env.processor("SANDBOX_FALLBACK", "", 0, cfg)
+		cfg.SandboxDefault, cfg.SandboxFallback = &sd, &sf
+		if sd.Weight+sf.Weight == 0 {
+			env.fail("PAYMENT_PROCESSOR_SANDBOX_DEFAULT_WEIGHT", "0", "at least one sandbox processor weight must be positive")
+		}
+	}
+	cfg.Environments = loadEnvironmentConfig(&env, cfg.SandboxDefault != nil)
+	return cfg, errors.Join(env.errs...)
+}
+
+// Builds the shared clients and queues from the configuration
+func setupInfrastructure(cfg Config) {
+	redisCluster = cfg.Redis.Topology.Mode == "cluster"
+	redisClient = newPrimaryClient(cfg.Redis)
+	// Summary reads get their own pools so a burst of aggregations can't
+	// hold the connections payment acceptance needs
+	summaryRedis := cfg.Redis
+	summaryRedis.PoolSize = cfg.Redis.SummaryPoolSize
+	readClients = nil
+	for _, addr := range cfg.Redis.ReadAddrs {
+		readClients = append(readClients, newRedisClient(summaryRedis, addr))
+	}
+	if len(readClients) == 0 {
+		readClients = append(readClients, newPrimaryClient(summaryRedis))
+	}
+	paymentQueue = make(chan paymentJob, cfg.QueueSize)
+	summaryLimiter = make(chan struct{}, cfg.SummaryConcurrency)
+	summaryWait = cfg.SummaryWait
+	httpClient = &http.Client{Timeout: cfg.HTTPTimeout}
+	historyShards = cfg.HistoryShards
+
+	storeKind, store = cfg.Store.Kind, newStore(cfg.Store)
+	durableIngest = cfg.StrictDurability
+	sharedMode = cfg.SharedQueue.Mode == "shared"
+	consistencyMode = cfg.SummaryWriter.Consistency
+	summaryWriter = newSummaryWriterPool(cfg.SummaryWriter)
+	queueEncoding = cfg.QueueEncoding
+	ledger = cfg.Ledger
+	idempotency = cfg.Idempotency
+
+	retries = newRetryPolicy(cfg.Retry)
+	clientLimits = newClientLimiter(cfg.RateLimit)
+	feeSchedules, costAware = cfg.FeeSchedules, cfg.CostAwareRouting
+	alertRoutes = cfg.AlertRoutes
+	setupRouting(cfg.Routing)
+
+	setupCurrencies(cfg.Currency)
+	namespaceTenants, namespaceProcessors = cfg.Namespaces.Tenants, cfg.Namespaces.Processors
+	setupSummaryAliases(cfg.SummaryAliases)
+	setupIDs(cfg.IDs)
+	requestedAtSkew = cfg.RequestedAt
+	amountBounds = cfg.Amounts
+	workerStartJitter, probeJitter = cfg.Jitter.WorkerStart, cfg.Jitter.Probe
+	setupProcessors(cfg)
+}
+
+// Client of the primary in the REDIS_URL topology
+func newPrimaryClient(cfg RedisConfig) redis.UniversalClient {
+	t := cfg.Topology
+	db := cfg.DB
+	if t.DB >= 0 {
+		db = t.DB
+	}
+	switch t.Mode {
+	case "sentinel":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       t.MasterName,
+			SentinelAddrs:    t.Addrs,
+			SentinelPassword: REDIS_SENTINEL_PASSWORD,
+			Password:         cfg.Password,
+			DB:               db,
+			PoolSize:         cfg.PoolSize,
+			DialTimeout:      cfg.DialTimeout,
+			ReadTimeout:      cfg.ReadTimeout,
+			WriteTimeout:     cfg.WriteTimeout,
+		})
+	case "cluster":
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        t.Addrs,
+			Password:     cfg.Password,
+			PoolSize:     cfg.PoolSize,
+			DialTimeout:  cfg.DialTimeout,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+		})
+	}
+	cfg.DB = db
+	return newRedisClient(cfg, t.Addrs[0])
+}
+
+func newRedisClient(cfg RedisConfig, addr string) redis.UniversalClient {
+	return redis.NewClient(&redis.Options{
+		Addr:         addr,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		PoolSize:     cfg.PoolSize,
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+	})
+}
+
+// ----------------------------------------------------------------------------
+// Environment parsing
+// ----------------------------------------------------------------------------
+
+// Strict counterpart of getEnv: a malformed value is an error instead of a
+// silent fallback to the default
+type envParser struct {
+	errs []error
+}
+
+func (p *envParser) fail(key, value, reason string) {
+	p.errs = append(p.errs, fmt.Errorf("%s=%q: %s", key, value, reason))
+}
+
+func (p *envParser) str(key, fallback string) string {
+	return getEnv(key, fallback)
+}
+
+func (p *envParser) int(key string, fallback, min int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		p.fail(key, raw, "not an integer")
+		return fallback
+	}
+	if n < min {
+		p.fail(key, raw, fmt.Sprintf("must be at least %d", min))
+		return fallback
+	}
+	return n
+}
+
+func (p *envParser) bool(key string, fallback bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		p.fail(key, raw, "must be true or false")
+		return fallback
+	}
+	return b
+}
+
+func (p *envParser) duration(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		p.fail(key, raw, "must be a positive duration like 500ms or 2s")
+		return fallback
+	}
+	return d
+}
+
+// Like duration, but 0 is accepted (it disables or shortcuts the knob)
+func (p *envParser) durationOrZero(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		p.fail(key, raw, "must be a duration like 500ms or 2s, or 0")
+		return fallback
+	}
+	return d
+}
+
+// Empty (the default) is 0, meaning unset
+func (p *envParser) optionalDuration(key string) time.Duration {
+	return p.duration(key, 0)
+}
+
+func (p *envParser) float(key string, fallback, min, max float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		p.fail(key, raw, "not a number")
+		return fallback
+	}
+	if f < min || f > max {
+		if math.IsInf(max, 1) {
+			p.fail(key, raw, fmt.Sprintf("must be at least %g", min))
+		} else {
+			p.fail(key, raw, fmt.Sprintf("must be between %g and %g", min, max))
+		}
+		return fallback
+	}
+	return f
+}
+
+// A decimal amount like 19.90; empty is fallback
+func (p *envParser) amount(key string, fallback Cents) Cents {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	c, err := parseCents(raw)
+	if err != nil || c <= 0 {
+		p.fail(key, raw, "must be a positive amount like 19.90")
+		return fallback
+	}
+	return c
+}
+
+// Records the error of a setting parsed by its own code
+func (p *envParser) check(key, value string, err error) {
+	if err != nil {
+		p.fail(key, value, err.Error())
+	}
+}
+
+func (p *envParser) oneOf(key, fallback string, allowed ...string) string {
+	value := getEnv(key, fallback)
+	for _, a := range allowed {
+		if value == a {
+			return value
+		}
+	}
+	names := make([]string, len(allowed))
+	for i, a := range allowed {
+		if names[i] = a; a == "" {
+			names[i] = `""`
+		}
+	}
+	p.fail(key, value, "must be one of "+strings.Join(names, ", "))
+	return fallback
+}
+
+// Accepts "9999" or ":9999"
+func (p *envParser) port(key, fallback string) string {
+	value := getEnv(key, fallback)
+	if path, ok := strings.CutPrefix(value, "unix:"); ok {
+		if path == "" {
+			p.fail(key, value, "unix: needs a socket path")
+			return fallback
+		}
+		return value
+	}
+	if !strings.HasPrefix(value, ":") {
+		value = ":" + value
+	}
+	if n, err := strconv.Atoi(value[1:]); err != nil || n < 0 || n > 65535 {
+		p.fail(key, value, "not a port")
+		return fallback
+	}
+	return value
+}
+
+func (p *envParser) url(key, fallback string) string {
+	value := getEnv(key, fallback)
+	if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		p.fail(key, value, "must be an http(s) URL")
+		return fallback
+	}
+	return value
+}
+
+// PAYMENT_PROCESSOR_<NAME>_*; timeout, concurrency, IP family and
+// User-Agent default to the global settings
+func (p *envParser) processor(name, fallbackURL string, fallbackWeight int, cfg Config) ProcessorConfig {
+	key := "PAYMENT_PROCESSOR_" + name + "_"
+	pc := ProcessorConfig{
+		URL:             p.url(key+"URL", fallbackURL),
+		Weight:          p.int(key+"WEIGHT", fallbackWeight, 0),
+		Timeout:         p.duration(key+"TIMEOUT", cfg.ProcessorTimeout),
+		MaxConcurrency:  p.int(key+"MAX_CONCURRENCY", cfg.MaxConcurrency, 1),
+		MaxConns:        p.int(key+"MAX_CONNS", 0, 0),
+		IdleConnTimeout: p.duration(key+"IDLE_CONN_TIMEOUT", 90*time.Second),
+
+		IPFamily:        p.oneOf(key+"IP_FAMILY", cfg.ProcessorIPFamily, ipFamilies...),
+		DialTimeout:     cfg.ProcessorDialTimeout,
+		FallbackDelay:   cfg.ProcessorFallbackDelay,
+		Proxy:           p.str(key+"PROXY", ""),
+		Headers:         make(http.Header),
+		SigningSecret:   p.str(key+"SIGNING_SECRET", ""),
+		SignatureHeader: p.str(key+"SIGNATURE_HEADER", "X-Gateway-Signature"),
+		Zone:            p.str(key+"ZONE", ""),
+		Region:          p.str(key+"REGION", ""),
+	}
+	if pc.Proxy != "" && pc.Proxy != "direct" {
+		if u, err := url.Parse(pc.Proxy); err != nil || u.Host == "" {
+			p.fail(key+"PROXY", pc.Proxy, `must be a proxy URL or "direct"`)
+			pc.Proxy = ""
+		}
+	}
+	if ua := p.str(key+"USER_AGENT", cfg.ProcessorUserAgent); ua != "" {
+		pc.Headers.Set("User-Agent", ua)
+	}
+	for name, value := range parseKeyValues(os.Getenv(key + "HEADERS")) {
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "" || strings.ContainsAny(name, " \t\r\n") || strings.ContainsAny(value, "\r\n") {
+			p.fail(key+"HEADERS", os.Getenv(key+"HEADERS"), "invalid header "+strconv.Quote(name))
+			continue
+		}
+		pc.Headers.Set(name, value)
+	}
+	pc.MaxIdleConns = p.int(key+"MAX_IDLE_CONNS", pc.MaxConcurrency, 1)
+	retries := cfg.MaxRetries
+	if retries == 0 {
+		retries = max(pc.MaxConcurrency/2, 1)
+	}
+	pc.MaxRetries = min(p.int(key+"MAX_RETRIES_IN_FLIGHT", retries, 1), pc.MaxConcurrency)
+	return pc
+}
+
+// Comma-separated subset of allowed
+func (p *envParser) subset(key, fallback string, allowed ...string) []string {
+	value := getEnv(key, fallback)
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if !slices.Contains(allowed, item) {
+			p.fail(key, value, "accepts "+strings.Join(allowed, ", ")+", not "+item)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// Comma-separated, blanks dropped
+func (p *envParser) list(key string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// CONFORMANCE RUN (rinha-payment-gateway verify)
+// ============================================================================
+
+// Options of one verify run
+type conformanceRun struct {
+	gateway        string
+	gatewayToken   string
+	processors     map[string]string // name -> base URL (admin API)
+	processorToken string
+
+	payments    int // Per phase
+	concurrency int
+	amount      Cents
+	settle      time.Duration
+	p99         time.Duration
+
+	client    *http.Client
+	mu        sync.Mutex
+	latencies []time.Duration
+	accepted  int
+	refused   map[int]int // Status -> count
+}
+
+// Drives a live gateway and its processors through a scripted scenario and
+// checks that the gateway summary matches what the processors recorded and
+// that ingest stayed within the latency SLO. Returns the exit code.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	run := conformanceRun{client: &http.Client{Timeout: 10 * time.Second}, refused: make(map[int]int)}
+	var defaultURL, fallbackURL, amount string
+	fs.StringVar(&run.gateway, "gateway", "http://localhost:9999", "gateway base URL")
+	fs.StringVar(&run.gatewayToken, "gateway-token", "", "ADMIN_TOKEN, to purge the gateway before the run")
+	fs.StringVar(&defaultURL, "default", "http://localhost:8001", "default processor base URL")
+	fs.StringVar(&fallbackURL, "fallback", "http://localhost:8002", "fallback processor base URL")
+	fs.StringVar(&run.processorToken, "processor-token", "123", "X-Rinha-Token of the processors' admin API")
+	fs.IntVar(&run.payments, "payments", 500, "payments sent in each phase")
+	fs.IntVar(&run.concurrency, "concurrency", 50, "concurrent senders")
+	fs.StringVar(&amount, "amount", "19.90", "amount of every payment")
+	fs.DurationVar(&run.settle, "settle", 10*time.Second, "how long to wait for the queue to drain after the last phase")
+	fs.DurationVar(&run.p99, "p99", 50*time.Millisecond, "p99 latency allowed for POST /payments")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cents, err := parseCents(amount)
+	if err != nil || cents <= 0 || run.payments < 1 || run.concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "verify: -amount must be positive and -payments, -concurrency at least 1")
+		return 2
+	}
+	run.amount = cents
+	run.processors = map[string]string{"default": strings.TrimRight(defaultURL, "/"), "fallback": strings.TrimRight(fallbackURL, "/")}
+	run.gateway = strings.TrimRight(run.gateway, "/")
+
+	ok := run.execute()
+	if ok {
+		fmt.Println("PASS")
+		return 0
+	}
+	fmt.Println("FAIL")
+	return 1
+}
+
+func (run *conformanceRun) execute() bool {
+	if run.gatewayToken != "" {
+		if err := run.call(http.MethodPost, run.gateway+"/admin/purge-payments", "Authorization", "Bearer "+run.gatewayToken, nil); err != nil {
+			fmt.Println("gateway purge failed:", err)
+			return false
+		}
+	}
+	for name, base := range run.processors {
+		if err := run.processorAdmin(base, http.MethodPost, "/admin/purge-payments", nil); err != nil {
+			fmt.Printf("%s processor purge failed: %v\n", name, err)
+			return false
+		}
+	}
+	// Whatever happened before the run stays out of the comparison
+	from := time.Now().UTC()
+
+	phases := []struct {
+		name          string
+		before, after func() error
+	}{
+		{name: "steady"},
+		{name: "default failing",
+			before: func() error { return run.setFailure("default", true) },
+			after:  func() error { return run.setFailure("default", false) }},
+		{name: "default slow",
+			before: func() error { return run.setDelay("default", 1000) },
+			after:  func() error { return run.setDelay("default", 0) }},
+		{name: "both failing",
+			before: func() error { return errors.Join(run.setFailure("default", true), run.setFailure("fallback", true)) },
+			after:  func() error { return errors.Join(run.setFailure("default", false), run.setFailure("fallback", false)) }},
+		{name: "recovered"},
+	}
+	for _, phase := range phases {
+		if phase.before != nil {
+			if err := phase.before(); err != nil {
+				fmt.Printf("phase %q: processor admin call failed: %v\n", phase.name, err)
+				return false
+			}
+		}
+		started := time.Now()
+		run.burst()
+		fmt.Printf("phase %-16s %d payments in %s\n", phase.name, run.payments, time.Since(started).Round(time.Millisecond))
+		if phase.after != nil {
+			if err := phase.after(); err != nil {
+				fmt.Printf("phase %q: processor admin call failed: %v\n", phase.name, err)
+				return false
+			}
+		}
+	}
+
+	fmt.Printf("waiting %s for the queue to drain\n", run.settle)
+	time.Sleep(run.settle)
+	to := time.Now().UTC()
+
+	ok := run.checkSummary(from, to)
+	return run.checkLatency() && ok
+}
+
+// Sends one phase worth of payments from run.concurrency senders
+func (run *conformanceRun) burst() {
+	ids := make(chan string, run.payments)
+	for i := 0; i < run.payments; i++ {
+		ids <- newUUIDv4()
+	}
+	close(ids)
+	body := func(id string) []byte {
+		return []byte(`{"correlationId":"` + id + `","amount":` + run.amount.String() + `}`)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < run.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				start := time.Now()
+				resp, err := run.client.Post(run.gateway+"/payments", "application/json", bytes.NewReader(body(id)))
+				elapsed := time.Since(start)
+				status := 0
+				if err == nil {
+					status = resp.StatusCode
+					_, _ = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				run.mu.Lock()
+				run.latencies = append(run.latencies, elapsed)
+				if status/100 == 2 {
+					run.accepted++
+				} else {
+					run.refused[status]++
+				}
+				run.mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// The gateway must report exactly what each processor recorded: a
+// difference in either direction is an inconsistency the contest penalizes
+func (run *conformanceRun) checkSummary(from, to time.Time) bool {
+	window := "?from=" + from.Format(time.RFC3339Nano) + "&to=" + to.Format(time.RFC3339Nano)
+	var gateway map[string]struct {
+		TotalRequests int64   `json:"totalRequests"`
+		TotalAmount   float64 `json:"totalAmount"`
+	}
+	if err := run.getJSON(run.gateway+"/payments-summary"+window, "", "", &gateway); err != nil {
+		fmt.Println("gateway summary failed:", err)
+		return false
+	}
+
+	ok := true
+	var recorded int64
+	for _, name := range []string{"default", "fallback"} {
+		var processor struct {
+			TotalRequests int64   `json:"totalRequests"`
+			TotalAmount   float64 `json:"totalAmount"`
+		}
+		if err := run.getJSON(run.processors[name]+"/admin/payments-summary"+window, "X-Rinha-Token", run.processorToken, &processor); err != nil {
+			fmt.Printf("%s processor summary failed: %v\n", name, err)
+			return false
+		}
+		got := gateway[name]
+		recorded += got.TotalRequests
+		match := got.TotalRequests == processor.TotalRequests && math.Abs(got.TotalAmount-processor.TotalAmount) < 0.005
+		fmt.Printf("%-8s gateway %d / %.2f, processor %d / %.2f  %s\n", name,
+			got.TotalRequests, got.TotalAmount, processor.TotalRequests, processor.TotalAmount, verdict(match))
+		ok = ok && match
+	}
+	// Payments failing on both processors are accepted but never recorded
+	fmt.Printf("accepted %d, recorded %d, refused %v\n", run.accepted, recorded, run.refused)
+	if recorded > int64(run.accepted) {
+		fmt.Println("more payments recorded than accepted  FAIL")
+		ok = false
+	}
+	return ok
+}
+
+func (run *conformanceRun) checkLatency() bool {
+	if len(run.latencies) == 0 {
+		return false
+	}
+	sort.Slice(run.latencies, func(i, j int) bool { return run.latencies[i] < run.latencies[j] })
+	p99 := run.latencies[(len(run.latencies)*99-1)/100]
+	ok := p99 <= run.p99
+	fmt.Printf("POST /payments p50 %s, p99 %s (SLO %s)  %s\n",
+		run.latencies[len(run.latencies)/2].Round(time.Microsecond), p99.Round(time.Microsecond), run.p99, verdict(ok))
+	return ok
+}
+
+func verdict(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "FAIL"
+}
+
+func (run *conformanceRun) setFailure(processor string, failing bool) error {
+	return run.processorAdmin(run.processors[processor], http.MethodPut, "/admin/configurations/failure", []byte(fmt.Sprintf(`{"failure":%t}`, failing)))
+}
+
+func (run *conformanceRun) setDelay(processor string, ms int) error {
+	return run.processorAdmin(run.processors[processor], http.MethodPut, "/admin/configurations/delay", []byte(fmt.Sprintf(`{"delay":%d}`, ms)))
+}
+
+func (run *conformanceRun) processorAdmin(base, method, path string, body []byte) error {
+	return run.call(method, base+path, "X-Rinha-Token", run.processorToken, body)
+}
+
+func (run *conformanceRun) call(method, url, header, value string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(header, value)
+	resp, err := run.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s returned %s", method, url, resp.Status)
+	}
+	return nil
+}
+
+func (run *conformanceRun) getJSON(url, header, value string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	resp, err := run.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return jsonFast.NewDecoder(resp.Body).Decode(out)
+}
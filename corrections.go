@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// CORRECTIONS (VOID / AMOUNT FIX)
+// ============================================================================
+
+const auditKey = "audit:log"
+
+// Body of POST /admin/corrections
+type correctionRequest struct {
+	CorrelationId string `json:"correlationId"`
+	Action        string `json:"action"` // "void" or "correct"
+	Amount        *Cents `json:"amount,omitempty"`
+	Reason        string `json:"reason"`
+}
+
+// Applies a correction only if the payment still has the effective amount
+// the caller computed it from; the status flag, the corrections bucket entry
+// and the audit entry are written together or not at all.
+var applyCorrectionScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'voided') == '1' then
+  return redis.error_reply('VOIDED')
+end
+local current = redis.call('HGET', KEYS[1], 'correctedAmount') or redis.call('HGET', KEYS[1], 'amount')
+if current ~= ARGV[1] then
+  return redis.error_reply('CONFLICT')
+end
+if ARGV[2] == '' then
+  redis.call('HSET', KEYS[1], 'voided', '1')
+else
+  redis.call('HSET', KEYS[1], 'correctedAmount', ARGV[2])
+end
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[3])
+redis.call('HSET', KEYS[3], ARGV[3], ARGV[5])
+redis.call('XADD', KEYS[4], '*', unpack(ARGV, 8))
+-- Ledger on: post the delta, legs swapped when it takes money back
+if #KEYS > 4 then
+  local delta = tonumber(string.match(ARGV[5], '^(-?%d+),'))
+  if delta ~= 0 then
+    local balances = {}
+    balances[ARGV[6]] = redis.call('HINCRBY', KEYS[6], ARGV[6], delta)
+    balances[ARGV[7]] = redis.call('HINCRBY', KEYS[6], ARGV[7], delta)
+    local debit, credit = ARGV[6], ARGV[7]
+    if delta < 0 then
+      debit, credit = ARGV[7], ARGV[6]
+    end
+    local kind = 'correct'
+    if ARGV[2] == '' then
+      kind = 'void'
+    end
+    redis.call('XADD', KEYS[5], '*', 'kind', kind, 'correlationId', string.sub(KEYS[1], 8),
+      'amount', math.abs(delta), 'debit', debit, 'credit', credit,
+      'debitBalance', balances[debit], 'creditBalance', balances[credit], 'correctionId', ARGV[3])
+  end
+end
+return 1
+`)
+
+func correctionKey(bucket, kind string) string {
+	return summaryPrefix(bucket) + ":corrections:" + kind
+}
+
+// POST /admin/corrections - Void or re-amount a recorded payment
+func handleAdminCorrections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if refusedInCluster(w) {
+		return
+	}
+	var req correctionRequest
+	if err := jsonFast.NewDecoder(r.Body).Decode(&req); err != nil || req.CorrelationId == "" || strings.TrimSpace(req.Reason) == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request", "correlationId and reason are required")
+		return
+	}
+	if req.Action == "correct" && (req.Amount == nil || *req.Amount <= 0) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_amount", "correct needs a positive amount")
+		return
+	}
+	if req.Action != "void" && req.Action != "correct" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_action", "action must be void or correct")
+		return
+	}
+
+	ctx := r.Context()
+	status, err := redisClient.HGetAll(ctx, "status:"+req.CorrelationId).Result()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	processor := status["processor"]
+	if processorByName(processor) == nil {
+		writeJSONError(w, http.StatusNotFound, "not_recorded", "no recorded payment with this correlationId")
+		return
+	}
+	if status["voided"] == "1" {
+		writeJSONError(w, http.StatusConflict, "already_voided", "payment is already voided")
+		return
+	}
+	if _, ok := status["refunded"]; ok {
+		writeJSONError(w, http.StatusConflict, "refunded", "payment has refunds; correct it with a refund instead")
+		return
+	}
+
+	current := status["amount"]
+	if corrected, ok := status["correctedAmount"]; ok {
+		current = corrected
+	}
+	currentAmount, _ := parseCents(current)
+	requestedAt, _ := time.Parse("2006-01-02T15:04:05.000Z07:00", status["requestedAt"])
+
+	newAmount, deltaAmount, deltaCount := "", -currentAmount, -1
+	if req.Action == "correct" {
+		newAmount = req.Amount.String()
+		deltaAmount, deltaCount = *req.Amount-currentAmount, 0
+	}
+	correctionID := newUUIDv7()
+
+	actor := r.Header.Get("X-Admin-User")
+	if actor == "" {
+		actor = "admin"
+	}
+	bucket := currencyBucket(processor, status["currency"])
+	ledgerKeys, debit, credit := ledgerCorrectionArgs(processor, bucket)
+	err = applyCorrectionScript.Run(ctx, redisClient,
+		append([]string{"status:" + req.CorrelationId, correctionKey(bucket, "history"), correctionKey(bucket, "data"), auditKey}, ledgerKeys...),
+		current,
+		newAmount,
+		correctionID,
+		requestedAt.UnixMilli(),
+		deltaAmount.Raw()+","+strconv.Itoa(deltaCount),
+		debit,
+		credit,
+		// Audit entry fields
+		"action", req.Action,
+		"correlationId", req.CorrelationId,
+		"processor", processor,
+		"previousAmount", current,
+		"newAmount", newAmount,
+		"reason", req.Reason,
+		"actor", actor,
+		"instance", INSTANCE_ID,
+		"at", time.Now().UTC().Format(time.RFC3339Nano),
+	).Err()
+	switch {
+	case err != nil && strings.Contains(err.Error(), "VOIDED"):
+		writeJSONError(w, http.StatusConflict, "already_voided", "payment was voided concurrently")
+		return
+	case err != nil && strings.Contains(err.Error(), "CONFLICT"):
+		writeJSONError(w, http.StatusConflict, "concurrent_correction", "payment was corrected concurrently, retry")
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(map[string]interface{}{
+		"correctionId":  correctionID,
+		"correlationId": req.CorrelationId,
+		"processor":     processor,
+		"action":        req.Action,
+		"deltaAmount":   deltaAmount,
+		"deltaCount":    deltaCount,
+	})
+}
+
+// Net adjustments for payments requested within [from, to]
+// Same shape as summaryScript over "rawDelta,deltaCount" values
+var correctionsSummaryScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[2])
+local count, total = 0, 0
+for i = 1, #ids, 1000 do
+	local vals = redis.call('HMGET', KEYS[2], unpack(ids, i, math.min(i + 999, #ids)))
+	for _, v in ipairs(vals) do
+		local delta, n = string.match(v or '', '^(-?%d+),(-?%d+)$')
+		if delta then
+			total = total + tonumber(delta)
+			count = count + tonumber(n)
+		end
+	end
+end
+return {count, string.format('%.0f', total)}
+`)
+
+func getCorrectionsData(bucket string, from, to time.Time) SummaryData {
+	keys := []string{correctionKey(bucket, "history"), correctionKey(bucket, "data")}
+	return runSummaryScript(correctionsSummaryScript, keys, from, to)
+}
+
+// Writes {"error": code, "message": msg} with the given status
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(jsonErrorBody(code, message))
+}
+
+func jsonErrorBody(code, message string) []byte {
+	body, _ := jsonFast.Marshal(map[string]string{"error": code, "message": message})
+	return append(body, '\n')
+}
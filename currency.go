@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// CURRENCIES
+// ============================================================================
+
+var (
+	// Set by setupCurrencies
+	defaultCurrency    string
+	acceptedCurrencies map[string]bool
+
+	// processor -> *cachedBuckets, see currencyBuckets
+	bucketCache sync.Map
+)
+
+// How long the currencies found for a processor are reused before scanning
+// again; a payment in a new currency shows up in listings, costs and
+// tiering within this
+const bucketCacheTTL = 10 * time.Second
+
+type cachedBuckets struct {
+	buckets []string
+	at      time.Time
+}
+
+// Active ISO 4217 alphabetic codes, funds and precious metals included
+const iso4217Codes = "AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BOV " +
+	"BRL BSD BTN BWP BYN BZD CAD CDF CHE CHF CHW CLF CLP CNY COP COU CRC CUP CVE CZK " +
+	"DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD HNL " +
+	"HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT " +
+	"LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MXV MYR " +
+	"MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF " +
+	"SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP " +
+	"TRY TTD TWD TZS UAH UGX USD USN UYI UYU UYW UZS VED VES VND VUV WST XAF XAG XAU " +
+	"XBA XBB XBC XBD XCD XCG XDR XOF XPD XPF XPT XSU XUA YER ZAR ZMW ZWG"
+
+var iso4217 = func() map[string]bool {
+	codes := make(map[string]bool)
+	for _, code := range strings.Fields(iso4217Codes) {
+		codes[code] = true
+	}
+	return codes
+}()
+
+type CurrencyConfig struct {
+	// Currency of payments sent without one. Its totals stay in the
+	// original summary keys, so a single-currency deployment is unchanged.
+	Default string
+	// Currencies accepted in the currency field; empty accepts any ISO 4217
+	// code
+	Accepted []string
+}
+
+func loadCurrencyConfig(env *envParser) CurrencyConfig {
+	c := CurrencyConfig{Default: env.str("DEFAULT_CURRENCY", "BRL")}
+	if !iso4217[c.Default] {
+		env.fail("DEFAULT_CURRENCY", c.Default, "must be an ISO 4217 code")
+	}
+	for _, code := range env.list("CURRENCIES") {
+		code = strings.ToUpper(code)
+		if !iso4217[code] {
+			env.fail("CURRENCIES", os.Getenv("CURRENCIES"), "accepts ISO 4217 codes, not "+code)
+			continue
+		}
+		c.Accepted = append(c.Accepted, code)
+	}
+	return c
+}
+
+func setupCurrencies(cfg CurrencyConfig) {
+	defaultCurrency = cfg.Default
+	acceptedCurrencies = make(map[string]bool)
+	for _, code := range cfg.Accepted {
+		acceptedCurrencies[code] = true
+	}
+}
+
+// Upper-cases a currency and reports whether it is accepted
+func acceptedCurrency(raw string) (string, bool) {
+	code := strings.ToUpper(raw)
+	if !iso4217[code] {
+		return code, false
+	}
+	return code, len(acceptedCurrencies) == 0 || acceptedCurrencies[code] || code == defaultCurrency
+}
+
+// Name the summaries of a processor are kept under for one currency:
+// the processor itself for the default currency, <processor>:<code>
+// otherwise
+func currencyBucket(processor, currency string) string {
+	if currency == "" || currency == defaultCurrency {
+		return processor
+	}
+	return processor + ":" + currency
+}
+
+// Every currencyBucket processor has recorded payments in: the processor
+// itself first, then <processor>:<code> for each other currency found in
+// Redis, in code order
+func currencyBuckets(ctx context.Context, processor string) []string {
+	if cached, ok := bucketCache.Load(processor); ok && time.Since(cached.(*cachedBuckets).at) < bucketCacheTTL {
+		return cached.(*cachedBuckets).buckets
+	}
+	prefix := summaryPrefix(processor) + ":"
+	codes := map[string]bool{}
+	err := scanKeys(ctx, prefix+"[A-Z][A-Z][A-Z]:history*", 1000, func(_ redis.UniversalClient, keys []string) error {
+		for _, key := range keys {
+			codes[strings.TrimPrefix(key, prefix)[:3]] = true
+		}
+		return nil
+	})
+	buckets := []string{processor}
+	for code := range codes {
+		buckets = append(buckets, currencyBucket(processor, code))
+	}
+	sort.Strings(buckets[1:])
+	if err == nil {
+		bucketCache.Store(processor, &cachedBuckets{buckets: buckets, at: time.Now()})
+	}
+	return buckets
+}
+
+// Currency of the payments kept under a currencyBucket
+func bucketCurrency(bucket string) string {
+	if _, code, ok := strings.Cut(bucket, ":"); ok {
+		return code
+	}
+	return defaultCurrency
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+)
+
+// ============================================================================
+// DEBUG LISTENER (DEBUG_PORT)
+// ============================================================================
+
+var (
+	// Where DEBUG_PORT binds: loopback unless opened up on purpose
+	DEBUG_HOST = getEnv("DEBUG_HOST", "127.0.0.1")
+
+	debugLog = componentLogger("debug")
+)
+
+// Importing net/http/pprof and expvar registers their handlers on the
+// DefaultServeMux, which the public listener serves; this hides them there
+// whether or not DEBUG_PORT is set.
+func hideDebug(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Serves /debug/pprof/ and /debug/vars on their own port (":<port>"; empty
+// disables)
+func startDebugServer(port string) {
+	if port == "" {
+		return
+	}
+	expvar.Publish("gateway", expvar.Func(debugVars))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(DEBUG_HOST, port[1:]))
+	if err != nil {
+		panic("debug listener: " + err.Error())
+	}
+	debugLog.Info("debug endpoints listening", "addr", ln.Addr().String())
+	// No write timeout: CPU profiles and traces stream for ?seconds=
+	go func() { _ = http.Serve(ln, mux) }()
+}
+
+// Queue and worker gauges, read on every /debug/vars
+func debugVars() interface{} {
+	return map[string]interface{}{
+		"queueDepth":     len(paymentQueue),
+		"queueCapacity":  cap(paymentQueue),
+		"workers":        workerCount(),
+		"workersBusy":    busyWorkers.Load(),
+		"goroutines":     runtime.NumGoroutine(),
+		"brownout":       brownedOut.Load(),
+		"loadShedding":   loadShedding.Load(),
+		"summaryPending": summaryWriter.Pending(),
+		"summaryLagMs":   summaryWriter.Lag().Milliseconds(),
+		"instance":       INSTANCE_ID,
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ============================================================================
+// PROCESSOR DIALING (DUAL STACK)
+// ============================================================================
+
+// any (resolver order), ipv4, ipv6, prefer-ipv4 or prefer-ipv6
+var ipFamilies = []string{"any", "ipv4", "ipv6", "prefer-ipv4", "prefer-ipv6"}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func newProcessorDialer(cfg ProcessorConfig) dialFunc {
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second, FallbackDelay: cfg.FallbackDelay}
+
+	switch cfg.IPFamily {
+	case "ipv4":
+		return fixedFamily(dialer, "tcp4")
+	case "ipv6":
+		return fixedFamily(dialer, "tcp6")
+	case "prefer-ipv4":
+		return raceFamilies(dialer, "tcp4", "tcp6", cfg.FallbackDelay)
+	case "prefer-ipv6":
+		return raceFamilies(dialer, "tcp6", "tcp4", cfg.FallbackDelay)
+	}
+	// Go already races both families (RFC 6555), primary family first
+	return dialer.DialContext
+}
+
+func fixedFamily(dialer *net.Dialer, network string) dialFunc {
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// Dials the preferred family and, if it has not connected after delay (or
+// fails sooner), the other one too; the first connection wins
+func raceFamilies(dialer *net.Dialer, preferred, other string, delay time.Duration) dialFunc {
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+		results := make(chan result, 2)
+		dial := func(network string) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- result{conn, err}
+		}
+
+		go dial(preferred)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		started, failed := 1, 0
+		var firstErr error
+		for {
+			select {
+			case <-timer.C:
+				if started == 1 {
+					started++
+					go dial(other)
+				}
+				continue
+			case r := <-results:
+				if r.err == nil {
+					// Close a slower winner that may still arrive
+					if started-failed > 1 {
+						go func() {
+							if late := <-results; late.conn != nil {
+								late.conn.Close()
+							}
+						}()
+					}
+					return r.conn, nil
+				}
+				failed++
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				if started == 1 {
+					// Preferred family failed fast: don't wait out the delay
+					started++
+					go dial(other)
+				} else if failed == started {
+					return nil, firstErr
+				}
+			}
+		}
+	}
+}
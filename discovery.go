@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// CONFIG DISCOVERY (CONSUL / ETCD)
+// ============================================================================
+
+var (
+	CONSUL_ADDR  = getEnv("CONSUL_ADDR", "http://127.0.0.1:8500")
+	CONSUL_TOKEN = getEnv("CONSUL_TOKEN", "")
+	ETCD_ADDR    = getEnv("ETCD_ADDR", "http://127.0.0.1:2379")
+
+	// Keys read: <prefix>/<processor>/url and <prefix>/<processor>/weight
+	CONFIG_PREFIX = getEnv("CONFIG_PREFIX", "rinha-gateway")
+
+	// Long-poll/stream client: no global timeout, watches block for minutes
+	discoveryClient = &http.Client{}
+
+	discoveryLog = componentLogger("discovery")
+)
+
+// backend is CONFIG_DISCOVERY: "" (disabled), "consul" or "etcd"
+func startConfigDiscovery(backend string) {
+	prefix := strings.Trim(CONFIG_PREFIX, "/") + "/"
+	switch backend {
+	case "consul":
+		go watchForever("consul", func(ctx context.Context) error { return watchConsul(ctx, prefix) })
+	case "etcd":
+		go watchForever("etcd", func(ctx context.Context) error { return watchEtcd(ctx, prefix) })
+	}
+}
+
+// Restarts a watch after errors with a capped backoff
+func watchForever(name string, watch func(ctx context.Context) error) {
+	backoff := time.Second
+	for {
+		err := watch(context.Background())
+		discoveryLog.Warn("config watch stopped", "backend", name, "err", err, "retryIn", backoff)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// Applies discovered values keyed relative to the prefix ("default/url")
+func applyDiscoveredConfig(values map[string]string) {
+	for key, value := range values {
+		name, field, ok := strings.Cut(key, "/")
+		p := processorByName(name)
+		if !ok || p == nil {
+			continue
+		}
+		switch field {
+		case "url":
+			if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+				discoveryLog.Warn("ignoring invalid discovered url", "processor", name, "value", value)
+			} else if value != p.BaseURL() {
+				p.SetURL(value)
+				discoveryLog.Info("processor url changed", "processor", name, "url", value)
+			}
+		case "weight":
+			if weight, err := strconv.Atoi(value); err != nil || weight < 0 {
+				discoveryLog.Warn("ignoring invalid discovered weight", "processor", name, "value", value)
+			} else if weight != p.Weight() {
+				p.SetWeight(weight)
+				discoveryLog.Info("processor weight changed", "processor", name, "weight", weight)
+			}
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Consul: KV blocking queries
+// ----------------------------------------------------------------------------
+
+func watchConsul(ctx context.Context, prefix string) error {
+	index := "0"
+	for {
+		u := strings.TrimSuffix(CONSUL_ADDR, "/") + "/v1/kv/" + prefix + "?recurse=true&wait=5m&index=" + index
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		if CONSUL_TOKEN != "" {
+			req.Header.Set("X-Consul-Token", CONSUL_TOKEN)
+		}
+		resp, err := discoveryClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		var entries []struct {
+			Key   string
+			Value string // base64
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = jsonFast.NewDecoder(resp.Body).Decode(&entries)
+		case http.StatusNotFound:
+			// Prefix has no keys yet
+		default:
+			err = fmt.Errorf("consul: %s", resp.Status)
+		}
+		newIndex := resp.Header.Get("X-Consul-Index")
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		values := make(map[string]string, len(entries))
+		for _, entry := range entries {
+			raw, _ := base64.StdEncoding.DecodeString(entry.Value)
+			values[strings.TrimPrefix(entry.Key, prefix)] = strings.TrimSpace(string(raw))
+		}
+		applyDiscoveredConfig(values)
+
+		// An index going backwards means the Consul state was reset
+		if n, _ := strconv.ParseUint(newIndex, 10, 64); n > 0 {
+			if old, _ := strconv.ParseUint(index, 10, 64); n < old {
+				newIndex = "0"
+			}
+			index = newIndex
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// etcd: v3 JSON gateway range + watch stream
+// ----------------------------------------------------------------------------
+
+type etcdKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func watchEtcd(ctx context.Context, prefix string) error {
+	key := base64.StdEncoding.EncodeToString([]byte(prefix))
+	rangeEnd := base64.StdEncoding.EncodeToString(prefixRangeEnd(prefix))
+
+	// Initial snapshot
+	var snapshot struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []etcdKV `json:"kvs"`
+	}
+	if err := etcdCall(ctx, "/v3/kv/range", map[string]string{"key": key, "range_end": rangeEnd}, &snapshot); err != nil {
+		return err
+	}
+	applyDiscoveredConfig(decodeEtcdKVs(prefix, snapshot.Kvs))
+	revision, _ := strconv.ParseInt(snapshot.Header.Revision, 10, 64)
+
+	// Watch from the next revision; the gateway streams one JSON object per event batch
+	body, _ := jsonFast.Marshal(map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            key,
+			"range_end":      rangeEnd,
+			"start_revision": strconv.FormatInt(revision+1, 10),
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(ETCD_ADDR, "/")+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := discoveryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd watch: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var msg struct {
+			Result struct {
+				Events []struct {
+					Type string `json:"type"`
+					Kv   etcdKV `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+		if err := jsonFast.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return err
+		}
+		kvs := make([]etcdKV, 0, len(msg.Result.Events))
+		for _, event := range msg.Result.Events {
+			// Deletes keep the last known value
+			if event.Type != "DELETE" {
+				kvs = append(kvs, event.Kv)
+			}
+		}
+		applyDiscoveredConfig(decodeEtcdKVs(prefix, kvs))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("etcd watch stream closed")
+}
+
+func etcdCall(ctx context.Context, path string, in, out interface{}) error {
+	body, err := jsonFast.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(ETCD_ADDR, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd %s: %s", path, resp.Status)
+	}
+	return jsonFast.NewDecoder(resp.Body).Decode(out)
+}
+
+func decodeEtcdKVs(prefix string, kvs []etcdKV) map[string]string {
+	values := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		k, _ := base64.StdEncoding.DecodeString(kv.Key)
+		v, _ := base64.StdEncoding.DecodeString(kv.Value)
+		values[strings.TrimPrefix(string(k), prefix)] = strings.TrimSpace(string(v))
+	}
+	return values
+}
+
+// Smallest key greater than every key with the prefix (etcd range_end)
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// DEAD-LETTER QUEUE
+// ============================================================================
+
+// Payments rejected by both processors, oldest first
+const dlqKey = "payments:dlq"
+
+// Entry served by GET /admin/dlq
+type dlqEntry struct {
+	ID       string       `json:"id"`
+	Payment  PostPayments `json:"payment"`
+	FailedAt string       `json:"failedAt"`
+	Instance string       `json:"instance"`
+}
+
+// Body of POST /admin/dlq/replay; an empty id list replays everything
+type dlqReplayRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// Queued alongside the failed status (see saveFailedStatus)
+func deadLetterArgs(payment PostPayments) *redis.XAddArgs {
+	data, _ := jsonFast.Marshal(payment)
+	return &redis.XAddArgs{
+		Stream: dlqKey,
+		Values: []interface{}{
+			"p", data,
+			"failedAt", time.Now().UTC().Format(time.RFC3339Nano),
+			"tenant", payment.tenant,
+			"callback", payment.callbackURL,
+			"namespace", payment.namespace,
+			"sandbox", payment.sandbox,
+			"instance", INSTANCE_ID,
+		},
+	}
+}
+
+func parseDLQEntry(msg redis.XMessage) (dlqEntry, bool) {
+	entry := dlqEntry{ID: msg.ID}
+	data, _ := msg.Values["p"].(string)
+	if jsonFast.UnmarshalFromString(data, &entry.Payment) != nil {
+		return entry, false
+	}
+	entry.FailedAt, _ = msg.Values["failedAt"].(string)
+	entry.Instance, _ = msg.Values["instance"].(string)
+	entry.Payment.tenant, _ = msg.Values["tenant"].(string)
+	entry.Payment.callbackURL, _ = msg.Values["callback"].(string)
+	entry.Payment.namespace, _ = msg.Values["namespace"].(string)
+	entry.Payment.sandbox = msg.Values["sandbox"] == "1"
+	return entry, true
+}
+
+// GET /admin/dlq?after=<id>&count=<n> - Page through dead-lettered payments
+func handleAdminDLQ(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	count, err := strconv.ParseInt(r.URL.Query().Get("count"), 10, 64)
+	if err != nil || count <= 0 || count > 1000 {
+		count = 100
+	}
+	start := "-"
+	if after := r.URL.Query().Get("after"); after != "" {
+		start = "(" + after
+	}
+
+	ctx := r.Context()
+	msgs, err := redisClient.XRangeN(ctx, dlqKey, start, "+", count).Result()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	size, _ := redisClient.XLen(ctx, dlqKey).Result()
+
+	entries := make([]dlqEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		if entry, ok := parseDLQEntry(msg); ok {
+			entries = append(entries, entry)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(map[string]interface{}{
+		"size":    size,
+		"entries": entries,
+	})
+}
+
+// POST /admin/dlq/replay - Re-enqueue dead-lettered payments
+func handleAdminDLQReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req dlqReplayRequest
+	if r.ContentLength != 0 {
+		if err := jsonFast.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	var msgs []redis.XMessage
+	if len(req.IDs) == 0 {
+		all, err := redisClient.XRange(ctx, dlqKey, "-", "+").Result()
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		msgs = all
+	} else {
+		for _, id := range req.IDs {
+			found, err := redisClient.XRange(ctx, dlqKey, id, id).Result()
+			if err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			msgs = append(msgs, found...)
+		}
+	}
+
+	replayed, skipped := 0, 0
+	for _, msg := range msgs {
+		entry, ok := parseDLQEntry(msg)
+		if !ok {
+			_ = redisClient.XDel(ctx, dlqKey, msg.ID).Err()
+			continue
+		}
+		if !replayDeadLetter(ctx, entry) {
+			skipped++
+			continue
+		}
+		replayed++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(map[string]int{"replayed": replayed, "skipped": skipped})
+}
+
+// Enqueues one entry the way ingest does (the shared stream, or the WAL then
+// the local queue under strict durability) and drops it from the DLQ only
+// once that write succeeded; false when it could not be queued
+func replayDeadLetter(ctx context.Context, entry dlqEntry) bool {
+	// "failed" is final for advanceStatus, so the replay resets it before the
+	// worker can see the job
+	status := "status:" + entry.Payment.CorrelationId
+	_ = redisClient.HSet(ctx, status, "state", "queued").Err()
+	if !requeueDeadLetter(ctx, entry.Payment) {
+		_ = redisClient.HSet(ctx, status, "state", "failed").Err()
+		return false
+	}
+	_ = redisClient.XDel(ctx, dlqKey, entry.ID).Err()
+	return true
+}
+
+func requeueDeadLetter(ctx context.Context, payment PostPayments) bool {
+	if sharedQueue() {
+		return sharedEnqueue(ctx, payment) == nil
+	}
+	job := paymentJob{PostPayments: payment, ctx: context.Background()}
+	if strictDurability() {
+		id, err := walAppend(ctx, payment)
+		if err != nil {
+			return false
+		}
+		job.walID = id
+	}
+	select {
+	case paymentQueue <- job:
+		return true
+	default:
+		walRemove(job.walID)
+		return false
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// DYNAMODB STORE (STORE=dynamodb)
+// ============================================================================
+
+var (
+	DYNAMODB_TABLE = getEnv("DYNAMODB_TABLE", "rinha-payments")
+	// Defaults to the regional endpoint of AWS_REGION
+	DYNAMODB_ENDPOINT = getEnv("DYNAMODB_ENDPOINT", "")
+
+	dynamoLog = componentLogger("dynamodb")
+)
+
+// Single table, string keys pk (hash) and sk (range):
+//
+//	status#<correlationId>      -                        status fields, as strings
+//	pay#<bucket>#<start ms>     <ms, 13 digits>#<id>     amount (cents)
+//	partitions#<bucket>         <start ms, 13 digits>    one per partition in use
+//
+// Payments of a currencyBucket are spread over one partition per
+// DYNAMODB_PARTITION (StoreConfig) of requestedAt, so no partition runs hot for long and a
+// summary queries only the partitions its window touches, found through the
+// partitions#<bucket> index. A payment recorded twice lands on the same item
+// and counts once.
+type dynamoStore struct {
+	endpoint  string
+	table     string
+	partition int64 // ms
+	client    *http.Client
+
+	// Partitions this instance already put in the index
+	indexed sync.Map
+}
+
+func newDynamoStore(partition time.Duration) *dynamoStore {
+	endpoint := DYNAMODB_ENDPOINT
+	if endpoint == "" {
+		endpoint = "https://dynamodb." + AWS_REGION + ".amazonaws.com"
+	}
+	return &dynamoStore{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		table:     DYNAMODB_TABLE,
+		partition: partition.Milliseconds(),
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Wire format
+// ----------------------------------------------------------------------------
+
+type dynamoAttr struct {
+	S *string `json:"S,omitempty"`
+	N *string `json:"N,omitempty"`
+}
+
+type dynamoItem map[string]dynamoAttr
+
+func dynamoS(s string) dynamoAttr { return dynamoAttr{S: &s} }
+
+func dynamoN(n int64) dynamoAttr {
+	s := strconv.FormatInt(n, 10)
+	return dynamoAttr{N: &s}
+}
+
+func (item dynamoItem) str(name string) string {
+	if a, ok := item[name]; ok && a.S != nil {
+		return *a.S
+	}
+	return ""
+}
+
+func (item dynamoItem) num(name string) int64 {
+	if a, ok := item[name]; ok && a.N != nil {
+		n, _ := strconv.ParseInt(*a.N, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// Status fields of a status item
+func (item dynamoItem) status() map[string]string {
+	status := make(map[string]string, len(item))
+	for name, a := range item {
+		if name != "pk" && name != "sk" && a.S != nil {
+			status[name] = *a.S
+		}
+	}
+	return status
+}
+
+type dynamoError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *dynamoError) Error() string {
+	return "dynamodb: " + e.Type + ": " + e.Message
+}
+
+func isDynamoError(err error, kind string) bool {
+	e, ok := err.(*dynamoError)
+	return ok && e.Type == kind
+}
+
+// Sends one API call. Throttling and 5xx answers are retried a few times
+// with jittered backoff.
+func (s *dynamoStore) call(ctx context.Context, op string, in, out interface{}) error {
+	body, err := jsonFast.Marshal(in)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = s.send(ctx, op, body, out)
+		e, ok := err.(*dynamoError)
+		retryable := ok && (e.Type == "ProvisionedThroughputExceededException" || e.Type == "ThrottlingException" ||
+			e.Type == "RequestLimitExceeded" || e.Type == "InternalServerError")
+		if !retryable || attempt == 3 {
+			return err
+		}
+		backoff := time.Duration(25<<attempt)*time.Millisecond + randomDelay(25*time.Millisecond)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *dynamoStore) send(ctx context.Context, op string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+op)
+	signAWSRequest(req, body, "dynamodb")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &dynamoError{}
+		if jsonFast.Unmarshal(data, e) != nil || e.Type == "" {
+			e.Type = "InternalServerError"
+			e.Message = resp.Status
+		}
+		// "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException"
+		if i := strings.LastIndexByte(e.Type, '#'); i >= 0 {
+			e.Type = e.Type[i+1:]
+		}
+		if resp.StatusCode >= 500 {
+			e.Type = "InternalServerError"
+		}
+		return e
+	}
+	if out == nil {
+		return nil
+	}
+	return jsonFast.Unmarshal(data, out)
+}
+
+// ----------------------------------------------------------------------------
+// Keys
+// ----------------------------------------------------------------------------
+
+func dynamoStatusKey(correlationId string) dynamoItem {
+	return dynamoItem{"pk": dynamoS("status#" + correlationId), "sk": dynamoS("-")}
+}
+
+// 13 digits cover millisecond timestamps up to the year 2286, so they sort
+// as strings
+func dynamoMillis(ms int64) string {
+	return fmt.Sprintf("%013d", max(ms, 0))
+}
+
+func (s *dynamoStore) partitionOf(ms int64) int64 {
+	return ms - ms%s.partition
+}
+
+func (s *dynamoStore) recordItems(processor string, payment PostPayments) (record, index dynamoItem) {
+	ts, _ := time.Parse("2006-01-02T15:04:05.000Z07:00", payment.RequestedAt)
+	at := ts.UnixMilli()
+	bucket := currencyBucket(processor, payment.Currency)
+	start := dynamoMillis(s.partitionOf(at))
+	record = dynamoItem{
+		"pk":     dynamoS("pay#" + bucket + "#" + start),
+		"sk":     dynamoS(dynamoMillis(at) + "#" + payment.CorrelationId),
+		"amount": dynamoN(int64(payment.Amount)),
+	}
+	index = dynamoItem{"pk": dynamoS("partitions#" + bucket), "sk": dynamoS(start)}
+	return record, index
+}
+
+// ----------------------------------------------------------------------------
+// Status
+// ----------------------------------------------------------------------------
+
+func (s *dynamoStore) Claim(ctx context.Context, payment PostPayments) (map[string]string, bool, error) {
+	item := dynamoStatusKey(payment.CorrelationId)
+	item["state"] = dynamoS("received")
+	item["amount"] = dynamoS(payment.Amount.String())
+	item["receivedAt"] = dynamoS(time.Now().UTC().Format(time.RFC3339Nano))
+	item["instance"] = dynamoS(INSTANCE_ID)
+	err := s.call(ctx, "PutItem", map[string]interface{}{
+		"TableName":           s.table,
+		"Item":                item,
+		"ConditionExpression": "attribute_not_exists(pk)",
+	}, nil)
+	if isDynamoError(err, "ConditionalCheckFailedException") {
+		existing, err := s.Status(ctx, payment.CorrelationId)
+		return existing, false, err
+	}
+	return nil, err == nil, err
+}
+
+func (s *dynamoStore) Release(ctx context.Context, correlationId string) {
+	_ = s.call(ctx, "DeleteItem", map[string]interface{}{"TableName": s.table, "Key": dynamoStatusKey(correlationId)}, nil)
+}
+
+// SETs fields (name, value pairs) on a status item under an optional
+// condition, creating it when missing unless the condition forbids it
+func (s *dynamoStore) updateStatus(ctx context.Context, correlationId, condition string, conditionValues dynamoItem, returnOld bool, fields ...string) (dynamoItem, error) {
+	names := make(map[string]string, len(fields)/2)
+	values := make(dynamoItem, len(fields)/2+len(conditionValues))
+	sets := make([]string, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		n := strconv.Itoa(i / 2)
+		names["#f"+n] = fields[i]
+		values[":f"+n] = dynamoS(fields[i+1])
+		sets = append(sets, "#f"+n+" = :f"+n)
+	}
+	in := map[string]interface{}{
+		"TableName":                s.table,
+		"Key":                      dynamoStatusKey(correlationId),
+		"UpdateExpression":         "SET " + strings.Join(sets, ", "),
+		"ExpressionAttributeNames": names,
+	}
+	if condition != "" {
+		names["#state"] = "state"
+		for k, v := range conditionValues {
+			values[k] = v
+		}
+		in["ConditionExpression"] = condition
+	}
+	in["ExpressionAttributeValues"] = values
+	if returnOld {
+		in["ReturnValues"] = "ALL_OLD"
+	}
+	var out struct{ Attributes dynamoItem }
+	err := s.call(ctx, "UpdateItem", in, &out)
+	return out.Attributes, err
+}
+
+func (s *dynamoStore) AdvanceStatus(ctx context.Context, payment PostPayments, state string) bool {
+	// Only from a state ranked below, or from no status at all
+	condition, values := "attribute_not_exists(pk)", dynamoItem{}
+	var earlier []string
+	for from, rank := range statusRank {
+		if rank < statusRank[state] {
+			earlier = append(earlier, ":s"+strconv.Itoa(rank))
+			values[":s"+strconv.Itoa(rank)] = dynamoS(from)
+		}
+	}
+	if len(earlier) > 0 {
+		condition += " OR #state IN (" + strings.Join(earlier, ", ") + ")"
+	} else {
+		values = nil
+	}
+	_, err := s.updateStatus(ctx, payment.CorrelationId, condition, values, false,
+		"state", state,
+		"amount", payment.Amount.String(),
+		state+"At", time.Now().UTC().Format(time.RFC3339Nano),
+		"instance", INSTANCE_ID,
+	)
+	if isDynamoError(err, "ConditionalCheckFailedException") {
+		current, _ := s.Status(ctx, payment.CorrelationId)
+		return current["state"] == "cancelled"
+	}
+	if err != nil {
+		dynamoLog.Warn("status update failed", "correlationId", payment.CorrelationId, "state", state, "err", err)
+	}
+	return false
+}
+
+func (s *dynamoStore) Cancel(ctx context.Context, correlationId string) (string, error) {
+	old, err := s.updateStatus(ctx, correlationId, "#state IN (:received, :queued)",
+		dynamoItem{":received": dynamoS("received"), ":queued": dynamoS("queued")}, true,
+		"state", "cancelled",
+		"cancelledAt", time.Now().UTC().Format(time.RFC3339Nano),
+		"cancelledBy", INSTANCE_ID,
+	)
+	if isDynamoError(err, "ConditionalCheckFailedException") {
+		current, err := s.Status(ctx, correlationId)
+		return current["state"], err
+	}
+	if err != nil {
+		return "", err
+	}
+	return old.str("state"), nil
+}
+
+func (s *dynamoStore) RecordFailure(payment PostPayments) {
+	_, err := s.updateStatus(context.Background(), payment.CorrelationId, "", nil, false,
+		"state", "failed",
+		"amount", payment.Amount.String(),
+		"requestedAt", payment.RequestedAt,
+		"instance", INSTANCE_ID,
+	)
+	if err != nil {
+		dynamoLog.Warn("failure not recorded", "correlationId", payment.CorrelationId, "err", err)
+	}
+}
+
+func (s *dynamoStore) Status(ctx context.Context, correlationId string) (map[string]string, error) {
+	var out struct{ Item dynamoItem }
+	err := s.call(ctx, "GetItem", map[string]interface{}{
+		"TableName":      s.table,
+		"Key":            dynamoStatusKey(correlationId),
+		"ConsistentRead": true,
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return out.Item.status(), nil
+}
+
+// BatchGetItem takes 100 distinct keys per call
+func (s *dynamoStore) Statuses(ctx context.Context, correlationIds []string) ([]map[string]string, error) {
+	found := make(map[string]map[string]string, len(correlationIds))
+	var keys []dynamoItem
+	seen := make(map[string]bool, len(correlationIds))
+	for i, id := range correlationIds {
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, dynamoStatusKey(id))
+		}
+		if len(keys) < 100 && i < len(correlationIds)-1 {
+			continue
+		}
+		for len(keys) > 0 {
+			var out struct {
+				Responses       map[string][]dynamoItem
+				UnprocessedKeys map[string]struct{ Keys []dynamoItem }
+			}
+			err := s.call(ctx, "BatchGetItem", map[string]interface{}{
+				"RequestItems": map[string]interface{}{s.table: map[string]interface{}{"Keys": keys, "ConsistentRead": true}},
+			}, &out)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range out.Responses[s.table] {
+				found[strings.TrimPrefix(item.str("pk"), "status#")] = item.status()
+			}
+			keys = out.UnprocessedKeys[s.table].Keys
+		}
+	}
+	statuses := make([]map[string]string, len(correlationIds))
+	for i, id := range correlationIds {
+		if statuses[i] = found[id]; statuses[i] == nil {
+			statuses[i] = map[string]string{}
+		}
+	}
+	return statuses, nil
+}
+
+// ----------------------------------------------------------------------------
+// Payments
+// ----------------------------------------------------------------------------
+
+func (s *dynamoStore) RecordPayment(processor string, payment PostPayments) {
+	s.RecordPayments([]summaryJob{{processor: processor, payment: payment}})
+}
+
+// Records and new partitions go out in BatchWriteItems of 25; statuses
+// need UpdateItem (a put would drop their other fields), a few at a time
+func (s *dynamoStore) RecordPayments(batch []summaryJob) {
+	ctx := context.Background()
+	writes := make([]interface{}, 0, len(batch))
+	seen := make(map[string]bool, len(batch))
+	for _, job := range batch {
+		record, index := s.recordItems(job.processor, job.payment)
+		// BatchWriteItem refuses the same key twice in one call
+		if key := record.str("pk") + "/" + record.str("sk"); !seen[key] {
+			seen[key] = true
+			writes = append(writes, map[string]interface{}{"PutRequest": map[string]interface{}{"Item": record}})
+		}
+		if key := index.str("pk") + "/" + index.str("sk"); !seen[key] {
+			seen[key] = true
+			if _, done := s.indexed.Load(key); !done {
+				writes = append(writes, map[string]interface{}{"PutRequest": map[string]interface{}{"Item": index}})
+			}
+		}
+	}
+	if err := s.batchWrite(ctx, writes); err != nil {
+		dynamoLog.Error("payments not recorded", "payments", len(batch), "err", err)
+		return
+	}
+	for key := range seen {
+		if strings.HasPrefix(key, "partitions#") {
+			s.indexed.Store(key, true)
+		}
+	}
+
+	const parallelism = 8
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for _, job := range batch {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job summaryJob) {
+			defer func() { <-sem; wg.Done() }()
+			fields := []string{
+				"state", "processed-" + job.processor,
+				"amount", job.payment.Amount.String(),
+				"processor", job.processor,
+				"requestedAt", job.payment.RequestedAt,
+				"instance", INSTANCE_ID,
+			}
+			if job.payment.Currency != "" {
+				fields = append(fields, "currency", job.payment.Currency)
+			}
+			if _, err := s.updateStatus(ctx, job.payment.CorrelationId, "", nil, false, fields...); err != nil {
+				dynamoLog.Warn("status not recorded", "correlationId", job.payment.CorrelationId, "err", err)
+			}
+		}(job)
+	}
+	wg.Wait()
+}
+
+// Sends put/delete requests 25 at a time, resending what DynamoDB hands
+// back unprocessed
+func (s *dynamoStore) batchWrite(ctx context.Context, writes []interface{}) error {
+	for len(writes) > 0 {
+		chunk := writes[:min(len(writes), 25)]
+		writes = writes[len(chunk):]
+		for attempt := 0; len(chunk) > 0; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(25<<min(attempt, 5)) * time.Millisecond)
+			}
+			var out struct {
+				UnprocessedItems map[string][]interface{}
+			}
+			if err := s.call(ctx, "BatchWriteItem", map[string]interface{}{
+				"RequestItems": map[string]interface{}{s.table: chunk},
+			}, &out); err != nil {
+				return err
+			}
+			chunk = out.UnprocessedItems[s.table]
+		}
+	}
+	return nil
+}
+
+// Pages through a Query, handing each item to fn
+func (s *dynamoStore) query(ctx context.Context, in map[string]interface{}, fn func(dynamoItem)) error {
+	in["TableName"] = s.table
+	for {
+		var out struct {
+			Items            []dynamoItem
+			LastEvaluatedKey dynamoItem
+		}
+		if err := s.call(ctx, "Query", in, &out); err != nil {
+			return err
+		}
+		for _, item := range out.Items {
+			fn(item)
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		in["ExclusiveStartKey"] = out.LastEvaluatedKey
+	}
+}
+
+// Calls fn with the requestedAt (ms) and amount of every payment of a
+// bucket requested within [from, to]
+func (s *dynamoStore) scanPayments(ctx context.Context, bucket string, from, to time.Time, fn func(at int64, amount Cents)) error {
+	min, max := from.UnixMilli(), to.UnixMilli()
+	if max < min || max < 0 {
+		return nil
+	}
+	var partitions []string
+	err := s.query(ctx, map[string]interface{}{
+		"KeyConditionExpression": "pk = :pk AND sk BETWEEN :from AND :to",
+		"ExpressionAttributeValues": dynamoItem{
+			":pk":   dynamoS("partitions#" + bucket),
+			":from": dynamoS(dynamoMillis(s.partitionOf(min))),
+			":to":   dynamoS(dynamoMillis(s.partitionOf(max))),
+		},
+	}, func(item dynamoItem) { partitions = append(partitions, item.str("sk")) })
+	if err != nil {
+		return err
+	}
+	for _, start := range partitions {
+		// Every sort key is "<ms>#<id>", so <to + 1 ms> alone sorts after
+		// all of the last millisecond
+		err := s.query(ctx, map[string]interface{}{
+			"KeyConditionExpression": "pk = :pk AND sk BETWEEN :from AND :to",
+			"ExpressionAttributeValues": dynamoItem{
+				":pk":   dynamoS("pay#" + bucket + "#" + start),
+				":from": dynamoS(dynamoMillis(min)),
+				":to":   dynamoS(dynamoMillis(max + 1)),
+			},
+			"ProjectionExpression":     "#sk, #amount",
+			"ExpressionAttributeNames": map[string]string{"#sk": "sk", "#amount": "amount"},
+		}, func(item dynamoItem) {
+			at, _ := strconv.ParseInt(strings.SplitN(item.str("sk"), "#", 2)[0], 10, 64)
+			fn(at, Cents(item.num("amount")))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dynamoStore) Summary(processor string, from, to time.Time) SummaryData {
+	result := SummaryData{}
+	err := s.scanPayments(context.Background(), processor, from, to, func(at int64, amount Cents) {
+		result.TotalRequests++
+		result.TotalAmount += amount
+	})
+	if err != nil {
+		dynamoLog.Warn("summary read failed", "processor", processor, "err", err)
+	}
+	return result
+}
+
+func (s *dynamoStore) SummarySeries(ctx context.Context, processor string, from, to time.Time, bucket time.Duration, emit func(summaryBucket) error) error {
+	size := bucket.Milliseconds()
+	buckets := make(map[int64]SummaryData)
+	err := s.scanPayments(ctx, processor, from, to, func(at int64, amount Cents) {
+		d := buckets[at-at%size]
+		d.TotalRequests++
+		d.TotalAmount += amount
+		buckets[at-at%size] = d
+	})
+	if err != nil {
+		return err
+	}
+	return emitBuckets(buckets, emit)
+}
+
+// Deletes every item of the table, which is meant to hold nothing else
+func (s *dynamoStore) Purge(ctx context.Context) (int, error) {
+	var deletes []interface{}
+	in := map[string]interface{}{"TableName": s.table, "ProjectionExpression": "pk, sk"}
+	for {
+		var out struct {
+			Items            []dynamoItem
+			LastEvaluatedKey dynamoItem
+		}
+		if err := s.call(ctx, "Scan", in, &out); err != nil {
+			return 0, err
+		}
+		for _, item := range out.Items {
+			deletes = append(deletes, map[string]interface{}{"DeleteRequest": map[string]interface{}{"Key": item}})
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		in["ExclusiveStartKey"] = out.LastEvaluatedKey
+	}
+	s.indexed.Range(func(key, _ interface{}) bool {
+		s.indexed.Delete(key)
+		return true
+	})
+	return len(deletes), s.batchWrite(ctx, deletes)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// PAYMENT EVENTS (SSE + WEBHOOKS)
+// ============================================================================
+
+var (
+	// API key -> tenant, e.g. "key-a:acme,key-b:globex"
+	API_KEY_TENANTS = getEnv("API_KEY_TENANTS", "")
+
+	tenants = parseKeyValues(API_KEY_TENANTS)
+	events  = &eventBus{subscribers: make(map[*eventSubscriber]struct{})}
+
+	metricEventsDropped = newCounterVec("gateway_events_dropped_total", "Events dropped because a subscriber fell behind.", "subscriber")
+
+	eventLog = componentLogger("events")
+)
+
+// Outcome of one payment, as delivered to subscribers
+type paymentEvent struct {
+	Type          string `json:"type"` // payment.processed or payment.failed
+	CorrelationId string `json:"correlationId"`
+	Processor     string `json:"processor,omitempty"`
+	Amount        Cents  `json:"amount"`
+	RequestedAt   string `json:"requestedAt"`
+	Tenant        string `json:"tenant,omitempty"`
+	// Charged to the tenant: its fee override, else the FEE_SCHEDULE rate
+	Fee      Cents  `json:"fee,omitempty"`
+	Instance string `json:"instance"`
+	Time     string `json:"time"`
+}
+
+func (e paymentEvent) outcome() string {
+	return strings.TrimPrefix(e.Type, "payment.")
+}
+
+// Subscriber-side selection; empty fields match everything
+type eventFilter struct {
+	processors map[string]bool
+	outcomes   map[string]bool
+	tenants    map[string]bool
+	minAmount  Cents
+}
+
+// Reads processor, outcome, tenant (comma lists) and minAmount
+func parseEventFilter(q url.Values) (eventFilter, error) {
+	f := eventFilter{
+		processors: splitSet(q.Get("processor")),
+		outcomes:   splitSet(q.Get("outcome")),
+		tenants:    splitSet(q.Get("tenant")),
+	}
+	if v := q.Get("minAmount"); v != "" {
+		amount, err := parseCents(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid minAmount %q", v)
+		}
+		f.minAmount = amount
+	}
+	for outcome := range f.outcomes {
+		if outcome != "processed" && outcome != "failed" {
+			return f, fmt.Errorf("invalid outcome %q", outcome)
+		}
+	}
+	return f, nil
+}
+
+func (f eventFilter) match(e paymentEvent) bool {
+	return (len(f.processors) == 0 || f.processors[e.Processor]) &&
+		(len(f.outcomes) == 0 || f.outcomes[e.outcome()]) &&
+		(len(f.tenants) == 0 || f.tenants[e.Tenant]) &&
+		e.Amount >= f.minAmount
+}
+
+func splitSet(list string) map[string]bool {
+	if list == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// "a:1,b:2" -> {a: 1, b: 2}
+func parseKeyValues(spec string) map[string]string {
+	values := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(entry), ":"); ok {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// Tenant owning a request's API key (X-API-Key), from API_KEY_TENANTS or
+// /admin/tenants; "" if unmapped
+func tenantFor(apiKey string) string {
+	if tenant, ok := tenants[apiKey]; ok {
+		return tenant
+	}
+	return registeredTenant(apiKey)
+}
+
+// ----------------------------------------------------------------------------
+// Fan-out
+// ----------------------------------------------------------------------------
+
+// In-process fan-out. Publishing never blocks the worker: a subscriber
+// whose buffer is full misses the event.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+type eventSubscriber struct {
+	name   string
+	filter eventFilter
+	ch     chan paymentEvent
+}
+
+func (b *eventBus) Subscribe(name string, filter eventFilter) *eventSubscriber {
+	s := &eventSubscriber{name: name, filter: filter, ch: make(chan paymentEvent, 1024)}
+	b.mu.Lock()
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+func (b *eventBus) Unsubscribe(s *eventSubscriber) {
+	b.mu.Lock()
+	delete(b.subscribers, s)
+	b.mu.Unlock()
+}
+
+func (b *eventBus) Publish(e paymentEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subscribers {
+		if !s.filter.match(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			metricEventsDropped.Inc(s.name)
+		}
+	}
+}
+
+// Publishes a final outcome; processor is "" for failures
+func publishOutcome(payment PostPayments, processor string) {
+	if shedding("events") {
+		return
+	}
+	events.Publish(outcomeEvent(payment, processor))
+}
+
+// Event of a final outcome, also the body of completion callbacks
+func outcomeEvent(payment PostPayments, processor string) paymentEvent {
+	e := paymentEvent{
+		Type:          "payment.processed",
+		CorrelationId: payment.CorrelationId,
+		Processor:     processor,
+		Amount:        payment.Amount,
+		RequestedAt:   payment.RequestedAt,
+		Tenant:        payment.tenant,
+		Instance:      INSTANCE_ID,
+		Time:          time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if processor == "" {
+		e.Type = "payment.failed"
+	} else {
+		at, err := time.Parse(time.RFC3339Nano, payment.RequestedAt)
+		if err != nil {
+			at = time.Now()
+		}
+		e.Fee = Cents(math.Round(float64(payment.Amount) * tenantFeeRate(payment.tenant, processor, at)))
+	}
+	return e
+}
+
+// ----------------------------------------------------------------------------
+// Server-sent events
+// ----------------------------------------------------------------------------
+
+// GET /events?processor=&outcome=&tenant=&minAmount= - Live outcome stream
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sub := events.Subscribe("sse", filter)
+	defer events.Unsubscribe(sub)
+
+	// The stream outlives SERVER_WRITE_TIMEOUT by design
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-serverStopping:
+			return
+		case <-keepalive.C:
+			_, _ = w.Write([]byte(": keepalive\n\n"))
+		case e := <-sub.ch:
+			data, _ := jsonFast.Marshal(e)
+			_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Webhooks
+// ----------------------------------------------------------------------------
+
+// A webhook receiving the events that pass its filter
+type eventWebhook struct {
+	target *url.URL
+	filter eventFilter
+}
+
+// EVENT_WEBHOOKS is whitespace-separated webhook URLs; an optional fragment
+// holds the filter, e.g. https://fraud.example/hook#outcome=failed&minAmount=500
+func loadEventWebhooks(env *envParser) []eventWebhook {
+	var hooks []eventWebhook
+	for _, raw := range strings.Fields(os.Getenv("EVENT_WEBHOOKS")) {
+		target, err := url.Parse(raw)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			env.fail("EVENT_WEBHOOKS", raw, "must be an http(s) URL")
+			continue
+		}
+		query, err := url.ParseQuery(target.Fragment)
+		if err != nil {
+			env.fail("EVENT_WEBHOOKS", raw, "invalid filter")
+			continue
+		}
+		filter, err := parseEventFilter(query)
+		if err != nil {
+			env.fail("EVENT_WEBHOOKS", raw, "invalid filter: "+err.Error())
+			continue
+		}
+		target.Fragment = ""
+		hooks = append(hooks, eventWebhook{target: target, filter: filter})
+	}
+	return hooks
+}
+
+// Subscribes every webhook; one delivery goroutine per hook
+func startEventWebhooks(hooks []eventWebhook) {
+	for _, hook := range hooks {
+		sub := events.Subscribe("webhook:"+hook.target.Host, hook.filter)
+		go deliverWebhooks(hook.target.String(), sub)
+	}
+}
+
+func deliverWebhooks(target string, sub *eventSubscriber) {
+	for e := range sub.ch {
+		body, err := jsonFast.Marshal(e)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		signWebhook(req, body)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			eventLog.Warn("event webhook failed", "subscriber", sub.name, "correlationId", e.CorrelationId, "err", err)
+		} else {
+			resp.Body.Close()
+		}
+		cancel()
+	}
+}
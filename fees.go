@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// PROCESSOR FEE SCHEDULES
+// ============================================================================
+
+var (
+	// Set from Config.FeeSchedules and Config.CostAwareRouting at startup
+	feeSchedules map[string][]feePeriod
+	costAware    bool
+)
+
+// Fee rate effective from a point in time
+type feePeriod struct {
+	From time.Time
+	Rate float64
+}
+
+// FEE_SCHEDULE: comma-separated <processor>:<rate>[@<RFC3339 effective
+// from>], e.g. "default:0.05,fallback:0.15,default:0.04@2025-08-01T00:00:00Z"
+func parseFeeSchedule(spec string) (map[string][]feePeriod, error) {
+	schedules := make(map[string][]feePeriod)
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		rateSpec, fromSpec, hasFrom := strings.Cut(rest, "@")
+		rate, err := strconv.ParseFloat(rateSpec, 64)
+		if err != nil || rate < 0 || rate >= 1 {
+			return nil, fmt.Errorf("invalid fee rate in entry %q", entry)
+		}
+		period := feePeriod{From: time.Unix(0, 0).UTC(), Rate: rate}
+		if hasFrom {
+			if period.From, err = time.Parse(time.RFC3339, fromSpec); err != nil {
+				return nil, fmt.Errorf("invalid effective date in entry %q", entry)
+			}
+		}
+		schedules[name] = append(schedules[name], period)
+	}
+	for _, periods := range schedules {
+		sort.Slice(periods, func(i, j int) bool { return periods[i].From.Before(periods[j].From) })
+	}
+	return schedules, nil
+}
+
+// Rate in effect for a processor at time t (zero when unscheduled)
+func feeRate(processor string, t time.Time) float64 {
+	periods := feeSchedules[processor]
+	i := sort.Search(len(periods), func(i int) bool { return periods[i].From.After(t) })
+	if i == 0 {
+		return 0
+	}
+	return periods[i-1].Rate
+}
+
+// Fees of a processor's payments in [from, to]: the window is split where
+// its schedule changes rate and each part priced as a whole, so this can be
+// a few cents off the per-payment rounding of /payments-costs. Refunds
+// don't give fees back: summary.TotalAmount, already net of refunds, loses
+// the full fee.
+func addSummaryFees(summary *ProcessorSummary, processor, bucket string, from, to time.Time) {
+	fee := Cents(0)
+	periods := feeSchedules[processor]
+	for i, period := range periods {
+		start, end := period.From, to
+		if i+1 < len(periods) {
+			end = periods[i+1].From.Add(-time.Millisecond)
+		}
+		start, end = maxTime(start, from), minTime(end, to)
+		if period.Rate == 0 || start.After(end) {
+			continue
+		}
+		part := store.Summary(bucket, start, end)
+		fee += Cents(math.Round(float64(part.TotalAmount) * period.Rate))
+	}
+	net := summary.TotalAmount - fee
+	summary.TotalFee, summary.NetAmount = &fee, &net
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// Report entry of GET /payments-costs
+type CostData struct {
+	TotalRequests int64 `json:"totalRequests"`
+	TotalAmount   Cents `json:"totalAmount"`
+	TotalFee      Cents `json:"totalFee"` // Each payment's fee rounded to the cent
+	// The same per currency other than DEFAULT_CURRENCY, never added to
+	// the totals above
+	Currencies map[string]CostData `json:"currencies,omitempty"`
+}
+
+// GET /payments-costs?from=&to= - Fees per processor and currency, each
+// payment priced with the schedule in effect at its requestedAt
+func handlePaymentsCosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	from, _ := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+	to, _ := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+	if from.IsZero() {
+		from = time.Unix(0, 0).UTC()
+	}
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+
+	resp := make(map[string]CostData, len(processors))
+	for _, p := range processors {
+		buckets := currencyBuckets(r.Context(), p.Name)
+		costs := getCostData(p.Name, buckets[0], from, to)
+		for _, bucket := range buckets[1:] {
+			if costs.Currencies == nil {
+				costs.Currencies = map[string]CostData{}
+			}
+			costs.Currencies[bucketCurrency(bucket)] = getCostData(p.Name, bucket, from, to)
+		}
+		resp[p.Name] = costs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(resp)
+}
+
+// Costs of a processor's payments in one currencyBucket
+func getCostData(processor, bucket string, from, to time.Time) CostData {
+	ctx := context.Background()
+	client := readClient()
+	result := CostData{}
+
+	for shard := 0; shard < max(historyShards, 1); shard++ {
+		entries, _ := client.ZRangeByScoreWithScores(ctx, summaryKey(bucket, "history", shard), &redis.ZRangeBy{
+			Min: fmt.Sprint(from.UnixMilli()),
+			Max: fmt.Sprint(to.UnixMilli()),
+		}).Result()
+		if len(entries) == 0 {
+			continue
+		}
+
+		ids := make([]string, len(entries))
+		for i, entry := range entries {
+			ids[i], _ = entry.Member.(string)
+		}
+		vals, _ := client.HMGet(ctx, summaryKey(bucket, "data", shard), ids...).Result()
+		for i, val := range vals {
+			v, ok := val.(string)
+			if !ok {
+				continue
+			}
+			amount, err := parseRawCents(v)
+			if err != nil {
+				continue
+			}
+			at := time.UnixMilli(int64(entries[i].Score))
+			result.TotalRequests++
+			result.TotalAmount += amount
+			result.TotalFee += Cents(math.Round(float64(amount) * feeRate(processor, at)))
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// PARTIAL RESPONSES (?fields=)
+// ============================================================================
+
+// Selected fields as a tree of JSON object keys. A node without children
+// selects its whole value; siblings keep the order the client listed them
+// in, which is also the order they are written in.
+type fieldTree []fieldNode
+
+type fieldNode struct {
+	name string
+	sub  fieldTree
+}
+
+// Everything /payments-summary can return
+var summaryFields = fieldTree{
+	{name: "currency"},
+	{name: "default", sub: processorSummaryFields},
+	{name: "fallback", sub: processorSummaryFields},
+	{name: "corrections", sub: fieldTree{
+		{name: "default", sub: summaryDataFields},
+		{name: "fallback", sub: summaryDataFields},
+	}},
+	{name: "refunds", sub: fieldTree{
+		{name: "default", sub: summaryDataFields},
+		{name: "fallback", sub: summaryDataFields},
+	}},
+}
+
+var summaryDataFields = fieldTree{{name: "totalRequests"}, {name: "totalAmount"}}
+
+var processorSummaryFields = fieldTree{{name: "totalRequests"}, {name: "totalAmount"}, {name: "totalFee"}, {name: "netAmount"}}
+
+// Parses "default.totalAmount,fallback" against the schema; a nil tree means
+// no selection (the full response)
+func parseFields(raw string, schema fieldTree) (fieldTree, error) {
+	var t fieldTree
+	for _, path := range strings.Split(raw, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		parts := strings.Split(path, ".")
+		if !schema.allows(parts) {
+			return nil, errors.New("unknown field " + strconv.Quote(path))
+		}
+		t = t.add(parts)
+	}
+	if t == nil {
+		return nil, errors.New("fields must name at least one field")
+	}
+	return t, nil
+}
+
+func (t fieldTree) allows(path []string) bool {
+	for _, n := range t {
+		if n.name == path[0] {
+			return len(path) == 1 || n.sub.allows(path[1:])
+		}
+	}
+	return false
+}
+
+func (t fieldTree) add(path []string) fieldTree {
+	for i := range t {
+		if t[i].name != path[0] {
+			continue
+		}
+		// A whole node absorbs deeper paths; a bare name widens a partial one
+		if len(path) == 1 {
+			t[i].sub = nil
+		} else if t[i].sub != nil {
+			t[i].sub = t[i].sub.add(path[1:])
+		}
+		return t
+	}
+	n := fieldNode{name: path[0]}
+	if len(path) > 1 {
+		n.sub = fieldTree(nil).add(path[1:])
+	}
+	return append(t, n)
+}
+
+// Whether the value under name is needed at all; true without a selection
+func (t fieldTree) has(name string) bool {
+	if t == nil {
+		return true
+	}
+	for _, n := range t {
+		if n.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Keeps only the selected keys of an encoded object. Values are copied
+// verbatim, so custom encodings (Cents) survive untouched.
+func (t fieldTree) shape(doc []byte) []byte {
+	if t == nil {
+		return doc
+	}
+	var obj map[string]json.RawMessage
+	if jsonFast.Unmarshal(doc, &obj) != nil {
+		return doc
+	}
+	var out bytes.Buffer
+	out.WriteByte('{')
+	for _, n := range t {
+		raw, ok := obj[n.name]
+		if !ok {
+			continue
+		}
+		if out.Len() > 1 {
+			out.WriteByte(',')
+		}
+		out.WriteString(strconv.Quote(n.name))
+		out.WriteByte(':')
+		out.Write(n.sub.shape(raw))
+	}
+	out.WriteByte('}')
+	return out.Bytes()
+}
@@ -5,11 +5,16 @@ go 1.21
 require (
 	github.com/json-iterator/go v1.1.12
 	github.com/redis/go-redis/v9 v9.3.0
+	github.com/valyala/fasthttp v1.52.0
+	golang.org/x/sys v0.20.0
 )
 
 require (
+	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/klauspost/compress v1.17.6 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
 )
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ============================================================================
+// PROCESSOR HEALTH CHECKS
+// ============================================================================
+
+const (
+	minHealthCheckInterval = 5 * time.Second
+
+	// gateway:health:<processor> holds the latest result;
+	// gateway:health:<processor>:probe is held by the instance whose turn
+	// it is to call the processor, for one interval
+	healthKeyPrefix = "gateway:health:"
+)
+
+type HealthConfig struct {
+	// Processors allow one health call per 5 seconds; shorter values are raised
+	Interval time.Duration
+	// With the redis store, instances share one probe per processor per
+	// interval through Redis instead of each spending the budget on its own
+	Shared bool
+	// Route around a processor whose minimum response time is at least
+	// SlowMs and LatencyFactor times the other's
+	SlowMs        int
+	LatencyFactor int
+}
+
+func loadHealthConfig(env *envParser) HealthConfig {
+	return HealthConfig{
+		Interval:      max(env.duration("HEALTH_CHECK_INTERVAL", minHealthCheckInterval), minHealthCheckInterval),
+		Shared:        env.bool("HEALTH_CHECK_SHARED", true),
+		SlowMs:        env.int("HEALTH_SLOW_MS", 100, 0),
+		LatencyFactor: env.int("HEALTH_LATENCY_FACTOR", 3, 0),
+	}
+}
+
+// Body of GET /payments/health
+type processorHealth struct {
+	Failing         bool `json:"failing"`
+	MinResponseTime int  `json:"minResponseTime"`
+}
+
+func startHealthChecks(cfg HealthConfig) {
+	shared := cfg.Shared && redisBacked()
+	for _, p := range processors {
+		if shared {
+			go pollSharedHealth(p, cfg.Interval)
+		} else {
+			go pollHealth(p, cfg.Interval)
+		}
+	}
+}
+
+func pollHealth(p *Processor, interval time.Duration) {
+	time.Sleep(initialJitter(interval))
+	for {
+		wait := interval
+		if _, limited := probeHealth(p); limited {
+			wait += interval
+		}
+		time.Sleep(jittered(wait))
+	}
+}
+
+// Calls the processor and applies the result; limited means another caller
+// used the budget, so the cached value stays and the next call waits longer
+func probeHealth(p *Processor) (health processorHealth, limited bool) {
+	health, status, err := fetchHealth(p)
+	switch {
+	case err == nil && status == http.StatusOK:
+	case status == http.StatusTooManyRequests:
+		return health, true
+	default:
+		// Unreachable health endpoint: treat the processor as failing
+		health = processorHealth{Failing: true, MinResponseTime: p.MinResponseTime()}
+	}
+	p.setHealth(health)
+	return health, false
+}
+
+// Every second, each instance tries to take the processor's probe turn:
+// the one that gets it calls the processor and stores the result, the
+// others apply the stored result. So the deployment as a whole calls each
+// processor once per interval, and every instance sees the result within
+// about a second. While Redis is unreachable each instance probes on its own.
+func pollSharedHealth(p *Processor, interval time.Duration) {
+	key := healthKeyPrefix + p.Name
+	time.Sleep(initialJitter(time.Second))
+	for {
+		turn, err := takeHealthTurn(key, interval)
+		switch {
+		case err != nil:
+			if _, limited := probeHealth(p); limited {
+				time.Sleep(interval)
+			}
+			time.Sleep(jittered(interval))
+		case turn:
+			health, limited := probeHealth(p)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			if limited {
+				// Push the next turn back by another interval
+				redisClient.PExpire(ctx, key+":probe", 2*interval)
+			} else {
+				data, _ := jsonFast.Marshal(health)
+				redisClient.Set(ctx, key, data, 3*interval)
+			}
+			cancel()
+		default:
+			applySharedHealth(p, key)
+		}
+		time.Sleep(jittered(time.Second))
+	}
+}
+
+func takeHealthTurn(key string, interval time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return redisClient.SetNX(ctx, key+":probe", INSTANCE_ID, interval).Result()
+}
+
+// No stored result (the turn holder hasn't answered yet, or stopped) keeps
+// the current value until a turn comes up
+func applySharedHealth(p *Processor, key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, err := redisClient.Get(ctx, key).Result()
+	if err != nil {
+		return
+	}
+	var health processorHealth
+	if jsonFast.UnmarshalFromString(data, &health) == nil {
+		p.setHealth(health)
+	}
+}
+
+func fetchHealth(p *Processor) (processorHealth, int, error) {
+	var health processorHealth
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.PaymentsURL()+"/health", nil)
+	if err != nil {
+		return health, 0, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return health, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return health, resp.StatusCode, nil
+	}
+	return health, resp.StatusCode, jsonFast.NewDecoder(resp.Body).Decode(&health)
+}
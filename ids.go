@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// CORRELATION ID GENERATION
+// ============================================================================
+
+var (
+	// Set by setupInfrastructure
+	idConfig    IDConfig
+	idGenerator func() string
+)
+
+var idGenerators = map[string]func() string{
+	"uuidv7": newUUIDv7,
+	"uuidv4": newUUIDv4,
+}
+
+type IDConfig struct {
+	// What to do with a payment that has no correlationId: "require" (400)
+	// or "generate" (assign one and return it in the response body)
+	Policy string
+	// Per API key overrides, e.g. "key-a:generate,key-b:require"
+	Policies map[string]string
+	// Generator for assigned ids: "uuidv7" (time-ordered) or "uuidv4"
+	Generator string
+}
+
+func loadIDConfig(env *envParser) IDConfig {
+	c := IDConfig{
+		Policy:    env.oneOf("CORRELATION_ID_POLICY", "require", "require", "generate"),
+		Policies:  parseKeyValues(os.Getenv("CORRELATION_ID_POLICIES")),
+		Generator: env.oneOf("ID_GENERATOR", "uuidv7", "uuidv7", "uuidv4"),
+	}
+	for key, policy := range c.Policies {
+		if policy != "require" && policy != "generate" {
+			env.fail("CORRELATION_ID_POLICIES", key+":"+policy, "policies are require or generate")
+		}
+	}
+	return c
+}
+
+func setupIDs(cfg IDConfig) {
+	idConfig, idGenerator = cfg, idGenerators[cfg.Generator]
+}
+
+// Policy for the API key the request was sent with (X-API-Key)
+func correlationIDPolicy(apiKey string) string {
+	if policy, ok := idConfig.Policies[apiKey]; ok {
+		return policy
+	}
+	return idConfig.Policy
+}
+
+var (
+	uuidMu     sync.Mutex
+	uuidLastMs int64
+	uuidSeq    uint16
+)
+
+// RFC 9562 UUIDv7: 48-bit unix millis, then a 12-bit counter so ids minted
+// within the same millisecond still sort in creation order
+func newUUIDv7() string {
+	var b [16]byte
+	_, _ = rand.Read(b[6:])
+
+	uuidMu.Lock()
+	ms := time.Now().UnixMilli()
+	if ms <= uuidLastMs {
+		uuidSeq++
+		if uuidSeq > 0x0fff {
+			uuidLastMs++
+			uuidSeq = 0
+		}
+		ms = uuidLastMs
+	} else {
+		uuidLastMs = ms
+		uuidSeq = binary.BigEndian.Uint16(b[6:8]) & 0x07ff
+	}
+	seq := uuidSeq
+	uuidMu.Unlock()
+
+	b[0], b[1], b[2], b[3], b[4], b[5] = byte(ms>>40), byte(ms>>32), byte(ms>>24), byte(ms>>16), byte(ms>>8), byte(ms)
+	b[6] = 0x70 | byte(seq>>8)
+	b[7] = byte(seq)
+	b[8] = 0x80 | b[8]&0x3f
+	return formatUUID(b)
+}
+
+func newUUIDv4() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = 0x40 | b[6]&0x0f
+	b[8] = 0x80 | b[8]&0x3f
+	return formatUUID(b)
+}
+
+func formatUUID(b [16]byte) string {
+	var out [36]byte
+	hex.Encode(out[0:8], b[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], b[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], b[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], b[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], b[10:])
+	return string(out[:])
+}
+
+// Canonical 8-4-4-4-12 hex form, any version
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'):
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// BROKER INGESTION (INGEST_SOURCE)
+// ============================================================================
+
+var (
+	// Kafka consumer group / JetStream durable consumer, shared by every
+	// instance so each message goes to one of them
+	INGEST_GROUP = getEnv("INGEST_GROUP", SERVICE_NAME+"-ingest")
+
+	// Treated as the X-API-Key of every consumed payment (tenant,
+	// environment, correlationId policy, rate limit)
+	INGEST_API_KEY = getEnv("INGEST_API_KEY", "")
+
+	metricIngestMessages = newCounterVec("gateway_ingest_messages_total", "Messages consumed from INGEST_SOURCE by outcome (accepted, rejected, retried).", "outcome")
+
+	ingestLog = componentLogger("ingest")
+)
+
+// JetStream redelivers a message not acked within this, possibly to another
+// instance; its correlationId claim makes the repeat a replay
+const ingestAckWait = 30 * time.Second
+
+// A broker payments are read from. Messages are acked (or their offsets
+// committed) only once the pipeline took them, so a crash redelivers them
+// and the correlationId claim turns repeats into replays.
+type ingestSource interface {
+	name() string
+	// Runs until draining, calling handle for each message in order
+	consume(handle func(body []byte) bool) error
+	close()
+}
+
+type IngestConfig struct {
+	// Broker to consume payments from, alongside POST /payments:
+	// nats://[user:pass@]host:port/<stream> (a JetStream stream, read through
+	// a durable pull consumer) or kafka-rest:<url of a REST Proxy topic>, e.g.
+	// "kafka-rest:http://rest-proxy:8082/topics/payments". Each message is one
+	// payment, the same JSON a POST /payments takes.
+	Source string
+	Batch  int // Messages a JetStream source pulls at a time
+}
+
+func loadIngestConfig(env *envParser) IngestConfig {
+	c := IngestConfig{
+		Source: env.str("INGEST_SOURCE", ""),
+		Batch:  env.int("INGEST_BATCH", 100, 1),
+	}
+	if c.Source != "" {
+		_, err := parseIngestSource(c.Source, c.Batch)
+		env.check("INGEST_SOURCE", c.Source, err)
+		if strings.HasPrefix(c.Source, "nats:") && strings.ContainsAny(INGEST_GROUP, "./*> ") {
+			env.fail("INGEST_GROUP", INGEST_GROUP, "not a valid JetStream consumer name")
+		}
+	}
+	return c
+}
+
+func startIngest(cfg IngestConfig) {
+	if cfg.Source == "" {
+		return
+	}
+	// Checked by loadConfig
+	source, _ := parseIngestSource(cfg.Source, cfg.Batch)
+	go func() {
+		backoff := time.Second
+		for !draining.Load() {
+			err := source.consume(ingestMessage)
+			source.close()
+			if err == nil {
+				return
+			}
+			ingestLog.Warn("consumer stopped", "source", source.name(), "err", err, "retryIn", backoff)
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}()
+	ingestLog.Info("consuming payments", "source", source.name(), "group", INGEST_GROUP)
+}
+
+func parseIngestSource(raw string, batch int) (ingestSource, error) {
+	kind, target, _ := strings.Cut(raw, ":")
+	switch kind {
+	case "nats":
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return nil, errors.New("not a JetStream stream (nats://host:port/stream)")
+		}
+		stream := strings.TrimPrefix(u.Path, "/")
+		if stream == "" || strings.ContainsAny(stream, "./*> ") {
+			return nil, errors.New("not a JetStream stream (nats://host:port/stream)")
+		}
+		return &natsIngestSource{natsConn: natsConnFor(u), stream: stream, batch: batch}, nil
+	case "kafka-rest":
+		base, topic, ok := strings.Cut(target, "/topics/")
+		if !validCallbackURL(target) || !ok || topic == "" || strings.Contains(topic, "/") {
+			return nil, errors.New("not a Kafka REST Proxy topic URL (.../topics/<topic>)")
+		}
+		return &kafkaRestIngestSource{base: base, topic: topic}, nil
+	}
+	return nil, errors.New("must be nats:// or kafka-rest:")
+}
+
+// Feeds one message through the POST /payments pipeline. True once it's
+// settled: accepted, a replay, or rejected for good (a payment that will
+// never be valid is dropped rather than redelivered forever). While the
+// gateway only can't take it yet (full queue, rate limit, maintenance, store
+// down) it's retried in place, which holds the rest of the partition back;
+// false means shutdown came first and the message stays unacked.
+func ingestMessage(body []byte) bool {
+	backoff := 100 * time.Millisecond
+	for {
+		job, ingest, resp := admitPayment(ingestRequest{
+			ctx:      context.Background(),
+			body:     body,
+			apiKey:   INGEST_API_KEY,
+			clientIP: "ingest",
+		})
+		if resp == nil {
+			resp = enqueuePayment(job, ingest)
+		}
+		switch {
+		case resp.status/100 == 2:
+			metricIngestMessages.Inc("accepted")
+			return true
+		case resp.status/100 == 4 && resp.status != http.StatusTooManyRequests:
+			metricIngestMessages.Inc("rejected")
+			ingestLog.Warn("dropping rejected message", "status", resp.status, "answer", string(bytes.TrimSpace(resp.body)))
+			return true
+		}
+		metricIngestMessages.Inc("retried")
+		wait := backoff
+		if resp.retryAfter > 0 {
+			wait = time.Duration(resp.retryAfter) * time.Second
+		}
+		for end := time.Now().Add(wait); time.Now().Before(end); time.Sleep(100 * time.Millisecond) {
+			if draining.Load() {
+				return false
+			}
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// NATS JetStream (core protocol, no client library)
+// ----------------------------------------------------------------------------
+
+// Pulls batches from the durable consumer INGEST_GROUP, created on connect
+// if missing, and acks each message once handled
+type natsIngestSource struct {
+	natsConn
+	stream string
+	inbox  string
+	batch  int // Messages per pull
+}
+
+func (s *natsIngestSource) name() string { return "nats:" + s.stream }
+
+// A message delivered to the inbox; status is set on JetStream's own
+// notices (404 no messages, 408 pull expired, 100 heartbeat, ...)
+type natsMessage struct {
+	subject, reply string
+	status         int
+	payload        []byte
+}
+
+func (s *natsIngestSource) consume(handle func(body []byte) bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := s.connect(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	s.inbox = "_INBOX." + strings.ReplaceAll(newUUIDv7(), "-", "")
+	if err := s.write("SUB " + s.inbox + ".* 1\r\n"); err != nil {
+		return err
+	}
+	if err := s.ensureConsumer(); err != nil {
+		return err
+	}
+	const expires = 5 * time.Second
+	pull, _ := jsonFast.Marshal(map[string]interface{}{"batch": s.batch, "expires": expires.Nanoseconds()})
+	next := "$JS.API.CONSUMER.MSG.NEXT." + s.stream + "." + INGEST_GROUP
+	for !draining.Load() {
+		if err := s.publish(next, s.inbox+".pull", pull); err != nil {
+			return err
+		}
+		for received := 0; received < s.batch; {
+			_ = s.conn.SetReadDeadline(time.Now().Add(expires + 5*time.Second))
+			msg, err := s.readMessage()
+			if err != nil {
+				return err
+			}
+			if msg.status == 100 {
+				continue
+			}
+			if msg.status != 0 {
+				break // the pull ended early (404, 408) or was refused (409)
+			}
+			received++
+			if msg.reply == "" {
+				continue
+			}
+			if !handle(msg.payload) {
+				return nil
+			}
+			if err := s.publish(msg.reply, "", []byte("+ACK")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Creates the durable pull consumer; an existing one with the same
+// configuration is left as it is
+func (s *natsIngestSource) ensureConsumer() error {
+	req, _ := jsonFast.Marshal(map[string]interface{}{
+		"stream_name": s.stream,
+		"config": map[string]interface{}{
+			"durable_name":   INGEST_GROUP,
+			"ack_policy":     "explicit",
+			"ack_wait":       ingestAckWait.Nanoseconds(),
+			"deliver_policy": "all",
+		},
+	})
+	if err := s.publish("$JS.API.CONSUMER.DURABLE.CREATE."+s.stream+"."+INGEST_GROUP, s.inbox+".create", req); err != nil {
+		return err
+	}
+	_ = s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := s.readMessage()
+	if err != nil {
+		return err
+	}
+	if msg.status == 503 {
+		return errors.New("JetStream is not enabled on the server")
+	}
+	var answer struct {
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if jsonFast.Unmarshal(msg.payload, &answer) == nil && answer.Error != nil {
+		return errors.New("creating consumer " + INGEST_GROUP + ": " + answer.Error.Description)
+	}
+	return nil
+}
+
+func (s *natsIngestSource) write(data string) error {
+	_, err := s.conn.Write([]byte(data))
+	return err
+}
+
+func (s *natsIngestSource) publish(subject, reply string, data []byte) error {
+	if reply != "" {
+		subject += " " + reply
+	}
+	var buf bytes.Buffer
+	buf.WriteString("PUB " + subject + " " + strconv.Itoa(len(data)) + "\r\n")
+	buf.Write(data)
+	buf.WriteString("\r\n")
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+// Next MSG or HMSG, answering PINGs on the way
+func (s *natsIngestSource) readMessage() (natsMessage, error) {
+	for {
+		line, err := s.rd.ReadString('\n')
+		if err != nil {
+			return natsMessage{}, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			if err := s.write("PONG\r\n"); err != nil {
+				return natsMessage{}, err
+			}
+			continue
+		case "-ERR":
+			return natsMessage{}, errors.New("nats: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case "MSG", "HMSG":
+		default:
+			continue // INFO, PONG, +OK
+		}
+		// MSG <subject> <sid> [reply] <size>
+		// HMSG <subject> <sid> [reply] <header size> <total size>
+		sizes := 1
+		if fields[0] == "HMSG" {
+			sizes = 2
+		}
+		if len(fields) < 3+sizes {
+			return natsMessage{}, errors.New("nats: malformed " + fields[0])
+		}
+		msg := natsMessage{subject: fields[1]}
+		if len(fields) == 4+sizes {
+			msg.reply = fields[3]
+		}
+		total, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil || total < 0 {
+			return natsMessage{}, errors.New("nats: malformed " + fields[0])
+		}
+		headerSize := 0
+		if sizes == 2 {
+			if headerSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headerSize > total {
+				return natsMessage{}, errors.New("nats: malformed HMSG")
+			}
+		}
+		data := make([]byte, total+2) // and the trailing CRLF
+		if _, err := io.ReadFull(s.rd, data); err != nil {
+			return natsMessage{}, err
+		}
+		if headerSize > 0 {
+			// NATS/1.0 <status> <description>\r\n<headers>\r\n\r\n
+			status := strings.Fields(string(data[:headerSize]))
+			if len(status) > 1 {
+				msg.status, _ = strconv.Atoi(status[1])
+			}
+		}
+		msg.payload = data[headerSize:total]
+		return msg, nil
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Kafka through a REST Proxy (v2 consumer API)
+// ----------------------------------------------------------------------------
+
+// One consumer instance per gateway instance, in group INGEST_GROUP. Offsets
+// are committed after each fetch has been handled in full, never
+// automatically.
+type kafkaRestIngestSource struct {
+	base, topic string
+	instance    string // URL of our consumer instance, once created
+}
+
+func (s *kafkaRestIngestSource) name() string { return "kafka-rest:" + s.topic }
+
+type kafkaRestIngestRecord struct {
+	Partition int             `json:"partition"`
+	Offset    int64           `json:"offset"`
+	Value     json.RawMessage `json:"value"`
+}
+
+func (s *kafkaRestIngestSource) consume(handle func(body []byte) bool) error {
+	if err := s.subscribe(); err != nil {
+		return err
+	}
+	for !draining.Load() {
+		var records []kafkaRestIngestRecord
+		if err := s.call(http.MethodGet, "/records?timeout=1000", nil, &records); err != nil {
+			return err
+		}
+		for _, r := range records {
+			if !handle(r.Value) {
+				return nil
+			}
+		}
+		if len(records) > 0 {
+			// No body: everything fetched so far, which is all handled
+			if err := s.call(http.MethodPost, "/offsets", nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Creates (or, after a restart within the proxy's idle timeout, reuses) the
+// consumer instance and subscribes it to the topic
+func (s *kafkaRestIngestSource) subscribe() error {
+	s.instance = s.base + "/consumers/" + url.PathEscape(INGEST_GROUP) + "/instances/" + url.PathEscape(INSTANCE_ID)
+	create, _ := jsonFast.Marshal(map[string]string{
+		"name":               INSTANCE_ID,
+		"format":             "json",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	})
+	status, err := s.request(http.MethodPost, s.base+"/consumers/"+url.PathEscape(INGEST_GROUP), create, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusConflict {
+		return fmt.Errorf("rest proxy answered %d creating the consumer", status)
+	}
+	topics, _ := jsonFast.Marshal(map[string][]string{"topics": {s.topic}})
+	return s.call(http.MethodPost, "/subscription", topics, nil)
+}
+
+// Request against the consumer instance; any status but 2xx is an error
+// (a 404 means the proxy expired the instance, recreated on the retry)
+func (s *kafkaRestIngestSource) call(method, path string, body []byte, out interface{}) error {
+	status, err := s.request(method, s.instance+path, body, out)
+	if err == nil && status/100 != 2 {
+		err = fmt.Errorf("rest proxy answered %d to %s %s", status, method, path)
+	}
+	return err
+}
+
+func (s *kafkaRestIngestSource) request(method, target string, body []byte, out interface{}) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, _ := http.NewRequestWithContext(ctx, method, target, rd)
+	req.Header.Set("Content-Type", "application/vnd.kafka.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.json.v2+json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := jsonFast.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// Leaves the group so its partitions go to the other instances right away
+func (s *kafkaRestIngestSource) close() {
+	if s.instance != "" {
+		_, _ = s.request(http.MethodDelete, s.instance, nil, nil)
+		s.instance = ""
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// INSTANCE IDENTITY AND HEARTBEAT
+// ============================================================================
+
+// Bumped whenever the Redis key layout changes incompatibly
+const schemaVersion = 2
+
+const (
+	instanceKeyPrefix = "gateway:instance:"
+	schemaKey         = "gateway:schema"
+	heartbeatInterval = 5 * time.Second
+	heartbeatTTL      = 3 * heartbeatInterval
+)
+
+var (
+	INSTANCE_ID = getEnv("INSTANCE_ID", generateInstanceID())
+
+	instanceStartedAt = time.Now().UTC()
+)
+
+// Heartbeat value published by every running instance
+type instanceInfo struct {
+	ID            string `json:"id"`
+	Host          string `json:"host"`
+	StartedAt     string `json:"startedAt"`
+	FlushOnStart  bool   `json:"flushOnStart"`
+	SchemaVersion int    `json:"schemaVersion"`
+}
+
+func generateInstanceID() string {
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostnameOr("gateway"), os.Getpid(), hex.EncodeToString(suffix))
+}
+
+func localInstanceInfo(flushOnStart bool) instanceInfo {
+	return instanceInfo{
+		ID:            INSTANCE_ID,
+		Host:          hostnameOr(""),
+		StartedAt:     instanceStartedAt.Format(time.RFC3339),
+		FlushOnStart:  flushOnStart,
+		SchemaVersion: schemaVersion,
+	}
+}
+
+// Live instances other than this one
+func peerInstances(ctx context.Context) []instanceInfo {
+	var peers []instanceInfo
+	_ = scanKeys(ctx, instanceKeyPrefix+"*", 100, func(_ redis.UniversalClient, keys []string) error {
+		for _, key := range keys {
+			if strings.TrimPrefix(key, instanceKeyPrefix) == INSTANCE_ID {
+				continue
+			}
+			data, err := redisClient.Get(ctx, key).Result()
+			var info instanceInfo
+			if err == nil && jsonFast.UnmarshalFromString(data, &info) == nil {
+				peers = append(peers, info)
+			}
+		}
+		return nil
+	})
+	return peers
+}
+
+// Inspects the shared Redis before startup touches it and reports whether
+// flushing is still safe. Sharing is expected (two replicas behind nginx);
+// flushing or mixing schema versions while sharing is not.
+func checkSharedRedis(flushOnStart bool) (flushAllowed bool) {
+	ctx := context.Background()
+	flushAllowed = flushOnStart
+
+	if stored, err := redisClient.Get(ctx, schemaKey).Int(); err == nil && stored != schemaVersion {
+		sendAlert("schema_conflict", fmt.Sprintf("redis holds schema v%d, this instance uses v%d", stored, schemaVersion), nil)
+	}
+
+	for _, peer := range peerInstances(ctx) {
+		if peer.SchemaVersion != schemaVersion {
+			sendAlert("schema_conflict", fmt.Sprintf("instance %s runs schema v%d, this instance uses v%d",
+				peer.ID, peer.SchemaVersion, schemaVersion), nil)
+		}
+		if flushOnStart {
+			sendAlert("duplicate_flush", fmt.Sprintf("FLUSH_ON_START is set but instance %s (started %s) is live on this Redis; NOT flushing",
+				peer.ID, peer.StartedAt), nil)
+			flushAllowed = false
+		}
+	}
+	return flushAllowed
+}
+
+// Publishes the heartbeat and keeps watching for peers that flush on start
+// or run another schema version
+func startHeartbeat(flushOnStart bool) {
+	ctx := context.Background()
+	data, _ := jsonFast.MarshalToString(localInstanceInfo(flushOnStart))
+	_ = redisClient.Set(ctx, instanceKeyPrefix+INSTANCE_ID, data, heartbeatTTL).Err()
+	_ = redisClient.SetNX(ctx, schemaKey, schemaVersion, 0).Err()
+
+	go func() {
+		warned := make(map[string]bool)
+		for {
+			time.Sleep(jittered(heartbeatInterval))
+			_ = redisClient.Set(ctx, instanceKeyPrefix+INSTANCE_ID, data, heartbeatTTL).Err()
+			for _, peer := range peerInstances(ctx) {
+				if warned[peer.ID] {
+					continue
+				}
+				if peer.SchemaVersion != schemaVersion {
+					warned[peer.ID] = true
+					sendAlert("schema_conflict", fmt.Sprintf("instance %s runs schema v%d, this instance uses v%d",
+						peer.ID, peer.SchemaVersion, schemaVersion), nil)
+				} else if peer.FlushOnStart {
+					warned[peer.ID] = true
+					sendAlert("duplicate_flush", fmt.Sprintf("instance %s shares this Redis with FLUSH_ON_START enabled; disable it on shared deployments",
+						peer.ID), nil)
+				}
+			}
+		}
+	}()
+}
+
+// Removes the heartbeat so peers stop seeing this instance immediately
+func stopHeartbeat() {
+	_ = redisClient.Del(context.Background(), instanceKeyPrefix+INSTANCE_ID).Err()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ============================================================================
+// SCHEDULE JITTER
+// ============================================================================
+
+var (
+	// Set by setupInfrastructure
+	workerStartJitter time.Duration
+	probeJitter       float64
+)
+
+type JitterConfig struct {
+	// Each worker waits a random delay up to this before taking its first
+	// payment, so instances restarted together don't fire their first
+	// forwards (and retries) in lockstep
+	WorkerStart time.Duration
+	// Background loops (health checks, heartbeats, tiering, shared queue
+	// claims) wait their interval plus up to this fraction of it, and start
+	// at a random point within that fraction. Never shortens an interval:
+	// the health endpoints are rate limited.
+	Probe float64
+}
+
+func loadJitterConfig(env *envParser) JitterConfig {
+	return JitterConfig{
+		WorkerStart: env.durationOrZero("WORKER_START_JITTER", 200*time.Millisecond),
+		Probe:       env.float("PROBE_JITTER", 0.2, 0, 1),
+	}
+}
+
+// Uniform in [0, d]
+func randomDelay(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// interval plus up to the probe jitter of it
+func jittered(interval time.Duration) time.Duration {
+	return interval + randomDelay(time.Duration(float64(interval)*probeJitter))
+}
+
+// First wait of a background loop: a random phase instead of all instances
+// ticking together from their start
+func initialJitter(interval time.Duration) time.Duration {
+	return randomDelay(time.Duration(float64(interval) * probeJitter))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// DOUBLE-ENTRY LEDGER (LEDGER=true)
+// ============================================================================
+
+var (
+	// Journal every recorded payment and correction as balanced debit/credit
+	// entries, next to the mutable summary. Set from Config.Ledger at startup.
+	ledger bool
+)
+
+// Running balance of every account, in cents
+const ledgerBalancesKey = "ledger:balances"
+
+func ledgerEnabled() bool {
+	return ledger
+}
+
+// LEDGER needs the redis store, and no cluster: balances span processors,
+// which a cluster keeps in different slots
+func loadLedger(env *envParser, redis, cluster bool) bool {
+	on := env.bool("LEDGER", false)
+	if on && !redis {
+		env.fail("LEDGER", "true", "needs the redis store")
+	} else if on && cluster {
+		env.fail("LEDGER", "true", "is not supported with redis-cluster://")
+	}
+	return on
+}
+
+// Append-only journal of one processor (a Redis stream)
+func ledgerKey(processor string) string {
+	return "ledger:" + processor
+}
+
+// The two accounts of a processor in one currency (a currencyBucket). A
+// payment debits what the processor owes (receivable, debit-normal) and
+// credits what was taken in through it (payments, credit-normal); both
+// balances grow by the amount, and a reversal posts the legs swapped,
+// shrinking both.
+func ledgerAccounts(bucket string) (receivable, payments string) {
+	return bucket + ":receivable", bucket + ":payments"
+}
+
+// recordPaymentScript plus the journal entry, posted only the first time
+// a payment is recorded so replays (WAL, verification) never double-post.
+// Extra KEYS: ledger stream, balances. Extra ARGV: debit, credit account.
+var recordPaymentLedgerScript = redis.NewScript(`
+local existing = redis.call('HGET', KEYS[3], 'record')
+local key = existing or ARGV[8]
+redis.call('HSET', KEYS[1], key, ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[3], key)
+redis.call('HSET', KEYS[5], key, ARGV[1])
+redis.call('HSET', KEYS[3], 'state', ARGV[4], 'processor', ARGV[5], 'amount', ARGV[9], 'requestedAt', ARGV[6], 'instance', ARGV[7], 'record', key)
+if ARGV[10] ~= '' then
+  redis.call('HSET', KEYS[3], 'currency', ARGV[10])
+end
+redis.call('HINCRBY', KEYS[4], ARGV[7], 1)
+if not existing then
+  local debit = redis.call('HINCRBY', KEYS[7], ARGV[11], ARGV[2])
+  local credit = redis.call('HINCRBY', KEYS[7], ARGV[12], ARGV[2])
+  redis.call('XADD', KEYS[6], '*', 'kind', 'payment', 'correlationId', ARGV[1], 'amount', ARGV[2],
+    'debit', ARGV[11], 'credit', ARGV[12], 'debitBalance', debit, 'creditBalance', credit,
+    'requestedAt', ARGV[6], 'instance', ARGV[7])
+end
+return 1
+`)
+
+// Script recording a processed payment, with its journal entry when the
+// ledger is on
+func recordScript() *redis.Script {
+	if ledgerEnabled() {
+		return recordPaymentLedgerScript
+	}
+	return recordPaymentScript
+}
+
+func withLedgerArgs(processor, bucket string, keys []string, args []interface{}) ([]string, []interface{}) {
+	if !ledgerEnabled() {
+		return keys, args
+	}
+	receivable, payments := ledgerAccounts(bucket)
+	return append(keys, ledgerKey(processor), ledgerBalancesKey), append(args, receivable, payments)
+}
+
+// Correction entry arguments for applyCorrectionScript: empty accounts
+// when the ledger is off
+func ledgerCorrectionArgs(processor, bucket string) (keys []string, debit, credit string) {
+	if !ledgerEnabled() {
+		return nil, "", ""
+	}
+	receivable, payments := ledgerAccounts(bucket)
+	return []string{ledgerKey(processor), ledgerBalancesKey}, receivable, payments
+}
+
+// One journal entry, as served by GET /admin/ledger
+type ledgerEntry struct {
+	ID            string `json:"id"`
+	Kind          string `json:"kind"` // payment, void, correct or refund
+	CorrelationId string `json:"correlationId"`
+	Amount        Cents  `json:"amount"`
+	Debit         string `json:"debit"`
+	Credit        string `json:"credit"`
+	DebitBalance  Cents  `json:"debitBalance"`
+	CreditBalance Cents  `json:"creditBalance"`
+	CorrectionId  string `json:"correctionId,omitempty"`
+	Time          string `json:"time"`
+}
+
+func parseLedgerEntry(msg redis.XMessage) ledgerEntry {
+	field := func(name string) string {
+		v, _ := msg.Values[name].(string)
+		return v
+	}
+	cents := func(name string) Cents {
+		c, _ := parseRawCents(field(name))
+		return c
+	}
+	millis, _, _ := strings.Cut(msg.ID, "-")
+	ms, _ := strconv.ParseInt(millis, 10, 64)
+	return ledgerEntry{
+		ID:            msg.ID,
+		Kind:          field("kind"),
+		CorrelationId: field("correlationId"),
+		Amount:        cents("amount"),
+		Debit:         field("debit"),
+		Credit:        field("credit"),
+		DebitBalance:  cents("debitBalance"),
+		CreditBalance: cents("creditBalance"),
+		CorrectionId:  field("correctionId"),
+		Time:          time.UnixMilli(ms).UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// GET /admin/ledger?processor=default&after=<entry id>&count=100 - Journal
+// entries of one processor, oldest first
+func handleAdminLedger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	processor := r.URL.Query().Get("processor")
+	if processorByName(processor) == nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_processor", "processor must name a configured processor")
+		return
+	}
+	count, err := strconv.ParseInt(r.URL.Query().Get("count"), 10, 64)
+	if err != nil || count <= 0 || count > 1000 {
+		count = 100
+	}
+	start := "-"
+	if after := r.URL.Query().Get("after"); after != "" {
+		start = "(" + after
+	}
+	msgs, err := redisClient.XRangeN(r.Context(), ledgerKey(processor), start, "+", count).Result()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	entries := make([]ledgerEntry, len(msgs))
+	for i, msg := range msgs {
+		entries[i] = parseLedgerEntry(msg)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(map[string]interface{}{"processor": processor, "entries": entries})
+}
+
+// Balances of one processor against its reported all-time total
+type ledgerReconciliation struct {
+	Receivable Cents `json:"receivable"`
+	Payments   Cents `json:"payments"`
+	// totalAmount of /payments-summary (net of refunds) plus corrections,
+	// over all time
+	ReportedTotal Cents `json:"reportedTotal"`
+	Balanced      bool  `json:"balanced"`
+	// The same per currency other than DEFAULT_CURRENCY, whose amounts the
+	// figures above never include
+	Currencies map[string]ledgerReconciliation `json:"currencies,omitempty"`
+}
+
+// GET /admin/ledger/balances - Account balances per processor and currency,
+// reconciled with the summary. Payments tiered to cold storage leave the
+// summary but not the ledger, so they show up as a difference.
+func handleAdminLedgerBalances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	balances, err := redisClient.HGetAll(r.Context(), ledgerBalancesKey).Result()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	from, to := time.Unix(0, 0), time.UnixMilli(math.MaxInt64/2)
+	resp := make(map[string]ledgerReconciliation, len(processors))
+	for _, p := range processors {
+		rec := reconcileLedger(balances, p.Name, from, to)
+		for _, bucket := range ledgerBuckets(r.Context(), balances, p.Name)[1:] {
+			if rec.Currencies == nil {
+				rec.Currencies = map[string]ledgerReconciliation{}
+			}
+			rec.Currencies[bucketCurrency(bucket)] = reconcileLedger(balances, bucket, from, to)
+		}
+		resp[p.Name] = rec
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(resp)
+}
+
+func reconcileLedger(balances map[string]string, bucket string, from, to time.Time) ledgerReconciliation {
+	receivable, payments := ledgerAccounts(bucket)
+	rec := ledgerReconciliation{}
+	rec.Receivable, _ = parseRawCents(balances[receivable])
+	rec.Payments, _ = parseRawCents(balances[payments])
+	rec.ReportedTotal = getSummaryData(bucket, from, to).TotalAmount + getCorrectionsData(bucket, from, to).TotalAmount -
+		getRefundsData(bucket, from, to).TotalAmount
+	rec.Balanced = rec.Receivable == rec.Payments && rec.Receivable == rec.ReportedTotal
+	return rec
+}
+
+// Currency buckets of a processor with summary keys or ledger accounts: a
+// currency whose payments were all tiered out still has balances
+func ledgerBuckets(ctx context.Context, balances map[string]string, processor string) []string {
+	buckets := append([]string(nil), currencyBuckets(ctx, processor)...)
+	seen := map[string]bool{}
+	for _, bucket := range buckets {
+		seen[bucket] = true
+	}
+	var extra []string
+	for account := range balances {
+		bucket, ok := strings.CutSuffix(account, ":receivable")
+		if name, code, found := strings.Cut(bucket, ":"); ok && found && name == processor && iso4217[code] && !seen[bucket] {
+			seen[bucket] = true
+			extra = append(extra, bucket)
+		}
+	}
+	sort.Strings(extra)
+	return append(buckets, extra...)
+}
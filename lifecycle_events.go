@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// LIFECYCLE EVENT PUBLICATION (EVENT_BUS)
+// ============================================================================
+
+var (
+	lifecycleSinks []*lifecycleOutlet
+
+	metricLifecycleEvents = newCounterVec("gateway_lifecycle_events_total", "Lifecycle events by outcome (published, dropped).", "outcome")
+
+	lifecycleLog = componentLogger("event_bus")
+)
+
+// CloudEvents 1.0 envelope (structured JSON). type is one of
+// payment.accepted, payment.processed, payment.failed, payment.dead_lettered,
+// payment.cancelled;
+// subject is the correlationId, which is also the Kafka record key.
+type lifecycleEvent struct {
+	SpecVersion     string             `json:"specversion"`
+	ID              string             `json:"id"`
+	Source          string             `json:"source"`
+	Type            string             `json:"type"`
+	Subject         string             `json:"subject"`
+	Time            string             `json:"time"`
+	DataContentType string             `json:"datacontenttype"`
+	Data            lifecycleEventData `json:"data"`
+}
+
+type lifecycleEventData struct {
+	CorrelationId string `json:"correlationId"`
+	Amount        Cents  `json:"amount"`
+	Currency      string `json:"currency,omitempty"`
+	// Set once the payment has been sent to a processor
+	RequestedAt string `json:"requestedAt,omitempty"`
+	// The processor that accepted it (payment.processed only)
+	Processor string `json:"processor,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	Fee       Cents  `json:"fee,omitempty"`
+}
+
+type EventBusConfig struct {
+	// Destinations for payment lifecycle events (EVENT_BUS, whitespace
+	// separated): redis:<channel> (Pub/Sub on the store's Redis),
+	// nats://[user:pass@]host:port/<subject> or kafka-rest:<url of a REST
+	// Proxy topic>, e.g.
+	// "nats://nats:4222/payments kafka-rest:http://rest-proxy:8082/topics/payments"
+	Destinations []string
+	Buffer       int // Events each destination buffers; the ones past that are dropped
+	Batch        int // Events per publish call
+}
+
+func loadEventBusConfig(env *envParser, redis bool) EventBusConfig {
+	c := EventBusConfig{
+		Destinations: strings.Fields(os.Getenv("EVENT_BUS")),
+		Buffer:       env.int("EVENT_BUS_BUFFER", 10000, 1),
+		Batch:        env.int("EVENT_BUS_BATCH", 100, 1),
+	}
+	for _, raw := range c.Destinations {
+		_, err := parseLifecycleSink(raw, redis)
+		env.check("EVENT_BUS", raw, err)
+	}
+	return c
+}
+
+// Destination for published events
+type lifecycleSink interface {
+	name() string
+	publish(ctx context.Context, batch []lifecycleEvent) error
+}
+
+// A sink with its own buffer and delivery goroutine, so a slow broker only
+// holds back itself
+type lifecycleOutlet struct {
+	sink  lifecycleSink
+	ch    chan lifecycleEvent
+	batch int // Events sent per publish call
+}
+
+func startEventBus(cfg EventBusConfig) {
+	for _, raw := range cfg.Destinations {
+		// Checked by loadConfig
+		sink, _ := parseLifecycleSink(raw, true)
+		outlet := &lifecycleOutlet{sink: sink, ch: make(chan lifecycleEvent, cfg.Buffer), batch: cfg.Batch}
+		lifecycleSinks = append(lifecycleSinks, outlet)
+		go outlet.run()
+	}
+}
+
+// Builds the sink of one EVENT_BUS entry; redis:<channel> only exists with
+// the redis store
+func parseLifecycleSink(raw string, redis bool) (lifecycleSink, error) {
+	kind, target, _ := strings.Cut(raw, ":")
+	switch kind {
+	case "redis":
+		if !redis || target == "" {
+			return nil, errors.New("redis:<channel> needs the redis store")
+		}
+		return redisLifecycleSink{channel: target}, nil
+	case "nats":
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+			return nil, errors.New("not a NATS destination (nats://host:port/subject)")
+		}
+		return &natsLifecycleSink{natsConn: natsConnFor(u), subject: strings.TrimPrefix(u.Path, "/")}, nil
+	case "kafka-rest":
+		if !validCallbackURL(target) {
+			return nil, errors.New("not a Kafka REST Proxy URL")
+		}
+		return kafkaRestLifecycleSink{url: target}, nil
+	}
+	return nil, errors.New("entries must be redis:, nats:// or kafka-rest:")
+}
+
+// Hands the event to every destination without blocking the caller
+func publishLifecycle(kind string, payment PostPayments, processor string) {
+	if len(lifecycleSinks) == 0 {
+		return
+	}
+	e := lifecycleEvent{
+		SpecVersion:     "1.0",
+		ID:              newUUIDv7(),
+		Source:          "/" + SERVICE_NAME + "/" + INSTANCE_ID,
+		Type:            "payment." + kind,
+		Subject:         payment.CorrelationId,
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data: lifecycleEventData{
+			CorrelationId: payment.CorrelationId,
+			Amount:        payment.Amount,
+			Currency:      payment.Currency,
+			RequestedAt:   payment.RequestedAt,
+			Processor:     processor,
+			Tenant:        payment.tenant,
+		},
+	}
+	if processor != "" {
+		e.Data.Fee = outcomeEvent(payment, processor).Fee
+	}
+	for _, outlet := range lifecycleSinks {
+		select {
+		case outlet.ch <- e:
+		default:
+			metricLifecycleEvents.Inc("dropped")
+		}
+	}
+}
+
+// Publishes whatever is buffered, up to o.batch at a time. Delivery
+// is at most once: a failed batch is logged and dropped.
+func (o *lifecycleOutlet) run() {
+	batch := make([]lifecycleEvent, 0, o.batch)
+	for e := range o.ch {
+		batch = append(batch[:0], e)
+	fill:
+		for len(batch) < o.batch {
+			select {
+			case e := <-o.ch:
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := o.sink.publish(ctx, batch)
+		cancel()
+		if err != nil {
+			for range batch {
+				metricLifecycleEvents.Inc("dropped")
+			}
+			lifecycleLog.Warn("event publication failed", "sink", o.sink.name(), "events", len(batch), "err", err)
+			continue
+		}
+		for range batch {
+			metricLifecycleEvents.Inc("published")
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Redis Pub/Sub
+// ----------------------------------------------------------------------------
+
+type redisLifecycleSink struct{ channel string }
+
+func (s redisLifecycleSink) name() string { return "redis:" + s.channel }
+
+func (s redisLifecycleSink) publish(ctx context.Context, batch []lifecycleEvent) error {
+	pipe := redisClient.Pipeline()
+	for _, e := range batch {
+		data, err := jsonFast.Marshal(e)
+		if err != nil {
+			continue
+		}
+		pipe.Publish(ctx, s.channel, data)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ----------------------------------------------------------------------------
+// NATS (core protocol, no client library)
+// ----------------------------------------------------------------------------
+
+// One connection, opened on first use and reopened after an error. Each
+// batch ends with a PING so a PONG confirms the server took all of it.
+type natsLifecycleSink struct {
+	natsConn
+	subject string
+
+	mu sync.Mutex
+}
+
+// Client side of a NATS connection, also used by the INGEST_SOURCE consumer
+type natsConn struct {
+	addr, user, pass string
+
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// Address and credentials of a nats://[user:pass@]host:port URL
+func natsConnFor(u *url.URL) natsConn {
+	c := natsConn{addr: u.Host}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.pass, _ = u.User.Password()
+	}
+	return c
+}
+
+func (s *natsLifecycleSink) name() string { return "nats:" + s.subject }
+
+func (s *natsLifecycleSink) publish(ctx context.Context, batch []lifecycleEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf bytes.Buffer
+	for _, e := range batch {
+		data, err := jsonFast.Marshal(e)
+		if err != nil {
+			continue
+		}
+		buf.WriteString("PUB " + s.subject + " " + strconv.Itoa(len(data)) + "\r\n")
+		buf.Write(data)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("PING\r\n")
+	reused := s.conn != nil
+	err := s.send(ctx, buf.Bytes())
+	if err != nil && reused {
+		// The server drops idle clients: retry once on a fresh connection
+		s.close()
+		err = s.send(ctx, buf.Bytes())
+	}
+	if err != nil {
+		s.close()
+	}
+	return err
+}
+
+func (s *natsLifecycleSink) send(ctx context.Context, data []byte) error {
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetDeadline(deadline)
+	}
+	if _, err := s.conn.Write(data); err != nil {
+		return err
+	}
+	return s.awaitPong()
+}
+
+func (s *natsConn) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	s.conn, s.rd = conn, bufio.NewReader(conn)
+	// The server speaks first (INFO)
+	if line, err := s.rd.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO") {
+		s.close()
+		return errors.New("not a NATS server")
+	}
+	// Headers carry JetStream's status notices
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "headers": true, "name": SERVICE_NAME + "/" + INSTANCE_ID}
+	switch {
+	case s.user != "" && s.pass != "":
+		opts["user"], opts["pass"] = s.user, s.pass
+	case s.user != "":
+		opts["auth_token"] = s.user
+	}
+	connect, _ := jsonFast.Marshal(opts)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		s.close()
+		return err
+	}
+	if err := s.awaitPong(); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+// Reads up to our PONG, answering the server's own PINGs on the way
+func (s *natsConn) awaitPong() error {
+	for {
+		line, err := s.rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (s *natsConn) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.rd = nil, nil
+}
+
+// ----------------------------------------------------------------------------
+// Kafka through a REST Proxy (v2 JSON API)
+// ----------------------------------------------------------------------------
+
+type kafkaRestLifecycleSink struct{ url string }
+
+func (s kafkaRestLifecycleSink) name() string { return "kafka-rest:" + s.url }
+
+type kafkaRestRecord struct {
+	Key   string         `json:"key"`
+	Value lifecycleEvent `json:"value"`
+}
+
+func (s kafkaRestLifecycleSink) publish(ctx context.Context, batch []lifecycleEvent) error {
+	records := make([]kafkaRestRecord, len(batch))
+	for i, e := range batch {
+		records[i] = kafkaRestRecord{Key: e.Subject, Value: e}
+	}
+	body, err := jsonFast.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("rest proxy answered %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// ADAPTIVE PROCESSOR CONCURRENCY (CONCURRENCY_LIMITER=aimd)
+// ============================================================================
+
+var (
+	aimdLog = componentLogger("limiter")
+)
+
+type LimiterConfig struct {
+	// fixed: every processor gets its MAX_CONCURRENCY slots. aimd: the limit
+	// moves between MinConcurrency and MAX_CONCURRENCY with latency
+	Kind           string
+	MinConcurrency int
+	// A forward within minResponseTime plus this slack counts as fast and
+	// grows the limit; a slower success leaves it alone
+	LatencySlack time.Duration
+	// Factor the limit is multiplied by on an error or timeout
+	Backoff float64
+}
+
+func loadLimiterConfig(env *envParser) LimiterConfig {
+	c := LimiterConfig{
+		Kind:           env.oneOf("CONCURRENCY_LIMITER", "fixed", "fixed", "aimd"),
+		MinConcurrency: env.int("AIMD_MIN_CONCURRENCY", 2, 1),
+		LatencySlack:   env.durationOrZero("AIMD_LATENCY_SLACK", 50*time.Millisecond),
+		Backoff:        env.float("AIMD_BACKOFF", 0.5, 0, 1),
+	}
+	if c.Backoff == 0 || c.Backoff == 1 {
+		env.fail("AIMD_BACKOFF", strconv.FormatFloat(c.Backoff, 'g', -1, 64), "must be between 0 and 1, exclusive")
+	}
+	return c
+}
+
+// Slots for forwards to one processor
+type concurrencyLimiter interface {
+	acquire(ctx context.Context) bool
+	// outcome and latency of the forward that held the slot
+	release(outcome forwardOutcome, elapsed time.Duration)
+	limit() int
+	inFlight() int
+}
+
+func newConcurrencyLimiter(p *Processor, maxConcurrency int, cfg LimiterConfig) concurrencyLimiter {
+	if cfg.Kind == "aimd" {
+		return newAIMDLimiter(p, maxConcurrency, cfg)
+	}
+	return make(fixedLimiter, maxConcurrency)
+}
+
+// ----------------------------------------------------------------------------
+// Fixed
+// ----------------------------------------------------------------------------
+
+type fixedLimiter chan struct{}
+
+func (l fixedLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l fixedLimiter) release(forwardOutcome, time.Duration) { <-l }
+func (l fixedLimiter) limit() int                            { return cap(l) }
+func (l fixedLimiter) inFlight() int                         { return len(l) }
+
+// ----------------------------------------------------------------------------
+// AIMD
+// ----------------------------------------------------------------------------
+
+// Additive increase (about one slot per limit's worth of fast forwards),
+// multiplicative decrease on failures. Failures of forwards that started
+// before the last decrease don't decrease it again: they are the same
+// congestion, seen once per in-flight request.
+type aimdLimiter struct {
+	p        *Processor
+	min, max float64
+	slack    time.Duration
+	backoff  float64
+
+	mu           sync.Mutex
+	current      float64
+	active       int
+	wake         chan struct{} // Closed and replaced whenever a slot frees up
+	lastDecrease time.Time
+}
+
+func newAIMDLimiter(p *Processor, maxConcurrency int, cfg LimiterConfig) *aimdLimiter {
+	minimum := float64(min(cfg.MinConcurrency, maxConcurrency))
+	return &aimdLimiter{
+		p:       p,
+		min:     minimum,
+		max:     float64(maxConcurrency),
+		slack:   cfg.LatencySlack,
+		backoff: cfg.Backoff,
+		// Halfway up: room to grow without opening with a burst
+		current: max(minimum, float64(maxConcurrency)/2),
+		wake:    make(chan struct{}),
+	}
+}
+
+func (l *aimdLimiter) acquire(ctx context.Context) bool {
+	for {
+		l.mu.Lock()
+		if l.active < int(l.current) {
+			l.active++
+			l.mu.Unlock()
+			return true
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (l *aimdLimiter) release(outcome forwardOutcome, elapsed time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	switch {
+	case outcome == forwardRetryable || outcome == forwardTimedOut:
+		started := time.Now().Add(-elapsed)
+		if started.After(l.lastDecrease) {
+			l.current = max(l.min, l.current*l.backoff)
+			l.lastDecrease = time.Now()
+			aimdLog.Debug("concurrency decreased", "processor", l.p.Name, "limit", int(l.current))
+		}
+	case elapsed <= time.Duration(l.p.MinResponseTime())*time.Millisecond+l.slack:
+		l.current = min(l.max, l.current+1/l.current)
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+func (l *aimdLimiter) limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.current)
+}
+
+func (l *aimdLimiter) inFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
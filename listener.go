@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// LISTENER
+// ============================================================================
+
+var (
+	// Group (name or gid; empty keeps ours) of the socket file under
+	// PORT=unix:<path>, so a proxy in the same pod can connect
+	UNIX_SOCKET_GROUP = getEnv("UNIX_SOCKET_GROUP", "")
+
+	listenerLog = componentLogger("listener")
+)
+
+type ListenerConfig struct {
+	// Let several gateway processes bind the same port (kernel load balancing)
+	ReusePort bool
+	// Permissions of the socket file under PORT=unix:<path>
+	SocketMode os.FileMode
+}
+
+func loadListenerConfig(env *envParser) ListenerConfig {
+	c := ListenerConfig{ReusePort: env.bool("REUSE_PORT", false), SocketMode: 0o660}
+	if raw := os.Getenv("UNIX_SOCKET_MODE"); raw != "" {
+		if mode, err := strconv.ParseUint(raw, 8, 32); err != nil || mode > 0o777 {
+			env.fail("UNIX_SOCKET_MODE", raw, "must be an octal mode like 0660")
+		} else {
+			c.SocketMode = os.FileMode(mode)
+		}
+	}
+	return c
+}
+
+// Opens the main listener: an inherited systemd socket when LISTEN_FDS is
+// set, otherwise a unix socket for "unix:<path>" or a TCP socket on addr.
+// Features the platform lacks are reported and skipped instead of failing
+// startup.
+func listen(addr string, cfg ListenerConfig) (net.Listener, error) {
+	if ln, ok, err := activatedListener(); ok || err != nil {
+		return ln, err
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return listenUnix(path, cfg)
+	}
+
+	lc := net.ListenConfig{}
+	if cfg.ReusePort {
+		if reusePortSupported {
+			lc.Control = setReusePort
+		} else {
+			listenerLog.Warn("REUSE_PORT is not supported on this platform, ignoring")
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// systemd socket activation: fds start at 3 and LISTEN_PID must match us
+func activatedListener() (net.Listener, bool, error) {
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if fds < 1 {
+		return nil, false, nil
+	}
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != 0 && pid != os.Getpid() {
+		return nil, false, nil
+	}
+	if !socketActivationSupported {
+		listenerLog.Warn("socket activation is not supported on this platform, ignoring LISTEN_FDS")
+		return nil, false, nil
+	}
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+
+	f := os.NewFile(3, "LISTEN_FD_3")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, true, fmt.Errorf("socket activation: %w", err)
+	}
+	return ln, true, nil
+}
+
+// Binds the socket, replacing one left behind by a process that died
+// without closing it. Closing the listener on shutdown removes the file.
+func listenUnix(path string, cfg ListenerConfig) (net.Listener, error) {
+	if cfg.ReusePort {
+		listenerLog.Warn("REUSE_PORT does not apply to unix sockets, ignoring")
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		listenerLog.Info("removing stale socket", "path", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(path, cfg.SocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func setSocketPermissions(path string, mode os.FileMode) error {
+	if UNIX_SOCKET_GROUP != "" {
+		gid, err := strconv.Atoi(UNIX_SOCKET_GROUP)
+		if err != nil {
+			group, lerr := user.LookupGroup(UNIX_SOCKET_GROUP)
+			if lerr != nil {
+				return fmt.Errorf("UNIX_SOCKET_GROUP: %w", lerr)
+			}
+			gid, _ = strconv.Atoi(group.Gid)
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("UNIX_SOCKET_GROUP: %w", err)
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("UNIX_SOCKET_MODE: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "syscall"
+
+// Windows and other platforms: no SO_REUSEPORT and no inherited sockets
+const (
+	reusePortSupported        = false
+	socketActivationSupported = false
+)
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// PAYMENT LISTING (GET /payments)
+// ============================================================================
+
+// Up to ARGV[5] records of one shard after the cursor (score ARGV[3],
+// record key ARGV[4]) and at most ARGV[2] ms, as flat {recordKey, score,
+// correlationId, cents} quads. Ties on the score are ordered by record key,
+// as in the sorted set itself.
+// Reads the range in windows, so a page costs about its own size rather
+// than the whole remaining history.
+var listScript = redis.NewScript(`
+local after, afterKey, limit = tonumber(ARGV[3]), ARGV[4], tonumber(ARGV[5])
+local out, offset = {}, 0
+while true do
+  local entries = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[2], 'WITHSCORES', 'LIMIT', offset, 1000)
+  if #entries == 0 then
+    return out
+  end
+  offset = offset + #entries / 2
+  for i = 1, #entries, 2 do
+    local key, score = entries[i], tonumber(entries[i + 1])
+    if score > after or (score == after and key > afterKey) then
+      out[#out + 1] = key
+      out[#out + 1] = entries[i + 1]
+      out[#out + 1] = redis.call('HGET', KEYS[3], key) or key
+      out[#out + 1] = redis.call('HGET', KEYS[2], key) or '0'
+      if #out >= limit * 4 then
+        return out
+      end
+    end
+  end
+end
+`)
+
+type listedPayment struct {
+	CorrelationId string `json:"correlationId"`
+	Amount        Cents  `json:"amount"`
+	RequestedAt   string `json:"requestedAt"`
+	Processor     string `json:"processor"`
+	Status        string `json:"status"`
+	// Set outside DEFAULT_CURRENCY
+	Currency string `json:"currency,omitempty"`
+
+	at  int64  // Score
+	key string // Record key, the tie breaker
+}
+
+type paymentList struct {
+	Payments []listedPayment `json:"payments"`
+	// Pass as ?cursor= for the next page; absent on the last one
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GET /payments?processor=&from=&to=&limit=&cursor= - recorded payments,
+// oldest first, from the summary history. Only what is still in Redis is
+// listed, not what was tiered to cold storage.
+func handlePaymentList(maxLimit int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !redisBacked() {
+			writeJSONError(w, http.StatusNotImplemented, "listing_unavailable", "listing needs STORE=redis")
+			return
+		}
+		query := r.URL.Query()
+
+		names := []string{"default", "fallback"}
+		if p := query.Get("processor"); p != "" {
+			if processorByName(p) == nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid_processor", "processor must be default or fallback")
+				return
+			}
+			names = []string{p}
+		}
+
+		from, to := int64(0), time.Now().UnixMilli()
+		for _, bound := range []struct {
+			param string
+			ms    *int64
+		}{{"from", &from}, {"to", &to}} {
+			if raw := query.Get(bound.param); raw != "" {
+				t, err := time.Parse(time.RFC3339, raw)
+				if err != nil {
+					writeJSONError(w, http.StatusBadRequest, "invalid_range", bound.param+" must be an RFC 3339 timestamp")
+					return
+				}
+				*bound.ms = t.UnixMilli()
+			}
+		}
+
+		limit := 50
+		if raw := query.Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > maxLimit {
+				writeJSONError(w, http.StatusBadRequest, "invalid_limit", "limit must be between 1 and "+strconv.Itoa(maxLimit))
+				return
+			}
+			limit = n
+		}
+
+		after, afterKey := from-1, ""
+		if raw := query.Get("cursor"); raw != "" {
+			var ok bool
+			if after, afterKey, ok = decodeListCursor(raw); !ok {
+				writeJSONError(w, http.StatusBadRequest, "invalid_cursor", "cursor must come from a previous nextCursor")
+				return
+			}
+		}
+
+		// A reporting query: same slot budget as the summaries
+		if !acquireSummarySlot(r.Context()) {
+			metricSummaryBusy.Inc("")
+			writeSummaryBusy(w)
+			return
+		}
+		defer func() { <-summaryLimiter }()
+
+		// One page from every shard of every currency, merged: the first limit
+		// overall are the page
+		var page []listedPayment
+		for _, name := range names {
+			for _, bucket := range currencyBuckets(r.Context(), name) {
+				for shard := 0; shard < max(historyShards, 1); shard++ {
+					records, err := listShard(r.Context(), name, bucket, shard, max(from, after), to, after, afterKey, limit)
+					if err != nil {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					page = append(page, records...)
+				}
+			}
+		}
+		sort.Slice(page, func(i, j int) bool {
+			if page[i].at != page[j].at {
+				return page[i].at < page[j].at
+			}
+			return page[i].key < page[j].key
+		})
+		resp := paymentList{Payments: []listedPayment{}}
+		if len(page) > limit {
+			page = page[:limit]
+			last := page[limit-1]
+			resp.NextCursor = encodeListCursor(last.at, last.key)
+		}
+		resp.Payments = append(resp.Payments, page...)
+
+		// Current state of each, in one pipeline
+		ids := make([]string, len(resp.Payments))
+		for i, p := range resp.Payments {
+			ids[i] = p.CorrelationId
+		}
+		if statuses, err := store.Statuses(r.Context(), ids); err == nil {
+			for i := range resp.Payments {
+				resp.Payments[i].Status = statuses[i]["state"]
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = jsonFast.NewEncoder(w).Encode(resp)
+	}
+}
+
+// Fetches one more than the page so a full page knows whether there is
+// a next one
+func listShard(ctx context.Context, processor, bucket string, shard int, from, to, after int64, afterKey string, limit int) ([]listedPayment, error) {
+	defer metricRedisLatency.Since("list_shard", time.Now())
+	keys := []string{summaryKey(bucket, "history", shard), summaryKey(bucket, "data", shard), summaryKey(bucket, "ids", shard)}
+	currency := ""
+	if bucket != processor {
+		currency = bucketCurrency(bucket)
+	}
+	flat, err := listScript.Run(ctx, readClient(), keys, from, to, after, afterKey, limit+1).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]listedPayment, 0, len(flat)/4)
+	for i := 0; i+3 < len(flat); i += 4 {
+		ms, _ := strconv.ParseInt(flat[i+1], 10, 64)
+		amount, _ := parseRawCents(flat[i+3])
+		records = append(records, listedPayment{
+			CorrelationId: flat[i+2],
+			Amount:        amount,
+			RequestedAt:   time.UnixMilli(ms).UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+			Processor:     processor,
+			Currency:      currency,
+			at:            ms,
+			key:           flat[i],
+		})
+	}
+	return records, nil
+}
+
+// Opaque to clients: the score and record key of the last payment returned
+func encodeListCursor(at int64, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(at, 10) + ":" + key))
+}
+
+func decodeListCursor(raw string) (int64, string, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return 0, "", false
+	}
+	score, key, ok := strings.Cut(string(data), ":")
+	at, err := strconv.ParseInt(score, 10, 64)
+	return at, key, ok && err == nil && key != ""
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// LOAD SHEDDING (queue watermarks)
+// ============================================================================
+
+var (
+	// Set by startLoadShedding
+	shedConfig ShedConfig
+
+	loadShedding atomic.Bool
+
+	metricLoadShed    = newCounterVec("gateway_load_shed_total", "Payments answered 503 while shedding, by priority.", "priority")
+	metricShedEntered = newCounterVec("gateway_load_shed_episodes_total", "Times the queue crossed the high watermark.", "")
+
+	sheddingLog = componentLogger("load_shedding")
+)
+
+var shedPriorities = map[string]bool{"low": true, "normal": true, "high": true}
+
+type ShedConfig struct {
+	// Answer 503 once the queue reaches High% of capacity and accept again
+	// once it drains to Low% (High 0 disables), so a payment that is
+	// accepted never waits behind a full queue
+	High, Low int
+	// all: every payment is shed while shedding. priority: only low
+	// priority ones, normal ones too from Critical%, high ones never (the
+	// queue-full 429 still applies)
+	Policy   string
+	Critical int
+	// Payments below this amount are low priority unless X-Payment-Priority
+	// says otherwise (0: only the header decides)
+	LowAmount  Cents
+	RetryAfter int  // Seconds
+	Audit      bool // Append every shed payment to the audit log (redis store only)
+}
+
+func loadShedConfig(env *envParser) ShedConfig {
+	c := ShedConfig{
+		High:       env.int("SHED_HIGH_WATERMARK", 0, 0),
+		Low:        env.int("SHED_LOW_WATERMARK", 50, 0),
+		Policy:     env.oneOf("SHED_POLICY", "all", "all", "priority"),
+		Critical:   env.int("SHED_CRITICAL_WATERMARK", 90, 0),
+		LowAmount:  env.amount("SHED_LOW_AMOUNT", 0),
+		RetryAfter: env.int("SHED_RETRY_AFTER", 1, 1),
+		Audit:      env.bool("SHED_AUDIT", true),
+	}
+	if c.High == 0 {
+		return c
+	}
+	if c.Low >= c.High || c.High > 100 {
+		env.fail("SHED_LOW_WATERMARK", strconv.Itoa(c.Low), "must be below SHED_HIGH_WATERMARK, both between 0 and 100")
+	}
+	if c.Policy == "priority" && (c.Critical < c.High || c.Critical > 100) {
+		env.fail("SHED_CRITICAL_WATERMARK", strconv.Itoa(c.Critical), "must lie between SHED_HIGH_WATERMARK and 100")
+	}
+	return c
+}
+
+func startLoadShedding(cfg ShedConfig) {
+	if cfg.High == 0 {
+		return
+	}
+	if cfg.Audit {
+		startAuditWriter()
+	}
+	shedConfig = cfg
+}
+
+// Priority of a payment: X-Payment-Priority when valid, else low below
+// the low amount, else normal
+func shedPriority(header string, payment PostPayments) string {
+	if shedPriorities[header] {
+		return header
+	}
+	if shedConfig.LowAmount > 0 && payment.Amount < shedConfig.LowAmount {
+		return "low"
+	}
+	return "normal"
+}
+
+// Answer for a payment arriving while the queue is above its watermarks, or
+// nil to go on. Decided on every arrival, with hysteresis, so shedding
+// starts the moment the queue crosses the high watermark. In shared mode
+// the queue is the stream's backlog (see queueBacklog).
+func checkQueueWatermark(req ingestRequest, payment PostPayments) *ingestResponse {
+	if shedConfig.High == 0 {
+		return nil
+	}
+	fill := queueFillPercent()
+	switch {
+	case !loadShedding.Load() && fill >= shedConfig.High:
+		if loadShedding.CompareAndSwap(false, true) {
+			metricShedEntered.Inc("")
+			sheddingLog.Warn("queue above high watermark, shedding payments", "queueFillPercent", fill, "policy", shedConfig.Policy)
+		}
+	case loadShedding.Load() && fill <= shedConfig.Low:
+		if loadShedding.CompareAndSwap(true, false) {
+			sheddingLog.Info("queue back at low watermark, accepting payments", "queueFillPercent", fill)
+		}
+	}
+	if !loadShedding.Load() {
+		return nil
+	}
+	priority := shedPriority(req.priority, payment)
+	if shedConfig.Policy == "priority" {
+		switch {
+		case priority == "high":
+			return nil
+		case priority == "normal" && fill < shedConfig.Critical:
+			return nil
+		}
+	}
+	metricLoadShed.Inc(priority)
+	metricPaymentsRejected.Inc("shed")
+	if shedConfig.Audit {
+		queueAudit([]interface{}{
+			"action", "shed",
+			"correlationId", payment.CorrelationId,
+			"amount", payment.Amount.String(),
+			"priority", priority,
+			"policy", shedConfig.Policy,
+			"queueFillPercent", fill,
+			"instance", INSTANCE_ID,
+			"at", time.Now().UTC().Format(time.RFC3339Nano),
+		})
+	}
+	return &ingestResponse{status: http.StatusServiceUnavailable, retryAfter: shedConfig.RetryAfter,
+		body: jsonErrorBody("overloaded", "queue above "+strconv.Itoa(shedConfig.High)+"% of capacity, retry later")}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// LOGGING
+// ============================================================================
+
+var (
+	// debug, info, warn or error
+	LOG_LEVEL = getEnv("LOG_LEVEL", "info")
+
+	// text (logfmt) or json
+	LOG_FORMAT = getEnv("LOG_FORMAT", "text")
+
+	logger = newLogger()
+)
+
+// Built at package init, ahead of loadConfig, since every component logger
+// derives from it: a bad LOG_LEVEL or LOG_FORMAT falls back to info and
+// text here and fails startup in checkLogSettings
+func newLogger() *slog.Logger {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(LOG_LEVEL))
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.EqualFold(LOG_FORMAT, "json") {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	return slog.New(handler).With("instance", INSTANCE_ID)
+}
+
+func checkLogSettings(env *envParser) {
+	var level slog.Level
+	env.check("LOG_LEVEL", LOG_LEVEL, level.UnmarshalText([]byte(LOG_LEVEL)))
+	if f := strings.ToLower(LOG_FORMAT); f != "text" && f != "json" {
+		env.fail("LOG_FORMAT", LOG_FORMAT, "must be text or json")
+	}
+}
+
+// Logger tagged with the subsystem it belongs to
+func componentLogger(component string) *slog.Logger {
+	return logger.With("component", component)
+}
+
+// ----------------------------------------------------------------------------
+// Request logging
+// ----------------------------------------------------------------------------
+
+var httpLog = componentLogger("http")
+
+// Logs every request at debug level and server errors at warn
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		logRequest(r.Method, r.URL.Path, rec.status, start, r.RemoteAddr)
+	})
+}
+
+// The line logRequests writes, shared with the routes fasthttp serves natively
+func logRequest(method, path string, status int, start time.Time, remote string) {
+	level := slog.LevelDebug
+	if status >= 500 {
+		level = slog.LevelWarn
+	}
+	if !httpLog.Enabled(context.Background(), level) {
+		return
+	}
+	httpLog.Log(context.Background(), level, "request",
+		"method", method,
+		"path", path,
+		"status", status,
+		"duration", time.Since(start),
+		"remote", remote,
+	)
+}
+
+// Captures the status code; keeps streaming and upgrades working
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Lets http.ResponseController reach the real writer (write deadlines)
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
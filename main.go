@@ -3,17 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
-	"fmt"
-	"math"
+	"errors"
+	"hash/fnv"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/redis/go-redis/v9"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/redis/go-redis/v9"
 )
 
 // ============================================================================
@@ -21,49 +22,101 @@ import (
 // ============================================================================
 
 var (
-	// Server configuration
-	PORT      = getEnv("PORT", ":9999")
-	REDIS_URL = getEnv("REDIS_URL", "127.0.0.1:6379")
-	WORKERS   = getEnv("WORKERS", "30")
-
-	// Pre-compiled URLs for performance
-	DEFAULT_PAYMENTS_URL  = getEnv("PAYMENT_PROCESSOR_DEFAULT_URL", "http://localhost:8001") + "/payments"
-	FALLBACK_PAYMENTS_URL = getEnv("PAYMENT_PROCESSOR_FALLBACK_URL", "http://localhost:8002") + "/payments"
-
-	// Core infrastructure
-	paymentQueue = make(chan PostPayments, 100_000) // Payment processing queue
-	redisClient  = redis.NewClient(&redis.Options{Addr: REDIS_URL})
-	
-	// HTTP client with natural timeout
-	httpClient = &http.Client{Timeout: 5 * time.Second}
-	
+	// Core infrastructure, built from the Config by setupInfrastructure
+	paymentQueue chan paymentJob // Payment processing queue
+	redisClient  redis.UniversalClient
+	readClients  []redis.UniversalClient // Summary query clients: replicas or a separate primary pool
+	readCursor   atomic.Uint64
+
+	// Number of hash slots the per-processor history/data keys are split into
+	historyShards = 1
+
+	// HTTP client for everything but the processors
+	httpClient *http.Client
+
 	// Concurrency and performance control
-	concurrencyLimiter = make(chan struct{}, 30)      // Concurrent request limiter
-	bufferPool         = sync.Pool{New: func() interface{} { 
+	summaryLimiter chan struct{} // Concurrent /payments-summary limiter
+	summaryWait    time.Duration
+	bufferPool     = sync.Pool{New: func() interface{} {
 		buf := make([]byte, 0, 1024)
 		return bytes.NewBuffer(buf)
 	}}
-	
+
 	// Ultra-fast JSON for summary
 	jsonFast = jsoniter.ConfigCompatibleWithStandardLibrary
-	
 )
 
 // Payment structure
 type PostPayments struct {
-	CorrelationId string  `json:"correlationId"`
-	Amount        float64 `json:"amount"`
-	RequestedAt   string  `json:"requestedAt"`
+	CorrelationId string `json:"correlationId"`
+	Amount        Cents  `json:"amount"`
+	RequestedAt   string `json:"requestedAt"`
+	// ISO 4217; empty means DEFAULT_CURRENCY. Queued and stored, but
+	// never sent to processors (see processorPayment)
+	Currency string `json:"currency,omitempty"`
+
+	tenant      string // From the API key; never sent to processors
+	callbackURL string // Per-payment completion callback, if allowed
+	namespace   string // See paymentNamespace
+	sandbox     bool   // See sandboxPayment
+}
+
+// Body of a processor's POST /payments, whose contract has these fields only
+type processorPayment struct {
+	CorrelationId string `json:"correlationId"`
+	Amount        Cents  `json:"amount"`
+	RequestedAt   string `json:"requestedAt"`
+}
+
+// Queued payment plus the submitting request's context (sync mode only)
+type paymentJob struct {
+	PostPayments
+	ctx    context.Context
+	result chan string // Processor that accepted it, "" on failure
+	walID  string      // WAL entry to drop once the outcome is recorded
+	// Shared queue entry to ack once the outcome is recorded
+	streamID string
+
+	generatedID bool      // correlationId was assigned at ingest
+	trace       *trace    // nil unless sampled
+	queuedAt    time.Time // Start of the "queue wait" span
 }
 
 // Summary data structure
 type SummaryData struct {
-	TotalRequests int64   `json:"totalRequests"`
-	TotalAmount   float64 `json:"totalAmount"`
+	TotalRequests int64 `json:"totalRequests"`
+	TotalAmount   Cents `json:"totalAmount"`
 }
 
 // Response structure for /payments-summary endpoint
 type PaymentsSummary struct {
+	// Set when filtered with ?currency=
+	Currency string `json:"currency,omitempty"`
+
+	Default  ProcessorSummary `json:"default"`
+	Fallback ProcessorSummary `json:"fallback"`
+
+	// Net voids/amount fixes over the same window, kept apart from the totals
+	Corrections *CorrectionsSummary `json:"corrections,omitempty"`
+
+	// Refunds of payments in the window, already taken off the totals
+	Refunds *RefundsSummary `json:"refunds,omitempty"`
+}
+
+// Totals of one processor; with FEE_SCHEDULE also its fees over the
+// window and the amount left after them
+type ProcessorSummary struct {
+	SummaryData
+	TotalFee  *Cents `json:"totalFee,omitempty"`
+	NetAmount *Cents `json:"netAmount,omitempty"`
+}
+
+type CorrectionsSummary struct {
+	Default  SummaryData `json:"default"`
+	Fallback SummaryData `json:"fallback"`
+}
+
+type RefundsSummary struct {
 	Default  SummaryData `json:"default"`
 	Fallback SummaryData `json:"fallback"`
 }
@@ -82,195 +135,1044 @@ func getEnv(key, fallback string) string {
 // ============================================================================
 
 func main() {
-	// Clean Redis on startup
+	// rinha-payment-gateway verify [flags]: conformance run against a live
+	// deployment instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		panic(err)
+	}
+	setupInfrastructure(cfg)
+
+	// Clean Redis on startup (never by default under strict durability,
+	// it would wipe the WAL we are about to recover). Refused while another
+	// instance is live on the same Redis.
 	ctx := context.Background()
-	_ = redisClient.FlushAll(ctx).Err()
+	noteStartup(func(r *startupReport) {
+		r.Store, r.FlushOnStart, r.ConfigDigest = cfg.Store.Kind, cfg.FlushOnStart, configDigest(cfg)
+	})
+	if redisBacked() {
+		stored, _ := redisClient.Get(ctx, schemaKey).Int()
+		noteStartup(func(r *startupReport) { r.StoredSchemaVersion = stored })
+		// Same scoped purge as POST /admin/purge-payments, never FlushAll:
+		// the database may hold other services' keys
+		if !checkSharedRedis(cfg.FlushOnStart) {
+			noteStartup(func(r *startupReport) { r.FlushRefused = cfg.FlushOnStart })
+		} else {
+			purged, err := purgeGatewayKeys(ctx)
+			if err != nil {
+				logger.Error("startup purge failed", "err", err)
+			}
+			noteStartup(func(r *startupReport) {
+				r.KeysPurged = purged
+				if err != nil {
+					r.Errors = append(r.Errors, "startup purge: "+err.Error())
+				}
+			})
+		}
+		startHeartbeat(cfg.FlushOnStart)
+	}
 
-	// Start payment processing workers
-	workers, _ := strconv.Atoi(WORKERS)
-	for i := 0; i < workers; i++ {
-		go processPayments(paymentQueue)
+	// POST outcomes to PAYMENT_CALLBACK_URL or the payment's callbackUrl;
+	// ready before the first worker finishes anything
+	startCallbacks(cfg.Callbacks)
+
+	// Publish lifecycle events to EVENT_BUS (Redis Pub/Sub, NATS, Kafka)
+	startEventBus(cfg.EventBus)
+
+	// Start payment processing workers, resized with the load between
+	// WORKERS_MIN and WORKERS_MAX
+	for i := 0; i < cfg.Workers; i++ {
+		startWorker()
+	}
+	startAutoscaler(cfg.WorkersMin, cfg.WorkersMax, cfg.Autoscale)
+
+	// Consume the shared queue in INSTANCE_MODE=shared
+	startSharedQueue(cfg.SharedQueue)
+
+	// Replay payments accepted but not finished before a crash
+	if n := walRecover(); n > 0 {
+		logger.Info("recovered payments from the WAL", "component", "wal", "payments", n)
+		noteStartup(func(r *startupReport) { r.WALRecovered = n })
 	}
+	noteStartupQueues(ctx)
+
+	// Export sampled traces
+	startTracing(cfg.Tracing)
+
+	// Upload periodic CPU/heap profiles to PROFILE_UPLOAD_URL
+	startProfiling(cfg.Profiling)
+
+	// pprof and expvar on DEBUG_PORT, never on the public listener
+	startDebugServer(cfg.DebugPort)
+
+	// Deliver payment outcomes to EVENT_WEBHOOKS
+	startEventWebhooks(cfg.EventWebhooks)
+
+	// Load /admin/tenants settings and keep them refreshed
+	startTenants(cfg.Tenants)
+
+	// Follow POST /admin/maintenance made through any instance
+	startMaintenance(cfg.MaintenanceDuration)
+
+	// Shed non-essential work under extreme load
+	startBrownout(cfg.Brownout)
+	startLoadShedding(cfg.Shed)
+
+	// Audit payments refused for a requestedAt outside the window
+	startRequestedAtWindow()
+
+	// Refuse optional async work past the goroutine/FD budgets
+	startBudgets(cfg.Limits.GoroutineBudget, cfg.Limits.FDBudget)
+
+	// Start summary writers; drain and flush everything on termination
+	summaryWriter.Start()
+	go shutdownOnSignal(cfg.Server)
+
+	// Move expired records to cold storage
+	startTiering(cfg.Tiering)
+
+	// Detect stuck workers
+	startWatchdog(cfg.Watchdog)
 
-	// Direct Redis processing, no batch handler needed
-	
+	// Track arrival rates and full-queue episodes
+	startQueueStats(cfg.Limits.QueueStatsEpisodes)
+
+	// Poll processor health for routing decisions
+	startHealthChecks(cfg.Health)
+
+	// Publish routing state to, or follow it from, the INSTANCE_ROLE peer
+	startReplication(cfg.Replication)
+
+	// Watch Consul/etcd for processor endpoint changes
+	startConfigDiscovery(cfg.Discovery)
 
 	// Setup HTTP handlers
-	setupHTTPHandlers()
+	setupHTTPHandlers(cfg)
+
+	// Consume payments from INGEST_SOURCE (Kafka, NATS JetStream)
+	startIngest(cfg.Ingest)
 
-	// Ensure PORT has colon prefix
-	if !strings.HasPrefix(PORT, ":") {
-		PORT = ":" + PORT
-	}
-	
 	// Start server
-	fmt.Println("Payment Gateway Server running on", PORT)
-	if err := http.ListenAndServe(PORT, nil); err != nil {
+	ln, err := listen(cfg.Port, cfg.Listener)
+	if err != nil {
+		panic(err)
+	}
+	ln = withTLS(ln, cfg.TLS)
+	logger.Info("payment gateway running", "addr", ln.Addr().String(), "engine", cfg.Engine, "submitMode", cfg.SubmitMode, "store", cfg.Store.Kind)
+	noteStartup(func(r *startupReport) { r.ReadyAt = time.Now().UTC().Format(time.RFC3339) })
+	if cfg.ConsulRegister {
+		if err := registerService(ln, cfg.TLS.enabled()); err != nil {
+			logger.Error("consul registration failed", "component", "registration", "err", err)
+		}
+	}
+	if cfg.Engine == "fasthttp" {
+		err = serveFastHTTP(ln, cfg.SubmitMode, cfg.Server)
+	} else {
+		err = serveHTTP(ln, cfg.Server)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
+	// Serving stopped for shutdown, which exits once the queue has drained
+	select {}
+}
+
+func serveHTTP(ln net.Listener, sc ServerConfig) error {
+	srv := &http.Server{
+		Handler:           logRequests(hideDebug(http.DefaultServeMux)),
+		ReadHeaderTimeout: sc.ReadHeaderTimeout,
+		ReadTimeout:       sc.ReadTimeout,
+		WriteTimeout:      sc.WriteTimeout,
+		IdleTimeout:       sc.IdleTimeout,
+	}
+	stopServer = srv.Shutdown
+	return srv.Serve(ln)
 }
 
 // ============================================================================
 // HTTP ENDPOINTS
 // ============================================================================
 
-func setupHTTPHandlers() {
+func setupHTTPHandlers(cfg Config) {
 	// POST /payments - Receive and process payments
-	http.HandleFunc("/payments", receivePayment)
-	
+	// GET /payments - Lists recorded payments, paginated
+	http.HandleFunc("/payments", receivePayment(cfg.SubmitMode, handlePaymentList(cfg.Limits.ListMax)))
+
+	// GET /payments/{correlationId} - Outcome of a single payment
+	http.HandleFunc("/payments/", handlePaymentStatus)
+
+	// POST /payments/status - Outcomes of many payments in one call
+	http.HandleFunc("/payments/status", handleBulkStatus(cfg.Limits.StatusBulkMax))
+
+	// POST /payments/batch - Many payments (JSON array or NDJSON) in one call
+	http.HandleFunc("/payments/batch", handlePaymentBatch(cfg.Limits.BatchMax))
+
 	// GET /payments-summary - Returns payment summary
 	http.HandleFunc("/payments-summary", handlePaymentsSummary)
+
+	// GET /payments-summary/wait - Long-polls until the summary changes
+	http.HandleFunc("/payments-summary/wait", handleSummaryWait(cfg.LongPoll))
+
+	// GET /payments-costs - Processor fees per the configured schedule
+	// GET /payments/search - Look payments up by amount and approximate time
+	if redisBacked() {
+		http.HandleFunc("/payments-costs", handlePaymentsCosts)
+		http.HandleFunc("/payments/search", handlePaymentSearch(cfg.Search))
+	}
+
+	// GET /events - Filtered server-sent stream of payment outcomes
+	http.HandleFunc("/events", requireAdmin(handleEvents))
+
+	// GET /healthz, /readyz - Liveness and readiness probes
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz(cfg.Limits.ReadyQueueWatermark))
+
+	// GET /metrics - Prometheus text exposition
+	http.HandleFunc("/metrics", handleMetrics)
+
+	// /admin/* - Operational endpoints
+	setupAdminHandlers()
 }
 
-func receivePayment(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+// Handler for POST /payments, and GET through list; sync mode answers with
+// the processing outcome
+func receivePayment(submitMode string, list http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			list(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		buf := bufferPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufferPool.Put(buf)
+		if _, err := buf.ReadFrom(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		job, ingest, resp := admitPayment(ingestRequest{
+			ctx:         r.Context(),
+			body:        buf.Bytes(),
+			apiKey:      r.Header.Get("X-API-Key"),
+			clientIP:    clientIP(r),
+			traceparent: r.Header.Get("traceparent"),
+			priority:    r.Header.Get("X-Payment-Priority"),
+			namespace:   r.Header.Get(NAMESPACE_HEADER),
+		})
+		switch {
+		case resp != nil:
+			resp.write(w)
+		case submitMode == "sync":
+			ingest.End(false)
+			submitSync(w, r, job)
+		default:
+			enqueuePayment(job, ingest).write(w)
+		}
 	}
-	var p PostPayments
-	if err := jsonFast.NewDecoder(r.Body).Decode(&p); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+}
+
+// What ingest needs from a POST /payments, whatever the server engine
+type ingestRequest struct {
+	ctx         context.Context
+	body        []byte
+	apiKey      string // X-API-Key
+	clientIP    string
+	traceparent string
+	priority    string // X-Payment-Priority
+	namespace   string // NAMESPACE_HEADER
+}
+
+// Answer of the ingest path, written by the engine that received it
+type ingestResponse struct {
+	status int
+	body   []byte // JSON, when set
+	replay bool   // Idempotent-Replay: true
+	// Retry-After, in seconds, when over a rate limit
+	retryAfter int
+}
+
+func (resp *ingestResponse) write(w http.ResponseWriter) {
+	if resp.replay {
+		w.Header().Set("Idempotent-Replay", "true")
+	}
+	if resp.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(resp.retryAfter))
+	}
+	if resp.body != nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(resp.status)
+	if resp.body != nil {
+		_, _ = w.Write(resp.body)
+	}
+}
+
+// Validates a payment, claims its correlationId and persists it to the WAL
+// when required. Returns either a job ready to be queued (with its open
+// ingest span) or the final response.
+func admitPayment(req ingestRequest) (job paymentJob, ingest *activeSpan, resp *ingestResponse) {
+	metricPaymentsReceived.Inc("")
+	queueStats.noteArrival()
+	if draining.Load() {
+		metricPaymentsRejected.Inc("draining")
+		return job, nil, &ingestResponse{status: http.StatusServiceUnavailable}
+	}
+	if paused := checkMaintenance(); paused != nil {
+		return job, nil, paused
+	}
+	// One noisy client gets 429s before it can fill the shared queue
+	if limited := checkClientLimit(req); limited != nil {
+		return job, nil, limited
+	}
+	p, invalid := decodePayment(req.body)
+	if invalid != nil {
+		metricPaymentsRejected.Inc(invalid.code)
+		return job, nil, invalid.response()
+	}
+	if skewed := checkRequestedAt(p); skewed != nil {
+		return job, nil, skewed
+	}
+	// Above the high watermark payments are shed, by priority under
+	// SHED_POLICY=priority, until the queue drains
+	if shed := checkQueueWatermark(req, p); shed != nil {
+		return job, nil, shed
+	}
+	generated := false
+	if p.CorrelationId == "" {
+		if correlationIDPolicy(req.apiKey) != "generate" {
+			metricPaymentsRejected.Inc("missing_correlation_id")
+			return job, nil, &ingestResponse{status: http.StatusBadRequest,
+				body: jsonErrorBody("missing_correlation_id", "correlationId is required")}
+		}
+		p.CorrelationId, generated = idGenerator(), true
+	}
+	p.namespace = paymentNamespace(req.namespace, p.CorrelationId)
+	p.sandbox = sandboxPayment(req.apiKey)
+	if p.tenant = tenantFor(req.apiKey); p.tenant == "" {
+		p.tenant = namespaceTenants[p.namespace]
+	}
+	if limited := checkTenantLimit(p.tenant); limited != nil {
+		return job, nil, limited
+	}
+	job = paymentJob{PostPayments: p, ctx: context.Background(), generatedID: generated, trace: startTrace(req.traceparent, "payment")}
+	ingest = job.trace.StartSpan("ingest")
+	job.trace.SetAttr("payment.correlation_id", p.CorrelationId)
+
+	// A correlationId seen before gets the original outcome; if the store
+	// is unreachable the payment goes through unchecked
+	if idempotency {
+		if existing, claimed, err := store.Claim(req.ctx, p); err == nil && !claimed {
+			ingest.End(false)
+			job.trace.Finish(false)
+			metricPaymentsRejected.Inc("duplicate")
+			return job, nil, duplicateResponse(p.CorrelationId, existing)
+		}
+	}
+
+	// Under strict durability the payment is persisted before any ack (the
+	// shared queue already is)
+	if strictDurability() && !sharedQueue() {
+		id, err := walAppend(req.ctx, p)
+		if err != nil {
+			ingest.End(true)
+			job.trace.Finish(true)
+			metricPaymentsRejected.Inc("wal_unavailable")
+			store.Release(context.Background(), p.CorrelationId)
+			return job, nil, &ingestResponse{status: http.StatusServiceUnavailable}
+		}
+		job.walID = id
+	}
+	return job, ingest, nil
+}
+
+// Queues an admitted payment and answers right away (async mode)
+func enqueuePayment(job paymentJob, ingest *activeSpan) *ingestResponse {
+	if sharedQueue() {
+		return enqueueShared(job, ingest)
+	}
+	if job.trace != nil {
+		job.queuedAt = time.Now()
 	}
 	select {
-	case paymentQueue <- p:
-		w.WriteHeader(http.StatusCreated)
+	case paymentQueue <- job:
+		metricPaymentsQueued.Inc("")
+		markProgress(context.Background(), job.PostPayments, "queued")
+		publishLifecycle("accepted", job.PostPayments, "")
+		ingest.End(false)
+		if job.generatedID {
+			return &ingestResponse{status: http.StatusCreated, body: []byte(`{"correlationId":"` + job.CorrelationId + `"}`)}
+		}
+		return &ingestResponse{status: http.StatusCreated}
 	default:
+		ingest.End(true)
+		job.trace.Finish(true)
+		metricPaymentsRejected.Inc("queue_full")
+		queueStats.noteQueueFull()
+		walRemove(job.walID)
+		store.Release(context.Background(), job.CorrelationId)
+		return &ingestResponse{status: http.StatusTooManyRequests}
+	}
+}
+
+// The trace can't follow the payment to another instance, so it ends here
+func enqueueShared(job paymentJob, ingest *activeSpan) *ingestResponse {
+	if err := sharedEnqueue(job.ctx, job.PostPayments); err != nil {
+		ingest.End(true)
+		job.trace.Finish(true)
+		metricPaymentsRejected.Inc("queue_unavailable")
+		store.Release(context.Background(), job.CorrelationId)
+		return &ingestResponse{status: http.StatusServiceUnavailable}
+	}
+	metricPaymentsQueued.Inc("")
+	markProgress(context.Background(), job.PostPayments, "queued")
+	publishLifecycle("accepted", job.PostPayments, "")
+	ingest.End(false)
+	job.trace.Finish(false)
+	if job.generatedID {
+		return &ingestResponse{status: http.StatusCreated, body: []byte(`{"correlationId":"` + job.CorrelationId + `"}`)}
+	}
+	return &ingestResponse{status: http.StatusCreated}
+}
+
+// Waits for the outcome, bounded by the client's deadline if it sent one
+func submitSync(w http.ResponseWriter, r *http.Request, job paymentJob) {
+	ctx := r.Context()
+	if deadline, ok := requestDeadline(r); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	job.ctx = ctx
+	job.result = make(chan string, 1)
+	select {
+	case paymentQueue <- job:
+		metricPaymentsQueued.Inc("")
+		markProgress(context.Background(), job.PostPayments, "queued")
+		publishLifecycle("accepted", job.PostPayments, "")
+	default:
+		job.trace.Finish(true)
+		metricPaymentsRejected.Inc("queue_full")
+		queueStats.noteQueueFull()
+		walRemove(job.walID)
+		store.Release(context.Background(), job.CorrelationId)
 		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	select {
+	case processor := <-job.result:
+		if processor == "" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if processor == paymentCancelled {
+			writeJSONError(w, http.StatusConflict, "cancelled", "payment was cancelled before it was forwarded")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if job.generatedID {
+			_, _ = w.Write([]byte(`{"processor":"` + processor + `","correlationId":"` + job.CorrelationId + `"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"processor":"` + processor + `"}`))
+	case <-ctx.Done():
+		w.WriteHeader(http.StatusGatewayTimeout)
 	}
 }
 
+// Reads X-Request-Deadline (RFC3339 or unix millis) or Request-Timeout
+// (seconds or a Go duration)
+func requestDeadline(r *http.Request) (time.Time, bool) {
+	if v := r.Header.Get("X-Request-Deadline"); v != "" {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.UnixMilli(ms), true
+		}
+	}
+	if v := r.Header.Get("Request-Timeout"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			return time.Now().Add(time.Duration(secs * float64(time.Second))), true
+		}
+		if d, err := time.ParseDuration(v); err == nil {
+			return time.Now().Add(d), true
+		}
+	}
+	return time.Time{}, false
+}
+
 func handlePaymentsSummary(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	
+	q, ok := parseSummaryQuery(w, r)
+	if !ok {
+		return
+	}
+	if q.groupBy != "" {
+		writeSummarySeries(w, r, q)
+		return
+	}
+	body, ok := readSummary(r.Context(), q)
+	if !ok {
+		writeSummaryBusy(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// Window and field selection shared by the summary endpoints
+type summaryQuery struct {
+	from, to time.Time
+	fields   fieldTree
+	groupBy  string // minute, hour, day or "" for plain totals
+	currency string // "" for DEFAULT_CURRENCY
+	sandbox  bool   // ?environment=sandbox
+}
+
+// Answers 400 itself when the query is invalid
+func parseSummaryQuery(w http.ResponseWriter, r *http.Request) (summaryQuery, bool) {
+	var q summaryQuery
+
+	// Partial response: ?fields=default.totalAmount,fallback
+	if raw := r.URL.Query().Get("fields"); raw != "" {
+		var err error
+		if q.fields, err = parseFields(canonicalFields(raw), summaryFields); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_fields", err.Error())
+			return q, false
+		}
+	}
+
 	// Parse date parameters
-	from, _ := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
-	to, _ := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
-	if from.IsZero() {
-		from = time.Unix(0, 0).UTC()
+	q.from, _ = time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+	q.to, _ = time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+	if q.from.IsZero() {
+		q.from = time.Unix(0, 0).UTC()
+	}
+
+	if raw := r.URL.Query().Get("currency"); raw != "" {
+		code, ok := acceptedCurrency(raw)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "invalid_currency", "currency "+code+" is not an accepted ISO 4217 code")
+			return q, false
+		}
+		q.currency = code
+	}
+
+	switch r.URL.Query().Get("environment") {
+	case "", "production":
+	case "sandbox":
+		if sandboxDefault == nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_environment", "no sandbox processors are configured")
+			return q, false
+		}
+		q.sandbox = true
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid_environment", "environment must be production or sandbox")
+		return q, false
 	}
+
+	if q.groupBy = r.URL.Query().Get("groupBy"); q.groupBy != "" {
+		if _, ok := summaryGroupings[q.groupBy]; !ok {
+			writeJSONError(w, http.StatusBadRequest, "invalid_group_by", "groupBy must be minute, hour or day")
+			return q, false
+		}
+	}
+	return q, true
+}
+
+// Encodes the summary under a summary slot; false when none freed up in time
+func readSummary(ctx context.Context, q summaryQuery) ([]byte, bool) {
+	// Own slot budget: heavy reporting waits here, not in front of ingest
+	if !acquireSummarySlot(ctx) {
+		metricSummaryBusy.Inc("")
+		return nil, false
+	}
+	defer func() { <-summaryLimiter }()
+
+	from, to := q.from, q.to
 	if to.IsZero() {
 		to = time.Now().UTC()
 	}
 
-	// Build response with Redis data
-	resp := PaymentsSummary{
-		Default:  getSummaryData("default", from, to),
-		Fallback: getSummaryData("fallback", from, to),
+	// Build response with Redis data, skipping what wasn't asked for
+	var resp PaymentsSummary
+	if q.currency != "" {
+		resp.Currency = q.currency
+	}
+	defaultName, fallbackName := environmentProcessor("default", q.sandbox), environmentProcessor("fallback", q.sandbox)
+	defaultBucket, fallbackBucket := currencyBucket(defaultName, q.currency), currencyBucket(fallbackName, q.currency)
+	if q.fields.has("default") {
+		resp.Default.SummaryData = store.Summary(defaultBucket, from, to)
+	}
+	if q.fields.has("fallback") {
+		resp.Fallback.SummaryData = store.Summary(fallbackBucket, from, to)
+	}
+	if redisBacked() && q.fields.has("corrections") {
+		corrections := CorrectionsSummary{
+			Default:  getCorrectionsData(defaultBucket, from, to),
+			Fallback: getCorrectionsData(fallbackBucket, from, to),
+		}
+		if corrections != (CorrectionsSummary{}) {
+			resp.Corrections = &corrections
+		}
+	}
+	if redisBacked() {
+		// Totals are net of refunds, which are also listed on their own
+		refunds := RefundsSummary{
+			Default:  getRefundsData(defaultBucket, from, to),
+			Fallback: getRefundsData(fallbackBucket, from, to),
+		}
+		if q.fields.has("default") {
+			resp.Default.TotalAmount -= refunds.Default.TotalAmount
+		}
+		if q.fields.has("fallback") {
+			resp.Fallback.TotalAmount -= refunds.Fallback.TotalAmount
+		}
+		if q.fields.has("refunds") && refunds != (RefundsSummary{}) {
+			resp.Refunds = &refunds
+		}
+	}
+	if len(feeSchedules) > 0 {
+		if q.fields.has("default") {
+			addSummaryFees(&resp.Default, defaultName, defaultBucket, from, to)
+		}
+		if q.fields.has("fallback") {
+			addSummaryFees(&resp.Fallback, fallbackName, fallbackBucket, from, to)
+		}
+	}
+
+	body, _ := jsonFast.Marshal(resp)
+	return append(aliasSummary(q.fields.shape(body)), '\n'), true
+}
+
+func writeSummaryBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	writeJSONError(w, http.StatusServiceUnavailable, "summary_busy", "too many concurrent summary requests")
+}
+
+func acquireSummarySlot(ctx context.Context) bool {
+	select {
+	case summaryLimiter <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(summaryWait)
+	defer timer.Stop()
+	select {
+	case summaryLimiter <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
 	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	_ = jsonFast.NewEncoder(w).Encode(resp)
 }
 
 // ============================================================================
 // PAYMENT PROCESSING
 // ============================================================================
 
-func processPayments(queue <-chan PostPayments) {
-	for payment := range queue {
-		payment.RequestedAt = time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+func processPayments(w *worker, queue <-chan paymentJob) {
+	time.Sleep(randomDelay(workerStartJitter))
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.leave:
+			removedProcessed.Add(w.processed.Load())
+			return
+		case job := <-queue:
+			busyWorkers.Add(1)
+			started := time.Now()
+			job.trace.AddSpan("queue wait", job.queuedAt, started)
+			processor, requeue := processPayment(withTrace(job.ctx, job.trace), w, job.PostPayments)
+			if requeue {
+				// Retired mid-payment: hand it to the replacement workers
+				paymentQueue <- job
+				busyWorkers.Add(-1)
+				return
+			}
+			walRemove(job.walID)
+			sharedAck(job.streamID)
+			job.trace.Finish(processor == "")
+			w.setState("idle", "")
+			recordJobTime(time.Since(started))
+			busyWorkers.Add(-1)
+			if job.result != nil {
+				job.result <- processor
+			}
+		}
+	}
+}
 
-		// Try default processor with retry
-		processed := false
-		for i := 0; i < 5; i++ {
-			if forwardToProcessor(payment, DEFAULT_PAYMENTS_URL) {
-				processed = true
-				break
+// Forwards one payment and records the outcome; returns the processor that
+// accepted it, or "" when it failed or ctx expired first. requeue is set when
+// the worker was retired before an outcome was reached.
+func processPayment(jobCtx context.Context, w *worker, payment PostPayments) (processor string, requeue bool) {
+	ctx, cancel := w.bind(jobCtx)
+	defer cancel()
+	if !startProcessing(ctx, payment) {
+		return paymentCancelled, false
+	}
+
+	now := time.Now().UTC()
+	at := paymentTime(payment, now)
+	payment.RequestedAt = at.Format("2006-01-02T15:04:05.000Z07:00")
+
+	primary, secondary := routeProcessors(now, payment.sandbox)
+	// A namespace confined to one processor never falls back
+	if pinned := namespaceProcessor(payment.namespace, payment.sandbox); pinned != nil {
+		primary, secondary = pinned, nil
+	}
+
+	// Try primary processor with retry; a processor reported as failing
+	// gets a single attempt instead of burning the whole retry budget
+	attempts := retries.maxAttempts
+	if !primary.Available() {
+		attempts = 1
+	}
+	outcome := forwardRetryable
+	unsure := false // A timed-out forward may have gone through
+	retrying := false
+	for i := 0; i < attempts && ctx.Err() == nil; i++ {
+		if i > 0 {
+			// Held from the first retry until the loop ends
+			if !retrying {
+				if retrying = primary.acquireRetry(); !retrying {
+					metricRetriesShed.Inc(primary.Name)
+					break
+				}
 			}
-			time.Sleep(100 * time.Millisecond)
+			w.retries.Add(1)
+			metricProcessorRetries.Inc(primary.Name)
+		}
+		w.setState("forwarding:"+primary.Name, payment.CorrelationId)
+		switch outcome = callProcessor(ctx, primary, payment); outcome {
+		case forwardTimedOut:
+			unsure = true
+		case forwardAbsent:
+			unsure = false
+		}
+		if !outcome.retryable() {
+			break
 		}
-		
-		// Save only once after processing succeeds
-		if processed {
-			saveSummaryAsync("default", payment)
-		} else if forwardToProcessor(payment, FALLBACK_PAYMENTS_URL) {
-			saveSummaryAsync("fallback", payment)
+		// Breaker just opened: go straight to the secondary
+		if i == attempts-1 || primary.breaker.Open() {
+			break
+		}
+		delay := retries.Delay(i + 1)
+		if time.Since(now)+delay > retries.maxElapsed {
+			break
+		}
+		w.log.Debug("retrying payment", "correlationId", payment.CorrelationId, "processor", primary.Name, "attempt", i+1, "delay", delay)
+		w.setState("backoff", payment.CorrelationId)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
 		}
-		// If both fail, don't save = perfect consistency
 	}
+	if retrying {
+		primary.releaseRetry()
+	}
+
+	// Save only once after processing succeeds. A 4xx from the primary
+	// still goes to the secondary, which is an independent service.
+	w.processed.Add(1)
+	if outcome == forwardAccepted {
+		w.setState("recording", payment.CorrelationId)
+		metricPaymentsProcessed.Inc(primary.Name)
+		recordSummary(ctx, primary.Name, payment)
+		publishOutcome(payment, primary.Name)
+		notifyCompletion(payment, primary.Name)
+		publishLifecycle("processed", payment, primary.Name)
+		return primary.Name, false
+	}
+	if secondary == nil {
+		w.log.Debug("no fallback for the payment's namespace", "correlationId", payment.CorrelationId, "processor", primary.Name)
+	} else if unsure {
+		// Resending to the same processor is safe (a duplicate is a 422),
+		// sending it to the other one could charge it twice
+		w.log.Warn("primary timed out and could not be verified, not falling back", "correlationId", payment.CorrelationId, "processor", primary.Name)
+	} else if ctx.Err() == nil {
+		w.fallbacks.Add(1)
+		w.log.Debug("falling back", "correlationId", payment.CorrelationId, "from", primary.Name, "processor", secondary.Name)
+		w.setState("forwarding:"+secondary.Name, payment.CorrelationId)
+		if callProcessor(ctx, secondary, payment) == forwardAccepted {
+			w.setState("recording", payment.CorrelationId)
+			metricPaymentsProcessed.Inc(secondary.Name)
+			recordSummary(ctx, secondary.Name, payment)
+			publishOutcome(payment, secondary.Name)
+			notifyCompletion(payment, secondary.Name)
+			publishLifecycle("processed", payment, secondary.Name)
+			return secondary.Name, false
+		}
+	}
+	if w.retired() && jobCtx.Err() == nil {
+		return "", true
+	}
+	// If both fail, don't save summary = perfect consistency
+	w.failures.Add(1)
+	w.log.Warn("payment failed on both processors", "correlationId", payment.CorrelationId)
+	metricPaymentsFailed.Inc("")
+	store.RecordFailure(payment)
+	publishOutcome(payment, "")
+	notifyCompletion(payment, "")
+	publishLifecycle("failed", payment, "")
+	return "", false
 }
 
-func forwardToProcessor(payment PostPayments, processorURL string) bool {
-	// Control HTTP request concurrency
-	concurrencyLimiter <- struct{}{}
-	defer func() { <-concurrencyLimiter }()
+func forwardToProcessor(ctx context.Context, p *Processor, payment PostPayments) (outcome forwardOutcome) {
+	// Control HTTP request concurrency, per processor
+	if !p.limiter.acquire(ctx) {
+		return forwardRetryable
+	}
+	start := time.Now()
+	defer func() { p.limiter.release(outcome, time.Since(start)) }()
 
 	// Use buffer pool for JSON encoding
 	buf := bufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufferPool.Put(buf)
 
-	if err := jsonFast.NewEncoder(buf).Encode(payment); err != nil {
-		return false
+	body := processorPayment{CorrelationId: payment.CorrelationId, Amount: payment.Amount, RequestedAt: payment.RequestedAt}
+	if err := jsonFast.NewEncoder(buf).Encode(body); err != nil {
+		return forwardRejected
 	}
 
 	// Make HTTP request to processor (URL already includes /payments)
-	req, _ := http.NewRequest("POST", processorURL, buf)
+	req, _ := http.NewRequestWithContext(ctx, "POST", p.PaymentsURL(), buf)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := httpClient.Do(req)
+	resp, err := p.client.Do(req)
 	if err != nil {
-		return false
+		var netErr net.Error
+		if ctx.Err() == nil && errors.As(err, &netErr) && netErr.Timeout() {
+			return forwardTimedOut
+		}
+		return forwardRetryable
 	}
 	defer resp.Body.Close()
-	
-	return resp.StatusCode == http.StatusOK
+
+	return classifyStatus(resp.StatusCode)
 }
 
 // ============================================================================
 // SUMMARY SYSTEM (REPORTS)
 // ============================================================================
 
+// Hands the write to the summary writer pool
 func saveSummaryAsync(processor string, payment PostPayments) {
+	summaryWriter.Enqueue(processor, payment)
+}
+
+// Writes summary data, history and the payment status in one atomic script,
+// so status and summary can never disagree after a partial failure. Every
+// record carries the instance that wrote it; summary:<processor>:instances
+// counts payments per instance to expose load imbalance.
+//
+// History members and data fields are UUIDv7 record keys rather than
+// correlationIds, so equal-millisecond entries still sort by creation and
+// range scans walk keys in time order; summary:<processor>:ids maps them back.
+// A payment recorded twice reuses its first key. Data fields hold integer
+// cents; the status keeps the decimal form. Payments in a currency other
+// than DEFAULT_CURRENCY go to their own keys (see currencyBucket), and their
+// status carries the currency.
+var recordPaymentScript = redis.NewScript(`
+local key = redis.call('HGET', KEYS[3], 'record') or ARGV[8]
+redis.call('HSET', KEYS[1], key, ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[3], key)
+redis.call('HSET', KEYS[5], key, ARGV[1])
+redis.call('HSET', KEYS[3], 'state', ARGV[4], 'processor', ARGV[5], 'amount', ARGV[9], 'requestedAt', ARGV[6], 'instance', ARGV[7], 'record', key)
+if ARGV[10] ~= '' then
+  redis.call('HSET', KEYS[3], 'currency', ARGV[10])
+end
+redis.call('HINCRBY', KEYS[4], ARGV[7], 1)
+return 1
+`)
+
+func saveSummary(processor string, payment PostPayments) {
+	defer metricRedisLatency.Since("record_payment", time.Now())
+	if redisCluster {
+		saveClusterSummaries([]summaryJob{{processor: processor, payment: payment}})
+		return
+	}
+	keys, args := recordPaymentArgs(processor, payment)
+	_ = recordScript().Run(context.Background(), redisClient, keys, args...).Err()
+}
+
+// Records a batch in one pipeline of EVALSHAs. If Redis lost the script
+// (restart, SCRIPT FLUSH) nothing in the pipeline ran: load it and resend.
+func saveSummaries(batch []summaryJob) {
 	ctx := context.Background()
+	defer metricRedisLatency.Since("record_batch", time.Now())
+	if redisCluster {
+		saveClusterSummaries(batch)
+		return
+	}
+	send := func() error {
+		_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, job := range batch {
+				keys, args := recordPaymentArgs(job.processor, job.payment)
+				recordScript().EvalSha(ctx, pipe, keys, args...)
+			}
+			return nil
+		})
+		return err
+	}
+	if err := send(); err != nil && redis.HasErrorPrefix(err, "NOSCRIPT") {
+		if recordScript().Load(ctx, redisClient).Err() == nil {
+			_ = send()
+		}
+	}
+}
+
+func recordPaymentArgs(processor string, payment PostPayments) ([]string, []interface{}) {
 	ts, _ := time.Parse("2006-01-02T15:04:05.000Z07:00", payment.RequestedAt)
-	
-	pipe := redisClient.Pipeline()
-	pipe.HSet(ctx, "summary:"+processor+":data", payment.CorrelationId, payment.Amount)
-	pipe.ZAdd(ctx, "summary:"+processor+":history", redis.Z{
-		Score:  float64(ts.UnixMilli()),
-		Member: payment.CorrelationId,
+	shard := shardFor(payment.CorrelationId)
+	bucket := currencyBucket(processor, payment.Currency)
+	return withLedgerArgs(processor, bucket, []string{
+		summaryKey(bucket, "data", shard),
+		summaryKey(bucket, "history", shard),
+		"status:" + payment.CorrelationId,
+		summaryPrefix(processor) + ":instances",
+		summaryKey(bucket, "ids", shard),
+	}, []interface{}{
+		payment.CorrelationId,
+		payment.Amount.Raw(),
+		ts.UnixMilli(),
+		"processed-" + processor,
+		processor,
+		payment.RequestedAt,
+		INSTANCE_ID,
+		newUUIDv7(),
+		payment.Amount.String(),
+		payment.Currency,
 	})
-	_, _ = pipe.Exec(ctx)
 }
 
-// Direct Redis processing for consistency
-
-func getSummaryData(processor string, from, to time.Time) SummaryData {
+// Records a payment rejected by both processors (status and dead letter,
+// no summary)
+func saveFailedStatus(payment PostPayments) {
 	ctx := context.Background()
-	result := SummaryData{}
+	defer metricRedisLatency.Since("record_failure", time.Now())
+	_, _ = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, "status:"+payment.CorrelationId,
+			"state", "failed",
+			"amount", payment.Amount.String(),
+			"requestedAt", payment.RequestedAt,
+			"instance", INSTANCE_ID,
+		)
+		pipe.XAdd(ctx, deadLetterArgs(payment))
+		return nil
+	})
+	publishLifecycle("dead_lettered", payment, "")
+}
+
+// Summary key for a processor, suffixed with the shard when sharding is on
+func summaryKey(processor, kind string, shard int) string {
+	key := summaryPrefix(processor) + ":" + kind
+	if historyShards > 1 {
+		key += ":" + strconv.Itoa(shard)
+	}
+	return key
+}
 
-	// Get payment IDs in time range
-	ids, _ := redisClient.ZRangeByScore(ctx, "summary:"+processor+":history", &redis.ZRangeBy{
-		Min: fmt.Sprint(from.UnixMilli()),
-		Max: fmt.Sprint(to.UnixMilli()),
-	}).Result()
+// Shard owning a correlationId
+func shardFor(correlationId string) int {
+	if historyShards <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(correlationId))
+	return int(h.Sum32() % uint32(historyShards))
+}
 
-	if len(ids) == 0 {
-		return result
+// Fans the query out to every shard and merges the partial results
+func getSummaryData(processor string, from, to time.Time) SummaryData {
+	shards := historyShards
+	if shards < 1 {
+		shards = 1
 	}
+	partials := make([]SummaryData, shards)
 
-	// Get payment amounts
-	vals, _ := redisClient.HMGet(ctx, "summary:"+processor+":data", ids...).Result()
-	for _, val := range vals {
-		if v, ok := val.(string); ok {
-			if amount, err := strconv.ParseFloat(v, 64); err == nil {
-				result.TotalAmount += amount
-				result.TotalRequests++
-			}
-		}
+	var wg sync.WaitGroup
+	for shard := 0; shard < shards; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			partials[shard] = getShardSummary(processor, shard, from, to)
+		}(shard)
+	}
+	wg.Wait()
+
+	result := SummaryData{}
+	for _, partial := range partials {
+		result.TotalRequests += partial.TotalRequests
+		result.TotalAmount += partial.TotalAmount
 	}
-	
-	// Round to 2 decimal places
-	result.TotalAmount = math.Round(result.TotalAmount*100) / 100
 	return result
 }
 
+// Counts and sums a history window server side, so only two integers cross
+// the network. HMGET goes in chunks to stay under Lua's unpack limit; sums
+// are exact while below 2^53 cents.
+// KEYS: history, data. ARGV: min score, max score.
+var summaryScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[2])
+local count, total = 0, 0
+for i = 1, #ids, 1000 do
+	local vals = redis.call('HMGET', KEYS[2], unpack(ids, i, math.min(i + 999, #ids)))
+	for _, v in ipairs(vals) do
+		local cents = v and tonumber(v)
+		if cents then
+			count = count + 1
+			total = total + cents
+		end
+	end
+end
+return {count, string.format('%.0f', total)}
+`)
+
+func getShardSummary(processor string, shard int, from, to time.Time) SummaryData {
+	defer metricRedisLatency.Since("summary_shard", time.Now())
+	keys := []string{summaryKey(processor, "history", shard), summaryKey(processor, "data", shard)}
+	return runSummaryScript(summaryScript, keys, from, to)
+}
+
+// Decodes the {count, "total"} reply shared by the summary scripts
+func runSummaryScript(script *redis.Script, keys []string, from, to time.Time) SummaryData {
+	reply, err := script.Run(context.Background(), readClient(), keys, from.UnixMilli(), to.UnixMilli()).Slice()
+	if err != nil || len(reply) != 2 {
+		return SummaryData{}
+	}
+	count, _ := reply[0].(int64)
+	total, _ := reply[1].(string)
+	amount, _ := parseRawCents(total)
+	return SummaryData{TotalRequests: count, TotalAmount: amount}
+}
+
 // ============================================================================
 // UTILITIES
 // ============================================================================
 
+// Picks a summary client round-robin (the primary until setup has run)
+func readClient() redis.UniversalClient {
+	if len(readClients) == 0 {
+		return redisClient
+	}
+	return readClients[readCursor.Add(1)%uint64(len(readClients))]
+}
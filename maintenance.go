@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// MAINTENANCE MODE (POST /admin/maintenance)
+// ============================================================================
+
+const maintenanceKey = "gateway:maintenance"
+
+var (
+	maintenanceDefault time.Duration
+	maintenance        atomic.Pointer[maintenanceNotice]
+
+	maintenanceLog = componentLogger("maintenance")
+)
+
+// Active maintenance, as stored in Redis so every instance of a shared
+// deployment enters and leaves it together
+type maintenanceNotice struct {
+	Message string    `json:"message"`
+	Until   time.Time `json:"until"`
+}
+
+// Body of POST /admin/maintenance
+type maintenanceRequest struct {
+	Enabled  bool   `json:"enabled"`
+	Duration string `json:"duration"` // Go duration, MAINTENANCE_DURATION if empty
+	Message  string `json:"message"`
+}
+
+// defaultDuration (MAINTENANCE_DURATION) is how long maintenance lasts when
+// the request gives no duration; it always ends on its own
+func startMaintenance(defaultDuration time.Duration) {
+	maintenanceDefault = defaultDuration
+	if !redisBacked() {
+		return
+	}
+	refreshMaintenance()
+	go func() {
+		for {
+			time.Sleep(jittered(time.Second))
+			refreshMaintenance()
+		}
+	}()
+}
+
+// Picks up maintenance started or ended through another instance; the
+// key's TTL is the end of the window
+func refreshMaintenance() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, err := redisClient.Get(ctx, maintenanceKey).Result()
+	switch {
+	case err == redis.Nil:
+		setMaintenance(nil)
+	case err != nil:
+		// Keep the current state; it still ends on its own
+	default:
+		var n maintenanceNotice
+		if jsonFast.UnmarshalFromString(data, &n) == nil {
+			setMaintenance(&n)
+		}
+	}
+}
+
+func setMaintenance(n *maintenanceNotice) {
+	if old := maintenance.Swap(n); (old == nil) != (n == nil) {
+		if n != nil {
+			maintenanceLog.Warn("maintenance started, refusing payments", "until", n.Until.Format(time.RFC3339), "message", n.Message)
+		} else {
+			maintenanceLog.Info("maintenance ended, accepting payments")
+		}
+	}
+}
+
+// Notice in effect, nil outside maintenance or once its window has passed
+func activeMaintenance() *maintenanceNotice {
+	n := maintenance.Load()
+	if n == nil || !time.Now().Before(n.Until) {
+		return nil
+	}
+	return n
+}
+
+// 503 for a payment arriving during maintenance, or nil
+func checkMaintenance() *ingestResponse {
+	n := activeMaintenance()
+	if n == nil {
+		return nil
+	}
+	metricPaymentsRejected.Inc("maintenance")
+	return &ingestResponse{status: http.StatusServiceUnavailable, retryAfter: n.retryAfter(), body: n.body()}
+}
+
+// Seconds until the window ends, at least 1
+func (n *maintenanceNotice) retryAfter() int {
+	if s := int(time.Until(n.Until).Seconds()) + 1; s > 1 {
+		return s
+	}
+	return 1
+}
+
+func (n *maintenanceNotice) body() []byte {
+	body, _ := jsonFast.Marshal(map[string]string{
+		"error":   "maintenance",
+		"message": n.Message,
+		"until":   n.Until.UTC().Format(time.RFC3339),
+	})
+	return append(body, '\n')
+}
+
+// GET /admin/maintenance - Current state
+// POST /admin/maintenance - {"enabled":true,"duration":"10m","message":"..."}
+// starts it (or moves its end), {"enabled":false} ends it
+func handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req maintenanceRequest
+		if err := jsonFast.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", "body must be a maintenance request object")
+			return
+		}
+		var n *maintenanceNotice
+		if req.Enabled {
+			d := maintenanceDefault
+			if req.Duration != "" {
+				var err error
+				if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+					writeJSONError(w, http.StatusBadRequest, "invalid_duration", "duration must be a positive Go duration, e.g. 10m")
+					return
+				}
+			}
+			if req.Message == "" {
+				req.Message = "payments are paused for maintenance, retry later"
+			}
+			n = &maintenanceNotice{Message: req.Message, Until: time.Now().Add(d).UTC()}
+		}
+		if err := saveMaintenance(r.Context(), n); err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, "store_unavailable", err.Error())
+			return
+		}
+		setMaintenance(n)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	state := map[string]interface{}{"enabled": false}
+	if n := activeMaintenance(); n != nil {
+		state = map[string]interface{}{"enabled": true, "message": n.Message, "until": n.Until.Format(time.RFC3339)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(state)
+}
+
+func saveMaintenance(ctx context.Context, n *maintenanceNotice) error {
+	if !redisBacked() {
+		return nil
+	}
+	if n == nil {
+		return redisClient.Del(ctx, maintenanceKey).Err()
+	}
+	data, _ := jsonFast.Marshal(n)
+	return redisClient.Set(ctx, maintenanceKey, data, time.Until(n.Until)).Err()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// METRICS
+// ============================================================================
+
+var (
+	latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+	metricPaymentsReceived  = newCounterVec("gateway_payments_received_total", "POST /payments requests received.", "")
+	metricPaymentsQueued    = newCounterVec("gateway_payments_queued_total", "Payments accepted into the processing queue.", "")
+	metricPaymentsRejected  = newCounterVec("gateway_payments_rejected_total", "Payments rejected at ingest.", "reason")
+	metricPaymentsProcessed = newCounterVec("gateway_payments_processed_total", "Payments accepted by a processor.", "processor")
+	metricPaymentsFailed    = newCounterVec("gateway_payments_failed_total", "Payments rejected by every processor.", "")
+	metricProcessorRetries  = newCounterVec("gateway_processor_retries_total", "Retried processor calls.", "processor")
+	metricRetriesShed       = newCounterVec("gateway_processor_retries_shed_total", "Retries skipped because the processor's retry slots were full.", "processor")
+	metricSummaryBusy       = newCounterVec("gateway_summary_busy_total", "Summary requests refused for lack of a slot.", "")
+	metricProcessorLatency  = newHistogramVec("gateway_processor_request_seconds", "Processor request latency.", "processor", latencyBuckets)
+	metricRedisLatency      = newHistogramVec("gateway_redis_seconds", "Redis command/pipeline latency.", "operation", latencyBuckets)
+
+	allCounters   = []*counterVec{metricPaymentsReceived, metricPaymentsQueued, metricPaymentsRejected, metricPaymentsProcessed, metricPaymentsFailed, metricProcessorRetries, metricRetriesShed, metricTraces, metricEventsDropped, metricBrownouts, metricSummaryBusy, metricVerifications, metricWorkerScaling, metricSpawnRefused, metricTenantRateLimited, metricAlertFailures, metricCallbacks, metricLifecycleEvents, metricLoadShed, metricShedEntered, metricPaymentsCancelled, metricIngestMessages}
+	allHistograms = []*histogramVec{metricProcessorLatency, metricRedisLatency, metricSummaryBatch}
+)
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, c := range allCounters {
+		c.write(w)
+	}
+	for _, h := range allHistograms {
+		h.write(w)
+	}
+
+	writeGauge(w, "gateway_queue_depth", "Payments waiting in the processing queue.", "", float64(len(paymentQueue)))
+	writeGauge(w, "gateway_queue_capacity", "Processing queue capacity.", "", float64(cap(paymentQueue)))
+	writeQueueStatsMetrics(w)
+	writeGauge(w, "gateway_goroutines", "Goroutines running.", "", float64(runtime.NumGoroutine()))
+	writeGauge(w, "gateway_goroutine_budget", "Goroutines beyond which async work is refused (0 unlimited).", "", float64(goroutineBudget))
+	writeGauge(w, "gateway_open_fds", "File descriptors open at the last sample (-1 unknown).", "", float64(openFDCount.Load()))
+	writeGauge(w, "gateway_fd_budget", "Open descriptors beyond which async work is refused (0 unlimited).", "", float64(fdBudget))
+	writeGauge(w, "gateway_workers", "Workers in the pool.", "", float64(workerCount()))
+	writeGauge(w, "gateway_workers_busy", "Workers currently holding a payment.", "", float64(busyWorkers.Load()))
+
+	strict, eventual := 0.0, 0.0
+	if consistencyMode == "strict" {
+		strict = 1
+	} else {
+		eventual = 1
+	}
+	writeHeader(w, "gateway_consistency_mode", "Active summary consistency mode.", "gauge")
+	writeSample(w, "gateway_consistency_mode", `mode="strict"`, strict)
+	writeSample(w, "gateway_consistency_mode", `mode="eventual"`, eventual)
+
+	brownout := 0.0
+	if brownedOut.Load() {
+		brownout = 1
+	}
+	writeGauge(w, "gateway_brownout", "1 while non-essential work is shed.", "", brownout)
+
+	shed := 0.0
+	if loadShedding.Load() {
+		shed = 1
+	}
+	writeGauge(w, "gateway_load_shedding", "1 while payments are answered 503 above the queue high watermark.", "", shed)
+
+	writeGauge(w, "gateway_summary_lag_seconds", "Delay between processing and summary write.", "", summaryWriter.Lag().Seconds())
+	writeGauge(w, "gateway_summary_pending", "Summaries waiting to be written.", "", float64(summaryWriter.Pending()))
+
+	writeHeader(w, "gateway_breaker_state", "Circuit breaker state per processor (0 closed, 1 open, 2 half-open).", "gauge")
+	for _, p := range processors {
+		writeSample(w, "gateway_breaker_state", `processor="`+p.Name+`"`, float64(p.breaker.State()))
+	}
+
+	writeHeader(w, "gateway_processor_concurrency_limit", "Forwards allowed in flight per processor.", "gauge")
+	for _, p := range processors {
+		writeSample(w, "gateway_processor_concurrency_limit", `processor="`+p.Name+`"`, float64(p.limiter.limit()))
+	}
+	writeHeader(w, "gateway_processor_in_flight", "Forwards in flight per processor.", "gauge")
+	for _, p := range processors {
+		writeSample(w, "gateway_processor_in_flight", `processor="`+p.Name+`"`, float64(p.limiter.inFlight()))
+	}
+
+	writeHeader(w, "gateway_processor_retries_in_flight", "Payments in a retry loop per processor.", "gauge")
+	for _, p := range processors {
+		writeSample(w, "gateway_processor_retries_in_flight", `processor="`+p.Name+`"`, float64(len(p.retrySlots)))
+	}
+}
+
+// Label set for one series; every series carries the instance id
+func labels(extra string) string {
+	if extra == "" {
+		return `{instance_id="` + INSTANCE_ID + `"}`
+	}
+	return `{instance_id="` + INSTANCE_ID + `",` + extra + `}`
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name, extraLabels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels(extraLabels), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func writeGauge(w io.Writer, name, help, extraLabels string, value float64) {
+	writeHeader(w, name, help, "gauge")
+	writeSample(w, name, extraLabels, value)
+}
+
+// ----------------------------------------------------------------------------
+// Counters
+// ----------------------------------------------------------------------------
+
+// Counter family with at most one label; series are created on first use
+type counterVec struct {
+	name, help, label string
+	series            sync.Map // label value -> *atomic.Int64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label}
+}
+
+// Inc adds one to the series; pass "" for unlabeled counters
+func (c *counterVec) Inc(value string) {
+	c.Add(value, 1)
+}
+
+func (c *counterVec) Add(value string, n int64) {
+	v, ok := c.series.Load(value)
+	if !ok {
+		v, _ = c.series.LoadOrStore(value, new(atomic.Int64))
+	}
+	v.(*atomic.Int64).Add(n)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	for _, value := range sortedKeys(&c.series) {
+		v, _ := c.series.Load(value)
+		writeSample(w, c.name, labelPair(c.label, value), float64(v.(*atomic.Int64).Load()))
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Histograms
+// ----------------------------------------------------------------------------
+
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+	series            sync.Map // label value -> *histogram
+}
+
+type histogram struct {
+	counts  []atomic.Uint64 // One per bucket plus +Inf
+	sumBits atomic.Uint64   // float64 bits of the running sum
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets}
+}
+
+func (h *histogramVec) Observe(value string, seconds float64) {
+	v, ok := h.series.Load(value)
+	if !ok {
+		v, _ = h.series.LoadOrStore(value, &histogram{counts: make([]atomic.Uint64, len(h.buckets)+1)})
+	}
+	hist := v.(*histogram)
+	hist.counts[sort.SearchFloat64s(h.buckets, seconds)].Add(1)
+	for {
+		old := hist.sumBits.Load()
+		if hist.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+seconds)) {
+			return
+		}
+	}
+}
+
+// Since observes the time elapsed since start
+func (h *histogramVec) Since(value string, start time.Time) {
+	h.Observe(value, time.Since(start).Seconds())
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, value := range sortedKeys(&h.series) {
+		v, _ := h.series.Load(value)
+		hist := v.(*histogram)
+		pair := labelPair(h.label, value)
+		if pair != "" {
+			pair += ","
+		}
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i].Load()
+			writeSample(w, h.name+"_bucket", pair+`le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`, float64(cumulative))
+		}
+		cumulative += hist.counts[len(h.buckets)].Load()
+		writeSample(w, h.name+"_bucket", pair+`le="+Inf"`, float64(cumulative))
+		writeSample(w, h.name+"_sum", labelPair(h.label, value), math.Float64frombits(hist.sumBits.Load()))
+		writeSample(w, h.name+"_count", labelPair(h.label, value), float64(cumulative))
+	}
+}
+
+func labelPair(label, value string) string {
+	if label == "" {
+		return ""
+	}
+	return label + `="` + value + `"`
+}
+
+func sortedKeys(m *sync.Map) []string {
+	var keys []string
+	m.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// MONEY
+// ============================================================================
+
+// Amount in integer cents. JSON and the human-readable status fields carry
+// it as a decimal ("19.90"); summaries add cents, so totals never drift.
+type Cents int64
+
+// Parses a decimal amount exactly, without going through float64. More
+// than two fractional digits is an error rather than a silent rounding.
+func parseCents(s string) (Cents, error) {
+	raw := s
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, _ := strings.Cut(s, ".")
+	frac = strings.TrimRight(frac, "0")
+	if whole == "" || len(frac) > 2 || strings.ContainsAny(whole+frac, "+-eE") {
+		return 0, fmt.Errorf("invalid amount %q", raw)
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > (1<<63-1)/100-1 {
+		return 0, fmt.Errorf("invalid amount %q", raw)
+	}
+	cents := int64(0)
+	if frac != "" {
+		if cents, err = strconv.ParseInt((frac + "0")[:2], 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid amount %q", raw)
+		}
+	}
+	total := Cents(units*100 + cents)
+	if negative {
+		total = -total
+	}
+	return total, nil
+}
+
+func (c Cents) String() string {
+	sign := ""
+	if c < 0 {
+		sign, c = "-", -c
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, c/100, c%100)
+}
+
+func (c Cents) MarshalJSON() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Cents) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	parsed, err := parseCents(string(data))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// Redis hash representation of a summary amount
+func (c Cents) Raw() string {
+	return strconv.FormatInt(int64(c), 10)
+}
+
+func parseRawCents(s string) (Cents, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	return Cents(n), err
+}
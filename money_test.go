@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestParseCents(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Cents
+		ok   bool
+	}{
+		{"19.90", 1990, true},
+		{"19.9", 1990, true},
+		{"19", 1900, true},
+		{"19.", 1900, true},
+		{"0.01", 1, true},
+		{"0.0", 0, true},
+		{"0", 0, true},
+		{"-0.0", 0, true},
+		{"-1.50", -150, true},
+		// Trailing zeros past the cents are not precision
+		{"1.500", 150, true},
+		{"92233720368547757.99", 9223372036854775799, true},
+
+		{"1.999", 0, false},
+		{"0.001", 0, false},
+		{"+1", 0, false},
+		{"+1.00", 0, false},
+		{"--1", 0, false},
+		{"1.-5", 0, false},
+		{"1.+5", 0, false},
+		{"1e3", 0, false},
+		{"1E3", 0, false},
+		{"1.5e2", 0, false},
+		{"92233720368547758", 0, false},
+		{"9223372036854775807", 0, false},
+		{"99999999999999999999", 0, false},
+		{"", 0, false},
+		{"-", 0, false},
+		{".", 0, false},
+		{".50", 0, false},
+		{"-.50", 0, false},
+		{" 1", 0, false},
+		{"1_000", 0, false},
+		{"0x10", 0, false},
+		{"1,50", 0, false},
+		{`"1.50"`, 0, false},
+	}
+	for _, c := range cases {
+		got, err := parseCents(c.in)
+		if c.ok && (err != nil || got != c.want) {
+			t.Errorf("parseCents(%q) = %d, %v; want %d", c.in, got, err, c.want)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("parseCents(%q) = %d; want an error", c.in, got)
+		}
+	}
+}
+
+func TestCentsString(t *testing.T) {
+	cases := []struct {
+		in   Cents
+		want string
+	}{
+		{0, "0.00"},
+		{1, "0.01"},
+		{1990, "19.90"},
+		{-150, "-1.50"},
+		{-5, "-0.05"},
+	}
+	for _, c := range cases {
+		if got := c.in.String(); got != c.want {
+			t.Errorf("Cents(%d).String() = %q, want %q", int64(c.in), got, c.want)
+		}
+		if back, err := parseCents(c.want); err != nil || back != c.in {
+			t.Errorf("parseCents(%q) = %d, %v; want %d", c.want, back, err, int64(c.in))
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// ============================================================================
+// CORRELATION ID NAMESPACES
+// ============================================================================
+
+var (
+	NAMESPACE_HEADER = getEnv("NAMESPACE_HEADER", "")
+
+	// Set by setupInfrastructure
+	namespaceTenants    map[string]string
+	namespaceProcessors map[string]string
+)
+
+type NamespaceConfig struct {
+	// Namespace -> tenant and namespace -> processor, e.g. "e1:erp,c2:crm"
+	// and "e1:default,0000:fallback". A payment's namespace is the value of
+	// NAMESPACE_HEADER when that names one, else the longest of these keys
+	// its correlationId (a UUID, so hex digits) starts with, so upstream
+	// systems sharing a deployment can be told apart without API keys of
+	// their own.
+	Tenants    map[string]string
+	Processors map[string]string
+}
+
+func loadNamespaceConfig(env *envParser) NamespaceConfig {
+	c := NamespaceConfig{
+		Tenants:    parseKeyValues(os.Getenv("NAMESPACE_TENANTS")),
+		Processors: parseKeyValues(os.Getenv("NAMESPACE_PROCESSORS")),
+	}
+	for ns, processor := range c.Processors {
+		if ns == "" || (processor != "default" && processor != "fallback") {
+			env.fail("NAMESPACE_PROCESSORS", ns+":"+processor, "entries map a namespace to default or fallback")
+		}
+	}
+	for ns, tenant := range c.Tenants {
+		if ns == "" || !tenantNamePattern.MatchString(tenant) {
+			env.fail("NAMESPACE_TENANTS", ns+":"+tenant, "entries map a namespace to a tenant name")
+		}
+	}
+	return c
+}
+
+// Namespace of a payment ("" for none): the header value when it is a
+// configured namespace, else the longest matching correlationId prefix
+func paymentNamespace(header, correlationId string) string {
+	if header != "" && namespaceKnown(header) {
+		return header
+	}
+	id, best := strings.ToLower(correlationId), ""
+	for _, m := range []map[string]string{namespaceTenants, namespaceProcessors} {
+		for ns := range m {
+			if len(ns) > len(best) && strings.HasPrefix(id, strings.ToLower(ns)) {
+				best = ns
+			}
+		}
+	}
+	return best
+}
+
+func namespaceKnown(ns string) bool {
+	_, tenant := namespaceTenants[ns]
+	_, processor := namespaceProcessors[ns]
+	return tenant || processor
+}
+
+// Processor a namespace is confined to, in the payment's environment; nil
+// routes as usual
+func namespaceProcessor(ns string, sandbox bool) *Processor {
+	def, fb := environmentProcessors(sandbox)
+	switch namespaceProcessors[ns] {
+	case "default":
+		return def
+	case "fallback":
+		return fb
+	}
+	return nil
+}
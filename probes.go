@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ============================================================================
+// LIVENESS AND READINESS PROBES
+// ============================================================================
+
+type readiness struct {
+	Status string `json:"status"` // ready, degraded or not_ready
+	Redis  string `json:"redis"`  // ok, disabled or the ping error
+	// Workers running, 0 until startup has launched them
+	Workers       int  `json:"workers"`
+	QueueDepth    int  `json:"queueDepth"`
+	QueueCapacity int  `json:"queueCapacity"`
+	Draining      bool `json:"draining,omitempty"`
+	Brownout      bool `json:"brownout,omitempty"`
+	// Payments are refused but summaries served, so the instance stays ready
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+// GET /healthz - the process is up and serving HTTP. A brownout is still
+// healthy, but flagged in the body and the X-Brownout header.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if brownedOut.Load() {
+		w.Header().Set("X-Brownout", "true")
+		_, _ = w.Write([]byte("ok brownout\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// GET /readyz - 200 when ready; 503 when Redis is unreachable, no worker is
+// running, the instance is draining, or the queue is above queueWatermark%
+// of capacity (READY_QUEUE_WATERMARK; degraded: still working, but new
+// traffic is better sent elsewhere). In shared mode the depth is the
+// stream's backlog.
+func handleReadyz(queueWatermark int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready := readiness{
+			Status:        "ready",
+			Redis:         "disabled",
+			Workers:       workerCount(),
+			QueueDepth:    queueBacklog(),
+			QueueCapacity: cap(paymentQueue),
+			Draining:      draining.Load(),
+			Brownout:      brownedOut.Load(),
+			Maintenance:   activeMaintenance() != nil,
+		}
+		if redisBacked() {
+			ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+			defer cancel()
+			ready.Redis = "ok"
+			if err := redisClient.Ping(ctx).Err(); err != nil {
+				ready.Redis = err.Error()
+			}
+		}
+
+		switch {
+		case ready.Redis != "ok" && ready.Redis != "disabled", ready.Workers == 0, ready.Draining:
+			ready.Status = "not_ready"
+		case ready.QueueDepth*100 >= ready.QueueCapacity*queueWatermark:
+			ready.Status = "degraded"
+		}
+
+		status := http.StatusOK
+		if ready.Status != "ready" {
+			status = http.StatusServiceUnavailable
+		}
+		body, _ := jsonFast.Marshal(ready)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// PROCESSORS
+// ============================================================================
+
+var (
+	// Built by setupProcessors
+	defaultProcessor  *Processor
+	fallbackProcessor *Processor
+	processors        []*Processor
+
+	// Prefer the other processor when the first choice is at least slowMs
+	// (HEALTH_SLOW_MS) and latencyFactor times (HEALTH_LATENCY_FACTOR) as
+	// slow, so small absolute gaps never reroute; set by setupProcessors
+	slowMs, latencyFactor int
+
+	// Where this instance runs; processors are labelled the same way with
+	// PAYMENT_PROCESSOR_<NAME>_ZONE/_REGION for zone-affine routing
+	GATEWAY_ZONE   = getEnv("GATEWAY_ZONE", "")
+	GATEWAY_REGION = getEnv("GATEWAY_REGION", "")
+)
+
+// Payment processor endpoint; URL and weight can change at runtime
+type Processor struct {
+	Name string
+
+	baseURL     atomic.Pointer[string]
+	paymentsURL atomic.Pointer[string] // Pre-compiled for the hot path
+	weight      atomic.Int64
+
+	// Cached from GET /payments/health
+	failing         atomic.Bool
+	minResponseTime atomic.Int64 // Milliseconds
+
+	breaker *circuitBreaker
+	client  *http.Client       // Forwards and health checks
+	limiter concurrencyLimiter // Forwards in flight
+	// Payments in a retry loop; one that finds it full stops retrying here
+	retrySlots chan struct{}
+
+	zone, region string
+	stats        routeStats // Fed by callProcessor for score routing
+}
+
+func newProcessor(name string, cfg ProcessorConfig, breaker BreakerConfig, limiter LimiterConfig) *Processor {
+	p := &Processor{
+		Name:       name,
+		breaker:    newCircuitBreaker(breaker),
+		client:     newProcessorClient(cfg),
+		retrySlots: make(chan struct{}, cfg.MaxRetries),
+		zone:       cfg.Zone,
+		region:     cfg.Region,
+	}
+	p.limiter = newConcurrencyLimiter(p, cfg.MaxConcurrency, limiter)
+	p.SetURL(cfg.URL)
+	p.weight.Store(int64(cfg.Weight))
+	return p
+}
+
+// Claims a retry slot without waiting; false when the processor already has
+// MaxRetries payments retrying, so a storm leaves room for first attempts
+func (p *Processor) acquireRetry() bool {
+	select {
+	case p.retrySlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Processor) releaseRetry() {
+	<-p.retrySlots
+}
+
+func setupProcessors(cfg Config) {
+	defaultProcessor = newProcessor("default", cfg.Default, cfg.Breaker, cfg.Limiter)
+	fallbackProcessor = newProcessor("fallback", cfg.Fallback, cfg.Breaker, cfg.Limiter)
+	processors = []*Processor{defaultProcessor, fallbackProcessor}
+	slowMs, latencyFactor = cfg.Health.SlowMs, cfg.Health.LatencyFactor
+	setupSandbox(cfg)
+}
+
+// Processor transport. Dialing follows the IP family; proxies come from
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY unless the processor has its own proxy URL
+// or "direct". Requests carry the static headers, and are signed when the
+// processor has a signing secret.
+func newProcessorClient(cfg ProcessorConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newProcessorDialer(cfg)
+	transport.MaxConnsPerHost = cfg.MaxConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConns
+	transport.IdleConnTimeout = cfg.IdleConnTimeout
+	switch cfg.Proxy {
+	case "":
+		transport.Proxy = http.ProxyFromEnvironment
+	case "direct":
+		transport.Proxy = nil
+	default:
+		// Checked by loadConfig
+		proxyURL, _ := url.Parse(cfg.Proxy)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{Timeout: cfg.Timeout, Transport: newHeaderTransport(cfg, transport)}
+}
+
+// Adds the processor's User-Agent, static headers and signature to every
+// request
+type headerTransport struct {
+	next    http.RoundTripper
+	headers http.Header
+
+	secret          []byte
+	signatureHeader string
+}
+
+func newHeaderTransport(cfg ProcessorConfig, next http.RoundTripper) http.RoundTripper {
+	if len(cfg.Headers) == 0 && cfg.SigningSecret == "" {
+		return next
+	}
+	return &headerTransport{
+		next:            next,
+		headers:         cfg.Headers,
+		secret:          []byte(cfg.SigningSecret),
+		signatureHeader: cfg.SignatureHeader,
+	}
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	for key, values := range t.headers {
+		req.Header[key] = values
+	}
+	if len(t.secret) > 0 {
+		if err := t.sign(req); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// Sets "t=<unix>,v1=<hex>" with v1 = HMAC-SHA256(secret, "<t>.<body>"),
+// the webhook scheme minus the delivery id. Health checks sign an empty body.
+func (t *headerTransport) sign(req *http.Request) error {
+	var body []byte
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	req.Header.Set(t.signatureHeader, "t="+ts+",v1="+hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+func (p *Processor) BaseURL() string     { return *p.baseURL.Load() }
+func (p *Processor) PaymentsURL() string { return *p.paymentsURL.Load() }
+func (p *Processor) Weight() int         { return int(p.weight.Load()) }
+
+func (p *Processor) SetURL(baseURL string) {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	paymentsURL := baseURL + "/payments"
+	p.baseURL.Store(&baseURL)
+	p.paymentsURL.Store(&paymentsURL)
+}
+
+func (p *Processor) SetWeight(weight int) {
+	p.weight.Store(int64(weight))
+}
+
+func (p *Processor) Healthy() bool        { return !p.failing.Load() }
+func (p *Processor) MinResponseTime() int { return int(p.minResponseTime.Load()) }
+
+// Distance from this instance: 0 same zone, 1 same region, 2 elsewhere.
+// Missing labels on either side count as local.
+func (p *Processor) Locality() int {
+	switch {
+	case p.zone == "" && p.region == "", GATEWAY_ZONE == "" && GATEWAY_REGION == "":
+		return 0
+	case p.zone != "" && p.zone == GATEWAY_ZONE:
+		return 0
+	case p.region == "" || GATEWAY_REGION == "" || p.region == GATEWAY_REGION:
+		return 1
+	}
+	return 2
+}
+
+// Healthy and not short-circuited by its breaker
+func (p *Processor) Available() bool {
+	return p.Healthy() && !p.breaker.Open()
+}
+
+func (p *Processor) setHealth(h processorHealth) {
+	p.failing.Store(h.Failing)
+	p.minResponseTime.Store(int64(h.MinResponseTime))
+}
+
+// Orders the processors for a payment requested at `at`: the first one gets
+// the retries. Weights give the share of payments sent to each processor
+// first (or, with COST_AWARE_ROUTING, the cheaper fee in effect wins; with
+// ROUTING_STRATEGY=score, the lower latency/error/fee score). A
+// processor closer to this instance's zone/region then goes first whatever
+// the weights say, and health checks and breakers move a failing first
+// choice (or a much slower one at the same distance) to second place.
+// Sandbox payments are routed the same way between the sandbox pair.
+func routeProcessors(at time.Time, sandbox bool) (primary, secondary *Processor) {
+	defaultProcessor, fallbackProcessor := environmentProcessors(sandbox)
+	primary, secondary = defaultProcessor, fallbackProcessor
+	dw, fw := defaultProcessor.Weight(), fallbackProcessor.Weight()
+	if tuning := routing.Load(); tuning.Strategy == "score" {
+		if fallbackProcessor.routeScore(tuning, at).Score < defaultProcessor.routeScore(tuning, at).Score {
+			primary, secondary = fallbackProcessor, defaultProcessor
+		}
+	} else if costAware {
+		if feeRate(fallbackProcessor.Name, at) < feeRate(defaultProcessor.Name, at) {
+			primary, secondary = fallbackProcessor, defaultProcessor
+		}
+	} else if fw > 0 && (dw <= 0 || rand.Intn(dw+fw) >= dw) {
+		primary, secondary = fallbackProcessor, defaultProcessor
+	}
+	if secondary.Locality() < primary.Locality() {
+		primary, secondary = secondary, primary
+	}
+
+	switch {
+	case !primary.Available() && secondary.Available():
+		return secondary, primary
+	case primary.Locality() == secondary.Locality() &&
+		primary.Healthy() && secondary.Healthy() &&
+		primary.MinResponseTime() >= slowMs &&
+		primary.MinResponseTime() > latencyFactor*secondary.MinResponseTime():
+		return secondary, primary
+	}
+	return primary, secondary
+}
+
+// Forwards through the processor's circuit breaker; an open breaker fails
+// immediately without touching the network
+func callProcessor(ctx context.Context, p *Processor, payment PostPayments) forwardOutcome {
+	if !p.breaker.Allow() {
+		return forwardRetryable
+	}
+	span := traceFrom(ctx).StartSpan("forward " + p.Name)
+	span.SetAttr("processor.url", p.BaseURL())
+	start := time.Now()
+	outcome := forwardToProcessor(ctx, p, payment)
+	elapsed := time.Since(start)
+	metricProcessorLatency.Since(p.Name, start)
+	recordForwardTime(elapsed)
+	span.End(outcome != forwardAccepted)
+	switch {
+	case !outcome.retryable():
+		// A 4xx is a verdict on the payment, not on the processor
+		p.breaker.Success()
+		p.stats.observe(elapsed, false)
+	case ctx.Err() != nil:
+		p.breaker.Abandon()
+	default:
+		p.breaker.Failure()
+		p.stats.observe(elapsed, true)
+	}
+	if outcome == forwardTimedOut && ctx.Err() == nil {
+		outcome = verification.resolve(ctx, p, payment)
+	}
+	return outcome
+}
+
+func processorByName(name string) *Processor {
+	for _, p := range processors {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
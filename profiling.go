@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// CONTINUOUS PROFILING (PROFILE_UPLOAD_URL)
+// ============================================================================
+
+var (
+	profilingLog = componentLogger("profiling")
+)
+
+type ProfilingConfig struct {
+	// Where profiles go (empty disables). Format pyroscope posts to
+	// <url>/ingest the way a Pyroscope server expects; raw posts each pprof
+	// file to the URL as is, for a custom collector or an object store.
+	UploadURL string
+	Format    string
+	// One CPU profile of CPUDuration plus a heap snapshot every Interval:
+	// sampling costs CPU for a fraction of the time only
+	Interval    time.Duration
+	CPUDuration time.Duration
+}
+
+func loadProfilingConfig(env *envParser) ProfilingConfig {
+	c := ProfilingConfig{
+		UploadURL:   env.str("PROFILE_UPLOAD_URL", ""),
+		Format:      env.oneOf("PROFILE_FORMAT", "pyroscope", "pyroscope", "raw"),
+		Interval:    env.duration("PROFILE_INTERVAL", 60*time.Second),
+		CPUDuration: env.duration("PROFILE_CPU_DURATION", 10*time.Second),
+	}
+	if c.CPUDuration > c.Interval {
+		env.fail("PROFILE_CPU_DURATION", c.CPUDuration.String(), "must be at most PROFILE_INTERVAL")
+	}
+	return c
+}
+
+func startProfiling(cfg ProfilingConfig) {
+	if cfg.UploadURL == "" {
+		return
+	}
+	go profileForever(cfg)
+}
+
+func profileForever(cfg ProfilingConfig) {
+	time.Sleep(initialJitter(cfg.Interval))
+	for {
+		start := time.Now()
+		// Skipped while browned out, if BROWNOUT_SHED lists it
+		if !shedding("profiling") {
+			profileOnce(cfg)
+		}
+		time.Sleep(jittered(cfg.Interval - time.Since(start)))
+	}
+}
+
+func profileOnce(cfg ProfilingConfig) {
+	var buf bytes.Buffer
+	from := time.Now()
+	// Fails when something else (a /debug/pprof request) is profiling
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		profilingLog.Warn("cpu profile skipped", "err", err)
+	} else {
+		time.Sleep(cfg.CPUDuration)
+		pprof.StopCPUProfile()
+		uploadProfile(cfg, "cpu", from, time.Now(), buf.Bytes())
+	}
+
+	buf.Reset()
+	if err := pprof.Lookup("heap").WriteTo(&buf, 0); err == nil {
+		now := time.Now()
+		uploadProfile(cfg, "heap", now, now, buf.Bytes())
+	}
+}
+
+func uploadProfile(cfg ProfilingConfig, kind string, from, until time.Time, profile []byte) {
+	target := cfg.UploadURL
+	if cfg.Format == "pyroscope" {
+		query := url.Values{
+			"name":    {SERVICE_NAME + "." + kind + "{instance=" + INSTANCE_ID + "}"},
+			"from":    {strconv.FormatInt(from.Unix(), 10)},
+			"until":   {strconv.FormatInt(until.Unix(), 10)},
+			"format":  {"pprof"},
+			"spyName": {"gospy"},
+		}
+		target += "/ingest?" + query.Encode()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(profile))
+	if err != nil {
+		profilingLog.Error("profile upload failed", "profile", kind, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Profile-Type", kind)
+	req.Header.Set("X-Instance-Id", INSTANCE_ID)
+	resp, err := httpClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("collector returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		profilingLog.Warn("profile upload failed", "profile", kind, "err", err)
+	}
+}
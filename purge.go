@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// PAYMENT DATA PURGE
+// ============================================================================
+
+// Everything the gateway writes about payments. Instance heartbeats and the
+// schema marker stay, and keys of other services sharing the database are
+// never touched.
+var purgePatterns = []string{"summary:*", "status:*", "payments:*", "ledger:*", auditKey}
+
+// Deletes the gateway's payment keys and returns how many went
+func purgeGatewayKeys(ctx context.Context) (int, error) {
+	defer metricRedisLatency.Since("purge", time.Now())
+	deleted := 0
+	for _, pattern := range append(purgePatterns, SHARED_QUEUE_KEY) {
+		err := scanKeys(ctx, pattern, 1000, func(node redis.UniversalClient, keys []string) error {
+			n, err := unlinkKeys(ctx, node, keys)
+			deleted += n
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	// The consumer group went with the stream
+	if sharedQueue() {
+		_ = redisClient.XGroupCreateMkStream(ctx, SHARED_QUEUE_KEY, sharedQueueGroup, "0").Err()
+	}
+	return deleted, nil
+}
+
+// POST /admin/purge-payments - Deletes every payment, status and summary.
+// Destructive, so it needs ADMIN_TOKEN set (requireAdminToken).
+func handleAdminPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	deleted, err := store.Purge(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "purge_failed", err.Error())
+		return
+	}
+	logger.Warn("payment data purged", "component", "admin", "keys", deleted)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"deleted":` + strconv.Itoa(deleted) + "}\n"))
+}
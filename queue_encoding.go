@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ============================================================================
+// QUEUE ENTRY ENCODING (QUEUE_ENCODING)
+// ============================================================================
+
+var (
+	// How payments are written to the durable queues (shared queue stream
+	// and WAL): json, or msgpack, a [correlationId, cents, requestedAt]
+	// array (plus the currency, when set) about half the size. Entries of
+	// either encoding are always read, so it can be switched with a
+	// backlog in place. Set from Config.QueueEncoding at startup.
+	queueEncoding = "json"
+)
+
+var errQueueEntry = errors.New("malformed queue entry")
+
+func encodeQueued(payment PostPayments) ([]byte, error) {
+	if queueEncoding == "json" {
+		return jsonFast.Marshal(payment)
+	}
+	buf := make([]byte, 0, 16+len(payment.CorrelationId)+len(payment.RequestedAt))
+	if payment.Currency == "" {
+		buf = append(buf, 0x93) // fixarray of 3
+	} else {
+		buf = append(buf, 0x94)
+	}
+	buf = appendMsgpackString(buf, payment.CorrelationId)
+	buf = appendMsgpackInt(buf, int64(payment.Amount))
+	buf = appendMsgpackString(buf, payment.RequestedAt)
+	if payment.Currency != "" {
+		buf = appendMsgpackString(buf, payment.Currency)
+	}
+	return buf, nil
+}
+
+// Decodes either encoding, told apart by the first byte
+func decodeQueued(data string, payment *PostPayments) error {
+	if len(data) > 0 && data[0] == '{' {
+		return jsonFast.UnmarshalFromString(data, payment)
+	}
+	d := msgpackReader{data: data}
+	header := d.byte()
+	if header != 0x93 && header != 0x94 {
+		return errQueueEntry
+	}
+	payment.CorrelationId = d.string()
+	payment.Amount = Cents(d.int())
+	payment.RequestedAt = d.string()
+	if header == 0x94 {
+		payment.Currency = d.string()
+	}
+	if d.err != nil || d.off != len(data) {
+		return errQueueEntry
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// The msgpack subset used above: strings and integers
+// ----------------------------------------------------------------------------
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n < 1<<8:
+		buf = append(buf, 0xd9, byte(n))
+	case n < 1<<16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func appendMsgpackInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n < 128:
+		return append(buf, byte(n))
+	case n >= 0 && n < 1<<16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n >= 0 && n < 1<<32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+}
+
+// Reads values in order; the first error sticks and zeroes what follows
+type msgpackReader struct {
+	data string
+	off  int
+	err  error
+}
+
+func (r *msgpackReader) take(n int) string {
+	if r.err != nil || n < 0 || r.off+n > len(r.data) {
+		r.err = errQueueEntry
+		return ""
+	}
+	s := r.data[r.off : r.off+n]
+	r.off += n
+	return s
+}
+
+func (r *msgpackReader) byte() byte {
+	if s := r.take(1); s != "" {
+		return s[0]
+	}
+	return 0
+}
+
+func (r *msgpackReader) uint(size int) uint64 {
+	var n uint64
+	for _, b := range []byte(r.take(size)) {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+func (r *msgpackReader) string() string {
+	switch b := r.byte(); {
+	case b&0xe0 == 0xa0:
+		return r.take(int(b & 0x1f))
+	case b == 0xd9:
+		return r.take(int(r.uint(1)))
+	case b == 0xda:
+		return r.take(int(r.uint(2)))
+	case b == 0xdb:
+		return r.take(int(r.uint(4)))
+	}
+	r.err = errQueueEntry
+	return ""
+}
+
+func (r *msgpackReader) int() int64 {
+	switch b := r.byte(); {
+	case b < 0x80:
+		return int64(b)
+	case b >= 0xe0:
+		return int64(int8(b))
+	case b >= 0xcc && b <= 0xcf:
+		return int64(r.uint(1 << (b - 0xcc)))
+	case b >= 0xd0 && b <= 0xd3:
+		size := 1 << (b - 0xd0)
+		n := r.uint(size)
+		// Sign-extend from size bytes
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift
+	}
+	r.err = errQueueEntry
+	return 0
+}
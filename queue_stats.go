@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// AT-CAPACITY QUEUE ANALYTICS
+// ============================================================================
+
+var (
+	queueStats = &queueCapacityStats{}
+)
+
+// Sampling tick; an episode ends after one tick without a full-queue 429
+const queueStatsTick = 100 * time.Millisecond
+
+// A stretch of time during which payments were turned away because the
+// queue was full
+type queueFullEpisode struct {
+	Start           string  `json:"start"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Rejected        int64   `json:"rejected"`
+	// Highest arrivals per second seen during the episode
+	PeakArrivalRate int64 `json:"peakArrivalRate"`
+	Ongoing         bool  `json:"ongoing,omitempty"`
+
+	start time.Time
+}
+
+type queueCapacityStats struct {
+	arrivals atomic.Int64 // Payments received, ever
+	rejected atomic.Int64 // Full-queue 429s, ever
+
+	mu             sync.Mutex
+	window         [10]int64 // Arrivals per tick over the last second
+	tick           int
+	lastArrivals   int64
+	lastRejected   int64
+	arrivalRate    int64 // Arrivals in the last second
+	peakRate       int64 // Highest arrivalRate since start
+	peakRateAt     time.Time
+	current        *queueFullEpisode
+	episodes       []queueFullEpisode // Finished, oldest first
+	keep           int                // Episodes kept (QUEUE_STATS_EPISODES)
+	episodeCount   int64
+	fullSeconds    float64 // Finished episodes only
+	longestEpisode float64
+}
+
+func startQueueStats(keep int) {
+	queueStats.keep = keep
+	go func() {
+		for range time.Tick(queueStatsTick) {
+			queueStats.sample(time.Now())
+		}
+	}()
+}
+
+func (s *queueCapacityStats) noteArrival() { s.arrivals.Add(1) }
+
+func (s *queueCapacityStats) noteQueueFull() { s.rejected.Add(1) }
+
+func (s *queueCapacityStats) sample(now time.Time) {
+	arrivals, rejected := s.arrivals.Load(), s.rejected.Load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.window[s.tick%len(s.window)] = arrivals - s.lastArrivals
+	s.tick++
+	s.lastArrivals = arrivals
+	s.arrivalRate = 0
+	for _, n := range s.window {
+		s.arrivalRate += n
+	}
+	if s.arrivalRate > s.peakRate {
+		s.peakRate, s.peakRateAt = s.arrivalRate, now
+	}
+
+	newRejected := rejected - s.lastRejected
+	s.lastRejected = rejected
+	switch {
+	case newRejected > 0 && s.current == nil:
+		s.current = &queueFullEpisode{start: now.Add(-queueStatsTick), Start: now.Add(-queueStatsTick).UTC().Format(time.RFC3339Nano)}
+		s.episodeCount++
+		fallthrough
+	case newRejected > 0:
+		s.current.Rejected += newRejected
+		s.current.PeakArrivalRate = max(s.current.PeakArrivalRate, s.arrivalRate)
+	case s.current != nil:
+		// A quiet tick: the queue has had room again
+		e := *s.current
+		e.DurationSeconds = now.Sub(e.start).Seconds()
+		s.fullSeconds += e.DurationSeconds
+		s.longestEpisode = max(s.longestEpisode, e.DurationSeconds)
+		s.episodes = append(s.episodes, e)
+		if len(s.episodes) > s.keep {
+			s.episodes = s.episodes[len(s.episodes)-s.keep:]
+		}
+		s.current = nil
+	}
+}
+
+// Snapshot served by GET /admin/queue-stats
+type queueStatsReport struct {
+	QueueDepth    int `json:"queueDepth"`
+	QueueCapacity int `json:"queueCapacity"`
+	Workers       int `json:"workers"`
+	// Arrivals in the last second, and the highest such second since start
+	ArrivalRate     int64  `json:"arrivalRate"`
+	PeakArrivalRate int64  `json:"peakArrivalRate"`
+	PeakArrivalAt   string `json:"peakArrivalAt,omitempty"`
+	// Everything since start, ongoing episode included
+	Episodes              int64              `json:"episodes"`
+	Rejected              int64              `json:"rejected"`
+	AtCapacitySeconds     float64            `json:"atCapacitySeconds"`
+	LongestEpisodeSeconds float64            `json:"longestEpisodeSeconds"`
+	Recent                []queueFullEpisode `json:"recent"`
+}
+
+func (s *queueCapacityStats) report(now time.Time) queueStatsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := queueStatsReport{
+		QueueDepth:            len(paymentQueue),
+		QueueCapacity:         cap(paymentQueue),
+		Workers:               workerCount(),
+		ArrivalRate:           s.arrivalRate,
+		PeakArrivalRate:       s.peakRate,
+		Episodes:              s.episodeCount,
+		Rejected:              s.rejected.Load(),
+		AtCapacitySeconds:     s.fullSeconds,
+		LongestEpisodeSeconds: s.longestEpisode,
+		Recent:                append([]queueFullEpisode{}, s.episodes...),
+	}
+	if !s.peakRateAt.IsZero() {
+		r.PeakArrivalAt = s.peakRateAt.UTC().Format(time.RFC3339)
+	}
+	if s.current != nil {
+		e := *s.current
+		e.DurationSeconds, e.Ongoing = now.Sub(e.start).Seconds(), true
+		r.AtCapacitySeconds += e.DurationSeconds
+		r.LongestEpisodeSeconds = max(r.LongestEpisodeSeconds, e.DurationSeconds)
+		r.Recent = append(r.Recent, e)
+	}
+	return r
+}
+
+// GET /admin/queue-stats - How often and how long the queue was full
+func handleAdminQueueStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(queueStats.report(time.Now()))
+}
+
+func writeQueueStatsMetrics(w io.Writer) {
+	r := queueStats.report(time.Now())
+	writeGauge(w, "gateway_arrival_rate", "Payments received in the last second.", "", float64(r.ArrivalRate))
+	writeGauge(w, "gateway_arrival_rate_peak", "Highest payments received in one second since start.", "", float64(r.PeakArrivalRate))
+	writeHeader(w, "gateway_queue_full_episodes_total", "Stretches of time the queue turned payments away.", "counter")
+	writeSample(w, "gateway_queue_full_episodes_total", "", float64(r.Episodes))
+	writeHeader(w, "gateway_queue_full_seconds_total", "Time spent with the queue at capacity.", "counter")
+	writeSample(w, "gateway_queue_full_seconds_total", "", r.AtCapacitySeconds)
+	writeGauge(w, "gateway_queue_full_longest_seconds", "Longest stretch with the queue at capacity.", "", r.LongestEpisodeSeconds)
+}
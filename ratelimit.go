@@ -0,0 +1,197 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// PER-CLIENT RATE LIMITING
+// ============================================================================
+
+var (
+	// Built by setupInfrastructure
+	clientLimits *clientLimiter
+	// Proxies in front of the gateway whose X-Forwarded-For entry is believed
+	trustedProxies int
+)
+
+type RateLimitConfig struct {
+	// Payments per second admitted per client and instance (0 disables),
+	// with bursts of up to Burst (0 means one second's worth)
+	Rate  float64
+	Burst int
+	// What a client is: api_key (X-API-Key, the IP when absent) or ip
+	Key string
+	// Take the client IP from X-Forwarded-For, for when a proxy (the
+	// bundled nginx sets it) is the only direct peer: RATE_LIMIT_TRUST_PROXY
+	// true trusts one proxy hop, a number that many chained proxies, false none
+	TrustedProxies int
+}
+
+func loadRateLimitConfig(env *envParser) RateLimitConfig {
+	c := RateLimitConfig{
+		Rate:  env.float("RATE_LIMIT", 0, 0, math.Inf(1)),
+		Burst: env.int("RATE_LIMIT_BURST", 0, 0),
+		Key:   env.oneOf("RATE_LIMIT_KEY", "api_key", "api_key", "ip"),
+	}
+	switch raw := getEnv("RATE_LIMIT_TRUST_PROXY", "false"); raw {
+	case "false":
+	case "true":
+		c.TrustedProxies = 1
+	default:
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			env.fail("RATE_LIMIT_TRUST_PROXY", raw, "must be true, false or a number of proxies")
+		}
+		c.TrustedProxies = max(n, 0)
+	}
+	return c
+}
+
+// Refills at rate tokens per second, holding up to burst
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// Takes a token, or reports how long until there is one
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Buckets per client; a sweep drops the ones that have refilled, which
+// behave exactly like a new one
+type clientLimiter struct {
+	rate, burst float64
+	key         string
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newClientLimiter(cfg RateLimitConfig) *clientLimiter {
+	trustedProxies = cfg.TrustedProxies
+	rate, burst := cfg.Rate, float64(cfg.Burst)
+	if burst <= 0 {
+		burst = math.Max(math.Ceil(rate), 1)
+	}
+	l := &clientLimiter{rate: rate, burst: burst, key: cfg.Key, buckets: make(map[string]*tokenBucket)}
+	if rate > 0 {
+		go l.sweep()
+	}
+	return l
+}
+
+func (l *clientLimiter) sweep() {
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+		l.mu.Lock()
+		for client, b := range l.buckets {
+			b.mu.Lock()
+			b.refill(now)
+			full := b.tokens >= b.burst
+			b.mu.Unlock()
+			if full {
+				delete(l.buckets, client)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (l *clientLimiter) take(client string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	b := l.buckets[client]
+	if b == nil {
+		b = newTokenBucket(l.rate, l.burst, now)
+		l.buckets[client] = b
+	}
+	l.mu.Unlock()
+	return b.take(now)
+}
+
+// Who a payment is counted against
+func rateLimitClient(req ingestRequest) string {
+	if clientLimits.key == "api_key" && req.apiKey != "" {
+		return "key:" + req.apiKey
+	}
+	return "ip:" + req.clientIP
+}
+
+// Answer for a client over its limit, or nil to go on
+func checkClientLimit(req ingestRequest) *ingestResponse {
+	if clientLimits.rate <= 0 {
+		return nil
+	}
+	ok, wait := clientLimits.take(rateLimitClient(req))
+	if ok {
+		return nil
+	}
+	metricPaymentsRejected.Inc("rate_limited")
+	return rateLimitedResponse(clientLimits.key, clientLimits.rate, clientLimits.burst, wait)
+}
+
+// 429 with Retry-After (whole seconds, rounded up) and the limit that was hit
+func rateLimitedResponse(scope string, rate, burst float64, wait time.Duration) *ingestResponse {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	body, _ := jsonFast.Marshal(map[string]interface{}{
+		"error":   "rate_limited",
+		"message": "rate limit exceeded, retry in " + strconv.Itoa(retryAfter) + "s",
+		"limit": map[string]interface{}{
+			"scope":     scope,
+			"perSecond": rate,
+			"burst":     burst,
+		},
+		"retryAfter": retryAfter,
+	})
+	return &ingestResponse{status: http.StatusTooManyRequests, body: body, retryAfter: retryAfter}
+}
+
+// Client address of a net/http request, without the port
+func clientIP(r *http.Request) string {
+	return pickClientIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"))
+}
+
+// Each proxy appends the address it was reached from, so the client is the
+// entry as many hops from the right as there are trusted proxies; anything
+// further left came from the client itself and is not believed
+func pickClientIP(remoteAddr, forwardedFor string) string {
+	if trustedProxies > 0 && forwardedFor != "" {
+		entries := strings.Split(forwardedFor, ",")
+		return strings.TrimSpace(entries[max(len(entries)-trustedProxies, 0)])
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	b := newTokenBucket(2, 3, start)
+	steps := []struct {
+		at   time.Duration
+		ok   bool
+		wait time.Duration
+	}{
+		// Starts full: the whole burst goes through at once
+		{0, true, 0},
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 500 * time.Millisecond},
+		{250 * time.Millisecond, false, 250 * time.Millisecond},
+		{500 * time.Millisecond, true, 0},
+		{500 * time.Millisecond, false, 500 * time.Millisecond},
+		// A long idle refills up to the burst, not beyond
+		{time.Hour, true, 0},
+		{time.Hour, true, 0},
+		{time.Hour, true, 0},
+		{time.Hour, false, 500 * time.Millisecond},
+	}
+	for i, s := range steps {
+		ok, wait := b.take(start.Add(s.at))
+		if ok != s.ok || (!ok && (wait-s.wait).Abs() > time.Millisecond) {
+			t.Fatalf("step %d at +%s: take() = %v, %s; want %v, %s", i, s.at, ok, wait, s.ok, s.wait)
+		}
+	}
+}
+
+func TestPickClientIP(t *testing.T) {
+	defer func(n int) { trustedProxies = n }(trustedProxies)
+	cases := []struct {
+		proxies     int
+		remote, xff string
+		want        string
+	}{
+		{0, "10.0.0.1:5000", "1.1.1.1", "10.0.0.1"},
+		{0, "10.0.0.1", "", "10.0.0.1"},
+		{1, "10.0.0.1:5000", "", "10.0.0.1"},
+		{1, "10.0.0.1:5000", "1.1.1.1", "1.1.1.1"},
+		// What the client prepends itself is never believed
+		{1, "10.0.0.1:5000", "6.6.6.6, 1.1.1.1", "1.1.1.1"},
+		{2, "10.0.0.1:5000", "6.6.6.6, 1.1.1.1, 10.0.0.2", "1.1.1.1"},
+		{3, "10.0.0.1:5000", "1.1.1.1, 10.0.0.2", "1.1.1.1"},
+	}
+	for _, c := range cases {
+		trustedProxies = c.proxies
+		if got := pickClientIP(c.remote, c.xff); got != c.want {
+			t.Errorf("%d proxies: pickClientIP(%q, %q) = %q, want %q", c.proxies, c.remote, c.xff, got, c.want)
+		}
+	}
+}
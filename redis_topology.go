@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// REDIS TOPOLOGY (REDIS_URL)
+// ============================================================================
+
+// REDIS_URL picks how the primary is reached:
+//
+//	host:port, redis://host:port[/db]                  one server
+//	redis-sentinel://<master>@host:port,...[/db]       through Sentinel, following failovers
+//	redis-cluster://host:port,...                      Redis Cluster (seed nodes)
+type redisTopology struct {
+	Mode       string // standalone, sentinel or cluster
+	Addrs      []string
+	MasterName string
+	DB         int // -1 when the URL has none (REDIS_DB applies)
+}
+
+var (
+	// Sentinel's own password, when it differs from REDIS_PASSWORD's
+	REDIS_SENTINEL_PASSWORD = getEnv("REDIS_SENTINEL_PASSWORD", "")
+
+	// Set by setupInfrastructure from REDIS_URL
+	redisCluster bool
+)
+
+func parseRedisURL(raw string) (redisTopology, error) {
+	t := redisTopology{Mode: "standalone", DB: -1}
+	scheme, rest, hasScheme := strings.Cut(raw, "://")
+	if !hasScheme {
+		scheme, rest = "redis", raw
+	}
+	if path, db, ok := strings.Cut(rest, "/"); ok {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return t, errors.New("database must be a number")
+		}
+		rest, t.DB = path, n
+	}
+	switch scheme {
+	case "redis":
+	case "redis-sentinel":
+		t.Mode = "sentinel"
+		master, hosts, ok := strings.Cut(rest, "@")
+		if !ok || master == "" {
+			return t, errors.New("redis-sentinel:// needs <master name>@host:port,...")
+		}
+		t.MasterName, rest = master, hosts
+	case "redis-cluster":
+		t.Mode = "cluster"
+		if t.DB > 0 {
+			return t, errors.New("Redis Cluster has database 0 only")
+		}
+	default:
+		return t, errors.New("scheme must be redis, redis-sentinel or redis-cluster")
+	}
+	for _, addr := range strings.Split(rest, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			t.Addrs = append(t.Addrs, addr)
+		}
+	}
+	if len(t.Addrs) == 0 || (t.Mode == "standalone" && len(t.Addrs) > 1) {
+		return t, errors.New("standalone takes one host:port, sentinel and cluster at least one")
+	}
+	return t, nil
+}
+
+// ----------------------------------------------------------------------------
+// Cluster key hashing
+// ----------------------------------------------------------------------------
+
+// Summary keys of a currencyBucket start with "summary:<tag>", the tag
+// being the processor in braces under Redis Cluster: every summary key of a
+// processor (data, history, ids, corrections, refunds, in every currency
+// and shard) hashes to the same slot, so the scripts that read or write
+// several of them at once keep working. Outside a cluster the tag is the
+// plain processor name and keys are unchanged.
+func summaryPrefix(bucket string) string {
+	if !redisCluster {
+		return "summary:" + bucket
+	}
+	processor, currency, ok := strings.Cut(bucket, ":")
+	if !ok {
+		return "summary:{" + processor + "}"
+	}
+	return "summary:{" + processor + "}:" + currency
+}
+
+// Corrections and refunds check a payment's status and write its
+// processor's keys in one script, which a cluster can't run across slots
+func refusedInCluster(w http.ResponseWriter) bool {
+	if redisCluster {
+		writeJSONError(w, http.StatusNotImplemented, "unsupported_in_cluster", "not available with redis-cluster://")
+	}
+	return redisCluster
+}
+
+// Runs fn on every key matching pattern, in batches, with the node that
+// holds them. A cluster scans each primary, as SCAN only covers the node it
+// is sent to; fn is never called concurrently.
+func scanKeys(ctx context.Context, pattern string, count int64, fn func(node redis.UniversalClient, keys []string) error) error {
+	var mu sync.Mutex
+	scan := func(ctx context.Context, node redis.UniversalClient) error {
+		iter := node.Scan(ctx, 0, pattern, count).Iterator()
+		var batch []string
+		flush := func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			err := fn(node, batch)
+			batch = batch[:0]
+			return err
+		}
+		for iter.Next(ctx) {
+			if batch = append(batch, iter.Val()); len(batch) == int(count) {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if len(batch) > 0 {
+			return flush()
+		}
+		return nil
+	}
+	cluster, ok := redisClient.(*redis.ClusterClient)
+	if !ok {
+		return scan(ctx, redisClient)
+	}
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		return scan(ctx, node)
+	})
+}
+
+// UNLINKs keys held by one node. A cluster refuses multi-key commands
+// across slots, so there each key goes on its own, pipelined.
+func unlinkKeys(ctx context.Context, node redis.UniversalClient, keys []string) (int, error) {
+	if !redisCluster {
+		n, err := node.Unlink(ctx, keys...).Result()
+		return int(n), err
+	}
+	cmds, err := node.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Unlink(ctx, key)
+		}
+		return nil
+	})
+	n := 0
+	for _, cmd := range cmds {
+		n += int(cmd.(*redis.IntCmd).Val())
+	}
+	return n, err
+}
+
+// ----------------------------------------------------------------------------
+// Recording under Redis Cluster
+// ----------------------------------------------------------------------------
+
+// The status of a payment and its processor's summary keys live in
+// different slots, so in a cluster recordPaymentScript runs as two: first
+// the status, which fixes the record key (reused on a retry, as before),
+// then the summary, in the processor's slot. Each half is idempotent, but
+// the pair is not atomic: a failure in between leaves statuses processed
+// without their summary entry, which is logged.
+var recordStatusScript = redis.NewScript(`
+local key = redis.call('HGET', KEYS[1], 'record') or ARGV[1]
+redis.call('HSET', KEYS[1], 'state', ARGV[2], 'processor', ARGV[3], 'amount', ARGV[4], 'requestedAt', ARGV[5], 'instance', ARGV[6], 'record', key)
+if ARGV[7] ~= '' then
+  redis.call('HSET', KEYS[1], 'currency', ARGV[7])
+end
+return key
+`)
+
+// KEYS: data, history, ids, instances. ARGV: record key, cents, score,
+// correlationId, instance.
+var recordSummaryScript = redis.NewScript(`
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[4])
+redis.call('HINCRBY', KEYS[4], ARGV[5], 1)
+return 1
+`)
+
+func saveClusterSummaries(batch []summaryJob) {
+	if err := recordClusterSummaries(batch); err != nil {
+		logger.Error("payments not recorded", "component", "redis", "payments", len(batch), "err", err)
+	}
+}
+
+func recordClusterSummaries(batch []summaryJob) error {
+	ctx := context.Background()
+	statuses := make([]*redis.Cmd, len(batch))
+	err := pipelinedScripts(ctx, []*redis.Script{recordStatusScript}, func(pipe redis.Pipeliner) {
+		for i, job := range batch {
+			statuses[i] = recordStatusScript.EvalSha(ctx, pipe, []string{"status:" + job.payment.CorrelationId},
+				newUUIDv7(),
+				"processed-"+job.processor,
+				job.processor,
+				job.payment.Amount.String(),
+				job.payment.RequestedAt,
+				INSTANCE_ID,
+				job.payment.Currency,
+			)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return pipelinedScripts(ctx, []*redis.Script{recordSummaryScript}, func(pipe redis.Pipeliner) {
+		for i, job := range batch {
+			ts, _ := time.Parse("2006-01-02T15:04:05.000Z07:00", job.payment.RequestedAt)
+			shard := shardFor(job.payment.CorrelationId)
+			bucket := currencyBucket(job.processor, job.payment.Currency)
+			recordSummaryScript.EvalSha(ctx, pipe, []string{
+				summaryKey(bucket, "data", shard),
+				summaryKey(bucket, "history", shard),
+				summaryKey(bucket, "ids", shard),
+				summaryPrefix(job.processor) + ":instances",
+			}, statuses[i].Val(), job.payment.Amount.Raw(), ts.UnixMilli(), job.payment.CorrelationId, INSTANCE_ID)
+		}
+	})
+}
+
+// Sends a pipeline of EVALSHAs, loading the scripts (on every primary) and
+// resending once if Redis had lost them
+func pipelinedScripts(ctx context.Context, scripts []*redis.Script, fill func(redis.Pipeliner)) error {
+	_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		fill(pipe)
+		return nil
+	})
+	if err == nil || !redis.HasErrorPrefix(err, "NOSCRIPT") {
+		return err
+	}
+	for _, script := range scripts {
+		if err := script.Load(ctx, redisClient).Err(); err != nil {
+			return err
+		}
+	}
+	_, err = redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		fill(pipe)
+		return nil
+	})
+	return err
+}
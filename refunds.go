@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// REFUNDS
+// ============================================================================
+
+var (
+	// Processor endpoint a refund is forwarded to, relative to its base URL
+	REFUND_PATH = getEnv("REFUND_PATH", "/payments/{correlationId}/refund")
+
+	refundLog = componentLogger("refunds")
+)
+
+// Body of POST /payments/{correlationId}/refund; both fields are optional
+type refundRequest struct {
+	// Defaults to whatever has not been refunded yet
+	Amount *Cents `json:"amount,omitempty"`
+	// Client-chosen key: resending a refund with the same id is a no-op
+	RefundId string `json:"refundId,omitempty"`
+}
+
+// Records a refund the processor accepted, only if the payment still has
+// the effective amount it was checked against and the refunds stay within
+// it. Stored like a correction ("-amount,1"), so the corrections summary
+// script totals refunds too.
+// KEYS: status, refunds history, refunds data, audit log[, ledger stream, balances]
+// ARGV: current amount, current cents, refundId, cents, score, debit, credit, audit fields...
+var recordRefundScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'voided') == '1' then
+  return redis.error_reply('VOIDED')
+end
+local current = redis.call('HGET', KEYS[1], 'correctedAmount') or redis.call('HGET', KEYS[1], 'amount')
+if current ~= ARGV[1] then
+  return redis.error_reply('CONFLICT')
+end
+if redis.call('HEXISTS', KEYS[3], ARGV[3]) == 1 then
+  return redis.error_reply('DUPLICATE')
+end
+local refunded = tonumber(redis.call('HGET', KEYS[1], 'refunded') or '0')
+if refunded + tonumber(ARGV[4]) > tonumber(ARGV[2]) then
+  return redis.error_reply('EXCEEDS')
+end
+refunded = redis.call('HINCRBY', KEYS[1], 'refunded', ARGV[4])
+redis.call('ZADD', KEYS[2], ARGV[5], ARGV[3])
+redis.call('HSET', KEYS[3], ARGV[3], '-' .. ARGV[4] .. ',1')
+redis.call('XADD', KEYS[4], '*', unpack(ARGV, 8))
+-- Ledger on: the payment entry reversed, legs swapped
+if #KEYS > 4 then
+  local debit = redis.call('HINCRBY', KEYS[6], ARGV[7], -tonumber(ARGV[4]))
+  local credit = redis.call('HINCRBY', KEYS[6], ARGV[6], -tonumber(ARGV[4]))
+  redis.call('XADD', KEYS[5], '*', 'kind', 'refund', 'correlationId', string.sub(KEYS[1], 8),
+    'amount', ARGV[4], 'debit', ARGV[7], 'credit', ARGV[6],
+    'debitBalance', debit, 'creditBalance', credit, 'correctionId', ARGV[3])
+end
+return refunded
+`)
+
+func refundKey(bucket, kind string) string {
+	return summaryPrefix(bucket) + ":refunds:" + kind
+}
+
+// Refunds of payments requested within [from, to], as a count and a
+// positive total
+func getRefundsData(bucket string, from, to time.Time) SummaryData {
+	keys := []string{refundKey(bucket, "history"), refundKey(bucket, "data")}
+	data := runSummaryScript(correctionsSummaryScript, keys, from, to)
+	data.TotalAmount = -data.TotalAmount
+	return data
+}
+
+// POST /payments/{correlationId}/refund - Refunds a recorded payment
+// through the processor that took it
+func handleRefund(w http.ResponseWriter, r *http.Request, correlationId string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if refusedInCluster(w) {
+		return
+	}
+	var req refundRequest
+	if err := jsonStrict.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "body must be empty or {\"amount\": ..., \"refundId\": ...}")
+		return
+	}
+	if req.Amount != nil && *req.Amount <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_amount", "amount must be positive")
+		return
+	}
+	if req.RefundId == "" {
+		req.RefundId = newUUIDv7()
+	}
+
+	ctx := r.Context()
+	status, err := redisClient.HGetAll(ctx, "status:"+correlationId).Result()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	p := processorByName(status["processor"])
+	if p == nil {
+		writeJSONError(w, http.StatusNotFound, "not_recorded", "no processed payment with this correlationId")
+		return
+	}
+	if status["voided"] == "1" {
+		writeJSONError(w, http.StatusConflict, "already_voided", "payment is voided")
+		return
+	}
+	bucket := currencyBucket(p.Name, status["currency"])
+	if done, _ := redisClient.HExists(ctx, refundKey(bucket, "data"), req.RefundId).Result(); done {
+		writeRefund(w, http.StatusOK, correlationId, p.Name, req.RefundId, status)
+		return
+	}
+
+	current := status["amount"]
+	if corrected, ok := status["correctedAmount"]; ok {
+		current = corrected
+	}
+	currentAmount, _ := parseCents(current)
+	refunded, _ := parseRawCents(status["refunded"])
+	remaining := currentAmount - refunded
+	amount := remaining
+	if req.Amount != nil {
+		amount = *req.Amount
+	}
+	if amount <= 0 || amount > remaining {
+		writeJSONError(w, http.StatusConflict, "exceeds_payment", "at most "+remaining.String()+" is left to refund")
+		return
+	}
+
+	switch forwardRefund(ctx, p, correlationId, req.RefundId, amount) {
+	case forwardAccepted:
+	case forwardRejected:
+		writeJSONError(w, http.StatusUnprocessableEntity, "refund_rejected", "the processor refused the refund")
+		return
+	default:
+		writeJSONError(w, http.StatusBadGateway, "processor_unavailable", "the processor could not be reached, retry with the same refundId")
+		return
+	}
+
+	requestedAt, _ := time.Parse("2006-01-02T15:04:05.000Z07:00", status["requestedAt"])
+	actor := r.Header.Get("X-API-Key")
+	if actor == "" {
+		actor = "client"
+	}
+	ledgerKeys, debit, credit := ledgerCorrectionArgs(p.Name, bucket)
+	total, err := recordRefundScript.Run(context.Background(), redisClient,
+		append([]string{"status:" + correlationId, refundKey(bucket, "history"), refundKey(bucket, "data"), auditKey}, ledgerKeys...),
+		current,
+		currentAmount.Raw(),
+		req.RefundId,
+		amount.Raw(),
+		requestedAt.UnixMilli(),
+		debit,
+		credit,
+		// Audit entry fields
+		"action", "refund",
+		"correlationId", correlationId,
+		"processor", p.Name,
+		"previousAmount", current,
+		"refundAmount", amount.String(),
+		"refundId", req.RefundId,
+		"actor", actor,
+		"instance", INSTANCE_ID,
+		"at", time.Now().UTC().Format(time.RFC3339Nano),
+	).Int64()
+	switch {
+	case err != nil && strings.Contains(err.Error(), "DUPLICATE"):
+		writeRefund(w, http.StatusOK, correlationId, p.Name, req.RefundId, status)
+		return
+	case err != nil:
+		// The processor has refunded it: this needs a person
+		refundLog.Error("refund accepted by the processor but not recorded", "correlationId", correlationId,
+			"refundId", req.RefundId, "processor", p.Name, "amount", amount, "err", err)
+		writeJSONError(w, http.StatusConflict, "refund_not_recorded", "the processor accepted the refund but the payment changed meanwhile")
+		return
+	}
+	status["refunded"] = strconv.FormatInt(total, 10)
+	writeRefund(w, http.StatusCreated, correlationId, p.Name, req.RefundId, status)
+}
+
+func writeRefund(w http.ResponseWriter, code int, correlationId, processor, refundId string, status map[string]string) {
+	refunded, _ := parseRawCents(status["refunded"])
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = jsonFast.NewEncoder(w).Encode(map[string]interface{}{
+		"refundId":      refundId,
+		"correlationId": correlationId,
+		"processor":     processor,
+		"refunded":      refunded,
+	})
+}
+
+// Sends the refund to the processor: accepted on a 2xx, rejected on any
+// other 4xx, retryable otherwise
+func forwardRefund(ctx context.Context, p *Processor, correlationId, refundId string, amount Cents) forwardOutcome {
+	body, _ := jsonFast.Marshal(map[string]interface{}{
+		"refundId":    refundId,
+		"amount":      amount,
+		"requestedAt": time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+	})
+	target := p.BaseURL() + strings.ReplaceAll(REFUND_PATH, "{correlationId}", url.PathEscape(correlationId))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return forwardRetryable
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return forwardAccepted
+	case resp.StatusCode/100 == 4:
+		return forwardRejected
+	}
+	return forwardRetryable
+}
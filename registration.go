@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// SERVICE REGISTRATION (CONSUL)
+// ============================================================================
+
+var (
+	SERVICE_NAME = getEnv("SERVICE_NAME", "rinha-gateway")
+	// Address announced to Consul (defaults to the hostname)
+	SERVICE_ADDRESS = getEnv("SERVICE_ADDRESS", "")
+	// Health check URL polled by Consul (defaults to this instance's /readyz)
+	CONSUL_CHECK_URL = getEnv("CONSUL_CHECK_URL", "")
+
+	registeredServiceID string
+
+	registrationLog = componentLogger("registration")
+)
+
+// Registers this instance with the local Consul agent (CONSUL_REGISTER);
+// https marks a TLS listener for the default check URL
+func registerService(ln net.Listener, https bool) error {
+
+	address := SERVICE_ADDRESS
+	if address == "" {
+		address, _ = os.Hostname()
+	}
+	tcp, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("CONSUL_REGISTER needs a TCP listener, not %s", ln.Addr().Network())
+	}
+	port := tcp.Port
+	checkURL := CONSUL_CHECK_URL
+	if checkURL == "" {
+		scheme := "http://"
+		if https {
+			scheme = "https://"
+		}
+		checkURL = scheme + net.JoinHostPort(address, strconv.Itoa(port)) + "/readyz"
+	}
+	id := SERVICE_NAME + "-" + address + "-" + strconv.Itoa(port)
+
+	body, _ := jsonFast.Marshal(map[string]interface{}{
+		"ID":      id,
+		"Name":    SERVICE_NAME,
+		"Address": address,
+		"Port":    port,
+		"Check": map[string]string{
+			"HTTP":                           checkURL,
+			"Interval":                       "5s",
+			"Timeout":                        "2s",
+			"DeregisterCriticalServiceAfter": "1m",
+		},
+	})
+	if err := consulPut("/v1/agent/service/register", body); err != nil {
+		return err
+	}
+	registeredServiceID = id
+	registrationLog.Info("registered in consul", "serviceId", id)
+	return nil
+}
+
+// Removes the registration made at startup, if any
+func deregisterService() {
+	if registeredServiceID == "" {
+		return
+	}
+	if err := consulPut("/v1/agent/service/deregister/"+registeredServiceID, nil); err != nil {
+		registrationLog.Error("consul deregistration failed", "err", err)
+	}
+}
+
+func consulPut(path string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(CONSUL_ADDR, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if CONSUL_TOKEN != "" {
+		req.Header.Set("X-Consul-Token", CONSUL_TOKEN)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul %s: %s", path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// WARM STANDBY (INSTANCE_ROLE)
+// ============================================================================
+
+var (
+	REPLICATION_STREAM = getEnv("REPLICATION_STREAM", "gateway:replication")
+
+	// Set from ReplicationConfig.Role at startup
+	instanceRole string
+
+	replication = struct {
+		sync.Mutex
+		lastPublished time.Time
+		lastApplied   time.Time
+		source        string
+		err           string
+	}{}
+
+	replicationLog = componentLogger("replication")
+)
+
+// Routing state of an instance at one moment. Processor URLs stay out: each
+// instance takes them from its own configuration and discovery.
+type replicaSnapshot struct {
+	Instance   string              `json:"instance"`
+	At         time.Time           `json:"at"`
+	Routing    routingTuning       `json:"routing"`
+	Processors []processorSnapshot `json:"processors"`
+}
+
+type processorSnapshot struct {
+	Name            string  `json:"name"`
+	Weight          int     `json:"weight"`
+	Failing         bool    `json:"failing"`
+	MinResponseTime int     `json:"minResponseTime"`
+	Breaker         string  `json:"breaker"`
+	BreakerFailures int     `json:"breakerFailures"`
+	BreakerOpenedAt int64   `json:"breakerOpenedAt,omitempty"` // Unix millis
+	LatencyEwmaMs   float64 `json:"latencyEwmaMs"`
+	ErrorRate       float64 `json:"errorRate"`
+	Samples         int64   `json:"samples"`
+	// AIMD limiter only
+	ConcurrencyLimit float64 `json:"concurrencyLimit,omitempty"`
+}
+
+type ReplicationConfig struct {
+	// active: publish this instance's routing state every Interval.
+	// standby: apply the active's latest snapshot, so a takeover starts with
+	// its health, breakers, averages and concurrency limits instead of from
+	// scratch. Empty (the default) does neither.
+	Role     string
+	Interval time.Duration
+	// A standby ignores snapshots older than this: the active is gone and
+	// its own observations are better than stale ones
+	MaxAge time.Duration
+}
+
+func loadReplicationConfig(env *envParser, redis bool) ReplicationConfig {
+	c := ReplicationConfig{
+		Role:     env.oneOf("INSTANCE_ROLE", "", "", "active", "standby"),
+		Interval: env.duration("REPLICATION_INTERVAL", time.Second),
+		MaxAge:   env.duration("REPLICATION_MAX_AGE", 10*time.Second),
+	}
+	if c.Role != "" && !redis {
+		env.fail("INSTANCE_ROLE", c.Role, "needs the redis store")
+	}
+	if c.MaxAge < c.Interval {
+		env.fail("REPLICATION_MAX_AGE", c.MaxAge.String(), "must be no shorter than REPLICATION_INTERVAL")
+	}
+	return c
+}
+
+func startReplication(cfg ReplicationConfig) {
+	instanceRole = cfg.Role
+	if cfg.Role == "" {
+		return
+	}
+	go func() {
+		for {
+			var err error
+			if cfg.Role == "active" {
+				err = publishSnapshot()
+			} else {
+				err = applyLatestSnapshot(cfg.MaxAge)
+			}
+			noteReplication(err)
+			time.Sleep(jittered(cfg.Interval))
+		}
+	}()
+}
+
+func noteReplication(err error) {
+	replication.Lock()
+	defer replication.Unlock()
+	if err == nil {
+		replication.err = ""
+		return
+	}
+	if replication.err != err.Error() {
+		replicationLog.Warn("replication failed", "role", instanceRole, "err", err)
+	}
+	replication.err = err.Error()
+}
+
+func takeSnapshot() replicaSnapshot {
+	s := replicaSnapshot{Instance: INSTANCE_ID, At: time.Now().UTC(), Routing: *routing.Load()}
+	for _, p := range processors {
+		ps := processorSnapshot{
+			Name:            p.Name,
+			Weight:          p.Weight(),
+			Failing:         p.failing.Load(),
+			MinResponseTime: p.MinResponseTime(),
+		}
+		p.breaker.mu.Lock()
+		ps.Breaker, ps.BreakerFailures = p.breaker.state.String(), p.breaker.failures
+		if p.breaker.state != breakerClosed {
+			ps.BreakerOpenedAt = p.breaker.openedAt.UnixMilli()
+		}
+		p.breaker.mu.Unlock()
+		p.stats.mu.Lock()
+		ps.LatencyEwmaMs, ps.ErrorRate, ps.Samples = p.stats.latencyMs, p.stats.errorRate, p.stats.samples
+		p.stats.mu.Unlock()
+		if l, ok := p.limiter.(*aimdLimiter); ok {
+			l.mu.Lock()
+			ps.ConcurrencyLimit = l.current
+			l.mu.Unlock()
+		}
+		s.Processors = append(s.Processors, ps)
+	}
+	return s
+}
+
+func publishSnapshot() error {
+	data, _ := jsonFast.Marshal(takeSnapshot())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: REPLICATION_STREAM,
+		MaxLen: 10,
+		Approx: true,
+		Values: []interface{}{"s", data},
+	}).Err()
+	if err == nil {
+		replication.Lock()
+		replication.lastPublished = time.Now()
+		replication.Unlock()
+	}
+	return err
+}
+
+func applyLatestSnapshot(maxAge time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msgs, err := redisClient.XRevRangeN(ctx, REPLICATION_STREAM, "+", "-", 1).Result()
+	if err != nil || len(msgs) == 0 {
+		return err
+	}
+	data, _ := msgs[0].Values["s"].(string)
+	var s replicaSnapshot
+	if err := jsonFast.UnmarshalFromString(data, &s); err != nil {
+		return err
+	}
+	replication.Lock()
+	defer replication.Unlock()
+	if s.Instance == INSTANCE_ID || time.Since(s.At) > maxAge || !s.At.After(replication.lastApplied) {
+		return nil
+	}
+	if s.Routing.valid() {
+		routing.Store(&s.Routing)
+	}
+	for _, ps := range s.Processors {
+		if p := processorByName(ps.Name); p != nil {
+			restoreProcessor(p, ps)
+		}
+	}
+	replication.lastApplied, replication.source = s.At, s.Instance
+	return nil
+}
+
+func restoreProcessor(p *Processor, ps processorSnapshot) {
+	p.weight.Store(int64(ps.Weight))
+	p.setHealth(processorHealth{Failing: ps.Failing, MinResponseTime: ps.MinResponseTime})
+
+	b := p.breaker
+	b.mu.Lock()
+	b.state, b.failures, b.probing = breakerClosed, ps.BreakerFailures, 0
+	switch ps.Breaker {
+	case "open":
+		b.state = breakerOpen
+	case "half-open":
+		b.state = breakerHalfOpen
+	}
+	b.openedAt = time.UnixMilli(ps.BreakerOpenedAt)
+	b.mu.Unlock()
+
+	p.stats.mu.Lock()
+	p.stats.latencyMs, p.stats.errorRate, p.stats.samples = ps.LatencyEwmaMs, ps.ErrorRate, ps.Samples
+	p.stats.mu.Unlock()
+
+	if l, ok := p.limiter.(*aimdLimiter); ok && ps.ConcurrencyLimit > 0 {
+		l.mu.Lock()
+		l.current = min(l.max, max(l.min, ps.ConcurrencyLimit))
+		close(l.wake)
+		l.wake = make(chan struct{})
+		l.mu.Unlock()
+	}
+}
+
+// GET /admin/replication - Role and when state last went out or came in
+func handleAdminReplication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	replication.Lock()
+	state := map[string]interface{}{"role": instanceRole, "stream": REPLICATION_STREAM}
+	if !replication.lastPublished.IsZero() {
+		state["lastPublished"] = replication.lastPublished.UTC().Format(time.RFC3339Nano)
+	}
+	if !replication.lastApplied.IsZero() {
+		state["lastApplied"] = replication.lastApplied.Format(time.RFC3339Nano)
+		state["source"] = replication.source
+	}
+	if replication.err != "" {
+		state["error"] = replication.err
+	}
+	replication.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(state)
+}
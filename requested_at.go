@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// ============================================================================
+// REQUESTED_AT SKEW WINDOW
+// ============================================================================
+
+var (
+	// Set by setupInfrastructure
+	requestedAtSkew RequestedAtConfig
+)
+
+// A client-supplied requestedAt older than MaxAge or further ahead than
+// MaxAhead (0 disables either) gets a 400 and an audit log entry: a
+// replayed or corrupted upstream batch is turned away instead of landing in
+// past or future summaries. Only with a window is the client's requestedAt
+// trusted at all; without one every payment is stamped with the time it is
+// processed.
+type RequestedAtConfig struct {
+	MaxAge, MaxAhead time.Duration
+}
+
+func loadRequestedAtConfig(env *envParser) RequestedAtConfig {
+	return RequestedAtConfig{
+		MaxAge:   env.optionalDuration("REQUESTED_AT_MAX_AGE"),
+		MaxAhead: env.optionalDuration("REQUESTED_AT_MAX_AHEAD"),
+	}
+}
+
+// Rejections go to the audit log
+func startRequestedAtWindow() {
+	if requestedAtWindow() {
+		startAuditWriter()
+	}
+}
+
+func requestedAtWindow() bool {
+	return requestedAtSkew.MaxAge > 0 || requestedAtSkew.MaxAhead > 0
+}
+
+// Answer for a payment whose requestedAt is not RFC 3339 or lies outside
+// the window, or nil. Payments without one, or any payment while no window
+// is set, are stamped when processed and always pass.
+func checkRequestedAt(payment PostPayments) *ingestResponse {
+	if payment.RequestedAt == "" || !requestedAtWindow() {
+		return nil
+	}
+	now := time.Now()
+	at, err := time.Parse(time.RFC3339Nano, payment.RequestedAt)
+	var code, message string
+	switch {
+	case err != nil:
+		code, message = "invalid_requested_at", "requestedAt must be an RFC 3339 timestamp"
+	case requestedAtSkew.MaxAge > 0 && now.Sub(at) > requestedAtSkew.MaxAge:
+		code, message = "requested_at_too_old", "requestedAt is more than "+requestedAtSkew.MaxAge.String()+" in the past"
+	case requestedAtSkew.MaxAhead > 0 && at.Sub(now) > requestedAtSkew.MaxAhead:
+		code, message = "requested_at_in_future", "requestedAt is more than "+requestedAtSkew.MaxAhead.String()+" in the future"
+	default:
+		return nil
+	}
+	metricPaymentsRejected.Inc(code)
+	queueAudit([]interface{}{
+		"action", "requested_at_rejected",
+		"reason", code,
+		"correlationId", payment.CorrelationId,
+		"amount", payment.Amount.String(),
+		"requestedAt", payment.RequestedAt,
+		"instance", INSTANCE_ID,
+		"at", now.UTC().Format(time.RFC3339Nano),
+	})
+	return &ingestResponse{status: http.StatusBadRequest, body: jsonErrorBody(code, message)}
+}
+
+// Time a payment is forwarded and recorded at: with a window set, the
+// requestedAt it was admitted with, in UTC; otherwise, or for one that came
+// without, now
+func paymentTime(payment PostPayments, now time.Time) time.Time {
+	if !requestedAtWindow() {
+		return now
+	}
+	if at, err := time.Parse(time.RFC3339Nano, payment.RequestedAt); err == nil {
+		return at.UTC()
+	}
+	return now
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// ============================================================================
+// RETRY POLICY
+// ============================================================================
+
+var (
+	// Built by setupInfrastructure
+	retries retryPolicy
+)
+
+type RetryConfig struct {
+	MaxAttempts int // Against the primary processor before falling back
+	// Exponential backoff: base * 2^(retry-1), capped at MaxDelay
+	BaseDelay, MaxDelay time.Duration
+	// Stop retrying the primary once this much time went into it
+	MaxElapsed time.Duration
+	// "full" (uniform in [0, delay]), "equal" (delay/2 + uniform) or "none"
+	Jitter string
+}
+
+func loadRetryConfig(env *envParser) RetryConfig {
+	c := RetryConfig{
+		MaxAttempts: env.int("RETRY_MAX_ATTEMPTS", 5, 1),
+		BaseDelay:   env.durationOrZero("RETRY_BASE_DELAY", 100*time.Millisecond),
+		MaxDelay:    env.durationOrZero("RETRY_MAX_DELAY", time.Second),
+		MaxElapsed:  env.duration("RETRY_MAX_ELAPSED", 3*time.Second),
+		Jitter:      env.oneOf("RETRY_JITTER", "full", "full", "equal", "none"),
+	}
+	if c.MaxDelay < c.BaseDelay {
+		env.fail("RETRY_MAX_DELAY", c.MaxDelay.String(), "must be at least RETRY_BASE_DELAY")
+	}
+	return c
+}
+
+// Result of one processor call
+type forwardOutcome int
+
+const (
+	forwardAccepted  forwardOutcome = iota // 2xx, or 422: the processor already has it
+	forwardRetryable                       // Timeout, connection error, 5xx or 429
+	forwardRejected                        // Any other 4xx: the same request will never succeed
+	forwardTimedOut                        // Timed out: the processor may or may not have it
+	forwardAbsent                          // Timed out, then verified missing: safe to resend anywhere
+)
+
+// Worth another attempt
+func (o forwardOutcome) retryable() bool {
+	return o == forwardRetryable || o == forwardTimedOut || o == forwardAbsent
+}
+
+func classifyStatus(code int) forwardOutcome {
+	switch {
+	case code/100 == 2, code == http.StatusUnprocessableEntity:
+		return forwardAccepted
+	case code/100 == 5, code == http.StatusTooManyRequests:
+		return forwardRetryable
+	}
+	return forwardRejected
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	base, max   time.Duration
+	maxElapsed  time.Duration
+	jitter      string
+}
+
+func newRetryPolicy(cfg RetryConfig) retryPolicy {
+	return retryPolicy{
+		maxAttempts: cfg.MaxAttempts,
+		base:        cfg.BaseDelay,
+		max:         cfg.MaxDelay,
+		maxElapsed:  cfg.MaxElapsed,
+		jitter:      cfg.Jitter,
+	}
+}
+
+// Wait before retry n (1 for the first retry)
+func (p retryPolicy) Delay(n int) time.Duration {
+	delay := p.max
+	if exp := p.base << (n - 1); n < 32 && exp > 0 && exp < p.max {
+		delay = exp
+	}
+	if delay <= 0 {
+		return 0
+	}
+	switch p.jitter {
+	case "full":
+		return time.Duration(rand.Int63n(int64(delay) + 1))
+	case "equal":
+		return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	return delay
+}
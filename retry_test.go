@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := retryPolicy{base: 100 * time.Millisecond, max: time.Second, jitter: "none"}
+	cases := []struct {
+		n    int
+		want time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		// The shift overflows long before here; the cap still holds
+		{31, time.Second},
+		{40, time.Second},
+		{64, time.Second},
+	}
+	for _, c := range cases {
+		if got := p.Delay(c.n); got != c.want {
+			t.Errorf("Delay(%d) = %s, want %s", c.n, got, c.want)
+		}
+	}
+
+	if got := (retryPolicy{max: 0, jitter: "full"}).Delay(3); got != 0 {
+		t.Errorf("Delay with no base or max = %s, want 0", got)
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	cases := []struct {
+		jitter   string
+		min, max time.Duration
+	}{
+		{"full", 0, 400 * time.Millisecond},
+		{"equal", 200 * time.Millisecond, 400 * time.Millisecond},
+		{"none", 400 * time.Millisecond, 400 * time.Millisecond},
+	}
+	for _, c := range cases {
+		p := retryPolicy{base: 100 * time.Millisecond, max: time.Second, jitter: c.jitter}
+		for i := 0; i < 1000; i++ {
+			if got := p.Delay(3); got < c.min || got > c.max {
+				t.Fatalf("%s jitter: Delay(3) = %s, want within [%s, %s]", c.jitter, got, c.min, c.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// ROUTING SCORE
+// ============================================================================
+
+var (
+	routing atomic.Pointer[routingTuning]
+
+	routingLog = componentLogger("routing")
+)
+
+// Smoothing of the per-processor averages; higher reacts faster
+const routingAlpha = 0.2
+
+type routingTuning struct {
+	Strategy    string  `json:"strategy"`
+	LatencyCoef float64 `json:"latencyCoef"`
+	ErrorCoef   float64 `json:"errorCoef"`
+	FeeCoef     float64 `json:"feeCoef"`
+}
+
+// The startup tuning. Strategy weights follows the WEIGHT shares (or fees
+// with COST_AWARE_ROUTING); score sends the processor with the lowest
+// score = latency*latencyEwmaMs + errors*errorRate + fee*feeRate first, so
+// with the default coefficients a 10% error rate or a 5% fee weighs like
+// 100ms or 50ms. All of it is switchable live through PUT /admin/routing.
+func loadRoutingTuning(env *envParser) routingTuning {
+	return routingTuning{
+		Strategy:    env.oneOf("ROUTING_STRATEGY", "weights", "weights", "score"),
+		LatencyCoef: env.float("ROUTING_LATENCY_COEF", 1, 0, math.Inf(1)),
+		ErrorCoef:   env.float("ROUTING_ERROR_COEF", 1000, 0, math.Inf(1)),
+		FeeCoef:     env.float("ROUTING_FEE_COEF", 1000, 0, math.Inf(1)),
+	}
+}
+
+func setupRouting(t routingTuning) {
+	routing.Store(&t)
+}
+
+func (t *routingTuning) valid() bool {
+	return (t.Strategy == "weights" || t.Strategy == "score") &&
+		t.LatencyCoef >= 0 && t.ErrorCoef >= 0 && t.FeeCoef >= 0
+}
+
+// Moving averages of what the workers see when forwarding
+type routeStats struct {
+	mu        sync.Mutex
+	latencyMs float64
+	errorRate float64
+	samples   int64
+}
+
+func (s *routeStats) observe(elapsed time.Duration, failed bool) {
+	ms, errored := float64(elapsed)/float64(time.Millisecond), 0.0
+	if failed {
+		errored = 1
+	}
+	s.mu.Lock()
+	if s.samples == 0 {
+		s.latencyMs, s.errorRate = ms, errored
+	} else {
+		s.latencyMs += routingAlpha * (ms - s.latencyMs)
+		s.errorRate += routingAlpha * (errored - s.errorRate)
+	}
+	s.samples++
+	s.mu.Unlock()
+}
+
+// Score components of one processor, as served by GET /admin/routing
+type routeScore struct {
+	Processor     string  `json:"processor"`
+	LatencyEwmaMs float64 `json:"latencyEwmaMs"`
+	ErrorRate     float64 `json:"errorRate"`
+	FeeRate       float64 `json:"feeRate"`
+	Samples       int64   `json:"samples"`
+	Score         float64 `json:"score"`
+	Weight        int     `json:"weight"`
+	Locality      int     `json:"locality"`
+	Available     bool    `json:"available"`
+}
+
+// Before the first forward the health check's minResponseTime stands in
+// for the latency
+func (p *Processor) routeScore(t *routingTuning, at time.Time) routeScore {
+	p.stats.mu.Lock()
+	s := routeScore{
+		Processor:     p.Name,
+		LatencyEwmaMs: p.stats.latencyMs,
+		ErrorRate:     p.stats.errorRate,
+		Samples:       p.stats.samples,
+	}
+	p.stats.mu.Unlock()
+	if s.Samples == 0 {
+		s.LatencyEwmaMs = float64(p.MinResponseTime())
+	}
+	s.FeeRate = feeRate(p.Name, at)
+	s.Score = t.LatencyCoef*s.LatencyEwmaMs + t.ErrorCoef*s.ErrorRate + t.FeeCoef*s.FeeRate
+	s.Weight, s.Locality, s.Available = p.Weight(), p.Locality(), p.Available()
+	return s
+}
+
+// ----------------------------------------------------------------------------
+// GET/PUT /admin/routing
+// ----------------------------------------------------------------------------
+
+type routingView struct {
+	*routingTuning
+	CostAware  bool         `json:"costAware"`
+	Processors []routeScore `json:"processors"`
+}
+
+// Partial update: absent fields keep their value
+type routingUpdate struct {
+	Strategy    *string        `json:"strategy"`
+	LatencyCoef *float64       `json:"latencyCoef"`
+	ErrorCoef   *float64       `json:"errorCoef"`
+	FeeCoef     *float64       `json:"feeCoef"`
+	Weights     map[string]int `json:"weights"`
+}
+
+func handleAdminRouting(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var u routingUpdate
+		if err := jsonFast.NewDecoder(r.Body).Decode(&u); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", "body must be a routing update object")
+			return
+		}
+		next := *routing.Load()
+		if u.Strategy != nil {
+			next.Strategy = *u.Strategy
+		}
+		if u.LatencyCoef != nil {
+			next.LatencyCoef = *u.LatencyCoef
+		}
+		if u.ErrorCoef != nil {
+			next.ErrorCoef = *u.ErrorCoef
+		}
+		if u.FeeCoef != nil {
+			next.FeeCoef = *u.FeeCoef
+		}
+		if !next.valid() {
+			writeJSONError(w, http.StatusBadRequest, "invalid_routing", "strategy must be weights or score and coefficients non-negative")
+			return
+		}
+		for name, weight := range u.Weights {
+			if processorByName(name) == nil || weight < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid_weight", "unknown processor or negative weight: "+name)
+				return
+			}
+		}
+		for name, weight := range u.Weights {
+			processorByName(name).SetWeight(weight)
+		}
+		routing.Store(&next)
+		routingLog.Info("routing tuned", "strategy", next.Strategy,
+			"latencyCoef", next.LatencyCoef, "errorCoef", next.ErrorCoef, "feeCoef", next.FeeCoef)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	tuning, now := routing.Load(), time.Now()
+	view := routingView{routingTuning: tuning, CostAware: costAware}
+	for _, p := range processors {
+		view.Processors = append(view.Processors, p.routeScore(tuning, now))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(view)
+}
@@ -0,0 +1,83 @@
+package main
+
+import "os"
+
+// ============================================================================
+// SANDBOX ENVIRONMENT
+// ============================================================================
+
+var (
+	// Set from Config.Environments by setupSandbox
+	environments EnvironmentConfig
+
+	// Nil without a sandbox pair
+	sandboxDefault  *Processor
+	sandboxFallback *Processor
+)
+
+// The sandbox processors are named after their production counterparts,
+// which keeps their summary keys, metrics and statuses apart
+const sandboxPrefix = "sandbox_"
+
+type EnvironmentConfig struct {
+	// Environment of payments whose API key has none in APIKeys
+	// (API_KEY_ENVIRONMENTS, "key-a:sandbox,key-b:production"): production
+	// or sandbox. Sandbox payments go to the processors configured under
+	// PAYMENT_PROCESSOR_SANDBOX_DEFAULT_* and PAYMENT_PROCESSOR_SANDBOX_FALLBACK_*
+	// and are summed apart, under /payments-summary?environment=sandbox.
+	Default string
+	APIKeys map[string]string `json:"-"`
+}
+
+// sandbox reports whether the sandbox processor pair is configured
+func loadEnvironmentConfig(env *envParser, sandbox bool) EnvironmentConfig {
+	c := EnvironmentConfig{
+		Default: env.oneOf("GATEWAY_ENVIRONMENT", "production", "production", "sandbox"),
+		APIKeys: parseKeyValues(os.Getenv("API_KEY_ENVIRONMENTS")),
+	}
+	sandboxUsed := c.Default == "sandbox"
+	for key, e := range c.APIKeys {
+		if e != "production" && e != "sandbox" {
+			env.fail("API_KEY_ENVIRONMENTS", key+":"+e, "must be production or sandbox")
+		}
+		sandboxUsed = sandboxUsed || e == "sandbox"
+	}
+	if sandboxUsed && !sandbox {
+		env.fail("GATEWAY_ENVIRONMENT", c.Default, "the sandbox environment needs PAYMENT_PROCESSOR_SANDBOX_DEFAULT_URL and PAYMENT_PROCESSOR_SANDBOX_FALLBACK_URL")
+	}
+	return c
+}
+
+func setupSandbox(cfg Config) {
+	environments = cfg.Environments
+	if cfg.SandboxDefault == nil {
+		return
+	}
+	sandboxDefault = newProcessor(sandboxPrefix+"default", *cfg.SandboxDefault, cfg.Breaker, cfg.Limiter)
+	sandboxFallback = newProcessor(sandboxPrefix+"fallback", *cfg.SandboxFallback, cfg.Breaker, cfg.Limiter)
+	processors = append(processors, sandboxDefault, sandboxFallback)
+}
+
+// Whether a payment sent with apiKey belongs to the sandbox
+func sandboxPayment(apiKey string) bool {
+	if env, ok := environments.APIKeys[apiKey]; ok {
+		return env == "sandbox"
+	}
+	return environments.Default == "sandbox"
+}
+
+// Default and fallback processors of an environment
+func environmentProcessors(sandbox bool) (*Processor, *Processor) {
+	if sandbox {
+		return sandboxDefault, sandboxFallback
+	}
+	return defaultProcessor, fallbackProcessor
+}
+
+// Name the summary of processor ("default" or "fallback") is kept under
+func environmentProcessor(processor string, sandbox bool) string {
+	if sandbox {
+		return sandboxPrefix + processor
+	}
+	return processor
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// PAYMENT SEARCH (GET /payments/search)
+// ============================================================================
+
+type SearchConfig struct {
+	MaxMatches int           // Per shard
+	MaxWindow  time.Duration // Widest from/to (or at±window) one search may scan
+}
+
+func loadSearchConfig(env *envParser) SearchConfig {
+	return SearchConfig{
+		MaxMatches: env.int("SEARCH_MAX_MATCHES", 1000, 1),
+		MaxWindow:  env.duration("SEARCH_MAX_WINDOW", 24*time.Hour),
+	}
+}
+
+// Records of one shard in [ARGV[1], ARGV[2]] ms whose cents fall within
+// [ARGV[3], ARGV[4]], as flat {correlationId, requestedAtMs, cents} triples,
+// at most ARGV[5] of them. Filtering runs in Redis so only matches travel.
+var searchScript = redis.NewScript(`
+local entries = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[2], 'WITHSCORES')
+local min, max, limit = tonumber(ARGV[3]), tonumber(ARGV[4]), tonumber(ARGV[5])
+local out = {}
+for i = 1, #entries, 2000 do
+  local keys, scores = {}, {}
+  for j = i, math.min(i + 1999, #entries), 2 do
+    keys[#keys + 1] = entries[j]
+    scores[#scores + 1] = entries[j + 1]
+  end
+  local cents = redis.call('HMGET', KEYS[2], unpack(keys))
+  for k = 1, #keys do
+    local c = tonumber(cents[k])
+    if c and c >= min and c <= max then
+      out[#out + 1] = redis.call('HGET', KEYS[3], keys[k]) or keys[k]
+      out[#out + 1] = scores[k]
+      out[#out + 1] = cents[k]
+      if #out >= limit * 3 then
+        return out
+      end
+    end
+  end
+end
+return out
+`)
+
+type searchMatch struct {
+	CorrelationId string `json:"correlationId"`
+	Processor     string `json:"processor"`
+	Amount        Cents  `json:"amount"`
+	RequestedAt   string `json:"requestedAt"`
+	// Set outside DEFAULT_CURRENCY
+	Currency string `json:"currency,omitempty"`
+	// Distance from ?at=, when given
+	OffsetSeconds *float64 `json:"offsetSeconds,omitempty"`
+
+	at int64 // requestedAt, unix millis
+}
+
+type searchResponse struct {
+	Results []searchMatch `json:"results"`
+	// A shard hit SEARCH_MAX_MATCHES: narrow the window or the amount
+	Truncated bool `json:"truncated"`
+}
+
+// GET /payments/search?amount=42.00&epsilon=0.50&at=<RFC3339>&window=30m
+//
+// Time is either at±window (default 15m, closest first) or from/to (oldest
+// first); amount is exact unless epsilon widens it. Only payments still in
+// Redis are searched, not the ones tiered to cold storage.
+func handlePaymentSearch(cfg SearchConfig) http.HandlerFunc {
+	maxMatches := cfg.MaxMatches
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+
+		// Amount range in cents
+		minCents, maxCents := Cents(0), Cents(1<<53)
+		if raw := query.Get("amount"); raw != "" {
+			amount, err := parseCents(raw)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid_amount", err.Error())
+				return
+			}
+			epsilon := Cents(0)
+			if raw := query.Get("epsilon"); raw != "" {
+				if epsilon, err = parseCents(raw); err != nil || epsilon < 0 {
+					writeJSONError(w, http.StatusBadRequest, "invalid_epsilon", "epsilon must be a non-negative amount")
+					return
+				}
+			}
+			minCents, maxCents = amount-epsilon, amount+epsilon
+		}
+
+		// Time range
+		var from, to time.Time
+		var at time.Time
+		if raw := query.Get("at"); raw != "" {
+			var err error
+			if at, err = time.Parse(time.RFC3339, raw); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid_at", "at must be an RFC 3339 timestamp")
+				return
+			}
+			window := 15 * time.Minute
+			if raw := query.Get("window"); raw != "" {
+				if window, err = time.ParseDuration(raw); err != nil || window < 0 {
+					writeJSONError(w, http.StatusBadRequest, "invalid_window", "window must be a duration like 30m")
+					return
+				}
+			}
+			from, to = at.Add(-window), at.Add(window)
+		} else {
+			var errFrom, errTo error
+			from, errFrom = time.Parse(time.RFC3339, query.Get("from"))
+			to, errTo = time.Parse(time.RFC3339, query.Get("to"))
+			if errFrom != nil || errTo != nil || to.Before(from) {
+				writeJSONError(w, http.StatusBadRequest, "invalid_range", "give at (with an optional window) or both from and to")
+				return
+			}
+		}
+		if to.Sub(from) > cfg.MaxWindow {
+			writeJSONError(w, http.StatusBadRequest, "window_too_wide", "searches cover at most "+cfg.MaxWindow.String())
+			return
+		}
+
+		limit := 20
+		if raw := query.Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > 100 {
+				writeJSONError(w, http.StatusBadRequest, "invalid_limit", "limit must be between 1 and 100")
+				return
+			}
+			limit = n
+		}
+
+		// Same slot budget as the summaries: a search is a reporting query
+		if !acquireSummarySlot(r.Context()) {
+			metricSummaryBusy.Inc("")
+			writeSummaryBusy(w)
+			return
+		}
+		defer func() { <-summaryLimiter }()
+
+		resp := searchResponse{Results: []searchMatch{}}
+		for _, p := range processors {
+			for _, bucket := range currencyBuckets(r.Context(), p.Name) {
+				for shard := 0; shard < max(historyShards, 1); shard++ {
+					matches, err := searchShard(r.Context(), p.Name, bucket, shard, from, to, minCents, maxCents, maxMatches)
+					if err != nil {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					resp.Truncated = resp.Truncated || len(matches) >= maxMatches
+					resp.Results = append(resp.Results, matches...)
+				}
+			}
+		}
+
+		if at.IsZero() {
+			sort.Slice(resp.Results, func(i, j int) bool { return resp.Results[i].at < resp.Results[j].at })
+		} else {
+			for i := range resp.Results {
+				offset := float64(resp.Results[i].at-at.UnixMilli()) / 1000
+				resp.Results[i].OffsetSeconds = &offset
+			}
+			sort.Slice(resp.Results, func(i, j int) bool {
+				return math.Abs(*resp.Results[i].OffsetSeconds) < math.Abs(*resp.Results[j].OffsetSeconds)
+			})
+		}
+		if len(resp.Results) > limit {
+			resp.Results = resp.Results[:limit]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = jsonFast.NewEncoder(w).Encode(resp)
+	}
+}
+
+func searchShard(ctx context.Context, processor, bucket string, shard int, from, to time.Time, minCents, maxCents Cents, maxMatches int) ([]searchMatch, error) {
+	defer metricRedisLatency.Since("search_shard", time.Now())
+	keys := []string{summaryKey(bucket, "history", shard), summaryKey(bucket, "data", shard), summaryKey(bucket, "ids", shard)}
+	currency := ""
+	if bucket != processor {
+		currency = bucketCurrency(bucket)
+	}
+	flat, err := searchScript.Run(ctx, readClient(), keys,
+		from.UnixMilli(), to.UnixMilli(), int64(minCents), int64(maxCents), maxMatches).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]searchMatch, 0, len(flat)/3)
+	for i := 0; i+2 < len(flat); i += 3 {
+		ms, _ := strconv.ParseInt(flat[i+1], 10, 64)
+		amount, _ := parseRawCents(flat[i+2])
+		matches = append(matches, searchMatch{
+			CorrelationId: flat[i],
+			Processor:     processor,
+			Currency:      currency,
+			Amount:        amount,
+			RequestedAt:   time.UnixMilli(ms).UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+			at:            ms,
+		})
+	}
+	return matches, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// ============================================================================
+// FASTHTTP ENGINE (SERVER_ENGINE=fasthttp)
+// ============================================================================
+
+// POST /payments in async mode is served natively: the body is decoded in
+// place from fasthttp's request buffer and nothing goes through net/http
+// types. Every other route (and sync mode, which parks the request until
+// the outcome) runs the regular handlers through the adaptor. Both log the
+// same request line.
+func serveFastHTTP(ln net.Listener, submitMode string, sc ServerConfig) error {
+	fallback := fasthttpadaptor.NewFastHTTPHandler(logRequests(hideDebug(http.DefaultServeMux)))
+	server := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			if submitMode == "async" && ctx.IsPost() && string(ctx.Path()) == "/payments" {
+				fastReceivePayment(ctx)
+				return
+			}
+			fallback(ctx)
+		},
+		NoDefaultServerHeader: true,
+		NoDefaultDate:         true,
+		// fasthttp has no separate header timeout; ReadTimeout covers both
+		ReadTimeout:  sc.ReadTimeout,
+		WriteTimeout: sc.WriteTimeout,
+		IdleTimeout:  sc.IdleTimeout,
+	}
+	stopServer = server.ShutdownWithContext
+	return server.Serve(ln)
+}
+
+func fastReceivePayment(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	job, ingest, resp := admitPayment(ingestRequest{
+		ctx:         ctx,
+		body:        ctx.PostBody(),
+		apiKey:      string(ctx.Request.Header.Peek("X-API-Key")),
+		clientIP:    pickClientIP(ctx.RemoteAddr().String(), string(ctx.Request.Header.Peek("X-Forwarded-For"))),
+		traceparent: string(ctx.Request.Header.Peek("traceparent")),
+		priority:    string(ctx.Request.Header.Peek("X-Payment-Priority")),
+		namespace:   string(ctx.Request.Header.Peek(NAMESPACE_HEADER)),
+	})
+	if resp == nil {
+		resp = enqueuePayment(job, ingest)
+	}
+	if resp.replay {
+		ctx.Response.Header.Set("Idempotent-Replay", "true")
+	}
+	if resp.retryAfter > 0 {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(resp.retryAfter))
+	}
+	ctx.SetStatusCode(resp.status)
+	if resp.body != nil {
+		ctx.SetContentType("application/json")
+		ctx.SetBody(resp.body)
+	}
+	logRequest(http.MethodPost, "/payments", resp.status, start, ctx.RemoteAddr().String())
+}
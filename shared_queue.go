@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// SHARED WORK QUEUE (INSTANCE_MODE=shared)
+// ============================================================================
+
+var (
+	SHARED_QUEUE_KEY = getEnv("SHARED_QUEUE_KEY", "payments:queue")
+
+	// INSTANCE_MODE=shared; set by setupInfrastructure
+	sharedMode bool
+
+	sharedQueueLog = componentLogger("shared_queue")
+
+	// Stream entries sitting in the local channel or with a worker, until acked
+	sharedInFlight sync.Map
+	// Stream length, sampled: what every instance still has to work through
+	sharedBacklog atomic.Int64
+)
+
+const sharedQueueGroup = "workers"
+
+type SharedQueueConfig struct {
+	// standalone: every instance queues what it ingests in memory. shared:
+	// ingest appends to one Redis stream and the workers of every instance
+	// consume it through a consumer group, balancing load across instances
+	Mode string
+	// Entries pulled at once; the local channel never holds more than that,
+	// so the backlog stays in Redis where any instance can take it
+	Batch int
+	// Entries read but not acked for this long (their instance died) are
+	// claimed by another one
+	ClaimIdle time.Duration
+}
+
+func loadSharedQueueConfig(env *envParser, redis bool, submitMode string) SharedQueueConfig {
+	c := SharedQueueConfig{
+		Mode:      env.oneOf("INSTANCE_MODE", "standalone", "standalone", "shared"),
+		Batch:     env.int("SHARED_QUEUE_BATCH", 100, 1),
+		ClaimIdle: env.duration("SHARED_QUEUE_CLAIM_IDLE", 60*time.Second),
+	}
+	if c.Mode == "shared" && !redis {
+		env.fail("INSTANCE_MODE", c.Mode, "needs the redis store")
+	}
+	if c.Mode == "shared" && submitMode != "async" {
+		env.fail("INSTANCE_MODE", c.Mode, "needs SUBMIT_MODE=async")
+	}
+	return c
+}
+
+func sharedQueue() bool {
+	return sharedMode
+}
+
+func startSharedQueue(cfg SharedQueueConfig) {
+	if !sharedQueue() {
+		return
+	}
+	err := redisClient.XGroupCreateMkStream(context.Background(), SHARED_QUEUE_KEY, sharedQueueGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		panic("shared queue setup failed: " + err.Error())
+	}
+	go feedSharedQueue(cfg.Batch)
+	go claimSharedQueue(cfg.ClaimIdle, cfg.Batch)
+	go sampleSharedBacklog()
+}
+
+// Depth the watermarks and readiness judge: the stream's backlog in
+// shared mode, where the local channel holds one batch at most, and the
+// local channel otherwise. Either is measured against QUEUE_SIZE.
+func queueBacklog() int {
+	if sharedQueue() {
+		return int(sharedBacklog.Load())
+	}
+	return len(paymentQueue)
+}
+
+func queueFillPercent() int {
+	return queueBacklog() * 100 / cap(paymentQueue)
+}
+
+// Entries are deleted once acked, so the stream length is what is left
+// unread plus what is pending anywhere
+func sampleSharedBacklog() {
+	ctx := context.Background()
+	for {
+		if n, err := redisClient.XLen(ctx, SHARED_QUEUE_KEY).Result(); err == nil {
+			sharedBacklog.Store(n)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// Appends an admitted payment for whichever instance gets to it first. The
+// stream is durable, so it stands in for the WAL in this mode.
+func sharedEnqueue(ctx context.Context, payment PostPayments) error {
+	data, err := encodeQueued(payment)
+	if err != nil {
+		return err
+	}
+	defer metricRedisLatency.Since("shared_enqueue", time.Now())
+	return redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: SHARED_QUEUE_KEY,
+		Values: []interface{}{"p", data, "tenant", payment.tenant, "callback", payment.callbackURL, "namespace", payment.namespace, "sandbox", payment.sandbox, "instance", INSTANCE_ID},
+	}).Err()
+}
+
+// Acks and drops an entry once its outcome has been recorded; the summary is
+// written only by the instance that processed it
+func sharedAck(id string) {
+	if id == "" {
+		return
+	}
+	sharedInFlight.Delete(id)
+	ctx := context.Background()
+	pipe := redisClient.Pipeline()
+	pipe.XAck(ctx, SHARED_QUEUE_KEY, sharedQueueGroup, id)
+	pipe.XDel(ctx, SHARED_QUEUE_KEY, id)
+	_, _ = pipe.Exec(ctx)
+}
+
+// Keeps the local channel topped up from the stream until shutdown starts
+func feedSharedQueue(batch int) {
+	ctx := context.Background()
+	for !draining.Load() {
+		room := batch - len(paymentQueue)
+		if room <= 0 {
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		streams, err := redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    sharedQueueGroup,
+			Consumer: INSTANCE_ID,
+			Streams:  []string{SHARED_QUEUE_KEY, ">"},
+			Count:    int64(room),
+			Block:    time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			sharedQueueLog.Error("shared queue read failed", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				queueSharedEntry(msg)
+			}
+		}
+	}
+}
+
+// Takes over entries left pending by instances that stopped acking. Idle
+// means slow as often as dead: an entry whose owner still heartbeats is
+// left alone, and so is one of this instance's own still in flight. Its
+// own entries that are not (they didn't fit in the channel, or a previous
+// run under the same INSTANCE_ID read them) are queued again.
+func claimSharedQueue(idle time.Duration, batch int) {
+	ctx := context.Background()
+	for {
+		time.Sleep(jittered(idle / 2))
+		if draining.Load() {
+			return
+		}
+		start, claimed := "-", 0
+		live := map[string]bool{INSTANCE_ID: true}
+		for {
+			count := min(batch, cap(paymentQueue)-len(paymentQueue))
+			if count <= 0 {
+				break
+			}
+			pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: SHARED_QUEUE_KEY,
+				Group:  sharedQueueGroup,
+				Idle:   idle,
+				Start:  start,
+				End:    "+",
+				Count:  int64(count),
+			}).Result()
+			if err != nil {
+				sharedQueueLog.Error("shared queue claim failed", "err", err)
+				break
+			}
+			var ids []string
+			for _, entry := range pending {
+				if abandonedEntry(ctx, entry, live) {
+					ids = append(ids, entry.ID)
+				}
+			}
+			if len(ids) > 0 {
+				// MinIdle again: an entry another instance claimed or acked
+				// meanwhile is no longer idle and is skipped
+				msgs, err := redisClient.XClaim(ctx, &redis.XClaimArgs{
+					Stream:   SHARED_QUEUE_KEY,
+					Group:    sharedQueueGroup,
+					Consumer: INSTANCE_ID,
+					MinIdle:  idle,
+					Messages: ids,
+				}).Result()
+				if err != nil {
+					sharedQueueLog.Error("shared queue claim failed", "err", err)
+					break
+				}
+				for _, msg := range msgs {
+					if queueSharedEntry(msg) {
+						claimed++
+					}
+				}
+			}
+			if len(pending) < count {
+				break
+			}
+			start = "(" + pending[len(pending)-1].ID
+		}
+		if claimed > 0 {
+			sharedQueueLog.Warn("claimed abandoned shared queue entries", "payments", claimed)
+		}
+	}
+}
+
+// Whether an idle pending entry has nobody working on it. live caches the
+// heartbeat lookups of one claim round.
+func abandonedEntry(ctx context.Context, entry redis.XPendingExt, live map[string]bool) bool {
+	if entry.Consumer == INSTANCE_ID {
+		_, held := sharedInFlight.Load(entry.ID)
+		return !held
+	}
+	alive, seen := live[entry.Consumer]
+	if !seen {
+		n, err := redisClient.Exists(ctx, instanceKeyPrefix+entry.Consumer).Result()
+		// Unknown counts as alive: a duplicate forward is worse than a late one
+		alive = err != nil || n > 0
+		live[entry.Consumer] = alive
+	}
+	return !alive
+}
+
+// Hands an entry to the workers without waiting for room. One that doesn't
+// fit stays pending under this instance and the claimer queues it again
+// once it has idled.
+func queueSharedEntry(msg redis.XMessage) bool {
+	var payment PostPayments
+	data, _ := msg.Values["p"].(string)
+	if decodeQueued(data, &payment) != nil {
+		sharedAck(msg.ID)
+		return false
+	}
+	payment.tenant, _ = msg.Values["tenant"].(string)
+	payment.callbackURL, _ = msg.Values["callback"].(string)
+	payment.namespace, _ = msg.Values["namespace"].(string)
+	payment.sandbox = msg.Values["sandbox"] == "1"
+	if _, held := sharedInFlight.LoadOrStore(msg.ID, struct{}{}); held {
+		return false
+	}
+	select {
+	case paymentQueue <- paymentJob{PostPayments: payment, ctx: context.Background(), streamID: msg.ID}:
+		return true
+	default:
+		sharedInFlight.Delete(msg.ID)
+		return false
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// GRACEFUL SHUTDOWN
+// ============================================================================
+
+var (
+	// Set once shutdown starts; POST /payments answers 503 from then on
+	draining atomic.Bool
+
+	// Closed once the listener stops; streaming handlers (SSE, long-polls)
+	// end on it so they don't hold shutdown up until its deadline
+	serverStopping = make(chan struct{})
+
+	// Set by the engine: stops accepting and waits for in-flight requests
+	stopServer func(context.Context) error
+
+	shutdownLog = componentLogger("shutdown")
+)
+
+// Waits for SIGINT/SIGTERM, then: stop intake, let in-flight requests
+// finish, drain the queue, flush summaries, leave Consul/peers and exit
+func shutdownOnSignal(sc ServerConfig) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	shutdownLog.Info("shutting down, draining queue", "queued", len(paymentQueue))
+
+	draining.Store(true)
+	deregisterService()
+	stopServing(sc.ShutdownTimeout)
+
+	if left := drainQueue(sc.DrainTimeout); left > 0 {
+		if sharedQueue() {
+			shutdownLog.Warn("drain deadline reached, payments left pending in the shared queue for another instance", "left", left)
+		} else if strictDurability() {
+			shutdownLog.Warn("drain deadline reached, payments left in the WAL for the next start", "left", left)
+		} else {
+			shutdownLog.Error("drain deadline reached, payments dropped", "left", left)
+		}
+	}
+
+	summaryWriter.Close()
+	stopHeartbeat()
+	os.Exit(0)
+}
+
+// Closes the listener and waits up to timeout for open requests to get their
+// responses; whatever is still running after that is cut
+func stopServing(timeout time.Duration) {
+	close(serverStopping)
+	if stopServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := stopServer(ctx); err != nil {
+		shutdownLog.Warn("requests still open at the shutdown deadline", "err", err)
+	}
+}
+
+// Waits until the queue is empty and no worker holds a payment, or until
+// timeout; returns how many payments were still pending
+func drainQueue(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	idleChecks := 0
+	for time.Now().Before(deadline) {
+		// Two consecutive idle samples: a job can sit between the channel
+		// receive and the busy counter for an instant
+		if len(paymentQueue) == 0 && busyWorkers.Load() == 0 {
+			if idleChecks++; idleChecks == 2 {
+				return 0
+			}
+		} else {
+			idleChecks = 0
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return len(paymentQueue) + int(busyWorkers.Load())
+}
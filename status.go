@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// PAYMENT STATUS
+// ============================================================================
+
+var (
+	// Answer resubmitted correlationIds from their status instead of
+	// forwarding them again (IDEMPOTENCY)
+	idempotency bool
+)
+
+// received -> queued -> processing [-> verifying] -> processed-default | processed-fallback | failed
+//
+// A received or queued payment can also be cancelled (DELETE
+// /payments/{correlationId}), which is final.
+//
+// "verifying" marks a forward that timed out while the processor is asked
+// whether it got the payment (see verifier).
+//
+// "received" is written by the ingest claim (see claimPayment), which also
+// rejects correlationIds that were seen before.
+//
+// Writes come from the ingest handler and the workers without coordination,
+// so a transition only applies when it moves the payment forward; a late
+// "queued" can never overwrite "processing" or a final state.
+var advanceStatusScript = redis.NewScript(`
+local rank = {received = 1, queued = 2, processing = 3, verifying = 4}
+local current = redis.call('HGET', KEYS[1], 'state')
+if current == 'cancelled' then
+  return -1
+end
+local from = 0
+if current then
+  from = rank[current] or 5
+end
+if (rank[ARGV[1]] or 5) <= from then
+  return 0
+end
+redis.call('HSET', KEYS[1], 'state', ARGV[1], 'amount', ARGV[2], ARGV[3], ARGV[4], 'instance', ARGV[5])
+return 1
+`)
+
+// Moves a payment to a non-final state, stamping <state>At; true when it
+// was cancelled instead
+func advanceStatus(ctx context.Context, payment PostPayments, state string) bool {
+	defer metricRedisLatency.Since("status_"+state, time.Now())
+	n, _ := advanceStatusScript.Run(ctx, redisClient,
+		[]string{"status:" + payment.CorrelationId},
+		state,
+		payment.Amount.String(),
+		state+"At",
+		time.Now().UTC().Format(time.RFC3339Nano),
+		INSTANCE_ID,
+	).Int()
+	return n == -1
+}
+
+// Registers a first-seen correlationId; a known one returns its status
+// instead, so a resubmitted payment is answered rather than re-forwarded
+var claimPaymentScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+  return redis.call('HGETALL', KEYS[1])
+end
+redis.call('HSET', KEYS[1], 'state', 'received', 'amount', ARGV[1], 'receivedAt', ARGV[2], 'instance', ARGV[3])
+return {}
+`)
+
+func claimPayment(ctx context.Context, payment PostPayments) (map[string]string, bool, error) {
+	defer metricRedisLatency.Since("status_claim", time.Now())
+	flat, err := claimPaymentScript.Run(ctx, redisClient,
+		[]string{"status:" + payment.CorrelationId},
+		payment.Amount.String(),
+		time.Now().UTC().Format(time.RFC3339Nano),
+		INSTANCE_ID,
+	).StringSlice()
+	if err != nil || len(flat) == 0 {
+		return nil, err == nil, err
+	}
+	existing := make(map[string]string, len(flat)/2)
+	for i := 0; i+1 < len(flat); i += 2 {
+		existing[flat[i]] = flat[i+1]
+	}
+	return existing, false, nil
+}
+
+// Writes an intermediate state (queued, processing) unless a brownout is
+// shedding them; the final outcome is always recorded
+func markProgress(ctx context.Context, payment PostPayments, state string) {
+	if !shedding("status") {
+		store.AdvanceStatus(ctx, payment, state)
+	}
+}
+
+// Answers a resubmitted correlationId with what became of the original
+func duplicateResponse(correlationId string, existing map[string]string) *ingestResponse {
+	body, _ := jsonFast.Marshal(newPaymentStatus(correlationId, existing))
+	return &ingestResponse{status: http.StatusOK, body: append(body, '\n'), replay: true}
+}
+
+// Outcome of one payment as served by GET /payments/{correlationId}
+type paymentStatus struct {
+	CorrelationId   string `json:"correlationId"`
+	State           string `json:"state"`
+	Processor       string `json:"processor,omitempty"`
+	Amount          Cents  `json:"amount"`
+	Currency        string `json:"currency,omitempty"`
+	RequestedAt     string `json:"requestedAt,omitempty"`
+	Instance        string `json:"instance,omitempty"`
+	Voided          bool   `json:"voided,omitempty"`
+	CorrectedAmount *Cents `json:"correctedAmount,omitempty"`
+	Refunded        *Cents `json:"refunded,omitempty"`
+}
+
+func newPaymentStatus(correlationId string, fields map[string]string) paymentStatus {
+	status := paymentStatus{
+		CorrelationId: correlationId,
+		State:         fields["state"],
+		Processor:     fields["processor"],
+		Currency:      fields["currency"],
+		RequestedAt:   fields["requestedAt"],
+		Instance:      fields["instance"],
+		Voided:        fields["voided"] == "1",
+	}
+	status.Amount, _ = parseCents(fields["amount"])
+	if v, ok := fields["correctedAmount"]; ok {
+		corrected, _ := parseCents(v)
+		status.CorrectedAmount = &corrected
+	}
+	if v, ok := fields["refunded"]; ok {
+		refunded, _ := parseRawCents(v)
+		status.Refunded = &refunded
+	}
+	return status
+}
+
+// GET /payments/{correlationId}
+// DELETE /payments/{correlationId}
+// POST /payments/{correlationId}/refund
+func handlePaymentStatus(w http.ResponseWriter, r *http.Request) {
+	correlationId := strings.TrimPrefix(r.URL.Path, "/payments/")
+	if id, ok := strings.CutSuffix(correlationId, "/refund"); ok && redisBacked() && id != "" && !strings.Contains(id, "/") {
+		handleRefund(w, r, id)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if correlationId == "" || strings.Contains(correlationId, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		handleCancelPayment(w, r, correlationId)
+		return
+	}
+
+	fields, err := lookupStatus(r.Context(), correlationId)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if len(fields) == 0 || fields["state"] == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(newPaymentStatus(correlationId, fields))
+}
+
+// ----------------------------------------------------------------------------
+// POST /payments/status
+// ----------------------------------------------------------------------------
+
+type bulkStatusRequest struct {
+	CorrelationIds []string `json:"correlationIds"`
+}
+
+type bulkStatusResponse struct {
+	Payments []paymentStatus `json:"payments"`
+	// Requested ids the gateway has never seen, in request order
+	Missing []string `json:"missing"`
+}
+
+// Looks up to maxIds (STATUS_BULK_MAX) payments in one round trip, for reconciliation
+// jobs; duplicates in the request are answered once
+func handleBulkStatus(maxIds int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req bulkStatusRequest
+		if err := jsonFast.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", "body must be {\"correlationIds\": [...]}")
+			return
+		}
+		if len(req.CorrelationIds) == 0 || len(req.CorrelationIds) > maxIds {
+			writeJSONError(w, http.StatusBadRequest, "invalid_batch", "send between 1 and "+strconv.Itoa(maxIds)+" correlationIds")
+			return
+		}
+
+		ids := make([]string, 0, len(req.CorrelationIds))
+		seen := make(map[string]bool, len(req.CorrelationIds))
+		for _, id := range req.CorrelationIds {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+
+		statuses, err := store.Statuses(r.Context(), ids)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		resp := bulkStatusResponse{Payments: []paymentStatus{}, Missing: []string{}}
+		for i, id := range ids {
+			fields := statuses[i]
+			// Tiered payments only exist in cold storage
+			if len(fields) == 0 && coldStore != nil {
+				if fields, err = lookupStatus(r.Context(), id); err != nil {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+			}
+			if len(fields) == 0 || fields["state"] == "" {
+				resp.Missing = append(resp.Missing, id)
+				continue
+			}
+			resp.Payments = append(resp.Payments, newPaymentStatus(id, fields))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = jsonFast.NewEncoder(w).Encode(resp)
+	}
+}
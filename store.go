@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// STORAGE BACKENDS
+// ============================================================================
+
+var (
+	// Built by setupInfrastructure
+	store     Store
+	storeKind string
+)
+
+type StoreConfig struct {
+	// "redis" (shared, durable), "memory" (single instance, no Redis needed)
+	// or "dynamodb" (shared, durable, see dynamoStore)
+	Kind string
+	// Width of the time buckets DynamoDB payments are partitioned by
+	DynamoPartition time.Duration
+}
+
+func loadStoreConfig(env *envParser) StoreConfig {
+	c := StoreConfig{
+		Kind:            env.oneOf("STORE", "redis", "redis", "memory", "dynamodb"),
+		DynamoPartition: env.duration("DYNAMODB_PARTITION", time.Hour),
+	}
+	if c.DynamoPartition < time.Minute {
+		env.fail("DYNAMODB_PARTITION", c.DynamoPartition.String(), "must be at least 1m")
+	}
+	return c
+}
+
+// Persistence used by the payment path: outcomes, status and summaries.
+// WAL, DLQ, corrections, fee reports, tiering and instance coordination
+// stay Redis-only and are disabled under the other stores.
+type Store interface {
+	// Claim registers a new correlationId in state "received". If the id
+	// is already known it returns the existing status and claimed=false.
+	Claim(ctx context.Context, payment PostPayments) (existing map[string]string, claimed bool, err error)
+	// Release forgets a claim whose payment was never queued
+	Release(ctx context.Context, correlationId string)
+
+	RecordPayment(processor string, payment PostPayments)
+	// RecordPayments writes a batch from the summary writers in one go
+	RecordPayments(batch []summaryJob)
+	RecordFailure(payment PostPayments)
+	// AdvanceStatus reports true, without writing, for a cancelled payment
+	AdvanceStatus(ctx context.Context, payment PostPayments, state string) (cancelled bool)
+	// Cancel moves a received or queued payment to "cancelled" and returns
+	// the state it found ("" for an unknown correlationId)
+	Cancel(ctx context.Context, correlationId string) (string, error)
+	Status(ctx context.Context, correlationId string) (map[string]string, error)
+	// Statuses looks several up at once; missing ids get an empty map
+	Statuses(ctx context.Context, correlationIds []string) ([]map[string]string, error)
+	Summary(processor string, from, to time.Time) SummaryData
+	// SummarySeries emits the non-empty buckets of [from, to] in time order
+	SummarySeries(ctx context.Context, processor string, from, to time.Time, bucket time.Duration, emit func(summaryBucket) error) error
+	// Purge forgets every payment and returns how many keys/records went
+	Purge(ctx context.Context) (int, error)
+}
+
+func newStore(cfg StoreConfig) Store {
+	switch cfg.Kind {
+	case "memory":
+		return newMemoryStore()
+	case "dynamodb":
+		return newDynamoStore(cfg.DynamoPartition)
+	}
+	return redisStore{}
+}
+
+// Whether Redis-only features are available
+func redisBacked() bool {
+	return storeKind == "redis"
+}
+
+// ----------------------------------------------------------------------------
+// Redis
+// ----------------------------------------------------------------------------
+
+type redisStore struct{}
+
+func (redisStore) Claim(ctx context.Context, payment PostPayments) (map[string]string, bool, error) {
+	return claimPayment(ctx, payment)
+}
+
+func (redisStore) Release(ctx context.Context, correlationId string) {
+	_ = redisClient.Del(ctx, "status:"+correlationId).Err()
+}
+
+func (redisStore) RecordPayment(processor string, payment PostPayments) {
+	saveSummary(processor, payment)
+}
+
+func (redisStore) RecordPayments(batch []summaryJob) {
+	saveSummaries(batch)
+}
+
+func (redisStore) RecordFailure(payment PostPayments) {
+	saveFailedStatus(payment)
+}
+
+func (redisStore) AdvanceStatus(ctx context.Context, payment PostPayments, state string) bool {
+	return advanceStatus(ctx, payment, state)
+}
+
+func (redisStore) Cancel(ctx context.Context, correlationId string) (string, error) {
+	return cancelPayment(ctx, correlationId)
+}
+
+func (redisStore) Status(ctx context.Context, correlationId string) (map[string]string, error) {
+	return redisClient.HGetAll(ctx, "status:"+correlationId).Result()
+}
+
+// One pipeline of HGETALLs, read from the primary like single lookups
+func (redisStore) Statuses(ctx context.Context, correlationIds []string) ([]map[string]string, error) {
+	defer metricRedisLatency.Since("status_bulk", time.Now())
+	cmds := make([]*redis.MapStringStringCmd, len(correlationIds))
+	_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range correlationIds {
+			cmds[i] = pipe.HGetAll(ctx, "status:"+id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]map[string]string, len(cmds))
+	for i, cmd := range cmds {
+		statuses[i] = cmd.Val()
+	}
+	return statuses, nil
+}
+
+func (redisStore) Summary(processor string, from, to time.Time) SummaryData {
+	return getSummaryData(processor, from, to)
+}
+
+func (redisStore) SummarySeries(ctx context.Context, processor string, from, to time.Time, bucket time.Duration, emit func(summaryBucket) error) error {
+	return redisSummarySeries(ctx, processor, from, to, bucket, emit)
+}
+
+func (redisStore) Purge(ctx context.Context) (int, error) {
+	return purgeGatewayKeys(ctx)
+}
+
+// ----------------------------------------------------------------------------
+// Memory
+// ----------------------------------------------------------------------------
+
+type memoryRecord struct {
+	at     int64 // requestedAt, unix millis
+	amount Cents
+}
+
+// Same semantics as the Redis store (a payment recorded twice counts once,
+// status only moves forward) without durability. Summaries scan every
+// record, which is fine for tests and single-instance workloads.
+type memoryStore struct {
+	mu       sync.RWMutex
+	records  map[string]map[string]memoryRecord // currencyBucket -> correlationId -> record
+	statuses map[string]map[string]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		records:  make(map[string]map[string]memoryRecord),
+		statuses: make(map[string]map[string]string),
+	}
+}
+
+func (s *memoryStore) Claim(ctx context.Context, payment PostPayments) (map[string]string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.statuses[payment.CorrelationId]; ok {
+		copied := make(map[string]string, len(existing))
+		for k, v := range existing {
+			copied[k] = v
+		}
+		return copied, false, nil
+	}
+	s.setStatus(payment, "received", "receivedAt", time.Now().UTC().Format(time.RFC3339Nano))
+	return nil, true, nil
+}
+
+func (s *memoryStore) Purge(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.statuses)
+	s.records = make(map[string]map[string]memoryRecord)
+	s.statuses = make(map[string]map[string]string)
+	return n, nil
+}
+
+func (s *memoryStore) Release(ctx context.Context, correlationId string) {
+	s.mu.Lock()
+	delete(s.statuses, correlationId)
+	s.mu.Unlock()
+}
+
+func (s *memoryStore) RecordPayments(batch []summaryJob) {
+	for _, job := range batch {
+		s.RecordPayment(job.processor, job.payment)
+	}
+}
+
+func (s *memoryStore) RecordPayment(processor string, payment PostPayments) {
+	ts, _ := time.Parse("2006-01-02T15:04:05.000Z07:00", payment.RequestedAt)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket := currencyBucket(processor, payment.Currency)
+	if s.records[bucket] == nil {
+		s.records[bucket] = make(map[string]memoryRecord)
+	}
+	s.records[bucket][payment.CorrelationId] = memoryRecord{at: ts.UnixMilli(), amount: payment.Amount}
+	s.setStatus(payment, "processed-"+processor, "processor", processor, "requestedAt", payment.RequestedAt)
+	if payment.Currency != "" {
+		s.statuses[payment.CorrelationId]["currency"] = payment.Currency
+	}
+}
+
+func (s *memoryStore) RecordFailure(payment PostPayments) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setStatus(payment, "failed", "requestedAt", payment.RequestedAt)
+}
+
+var statusRank = map[string]int{"received": 1, "queued": 2, "processing": 3, "verifying": 4}
+
+func (s *memoryStore) AdvanceStatus(ctx context.Context, payment PostPayments, state string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from := 0
+	if current, ok := s.statuses[payment.CorrelationId]; ok {
+		if current["state"] == "cancelled" {
+			return true
+		}
+		if from = statusRank[current["state"]]; from == 0 {
+			from = 5
+		}
+	}
+	if statusRank[state] > from {
+		s.setStatus(payment, state, state+"At", time.Now().UTC().Format(time.RFC3339Nano))
+	}
+	return false
+}
+
+func (s *memoryStore) Cancel(ctx context.Context, correlationId string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.statuses[correlationId]
+	state := status["state"]
+	if state == "received" || state == "queued" {
+		status["state"] = "cancelled"
+		status["cancelledAt"] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	return state, nil
+}
+
+// Caller holds s.mu
+func (s *memoryStore) setStatus(payment PostPayments, state string, fields ...string) {
+	status := s.statuses[payment.CorrelationId]
+	if status == nil {
+		status = make(map[string]string)
+		s.statuses[payment.CorrelationId] = status
+	}
+	status["state"] = state
+	status["amount"] = payment.Amount.String()
+	status["instance"] = INSTANCE_ID
+	for i := 0; i+1 < len(fields); i += 2 {
+		status[fields[i]] = fields[i+1]
+	}
+}
+
+func (s *memoryStore) Status(ctx context.Context, correlationId string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status := make(map[string]string, len(s.statuses[correlationId]))
+	for k, v := range s.statuses[correlationId] {
+		status[k] = v
+	}
+	return status, nil
+}
+
+func (s *memoryStore) Statuses(ctx context.Context, correlationIds []string) ([]map[string]string, error) {
+	statuses := make([]map[string]string, len(correlationIds))
+	for i, id := range correlationIds {
+		statuses[i], _ = s.Status(ctx, id)
+	}
+	return statuses, nil
+}
+
+func (s *memoryStore) Summary(processor string, from, to time.Time) SummaryData {
+	min, max := from.UnixMilli(), to.UnixMilli()
+	result := SummaryData{}
+	s.mu.RLock()
+	for _, record := range s.records[processor] {
+		if record.at >= min && record.at <= max {
+			result.TotalRequests++
+			result.TotalAmount += record.amount
+		}
+	}
+	s.mu.RUnlock()
+	return result
+}
+
+func (s *memoryStore) SummarySeries(ctx context.Context, processor string, from, to time.Time, bucket time.Duration, emit func(summaryBucket) error) error {
+	min, max, size := from.UnixMilli(), to.UnixMilli(), bucket.Milliseconds()
+	buckets := make(map[int64]SummaryData)
+	s.mu.RLock()
+	for _, record := range s.records[processor] {
+		if record.at >= min && record.at <= max {
+			d := buckets[record.at-record.at%size]
+			d.TotalRequests++
+			d.TotalAmount += record.amount
+			buckets[record.at-record.at%size] = d
+		}
+	}
+	s.mu.RUnlock()
+	return emitBuckets(buckets, emit)
+}
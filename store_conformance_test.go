@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ============================================================================
+// STORE CONFORMANCE
+// ============================================================================
+
+// A Store backend is pluggable through newStore, but the gateway relies on
+// semantics the interface can't express: claims are exclusive, statuses only
+// move forward, a payment recorded twice counts once and summary windows are
+// inclusive at both ends. These checks pin them down so a new backend can be
+// run against them before it takes traffic. Every check purges the store,
+// so they run from go test only, never from the gateway binary.
+var storeChecks = []struct {
+	name  string
+	check func(ctx context.Context, s Store) error
+}{
+	{"claim is exclusive", checkStoreClaim},
+	{"concurrent claims", checkStoreConcurrentClaims},
+	{"release frees a claim", checkStoreRelease},
+	{"status only moves forward", checkStoreAdvance},
+	{"cancel", checkStoreCancel},
+	{"record is idempotent", checkStoreRecordIdempotent},
+	{"record batch", checkStoreRecordBatch},
+	{"record failure", checkStoreFailure},
+	{"statuses keep order", checkStoreStatuses},
+	{"summary window", checkStoreSummaryWindow},
+	{"summary isolation", checkStoreSummaryIsolation},
+	{"summary series", checkStoreSeries},
+	{"purge", checkStorePurge},
+}
+
+// Runs every check against s as a subtest. Each one purges s first: never
+// point it at a store holding real data.
+func RunStoreConformance(t *testing.T, s Store) {
+	for _, c := range storeChecks {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := runStoreCheck(ctx, s, c.check); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	RunStoreConformance(t, newMemoryStore())
+}
+
+// The other backends hold real data, so they are checked only when named
+// explicitly, configured from the environment like the gateway:
+//
+//	STORE_CONFORMANCE=redis REDIS_URL=localhost:6379 go test -run StoreConformance
+func TestStoreConformance(t *testing.T) {
+	kind := os.Getenv("STORE_CONFORMANCE")
+	if kind == "" || kind == "memory" {
+		t.Skip("set STORE_CONFORMANCE=redis or dynamodb to check that backend; its data is purged")
+	}
+	t.Setenv("STORE", kind)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupInfrastructure(cfg)
+	RunStoreConformance(t, store)
+}
+
+func runStoreCheck(ctx context.Context, s Store, check func(context.Context, Store) error) error {
+	if _, err := s.Purge(ctx); err != nil {
+		return fmt.Errorf("purge: %w", err)
+	}
+	return check(ctx, s)
+}
+
+// ----------------------------------------------------------------------------
+// Checks
+// ----------------------------------------------------------------------------
+
+// Payments requested at base+offset, far in the past so they can't mix
+// with live data the purge missed
+var conformanceBase = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func conformancePayment(id string, amount Cents, offset time.Duration) PostPayments {
+	return PostPayments{
+		CorrelationId: "conformance-" + id,
+		Amount:        amount,
+		RequestedAt:   conformanceBase.Add(offset).Format("2006-01-02T15:04:05.000Z"),
+	}
+}
+
+func checkStoreClaim(ctx context.Context, s Store) error {
+	p := conformancePayment("claim", 1990, 0)
+	if _, claimed, err := s.Claim(ctx, p); err != nil || !claimed {
+		return fmt.Errorf("first claim: claimed=%v err=%v", claimed, err)
+	}
+	existing, claimed, err := s.Claim(ctx, p)
+	if err != nil || claimed {
+		return fmt.Errorf("second claim: claimed=%v err=%v", claimed, err)
+	}
+	if existing["state"] != "received" {
+		return fmt.Errorf("second claim returned state %q, want received", existing["state"])
+	}
+	return expectState(ctx, s, p, "received")
+}
+
+func checkStoreConcurrentClaims(ctx context.Context, s Store) error {
+	p := conformancePayment("race", 1990, 0)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claims, errs := 0, []error{}
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, claimed, err := s.Claim(ctx, p)
+			mu.Lock()
+			defer mu.Unlock()
+			if claimed {
+				claims++
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if claims != 1 {
+		return fmt.Errorf("%d of 32 concurrent claims succeeded, want 1", claims)
+	}
+	return nil
+}
+
+func checkStoreRelease(ctx context.Context, s Store) error {
+	p := conformancePayment("release", 1990, 0)
+	if _, _, err := s.Claim(ctx, p); err != nil {
+		return err
+	}
+	s.Release(ctx, p.CorrelationId)
+	if err := expectState(ctx, s, p, ""); err != nil {
+		return err
+	}
+	if _, claimed, err := s.Claim(ctx, p); err != nil || !claimed {
+		return fmt.Errorf("claim after release: claimed=%v err=%v", claimed, err)
+	}
+	return nil
+}
+
+func checkStoreAdvance(ctx context.Context, s Store) error {
+	p := conformancePayment("advance", 1990, 0)
+	if _, _, err := s.Claim(ctx, p); err != nil {
+		return err
+	}
+	for _, state := range []string{"queued", "processing"} {
+		if s.AdvanceStatus(ctx, p, state) {
+			return fmt.Errorf("advance to %s reported a cancellation", state)
+		}
+		if err := expectState(ctx, s, p, state); err != nil {
+			return err
+		}
+	}
+	s.AdvanceStatus(ctx, p, "queued")
+	if err := expectState(ctx, s, p, "processing"); err != nil {
+		return fmt.Errorf("moved back: %w", err)
+	}
+	s.RecordPayment("default", p)
+	s.AdvanceStatus(ctx, p, "verifying")
+	return expectState(ctx, s, p, "processed-default")
+}
+
+func checkStoreCancel(ctx context.Context, s Store) error {
+	if state, err := s.Cancel(ctx, "conformance-unknown"); err != nil || state != "" {
+		return fmt.Errorf("cancel of an unknown id: state=%q err=%v", state, err)
+	}
+	p := conformancePayment("cancel", 1990, 0)
+	if _, _, err := s.Claim(ctx, p); err != nil {
+		return err
+	}
+	s.AdvanceStatus(ctx, p, "queued")
+	if state, err := s.Cancel(ctx, p.CorrelationId); err != nil || state != "queued" {
+		return fmt.Errorf("cancel: state=%q err=%v, want queued", state, err)
+	}
+	if !s.AdvanceStatus(ctx, p, "processing") {
+		return errors.New("a cancelled payment moved to processing")
+	}
+	if err := expectState(ctx, s, p, "cancelled"); err != nil {
+		return err
+	}
+
+	processed := conformancePayment("cancel-processed", 1990, 0)
+	s.RecordPayment("default", processed)
+	if state, err := s.Cancel(ctx, processed.CorrelationId); err != nil || state != "processed-default" {
+		return fmt.Errorf("cancel of a processed payment: state=%q err=%v", state, err)
+	}
+	return expectState(ctx, s, processed, "processed-default")
+}
+
+func checkStoreRecordIdempotent(ctx context.Context, s Store) error {
+	p := conformancePayment("twice", 1990, time.Second)
+	s.RecordPayment("default", p)
+	s.RecordPayment("default", p)
+	if err := expectSummary(s, "default", 0, time.Minute, SummaryData{TotalRequests: 1, TotalAmount: 1990}); err != nil {
+		return err
+	}
+	return expectState(ctx, s, p, "processed-default")
+}
+
+func checkStoreRecordBatch(ctx context.Context, s Store) error {
+	batch := make([]summaryJob, 0, 10)
+	for i := 0; i < 10; i++ {
+		batch = append(batch, summaryJob{processor: "fallback", payment: conformancePayment(fmt.Sprint("batch-", i), 100, time.Duration(i)*time.Second)})
+	}
+	// A repeat within the batch counts once too
+	batch = append(batch, batch[0])
+	s.RecordPayments(batch)
+	return expectSummary(s, "fallback", 0, time.Minute, SummaryData{TotalRequests: 10, TotalAmount: 1000})
+}
+
+func checkStoreFailure(ctx context.Context, s Store) error {
+	p := conformancePayment("failed", 1990, 0)
+	if _, _, err := s.Claim(ctx, p); err != nil {
+		return err
+	}
+	s.RecordFailure(p)
+	if err := expectState(ctx, s, p, "failed"); err != nil {
+		return err
+	}
+	return expectSummary(s, "default", 0, time.Minute, SummaryData{})
+}
+
+func checkStoreStatuses(ctx context.Context, s Store) error {
+	a, b := conformancePayment("statuses-a", 100, 0), conformancePayment("statuses-b", 200, 0)
+	s.RecordPayment("default", a)
+	s.RecordPayment("fallback", b)
+	statuses, err := s.Statuses(ctx, []string{b.CorrelationId, "conformance-missing", a.CorrelationId})
+	if err != nil {
+		return err
+	}
+	if len(statuses) != 3 {
+		return fmt.Errorf("%d statuses for 3 ids", len(statuses))
+	}
+	if statuses[0]["state"] != "processed-fallback" || len(statuses[1]) != 0 || statuses[2]["state"] != "processed-default" {
+		return fmt.Errorf("statuses out of order or missing id not empty: %v", statuses)
+	}
+	return nil
+}
+
+// Both ends of a window are inclusive, to the millisecond
+func checkStoreSummaryWindow(ctx context.Context, s Store) error {
+	for i, offset := range []time.Duration{-time.Millisecond, 0, 30 * time.Second, time.Minute, time.Minute + time.Millisecond} {
+		s.RecordPayment("default", conformancePayment(fmt.Sprint("window-", i), 100, offset))
+	}
+	if err := expectSummary(s, "default", 0, time.Minute, SummaryData{TotalRequests: 3, TotalAmount: 300}); err != nil {
+		return err
+	}
+	return expectSummary(s, "default", -time.Hour, time.Hour, SummaryData{TotalRequests: 5, TotalAmount: 500})
+}
+
+// Processors and currencies are summarised apart
+func checkStoreSummaryIsolation(ctx context.Context, s Store) error {
+	s.RecordPayment("default", conformancePayment("iso-default", 100, 0))
+	s.RecordPayment("fallback", conformancePayment("iso-fallback", 200, 0))
+	foreign := conformancePayment("iso-foreign", 400, 0)
+	foreign.Currency = "XTS"
+	s.RecordPayment("default", foreign)
+	if err := expectSummary(s, "default", 0, time.Minute, SummaryData{TotalRequests: 1, TotalAmount: 100}); err != nil {
+		return err
+	}
+	if err := expectSummary(s, "fallback", 0, time.Minute, SummaryData{TotalRequests: 1, TotalAmount: 200}); err != nil {
+		return err
+	}
+	return expectSummary(s, currencyBucket("default", foreign.Currency), 0, time.Minute, SummaryData{TotalRequests: 1, TotalAmount: 400})
+}
+
+// Buckets come in time order, empty ones left out, and add up to the
+// summary of the same window
+func checkStoreSeries(ctx context.Context, s Store) error {
+	for i, offset := range []time.Duration{0, 10 * time.Second, 20 * time.Second, 3 * time.Minute} {
+		s.RecordPayment("default", conformancePayment(fmt.Sprint("series-", i), 100, offset))
+	}
+	var starts []int64
+	total := SummaryData{}
+	err := s.SummarySeries(ctx, "default", conformanceBase, conformanceBase.Add(5*time.Minute), time.Minute, func(b summaryBucket) error {
+		starts = append(starts, b.start)
+		total.TotalRequests += b.TotalRequests
+		total.TotalAmount += b.TotalAmount
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	base := conformanceBase.UnixMilli()
+	if len(starts) != 2 || starts[0] != base || starts[1] != base+3*time.Minute.Milliseconds() {
+		return fmt.Errorf("bucket starts %v, want [%d %d]", starts, base, base+3*time.Minute.Milliseconds())
+	}
+	if want := (SummaryData{TotalRequests: 4, TotalAmount: 400}); total != want {
+		return fmt.Errorf("buckets add up to %+v, want %+v", total, want)
+	}
+	return nil
+}
+
+func checkStorePurge(ctx context.Context, s Store) error {
+	p := conformancePayment("purge", 100, 0)
+	s.RecordPayment("default", p)
+	if n, err := s.Purge(ctx); err != nil || n == 0 {
+		return fmt.Errorf("purge: removed=%d err=%v", n, err)
+	}
+	if err := expectState(ctx, s, p, ""); err != nil {
+		return err
+	}
+	if err := expectSummary(s, "default", 0, time.Minute, SummaryData{}); err != nil {
+		return err
+	}
+	if _, claimed, err := s.Claim(ctx, p); err != nil || !claimed {
+		return fmt.Errorf("claim after purge: claimed=%v err=%v", claimed, err)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Assertions
+// ----------------------------------------------------------------------------
+
+func expectState(ctx context.Context, s Store, p PostPayments, want string) error {
+	status, err := s.Status(ctx, p.CorrelationId)
+	if err != nil {
+		return err
+	}
+	if status["state"] != want {
+		return fmt.Errorf("%s is in state %q, want %q", p.CorrelationId, status["state"], want)
+	}
+	if want != "" && status["amount"] != p.Amount.String() {
+		return fmt.Errorf("%s has amount %q, want %q", p.CorrelationId, status["amount"], p.Amount.String())
+	}
+	return nil
+}
+
+func expectSummary(s Store, processor string, from, to time.Duration, want SummaryData) error {
+	got := s.Summary(processor, conformanceBase.Add(from), conformanceBase.Add(to))
+	if got != want {
+		return fmt.Errorf("summary of %s over [%s, %s]: %+v, want %+v", processor, from, to, got, want)
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// SUMMARY TIME SERIES (/payments-summary?groupBy=minute|hour|day)
+// ============================================================================
+
+var (
+	summaryGroupings = map[string]time.Duration{
+		"minute": time.Minute,
+		"hour":   time.Hour,
+		"day":    24 * time.Hour,
+	}
+
+	seriesLog = componentLogger("summary")
+)
+
+// Buckets aggregated per round trip. The series is read and written chunk
+// by chunk, so a year of minutes never sits in memory at once.
+const seriesChunkBuckets = 1000
+
+// Totals of one bucket; start is unix millis, aligned to the bucket size in UTC
+type summaryBucket struct {
+	start int64
+	SummaryData
+}
+
+// Per-bucket counts and cent sums of one history window, as flat
+// {bucketStart, count, cents} triples for the non-empty buckets only.
+// KEYS: history, data. ARGV: min score, max score, bucket size (ms).
+var seriesScript = redis.NewScript(`
+local entries = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[2], 'WITHSCORES')
+local size = tonumber(ARGV[3])
+local buckets, order = {}, {}
+for i = 1, #entries, 2000 do
+	local ids, scores = {}, {}
+	for j = i, math.min(i + 1999, #entries), 2 do
+		ids[#ids + 1] = entries[j]
+		scores[#scores + 1] = tonumber(entries[j + 1])
+	end
+	local vals = redis.call('HMGET', KEYS[2], unpack(ids))
+	for k, v in ipairs(vals) do
+		local cents = v and tonumber(v)
+		if cents then
+			local b = scores[k] - scores[k] % size
+			local acc = buckets[b]
+			if not acc then
+				acc = {0, 0}
+				buckets[b] = acc
+				order[#order + 1] = b
+			end
+			acc[1] = acc[1] + 1
+			acc[2] = acc[2] + cents
+		end
+	end
+end
+local out = {}
+for _, b in ipairs(order) do
+	out[#out + 1] = string.format('%.0f', b)
+	out[#out + 1] = tostring(buckets[b][1])
+	out[#out + 1] = string.format('%.0f', buckets[b][2])
+end
+return out
+`)
+
+// Per-bucket refunds or corrections of one window, as flat
+// {bucketStart, count, delta} triples over "rawDelta,deltaCount" values.
+// KEYS: history, data. ARGV: min score, max score, bucket size (ms).
+var adjustmentSeriesScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[2], 'WITHSCORES')
+local size = tonumber(ARGV[3])
+local buckets, order = {}, {}
+for i = 1, #ids, 2000 do
+	local members, scores = {}, {}
+	for j = i, math.min(i + 1999, #ids), 2 do
+		members[#members + 1] = ids[j]
+		scores[#scores + 1] = tonumber(ids[j + 1])
+	end
+	local vals = redis.call('HMGET', KEYS[2], unpack(members))
+	for k, v in ipairs(vals) do
+		local delta, n = string.match(v or '', '^(-?%d+),(-?%d+)$')
+		if delta then
+			local b = scores[k] - scores[k] % size
+			local acc = buckets[b]
+			if not acc then
+				acc = {0, 0}
+				buckets[b] = acc
+				order[#order + 1] = b
+			end
+			acc[1] = acc[1] + tonumber(n)
+			acc[2] = acc[2] + tonumber(delta)
+		end
+	end
+end
+local out = {}
+for _, b in ipairs(order) do
+	out[#out + 1] = string.format('%.0f', b)
+	out[#out + 1] = tostring(buckets[b][1])
+	out[#out + 1] = string.format('%.0f', buckets[b][2])
+end
+return out
+`)
+
+// Refunds and corrections of one processor, bucketed like the series
+type seriesAdjustments struct {
+	refunds, corrections map[int64]SummaryData
+}
+
+// Reads the same refunds and corrections getRefundsData and
+// getCorrectionsData total, per bucket. Both are scored by the payment's
+// requestedAt, so they land in the bucket of the payment they adjust.
+func readSeriesAdjustments(ctx context.Context, bucketName string, from, to time.Time, size int64) (seriesAdjustments, error) {
+	var adj seriesAdjustments
+	var err error
+	if adj.refunds, err = adjustmentBuckets(ctx, refundKey(bucketName, "history"), refundKey(bucketName, "data"), from, to, size); err != nil {
+		return adj, err
+	}
+	// Refunds are stored as negative corrections; the series reports them positive
+	for at, d := range adj.refunds {
+		d.TotalAmount = -d.TotalAmount
+		adj.refunds[at] = d
+	}
+	adj.corrections, err = adjustmentBuckets(ctx, correctionKey(bucketName, "history"), correctionKey(bucketName, "data"), from, to, size)
+	return adj, err
+}
+
+func adjustmentBuckets(ctx context.Context, history, data string, from, to time.Time, size int64) (map[int64]SummaryData, error) {
+	began := time.Now()
+	flat, err := adjustmentSeriesScript.Run(ctx, readClient(), []string{history, data}, from.UnixMilli(), to.UnixMilli(), size).StringSlice()
+	metricRedisLatency.Since("summary_series", began)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[int64]SummaryData, len(flat)/3)
+	for i := 0; i+2 < len(flat); i += 3 {
+		at, _ := strconv.ParseInt(flat[i], 10, 64)
+		count, _ := strconv.ParseInt(flat[i+1], 10, 64)
+		cents, _ := parseRawCents(flat[i+2])
+		buckets[at] = SummaryData{TotalRequests: count, TotalAmount: cents}
+	}
+	return buckets, nil
+}
+
+func appendSeriesTotals(buf []byte, name string, d SummaryData) []byte {
+	buf = append(buf, `,"`+name+`":{"totalRequests":`...)
+	buf = strconv.AppendInt(buf, d.TotalRequests, 10)
+	buf = append(buf, `,"totalAmount":`...)
+	buf = append(buf, d.TotalAmount.String()...)
+	return append(buf, '}')
+}
+
+// Streams the series of every processor asked for:
+// {"groupBy":"hour","default":[{"bucket":...,"totalRequests":...,"totalAmount":...}],"fallback":[...]}
+// Empty buckets are left out. Like /payments-summary, totalAmount is net of
+// the bucket's refunds, and a bucket with refunds or corrections lists
+// them alongside, so the buckets add up to the summary of the same window. Once the first byte is out an error can only
+// cut the stream short, which leaves the JSON unterminated.
+func writeSummarySeries(w http.ResponseWriter, r *http.Request, q summaryQuery) {
+	groupBy, bucket := q.groupBy, summaryGroupings[q.groupBy]
+	if !acquireSummarySlot(r.Context()) {
+		metricSummaryBusy.Inc("")
+		writeSummaryBusy(w)
+		return
+	}
+	defer func() { <-summaryLimiter }()
+
+	to := q.to
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/json")
+	buf := []byte(`{"groupBy":"` + groupBy + `"`)
+	for _, processor := range []string{"default", "fallback"} {
+		if !q.fields.has(processor) {
+			continue
+		}
+		buf = append(buf, `,"`+summaryAlias(processor)+`":[`...)
+		first := true
+		bucketName := currencyBucket(environmentProcessor(processor, q.sandbox), q.currency)
+		var adj seriesAdjustments
+		if redisBacked() {
+			var err error
+			if adj, err = readSeriesAdjustments(r.Context(), bucketName, q.from, to, bucket.Milliseconds()); err != nil {
+				seriesLog.Warn("summary series aborted", "processor", processor, "err", err)
+				_, _ = w.Write(buf)
+				return
+			}
+		}
+		err := store.SummarySeries(r.Context(), bucketName, q.from, to, bucket, func(b summaryBucket) error {
+			if !first {
+				buf = append(buf, ',')
+			}
+			first = false
+			buf = append(buf, `{"bucket":"`...)
+			buf = time.UnixMilli(b.start).UTC().AppendFormat(buf, time.RFC3339)
+			refunds, corrections := adj.refunds[b.start], adj.corrections[b.start]
+			buf = append(buf, `","totalRequests":`...)
+			buf = strconv.AppendInt(buf, b.TotalRequests, 10)
+			buf = append(buf, `,"totalAmount":`...)
+			buf = append(buf, (b.TotalAmount - refunds.TotalAmount).String()...)
+			if refunds != (SummaryData{}) && q.fields.has("refunds") {
+				buf = appendSeriesTotals(buf, "refunds", refunds)
+			}
+			if corrections != (SummaryData{}) && q.fields.has("corrections") {
+				buf = appendSeriesTotals(buf, "corrections", corrections)
+			}
+			buf = append(buf, '}')
+			if len(buf) < 32*1024 {
+				return nil
+			}
+			_, err := w.Write(buf)
+			buf = buf[:0]
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return err
+		})
+		if err != nil {
+			seriesLog.Warn("summary series aborted", "processor", processor, "err", err)
+			_, _ = w.Write(buf)
+			return
+		}
+		buf = append(buf, ']')
+	}
+	buf = append(buf, "}\n"...)
+	_, _ = w.Write(buf)
+}
+
+// Walks [from, to] chunk by chunk, merging the shards of each chunk before
+// emitting its buckets in time order. Each chunk starts at the next recorded
+// payment, so gaps (and the default from=epoch) cost one lookup, not a
+// round trip per empty chunk.
+func redisSummarySeries(ctx context.Context, processor string, from, to time.Time, bucket time.Duration, emit func(summaryBucket) error) error {
+	size := bucket.Milliseconds()
+	for cursor := from.UnixMilli(); cursor <= to.UnixMilli(); {
+		next, ok, err := nextHistoryScore(ctx, processor, cursor, to.UnixMilli())
+		if err != nil || !ok {
+			return err
+		}
+		chunk := next - next%size
+		lo, hi := max(chunk, cursor), min(chunk+size*seriesChunkBuckets-1, to.UnixMilli())
+		cursor = hi + 1
+		merged := make(map[int64]SummaryData)
+		for shard := 0; shard < max(historyShards, 1); shard++ {
+			keys := []string{summaryKey(processor, "history", shard), summaryKey(processor, "data", shard)}
+			began := time.Now()
+			flat, err := seriesScript.Run(ctx, readClient(), keys, lo, hi, size).StringSlice()
+			metricRedisLatency.Since("summary_series", began)
+			if err != nil {
+				return err
+			}
+			for i := 0; i+2 < len(flat); i += 3 {
+				at, _ := strconv.ParseInt(flat[i], 10, 64)
+				count, _ := strconv.ParseInt(flat[i+1], 10, 64)
+				cents, _ := parseRawCents(flat[i+2])
+				d := merged[at]
+				d.TotalRequests += count
+				d.TotalAmount += cents
+				merged[at] = d
+			}
+		}
+		if err := emitBuckets(merged, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Earliest history score in [from, to] across the shards
+func nextHistoryScore(ctx context.Context, processor string, from, to int64) (int64, bool, error) {
+	var next int64
+	found := false
+	for shard := 0; shard < max(historyShards, 1); shard++ {
+		entries, err := readClient().ZRangeByScoreWithScores(ctx, summaryKey(processor, "history", shard), &redis.ZRangeBy{
+			Min: strconv.FormatInt(from, 10), Max: strconv.FormatInt(to, 10), Count: 1,
+		}).Result()
+		if err != nil {
+			return 0, false, err
+		}
+		if len(entries) == 1 && (!found || int64(entries[0].Score) < next) {
+			next, found = int64(entries[0].Score), true
+		}
+	}
+	return next, found, nil
+}
+
+func emitBuckets(buckets map[int64]SummaryData, emit func(summaryBucket) error) error {
+	starts := make([]int64, 0, len(buckets))
+	for at := range buckets {
+		starts = append(starts, at)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, at := range starts {
+		if err := emit(summaryBucket{start: at, SummaryData: buckets[at]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// LONG-POLL SUMMARY (GET /payments-summary/wait)
+// ============================================================================
+
+type SummaryWaitConfig struct {
+	// How long a wait may block before answering 304, and the most a client
+	// may ask for with ?timeout=
+	Timeout, MaxTimeout time.Duration
+	// How often a waiting request re-reads the totals. Payments recorded by
+	// other instances only show up in Redis, so this polls rather than
+	// listening to the local event bus.
+	Poll time.Duration
+}
+
+func loadSummaryWaitConfig(env *envParser) SummaryWaitConfig {
+	c := SummaryWaitConfig{
+		Timeout:    env.duration("SUMMARY_WAIT_TIMEOUT", 30*time.Second),
+		MaxTimeout: env.duration("SUMMARY_WAIT_MAX_TIMEOUT", 2*time.Minute),
+		Poll:       env.duration("SUMMARY_WAIT_POLL", 250*time.Millisecond),
+	}
+	if c.MaxTimeout < c.Timeout {
+		env.fail("SUMMARY_WAIT_MAX_TIMEOUT", c.MaxTimeout.String(), "must be at least SUMMARY_WAIT_TIMEOUT")
+	}
+	return c
+}
+
+// Opaque version of an encoded summary: equal bodies, equal versions
+func summaryVersion(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// GET /payments-summary/wait?since=<version>&timeout=<duration> - Answers
+// right away when the summary no longer matches since (or since is empty),
+// otherwise blocks until it changes (200) or the timeout passes (304).
+// Takes the same from/to/fields as /payments-summary; the version comes back
+// in X-Summary-Version. A slot is held only while reading, not while waiting.
+func handleSummaryWait(cfg SummaryWaitConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		waitSummary(w, r, cfg)
+	}
+}
+
+func waitSummary(w http.ResponseWriter, r *http.Request, cfg SummaryWaitConfig) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q, ok := parseSummaryQuery(w, r)
+	if !ok {
+		return
+	}
+	if q.groupBy != "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_group_by", "groupBy is not supported when waiting")
+		return
+	}
+	timeout := cfg.Timeout
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 || d > cfg.MaxTimeout {
+			writeJSONError(w, http.StatusBadRequest, "invalid_timeout", "timeout must be a duration up to "+cfg.MaxTimeout.String())
+			return
+		}
+		timeout = d
+	}
+	since := r.URL.Query().Get("since")
+	// May block past SERVER_WRITE_TIMEOUT; give the answer room after it
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 5*time.Second))
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		body, ok := readSummary(r.Context(), q)
+		if !ok {
+			writeSummaryBusy(w)
+			return
+		}
+		version := summaryVersion(body)
+		if version != since {
+			w.Header().Set("X-Summary-Version", version)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(body)
+			return
+		}
+		select {
+		case <-time.After(cfg.Poll):
+		case <-deadline.C:
+			w.Header().Set("X-Summary-Version", version)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-serverStopping:
+			// Shutting down: answer as if the wait had timed out
+			w.Header().Set("X-Summary-Version", version)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
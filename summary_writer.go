@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// SUMMARY WRITER POOL
+// ============================================================================
+
+var (
+	// Built by setupInfrastructure
+	summaryWriter   *summaryWriterPool
+	consistencyMode string
+
+	metricSummaryBatch = newHistogramVec("gateway_summary_batch_size", "Payments per summary write.", "",
+		[]float64{1, 2, 5, 10, 25, 50, 100, 250, 500})
+)
+
+type SummaryWriterConfig struct {
+	Writers   int
+	QueueSize int
+	BatchSize int           // Payments each writer coalesces into one pipeline
+	BatchWait time.Duration // Longest a writer waits for its batch to fill
+	// strict: record before the worker moves on; eventual: record async
+	Consistency string
+}
+
+func loadSummaryWriterConfig(env *envParser) SummaryWriterConfig {
+	return SummaryWriterConfig{
+		Writers:     env.int("SUMMARY_WRITERS", 4, 1),
+		QueueSize:   env.int("SUMMARY_QUEUE_SIZE", 10_000, 1),
+		BatchSize:   env.int("SUMMARY_BATCH_SIZE", 100, 1),
+		BatchWait:   env.durationOrZero("SUMMARY_BATCH_WAIT", 5*time.Millisecond),
+		Consistency: env.oneOf("CONSISTENCY_MODE", "eventual", "eventual", "strict"),
+	}
+}
+
+// Pending summary write
+type summaryJob struct {
+	processor  string
+	payment    PostPayments
+	enqueuedAt time.Time
+}
+
+// Bounded pool of goroutines persisting summaries off the worker path.
+// A full queue blocks the caller, so a slow Redis applies backpressure to
+// payment workers instead of growing memory without limit.
+type summaryWriterPool struct {
+	jobs   chan summaryJob
+	wg     sync.WaitGroup
+	mu     sync.RWMutex // Guards jobs against send-after-close
+	closed bool
+
+	cfg      SummaryWriterConfig
+	lagNanos atomic.Int64 // Enqueue-to-write delay of the last written job
+}
+
+func newSummaryWriterPool(cfg SummaryWriterConfig) *summaryWriterPool {
+	return &summaryWriterPool{jobs: make(chan summaryJob, cfg.QueueSize), cfg: cfg}
+}
+
+func (p *summaryWriterPool) Start() {
+	for i := 0; i < p.cfg.Writers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.writeBatches(p.cfg.BatchSize, p.cfg.BatchWait)
+		}()
+	}
+}
+
+// Blocks for the first payment, then gathers more until the batch is full
+// or wait has passed. A closed queue flushes what was gathered and stops.
+func (p *summaryWriterPool) writeBatches(size int, wait time.Duration) {
+	batch := make([]summaryJob, 0, size)
+	timer := time.NewTimer(wait)
+	timer.Stop()
+	for {
+		job, ok := <-p.jobs
+		if !ok {
+			return
+		}
+		batch = append(batch[:0], job)
+		timer.Reset(wait)
+	gather:
+		for len(batch) < size {
+			select {
+			case job, ok := <-p.jobs:
+				if !ok {
+					break gather
+				}
+				batch = append(batch, job)
+			case <-timer.C:
+				break gather
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		if len(batch) == 1 {
+			store.RecordPayment(batch[0].processor, batch[0].payment)
+		} else {
+			store.RecordPayments(batch)
+		}
+		metricSummaryBatch.Observe("", float64(len(batch)))
+		p.lagNanos.Store(int64(time.Since(batch[0].enqueuedAt)))
+	}
+}
+
+// Enqueue blocks while the queue is full. After Close it writes inline so
+// late payments are never dropped.
+func (p *summaryWriterPool) Enqueue(processor string, payment PostPayments) {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		store.RecordPayment(processor, payment)
+		return
+	}
+	p.jobs <- summaryJob{processor: processor, payment: payment, enqueuedAt: time.Now()}
+	p.mu.RUnlock()
+}
+
+// Close is the flush-on-shutdown barrier: it returns once every queued
+// summary has been written.
+func (p *summaryWriterPool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// Current summary lag: zero in strict mode, otherwise the delay observed
+// by the last write (or zero once the queue is empty)
+func (p *summaryWriterPool) Lag() time.Duration {
+	if len(p.jobs) == 0 {
+		return 0
+	}
+	return time.Duration(p.lagNanos.Load())
+}
+
+func (p *summaryWriterPool) Pending() int {
+	return len(p.jobs)
+}
+
+// Records a processed payment according to CONSISTENCY_MODE. Strict
+// durability and the shared queue always write inline: the WAL entry is
+// dropped, or the stream entry acked, right after, and neither may go
+// before the summary is persisted.
+func recordSummary(ctx context.Context, processor string, payment PostPayments) {
+	// Async mode only hands the record over; the batched write is shared
+	// by many payments and isn't attributed to any one trace
+	span := traceFrom(ctx).StartSpan("record " + processor)
+	defer span.End(false)
+	if consistencyMode == "strict" || strictDurability() || sharedQueue() {
+		span.SetAttr("summary.write", "sync")
+		store.RecordPayment(processor, payment)
+		return
+	}
+	span.SetAttr("summary.write", "async")
+	saveSummaryAsync(processor, payment)
+}
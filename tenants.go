@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// TENANT SETTINGS (/admin/tenants)
+// ============================================================================
+
+var (
+	// Redis hash of tenant -> settings (JSON); not touched by the purge
+	TENANTS_KEY = getEnv("TENANTS_KEY", "tenants:config")
+
+	tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+	tenantDir     atomic.Pointer[tenantDirectory]
+	tenantBuckets = struct {
+		sync.Mutex
+		m map[string]*tokenBucket
+	}{m: make(map[string]*tokenBucket)}
+	tenantFeeds = struct {
+		sync.Mutex
+		m map[string]*tenantFeed
+	}{m: make(map[string]*tenantFeed)}
+	tenantExportEvery time.Duration
+
+	metricTenantRateLimited = newCounterVec("gateway_tenant_rate_limited_total", "Payments refused by a tenant's rate limit.", "tenant")
+
+	tenantLog = componentLogger("tenants")
+)
+
+// Settings of one tenant, as stored and as served by the admin API
+type tenantSettings struct {
+	Tenant string `json:"tenant"`
+	// Keys (X-API-Key) whose payments belong to the tenant, on top of
+	// API_KEY_TENANTS
+	APIKeys []string `json:"apiKeys,omitempty"`
+	// Receive every outcome of the tenant's payments, one POST per event
+	Webhooks []string `json:"webhooks,omitempty"`
+	// Receive the same events batched as NDJSON every TENANT_EXPORT_INTERVAL
+	Exports []string `json:"exports,omitempty"`
+	// Payments per second admitted per instance; 0 is unlimited
+	RateLimit float64 `json:"rateLimit,omitempty"`
+	// Processor -> fee rate charged to the tenant, reported in its events
+	// instead of the FEE_SCHEDULE rate
+	FeeRates  map[string]float64 `json:"feeRates,omitempty"`
+	UpdatedAt string             `json:"updatedAt,omitempty"`
+}
+
+// Loaded settings, swapped whole on every refresh
+type tenantDirectory struct {
+	tenants map[string]tenantSettings
+	byKey   map[string]string
+}
+
+type TenantConfig struct {
+	// How often every instance re-reads the settings, so a change made
+	// through one of them reaches the others
+	Refresh time.Duration
+	// How often buffered events are shipped to a tenant's export destinations
+	ExportInterval time.Duration
+}
+
+func loadTenantConfig(env *envParser) TenantConfig {
+	return TenantConfig{
+		Refresh:        env.duration("TENANT_REFRESH", 5*time.Second),
+		ExportInterval: env.duration("TENANT_EXPORT_INTERVAL", 10*time.Second),
+	}
+}
+
+func startTenants(cfg TenantConfig) {
+	if !redisBacked() {
+		return
+	}
+	tenantExportEvery = cfg.ExportInterval
+	refreshTenants()
+	go func() {
+		for {
+			time.Sleep(jittered(cfg.Refresh))
+			refreshTenants()
+		}
+	}()
+}
+
+func refreshTenants() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	loaded, err := loadTenants(ctx)
+	if err != nil {
+		tenantLog.Warn("tenant settings refresh failed", "err", err)
+		return
+	}
+	applyTenants(loaded)
+}
+
+func loadTenants(ctx context.Context) (map[string]tenantSettings, error) {
+	return readTenants(ctx, redisClient)
+}
+
+func readTenants(ctx context.Context, c redis.Cmdable) (map[string]tenantSettings, error) {
+	raw, err := c.HGetAll(ctx, TENANTS_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(map[string]tenantSettings, len(raw))
+	for name, data := range raw {
+		var s tenantSettings
+		if err := jsonFast.UnmarshalFromString(data, &s); err != nil {
+			tenantLog.Warn("skipping unreadable tenant settings", "tenant", name, "err", err)
+			continue
+		}
+		s.Tenant = name
+		loaded[name] = s
+	}
+	return loaded, nil
+}
+
+// Publishes a new directory, resets the rate limits that changed and
+// (re)subscribes the delivery feeds whose destinations changed. A key
+// stored under two tenants (written around the admin API) stays with the
+// first by name instead of going to whichever is read last.
+func applyTenants(loaded map[string]tenantSettings) {
+	dir := &tenantDirectory{tenants: loaded, byKey: make(map[string]string)}
+	names := make([]string, 0, len(loaded))
+	for name := range loaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, key := range loaded[name].APIKeys {
+			if owner, taken := dir.byKey[key]; taken && owner != name {
+				tenantLog.Warn("API key registered to two tenants, keeping the first", "tenant", owner, "ignored", name)
+				continue
+			}
+			dir.byKey[key] = name
+		}
+	}
+	tenantDir.Store(dir)
+
+	tenantBuckets.Lock()
+	for name, b := range tenantBuckets.m {
+		if s, ok := loaded[name]; !ok || s.RateLimit != b.rate {
+			delete(tenantBuckets.m, name)
+		}
+	}
+	tenantBuckets.Unlock()
+
+	tenantFeeds.Lock()
+	defer tenantFeeds.Unlock()
+	for name, feed := range tenantFeeds.m {
+		if s, ok := loaded[name]; !ok || feed.signature != feedSignature(s) {
+			feed.stop()
+			delete(tenantFeeds.m, name)
+		}
+	}
+	for name, s := range loaded {
+		if _, running := tenantFeeds.m[name]; !running && feedSignature(s) != "" {
+			tenantFeeds.m[name] = startTenantFeed(s)
+		}
+	}
+}
+
+func tenantSettingsFor(tenant string) (tenantSettings, bool) {
+	dir := tenantDir.Load()
+	if dir == nil || tenant == "" {
+		return tenantSettings{}, false
+	}
+	s, ok := dir.tenants[tenant]
+	return s, ok
+}
+
+// Tenant of an API key registered through /admin/tenants
+func registeredTenant(apiKey string) string {
+	if dir := tenantDir.Load(); dir != nil {
+		return dir.byKey[apiKey]
+	}
+	return ""
+}
+
+// Fee rate charged to a tenant for a payment made through processor at t
+func tenantFeeRate(tenant, processor string, t time.Time) float64 {
+	if s, ok := tenantSettingsFor(tenant); ok {
+		if rate, ok := s.FeeRates[processor]; ok {
+			return rate
+		}
+	}
+	return feeRate(processor, t)
+}
+
+// ----------------------------------------------------------------------------
+// Rate limits
+// ----------------------------------------------------------------------------
+
+// Answer for a payment over its tenant's per-instance limit, or nil
+func checkTenantLimit(tenant string) *ingestResponse {
+	s, ok := tenantSettingsFor(tenant)
+	if !ok || s.RateLimit <= 0 {
+		return nil
+	}
+	burst := math.Max(math.Ceil(s.RateLimit), 1)
+	now := time.Now()
+	tenantBuckets.Lock()
+	b := tenantBuckets.m[tenant]
+	if b == nil {
+		b = newTokenBucket(s.RateLimit, burst, now)
+		tenantBuckets.m[tenant] = b
+	}
+	tenantBuckets.Unlock()
+	ok, wait := b.take(now)
+	if ok {
+		return nil
+	}
+	metricTenantRateLimited.Inc(tenant)
+	metricPaymentsRejected.Inc("tenant_rate_limited")
+	return rateLimitedResponse("tenant", s.RateLimit, burst, wait)
+}
+
+// ----------------------------------------------------------------------------
+// Webhooks and exports
+// ----------------------------------------------------------------------------
+
+// Event subscriptions delivering one tenant's outcomes
+type tenantFeed struct {
+	signature string
+	subs      []*eventSubscriber
+}
+
+// Destinations of a tenant; feeds restart only when these change
+func feedSignature(s tenantSettings) string {
+	if len(s.Webhooks) == 0 && len(s.Exports) == 0 {
+		return ""
+	}
+	return strings.Join(s.Webhooks, " ") + "|" + strings.Join(s.Exports, " ")
+}
+
+func startTenantFeed(s tenantSettings) *tenantFeed {
+	feed := &tenantFeed{signature: feedSignature(s)}
+	filter := eventFilter{tenants: map[string]bool{s.Tenant: true}}
+	for _, target := range s.Webhooks {
+		sub := events.Subscribe("tenant:"+s.Tenant, filter)
+		feed.subs = append(feed.subs, sub)
+		go deliverWebhooks(target, sub)
+	}
+	for _, target := range s.Exports {
+		sub := events.Subscribe("tenant_export:"+s.Tenant, filter)
+		feed.subs = append(feed.subs, sub)
+		go exportEvents(target, sub)
+	}
+	return feed
+}
+
+// Closing a channel after Unsubscribe is safe: Publish holds the read lock
+// while sending, so nothing can be sending to it any more
+func (f *tenantFeed) stop() {
+	for _, sub := range f.subs {
+		events.Unsubscribe(sub)
+		close(sub.ch)
+	}
+}
+
+// Buffers events and POSTs them as NDJSON every TENANT_EXPORT_INTERVAL, or
+// sooner once 1MB is waiting. What is buffered when the feed stops is sent.
+func exportEvents(target string, sub *eventSubscriber) {
+	ticker := time.NewTicker(tenantExportEvery)
+	defer ticker.Stop()
+	var batch bytes.Buffer
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			if !ok {
+				postExport(target, sub.name, &batch)
+				return
+			}
+			line, err := jsonFast.Marshal(e)
+			if err != nil {
+				continue
+			}
+			batch.Write(line)
+			batch.WriteByte('\n')
+			if batch.Len() >= 1<<20 {
+				postExport(target, sub.name, &batch)
+			}
+		case <-ticker.C:
+			postExport(target, sub.name, &batch)
+		}
+	}
+}
+
+func postExport(target, name string, batch *bytes.Buffer) {
+	if batch.Len() == 0 {
+		return
+	}
+	body := bytes.Clone(batch.Bytes())
+	batch.Reset()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	signWebhook(req, body)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		tenantLog.Warn("tenant export failed", "subscriber", name, "bytes", len(body), "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		tenantLog.Warn("tenant export rejected", "subscriber", name, "status", resp.StatusCode)
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Admin API
+// ----------------------------------------------------------------------------
+
+// GET /admin/tenants - Every registered tenant, by name
+func handleAdminTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	loaded, err := loadTenants(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	list := make([]tenantSettings, 0, len(loaded))
+	for _, s := range loaded {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	w.Header().Set("Content-Type", "application/json")
+	_ = jsonFast.NewEncoder(w).Encode(map[string]interface{}{"tenants": list})
+}
+
+// GET/PUT/DELETE /admin/tenants/{name} - One tenant's settings. PUT replaces
+// them whole (201 when the tenant is new); changes are live on this instance
+// right away and on the others within TENANT_REFRESH.
+func handleAdminTenant(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/tenants/")
+	if !tenantNamePattern.MatchString(name) {
+		writeJSONError(w, http.StatusNotFound, "unknown_tenant", "tenant names are lowercase letters, digits, - and _")
+		return
+	}
+	ctx := r.Context()
+	loaded, err := loadTenants(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	current, exists := loaded[name]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			writeJSONError(w, http.StatusNotFound, "unknown_tenant", "no tenant named "+name)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = jsonFast.NewEncoder(w).Encode(current)
+
+	case http.MethodPut:
+		var s tenantSettings
+		if err := jsonFast.NewDecoder(r.Body).Decode(&s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", "body must be a tenant settings object")
+			return
+		}
+		s.Tenant = name
+		s.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		data, _ := jsonFast.Marshal(s)
+		// Validated and saved in one transaction, so two instances can't
+		// hand the same key to different tenants at once
+		var code, msg string
+		err := redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			if loaded, err = readTenants(ctx, tx); err != nil {
+				return err
+			}
+			_, exists = loaded[name]
+			if code, msg = validateTenant(s, loaded); code != "" {
+				return nil
+			}
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return pipe.HSet(ctx, TENANTS_KEY, name, data).Err()
+			})
+			return err
+		}, TENANTS_KEY)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if code != "" {
+			status := http.StatusBadRequest
+			if code == "api_key_in_use" {
+				status = http.StatusConflict
+			}
+			writeJSONError(w, status, code, msg)
+			return
+		}
+		loaded[name] = s
+		applyTenants(loaded)
+		tenantLog.Info("tenant settings saved", "tenant", name, "created", !exists)
+
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = jsonFast.NewEncoder(w).Encode(s)
+
+	case http.MethodDelete:
+		if !exists {
+			writeJSONError(w, http.StatusNotFound, "unknown_tenant", "no tenant named "+name)
+			return
+		}
+		if err := redisClient.HDel(ctx, TENANTS_KEY, name).Err(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delete(loaded, name)
+		applyTenants(loaded)
+		tenantLog.Info("tenant deleted", "tenant", name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Error code and message for settings that can't be saved, "" when valid.
+// An API key may belong to one tenant only, here or in API_KEY_TENANTS.
+func validateTenant(s tenantSettings, loaded map[string]tenantSettings) (string, string) {
+	for _, key := range s.APIKeys {
+		if key == "" {
+			return "invalid_api_key", "API keys can't be empty"
+		}
+		if owner, ok := tenants[key]; ok && owner != s.Tenant {
+			return "api_key_in_use", "API key already belongs to " + owner + " (API_KEY_TENANTS)"
+		}
+		for other, settings := range loaded {
+			for _, k := range settings.APIKeys {
+				if other != s.Tenant && k == key {
+					return "api_key_in_use", "API key already belongs to " + other
+				}
+			}
+		}
+	}
+	for _, raw := range append(append([]string{}, s.Webhooks...), s.Exports...) {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "invalid_url", "webhooks and exports must be http(s) URLs: " + raw
+		}
+	}
+	if s.RateLimit < 0 {
+		return "invalid_rate_limit", "rateLimit must be non-negative"
+	}
+	for processor, rate := range s.FeeRates {
+		if processorByName(processor) == nil || rate < 0 || rate >= 1 {
+			return "invalid_fee_rate", "fee rates need a known processor and a rate in [0, 1): " + processor
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// TLS ON THE MAIN LISTENER (TLS_CERT, TLS_KEY)
+// ============================================================================
+
+var (
+	tlsLog = componentLogger("tls")
+)
+
+type TLSConfig struct {
+	// PEM certificate (chain) and key; with both set the main listener
+	// speaks HTTPS, for either engine, so no terminating proxy is needed
+	Cert, Key string
+	// How often the files are checked for changes (0 disables; SIGHUP
+	// always reloads)
+	ReloadInterval time.Duration
+}
+
+func loadTLSConfig(env *envParser) TLSConfig {
+	c := TLSConfig{
+		Cert:           env.str("TLS_CERT", ""),
+		Key:            env.str("TLS_KEY", ""),
+		ReloadInterval: env.durationOrZero("TLS_RELOAD_INTERVAL", 10*time.Second),
+	}
+	if (c.Cert == "") != (c.Key == "") {
+		env.fail("TLS_CERT", c.Cert, "TLS_CERT and TLS_KEY must be set together")
+	}
+	return c
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.Cert != ""
+}
+
+// Current key pair, swapped whole on reload; handshakes pick it up from then
+// on, open connections keep theirs
+type certReloader struct {
+	cert              atomic.Pointer[tls.Certificate]
+	certMod, keyMod   time.Time
+	certFile, keyFile string
+}
+
+// Wraps ln in TLS when TLS_CERT/TLS_KEY are set. The files are read now
+// (an unreadable pair fails startup) and again on SIGHUP or when they change;
+// a pair that fails to load later is reported and the previous one kept.
+func withTLS(ln net.Listener, cfg TLSConfig) net.Listener {
+	if !cfg.enabled() {
+		return ln
+	}
+	r := &certReloader{certFile: cfg.Cert, keyFile: cfg.Key}
+	if err := r.load(); err != nil {
+		panic("TLS: " + err.Error())
+	}
+	go r.watch(cfg.ReloadInterval)
+	return tls.NewListener(ln, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.cert.Load(), nil
+		},
+	})
+}
+
+// Files that fail to load are not retried until they change again
+func (r *certReloader) load() error {
+	r.certMod, r.keyMod = modTime(r.certFile), modTime(r.keyFile)
+	pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&pair)
+	if leaf, err := x509.ParseCertificate(pair.Certificate[0]); err == nil {
+		tlsLog.Info("certificate loaded", "subject", leaf.Subject.String(), "notAfter", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Reloads on SIGHUP and, every interval, when either file's mtime moved
+// (renewals usually replace both, possibly a moment apart: the next tick
+// catches the second)
+func (r *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	for {
+		select {
+		case <-hup:
+			tlsLog.Info("SIGHUP, reloading certificate")
+		case <-tick:
+			if modTime(r.certFile).Equal(r.certMod) && modTime(r.keyFile).Equal(r.keyMod) {
+				continue
+			}
+		}
+		if err := r.load(); err != nil {
+			tlsLog.Error("certificate reload failed, keeping the previous one", "err", err)
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	if info, err := os.Stat(path); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
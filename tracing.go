@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// TRACING
+// ============================================================================
+
+var (
+	traceSampler sampler
+	traceExports = make(chan *trace, 4096)
+
+	metricTraces = newCounterVec("gateway_traces_total", "Finished traces by sampling decision.", "decision")
+
+	tracingLog = componentLogger("tracing")
+)
+
+// Decides which traces reach the collector. Start runs when the payment
+// arrives; Keep runs once it finishes, and only if Start said yes.
+type sampler interface {
+	Start() bool
+	Keep(t *trace) bool
+}
+
+type TracingConfig struct {
+	// off, always, ratio, rate (RateLimit traces/s cap) or tail (keep errors
+	// and payments slower than TailSlow, plus Ratio of the rest)
+	Sampler   string
+	Ratio     float64
+	RateLimit int
+	TailSlow  time.Duration
+	// OTLP/HTTP JSON collector, e.g. http://otel-collector:4318/v1/traces
+	Endpoint string
+}
+
+func loadTracingConfig(env *envParser) TracingConfig {
+	c := TracingConfig{
+		Sampler:   env.oneOf("TRACE_SAMPLER", "off", "off", "always", "ratio", "rate", "tail"),
+		Ratio:     env.float("TRACE_SAMPLE_RATIO", 0.01, 0, 1),
+		RateLimit: env.int("TRACE_RATE_LIMIT", 100, 0),
+		TailSlow:  env.duration("TRACE_TAIL_SLOW", 500*time.Millisecond),
+	}
+	if c.Sampler != "off" {
+		if os.Getenv("TRACE_ENDPOINT") == "" {
+			env.fail("TRACE_ENDPOINT", "", "is required when TRACE_SAMPLER is set")
+		} else {
+			c.Endpoint = env.url("TRACE_ENDPOINT", "")
+		}
+	}
+	return c
+}
+
+// Builds the sampler and starts the exporter
+func startTracing(cfg TracingConfig) {
+	switch cfg.Sampler {
+	case "off":
+		return
+	case "always":
+		traceSampler = alwaysSampler{}
+	case "ratio":
+		traceSampler = ratioSampler{ratio: cfg.Ratio}
+	case "rate":
+		traceSampler = newRateSampler(cfg.RateLimit)
+	case "tail":
+		traceSampler = tailSampler{slow: cfg.TailSlow, ratio: cfg.Ratio}
+	}
+	go exportTraces(cfg.Endpoint)
+}
+
+type alwaysSampler struct{}
+
+func (alwaysSampler) Start() bool        { return true }
+func (alwaysSampler) Keep(t *trace) bool { return true }
+
+type ratioSampler struct{ ratio float64 }
+
+func (s ratioSampler) Start() bool        { return mathrand.Float64() < s.ratio }
+func (s ratioSampler) Keep(t *trace) bool { return true }
+
+// Token bucket refilled every second
+type rateSampler struct {
+	mu     sync.Mutex
+	limit  int
+	tokens int
+	reset  time.Time
+}
+
+func newRateSampler(perSecond int) *rateSampler {
+	return &rateSampler{limit: perSecond, tokens: perSecond, reset: time.Now().Add(time.Second)}
+}
+
+func (s *rateSampler) Start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := time.Now(); now.After(s.reset) {
+		s.tokens, s.reset = s.limit, now.Add(time.Second)
+	}
+	if s.tokens == 0 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+func (s *rateSampler) Keep(t *trace) bool { return true }
+
+// Records everything and decides at the end: costs span bookkeeping on
+// every payment but only exports the interesting ones
+type tailSampler struct {
+	slow  time.Duration
+	ratio float64
+}
+
+func (tailSampler) Start() bool { return true }
+
+func (s tailSampler) Keep(t *trace) bool {
+	return t.failed || t.end.Sub(t.start) >= s.slow || mathrand.Float64() < s.ratio
+}
+
+// ----------------------------------------------------------------------------
+// Traces and spans
+// ----------------------------------------------------------------------------
+
+// One payment from ingest to outcome. A nil *trace (not sampled) is valid
+// everywhere and records nothing.
+type trace struct {
+	id         [16]byte
+	root       [8]byte
+	remote     [8]byte // Parent span from an incoming traceparent
+	name       string
+	start, end time.Time
+	failed     bool
+
+	mu    sync.Mutex
+	attrs map[string]string // On the root span
+	spans []span
+}
+
+type span struct {
+	id         [8]byte
+	name       string
+	start, end time.Time
+	attrs      map[string]string
+	failed     bool
+}
+
+// Span in progress; End records it on the trace
+type activeSpan struct {
+	t *trace
+	span
+}
+
+// Starts a trace for an incoming request, continuing its W3C traceparent
+// when present. An upstream "sampled" flag is honoured over the local
+// head decision.
+func startTrace(traceparent, name string) *trace {
+	if traceSampler == nil || shedding("tracing") {
+		return nil
+	}
+	t := &trace{name: name, start: time.Now()}
+	upstreamSampled := false
+	if parts := strings.Split(traceparent, "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		if _, err := hex.Decode(t.id[:], []byte(parts[1])); err == nil {
+			_, _ = hex.Decode(t.remote[:], []byte(parts[2]))
+			upstreamSampled = parts[3] == "01"
+		}
+	}
+	if !upstreamSampled && !traceSampler.Start() {
+		return nil
+	}
+	if t.id == ([16]byte{}) {
+		_, _ = rand.Read(t.id[:])
+	}
+	_, _ = rand.Read(t.root[:])
+	return t
+}
+
+func (t *trace) StartSpan(name string) *activeSpan {
+	if t == nil {
+		return nil
+	}
+	s := &activeSpan{t: t, span: span{name: name, start: time.Now()}}
+	_, _ = rand.Read(s.id[:])
+	return s
+}
+
+func (t *trace) SetAttr(key, value string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.attrs == nil {
+		t.attrs = make(map[string]string)
+	}
+	t.attrs[key] = value
+}
+
+// Records a span that already happened, such as the wait between two
+// points in the pipeline
+func (t *trace) AddSpan(name string, start, end time.Time) {
+	if t == nil || start.IsZero() {
+		return
+	}
+	s := span{name: name, start: start, end: end}
+	_, _ = rand.Read(s.id[:])
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+}
+
+func (s *activeSpan) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+}
+
+func (s *activeSpan) End(failed bool) {
+	if s == nil {
+		return
+	}
+	s.end, s.failed = time.Now(), failed
+	s.t.mu.Lock()
+	s.t.spans = append(s.t.spans, s.span)
+	s.t.mu.Unlock()
+}
+
+// Closes the trace and hands it to the exporter if the sampler keeps it
+func (t *trace) Finish(failed bool) {
+	if t == nil {
+		return
+	}
+	t.end, t.failed = time.Now(), failed
+	if !traceSampler.Keep(t) {
+		metricTraces.Inc("dropped")
+		return
+	}
+	select {
+	case traceExports <- t:
+		metricTraces.Inc("kept")
+	default:
+		metricTraces.Inc("overflow")
+	}
+}
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context, t *trace) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+func traceFrom(ctx context.Context) *trace {
+	t, _ := ctx.Value(traceKey{}).(*trace)
+	return t
+}
+
+// ----------------------------------------------------------------------------
+// OTLP/HTTP JSON export
+// ----------------------------------------------------------------------------
+
+func exportTraces(endpoint string) {
+	const batchSize = 256
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var batch []*trace
+	for {
+		select {
+		case t := <-traceExports:
+			if batch = append(batch, t); len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := postTraces(endpoint, batch); err != nil {
+			tracingLog.Warn("trace export failed", "traces", len(batch), "err", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       struct {
+		Code int `json:"code"` // 0 unset, 2 error
+	} `json:"status"`
+}
+
+func newOTLPAttr(key, value string) otlpAttr {
+	a := otlpAttr{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+func newOTLPSpan(traceID string, id, parent [8]byte, name string, kind int, start, end time.Time, failed bool) otlpSpan {
+	s := otlpSpan{
+		TraceID: traceID,
+		SpanID:  hex.EncodeToString(id[:]),
+		Name:    name,
+		Kind:    kind,
+		Start:   strconv.FormatInt(start.UnixNano(), 10),
+		End:     strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if parent != ([8]byte{}) {
+		s.ParentSpanID = hex.EncodeToString(parent[:])
+	}
+	if failed {
+		s.Status.Code = 2
+	}
+	return s
+}
+
+func postTraces(endpoint string, batch []*trace) error {
+	var spans []otlpSpan
+	for _, t := range batch {
+		traceID := hex.EncodeToString(t.id[:])
+		root := newOTLPSpan(traceID, t.root, t.remote, t.name, 2, t.start, t.end, t.failed)
+		t.mu.Lock()
+		for k, v := range t.attrs {
+			root.Attributes = append(root.Attributes, newOTLPAttr(k, v))
+		}
+		spans = append(spans, root)
+		for _, s := range t.spans {
+			child := newOTLPSpan(traceID, s.id, t.root, s.name, 1, s.start, s.end, s.failed)
+			for k, v := range s.attrs {
+				child.Attributes = append(child.Attributes, newOTLPAttr(k, v))
+			}
+			spans = append(spans, child)
+		}
+		t.mu.Unlock()
+	}
+
+	body, err := jsonFast.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []otlpAttr{
+				newOTLPAttr("service.name", SERVICE_NAME),
+				newOTLPAttr("service.instance.id", INSTANCE_ID),
+			}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "rinha-payment-gateway"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
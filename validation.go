@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// ============================================================================
+// PAYMENT VALIDATION
+// ============================================================================
+
+var (
+	// Set by setupInfrastructure
+	amountBounds AmountConfig
+
+	// jsonFast plus unknown-field rejection
+	jsonStrict = jsoniter.Config{
+		EscapeHTML:             true,
+		SortMapKeys:            true,
+		ValidateJsonRawMessage: true,
+		DisallowUnknownFields:  true,
+	}.Froze()
+)
+
+// Accepted amount range, inclusive; a Max of 0 means unbounded
+type AmountConfig struct {
+	Min, Max Cents
+}
+
+func loadAmountConfig(env *envParser) AmountConfig {
+	c := AmountConfig{
+		Min: env.amount("PAYMENT_AMOUNT_MIN", 1),
+		Max: env.amount("PAYMENT_AMOUNT_MAX", 0),
+	}
+	if c.Max > 0 && c.Max < c.Min {
+		env.fail("PAYMENT_AMOUNT_MAX", c.Max.String(), "must be at least PAYMENT_AMOUNT_MIN")
+	}
+	return c
+}
+
+// Rejection reason, written as {"error": code, "message": ...}
+type validationError struct {
+	code    string
+	message string
+}
+
+func (e *validationError) response() *ingestResponse {
+	return &ingestResponse{status: http.StatusBadRequest, body: jsonErrorBody(e.code, e.message)}
+}
+
+// Decodes POST /payments strictly: unknown fields, a correlationId that is
+// not a UUID and amounts outside the bounds are all rejected. A missing
+// correlationId is left to the caller's CORRELATION_ID_POLICY.
+func decodePayment(body []byte) (PostPayments, *validationError) {
+	var in struct {
+		PostPayments
+		CallbackUrl string `json:"callbackUrl"`
+	}
+	if err := jsonStrict.Unmarshal(body, &in); err != nil {
+		return in.PostPayments, decodeError(err.Error())
+	}
+	p := in.PostPayments
+	if in.CallbackUrl != "" {
+		if !perPaymentCallbacks() {
+			return p, &validationError{"unknown_field", "unknown field callbackUrl"}
+		}
+		if !validCallbackURL(in.CallbackUrl) {
+			return p, &validationError{"invalid_callback_url", "callbackUrl must be an http(s) URL"}
+		}
+		p.callbackURL = in.CallbackUrl
+	}
+	if p.Currency != "" {
+		code, ok := acceptedCurrency(p.Currency)
+		if !ok {
+			return p, &validationError{"invalid_currency", "currency " + code + " is not an accepted ISO 4217 code"}
+		}
+		p.Currency = code
+	}
+	if p.CorrelationId != "" && !isUUID(p.CorrelationId) {
+		return p, &validationError{"invalid_correlation_id", "correlationId must be a UUID"}
+	}
+	if p.Amount < amountBounds.Min {
+		return p, &validationError{"amount_too_small", "amount must be at least " + amountBounds.Min.String()}
+	}
+	if amountBounds.Max > 0 && p.Amount > amountBounds.Max {
+		return p, &validationError{"amount_too_large", "amount must be at most " + amountBounds.Max.String()}
+	}
+	return p, nil
+}
+
+// jsoniter only reports strings; pick the useful part out of them
+func decodeError(msg string) *validationError {
+	if _, field, ok := strings.Cut(msg, "found unknown field: "); ok {
+		field, _, _ = strings.Cut(field, ",")
+		return &validationError{"unknown_field", "unknown field " + field}
+	}
+	if _, amount, ok := strings.Cut(msg, "invalid amount "); ok {
+		amount, _, _ = strings.Cut(amount, ",")
+		return &validationError{"invalid_amount", "amount " + amount + " is not a decimal with at most 2 places"}
+	}
+	return &validationError{"invalid_json", "body must be a JSON payment object"}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ============================================================================
+// TIMEOUT VERIFICATION
+// ============================================================================
+
+var (
+	// A forward that timed out may still have been accepted. Before retrying
+	// or falling back, ask the processor (GET /payments/{correlationId})
+	// whether it has the payment; false treats timeouts as plain failures.
+	VERIFY_TIMEOUTS = getEnv("VERIFY_TIMEOUTS", "true")
+
+	// Budget for that lookup
+	VERIFY_TIMEOUT = getEnv("VERIFY_TIMEOUT", "1s")
+
+	verification = newVerifier()
+
+	metricVerifications = newCounterVec("gateway_forward_verifications_total", "Lookups after a timed-out forward, by result.", "result")
+)
+
+type verifier struct {
+	enabled bool
+	timeout time.Duration
+}
+
+func newVerifier() verifier {
+	timeout, err := time.ParseDuration(VERIFY_TIMEOUT)
+	if err != nil || timeout <= 0 {
+		panic("invalid VERIFY_TIMEOUT: " + VERIFY_TIMEOUT)
+	}
+	return verifier{enabled: VERIFY_TIMEOUTS == "true", timeout: timeout}
+}
+
+// Settles a timed-out forward: accepted when the processor has the payment,
+// absent when it doesn't (safe to send anywhere), still timed out when the
+// lookup fails too
+func (v verifier) resolve(ctx context.Context, p *Processor, payment PostPayments) forwardOutcome {
+	if !v.enabled {
+		return forwardRetryable
+	}
+	markProgress(ctx, payment, "verifying")
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	outcome, result := forwardTimedOut, "unknown"
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, p.BaseURL()+"/payments/"+url.PathEscape(payment.CorrelationId), nil)
+	if resp, err := p.client.Do(req); err == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			outcome, result = forwardAccepted, "found"
+		case http.StatusNotFound:
+			outcome, result = forwardAbsent, "absent"
+		}
+	}
+	metricVerifications.Inc(result)
+	return outcome
+}
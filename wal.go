@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ============================================================================
+// INGEST WRITE-AHEAD LOG (STRICT DURABILITY)
+// ============================================================================
+
+var (
+	// STRICT_DURABILITY: persist every payment to a Redis stream before
+	// answering 201. Set by setupInfrastructure.
+	durableIngest bool
+
+	// Per-instance stream so replicas never replay each other's entries
+	WAL_NAME = getEnv("WAL_NAME", hostnameOr("gateway"))
+	walKey   = "payments:wal:" + WAL_NAME
+
+	walLog = componentLogger("wal")
+)
+
+func strictDurability() bool {
+	return durableIngest
+}
+
+// Appends the payment to the WAL and returns the entry ID
+func walAppend(ctx context.Context, payment PostPayments) (string, error) {
+	data, err := encodeQueued(payment)
+	if err != nil {
+		return "", err
+	}
+	defer metricRedisLatency.Since("wal_append", time.Now())
+	return redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: walKey,
+		Values: []interface{}{"p", data, "tenant", payment.tenant, "callback", payment.callbackURL, "namespace", payment.namespace, "sandbox", payment.sandbox, "instance", INSTANCE_ID},
+	}).Result()
+}
+
+// Drops an entry once its outcome has been recorded
+func walRemove(id string) {
+	if id == "" {
+		return
+	}
+	_ = redisClient.XDel(context.Background(), walKey, id).Err()
+}
+
+// Re-enqueues every entry left behind by a previous run of this instance
+func walRecover() int {
+	if !strictDurability() {
+		return 0
+	}
+	ctx := context.Background()
+	recovered := 0
+	start := "-"
+	for {
+		entries, err := redisClient.XRangeN(ctx, walKey, start, "+", 1000).Result()
+		if err != nil {
+			walLog.Error("wal recovery failed", "recovered", recovered, "err", err)
+			return recovered
+		}
+		for _, entry := range entries {
+			var payment PostPayments
+			data, _ := entry.Values["p"].(string)
+			if err := decodeQueued(data, &payment); err != nil {
+				walRemove(entry.ID)
+				continue
+			}
+			payment.tenant, _ = entry.Values["tenant"].(string)
+			payment.callbackURL, _ = entry.Values["callback"].(string)
+			payment.namespace, _ = entry.Values["namespace"].(string)
+			payment.sandbox = entry.Values["sandbox"] == "1"
+			paymentQueue <- paymentJob{PostPayments: payment, ctx: context.Background(), walID: entry.ID}
+			recovered++
+		}
+		if len(entries) < 1000 {
+			return recovered
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+}
+
+func hostnameOr(fallback string) string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return fallback
+}
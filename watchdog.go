@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"time"
+)
+
+// ============================================================================
+// STALL WATCHDOG
+// ============================================================================
+
+type WatchdogConfig struct {
+	// Queue growing with no payment finished for this long is a stall (0 disables)
+	Stall time.Duration
+	// Replace the whole worker pool when a stall is detected
+	Restart bool
+}
+
+func loadWatchdogConfig(env *envParser) WatchdogConfig {
+	return WatchdogConfig{
+		Stall:   env.durationOrZero("WATCHDOG_STALL", 30*time.Second),
+		Restart: env.bool("WATCHDOG_RESTART", false),
+	}
+}
+
+func startWatchdog(cfg WatchdogConfig) {
+	if cfg.Stall == 0 {
+		return
+	}
+	stall := cfg.Stall
+
+	go func() {
+		lastProcessed := totalProcessed()
+		lastProgress := time.Now()
+		depthAtProgress := len(paymentQueue)
+		alerted := false
+
+		for range time.Tick(time.Second) {
+			processed, depth := totalProcessed(), len(paymentQueue)
+			if processed != lastProcessed {
+				lastProcessed, lastProgress, depthAtProgress, alerted = processed, time.Now(), depth, false
+				continue
+			}
+			stalledFor := time.Since(lastProgress)
+			if alerted || stalledFor < stall || depth <= depthAtProgress {
+				continue
+			}
+
+			alerted = true
+			fmt.Fprintf(os.Stderr, "watchdog: no payment finished for %s, queue depth %d -> %d\n",
+				stalledFor.Round(time.Second), depthAtProgress, depth)
+			_ = pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+			sendAlert("worker_stall", "payment workers stalled while the queue grows", map[string]interface{}{
+				"stalledSeconds": int(stalledFor.Seconds()),
+				"queueDepth":     depth,
+				"workers":        workerSnapshots(),
+			})
+
+			if cfg.Restart {
+				restartWorkers()
+				lastProgress, depthAtProgress, alerted = time.Now(), depth, false
+			}
+		}
+	}()
+}
+
+func totalProcessed() int64 {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	total := removedProcessed.Load()
+	for _, w := range workers {
+		total += w.processed.Load()
+	}
+	return total
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// WEBHOOK SIGNING
+// ============================================================================
+
+var (
+	// HMAC-SHA256 key for outgoing webhooks (empty sends them unsigned).
+	// During a rotation set the old key as WEBHOOK_SECRET_PREVIOUS: every
+	// delivery carries a signature for each, so receivers can switch over
+	// at their own pace.
+	WEBHOOK_SECRET          = getEnv("WEBHOOK_SECRET", "")
+	WEBHOOK_SECRET_PREVIOUS = getEnv("WEBHOOK_SECRET_PREVIOUS", "")
+)
+
+// Adds Webhook-Id and Webhook-Signature ("t=<unix>,v1=<hex>[,v1=<hex>]").
+// Each v1 is HMAC-SHA256(secret, "<id>.<t>.<body>"); receivers should
+// reject timestamps outside a few minutes and ids they have already seen.
+func signWebhook(req *http.Request, body []byte) {
+	signWebhookID(req, newUUIDv7(), body)
+}
+
+// Like signWebhook with a given Webhook-Id, kept across redeliveries
+func signWebhookID(req *http.Request, id string, body []byte) {
+	if WEBHOOK_SECRET == "" {
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	header := "t=" + ts
+	for _, secret := range []string{WEBHOOK_SECRET, WEBHOOK_SECRET_PREVIOUS} {
+		if secret != "" {
+			header += ",v1=" + webhookSignature(secret, id, ts, body)
+		}
+	}
+	req.Header.Set("Webhook-Id", id)
+	req.Header.Set("Webhook-Signature", header)
+}
+
+func webhookSignature(secret, id, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + "." + ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
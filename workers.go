@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// WORKER STATISTICS
+// ============================================================================
+
+var (
+	workersMu sync.Mutex
+	workers   []*worker
+
+	// Workers currently holding a payment
+	busyWorkers atomic.Int64
+
+	// Payments processed by workers the autoscaler removed, so totals
+	// don't drop when the pool shrinks
+	removedProcessed atomic.Int64
+)
+
+// Payment worker and its live counters
+type worker struct {
+	ID  int
+	log *slog.Logger
+
+	ctx  context.Context // Cancelled when the watchdog retires the worker
+	stop context.CancelFunc
+	// Closed when the autoscaler shrinks the pool: exit after the current job
+	leave chan struct{}
+
+	processed atomic.Int64
+	retries   atomic.Int64
+	fallbacks atomic.Int64
+	failures  atomic.Int64
+
+	mu      sync.Mutex
+	state   string
+	current string // correlationId being handled
+	since   time.Time
+}
+
+// Snapshot served by /admin/workers
+type workerSnapshot struct {
+	ID             int     `json:"id"`
+	State          string  `json:"state"`
+	CurrentPayment string  `json:"currentPayment,omitempty"`
+	StateSeconds   float64 `json:"stateSeconds"`
+	Processed      int64   `json:"processed"`
+	Retries        int64   `json:"retries"`
+	Fallbacks      int64   `json:"fallbacks"`
+	Failures       int64   `json:"failures"`
+}
+
+func newWorker(id int) *worker {
+	ctx, stop := context.WithCancel(context.Background())
+	return &worker{ID: id, log: componentLogger("worker").With("worker", id), ctx: ctx, stop: stop, leave: make(chan struct{}), state: "idle", since: time.Now()}
+}
+
+// Adds a worker to the pool and starts it
+func startWorker() {
+	workersMu.Lock()
+	w := newWorker(len(workers))
+	workers = append(workers, w)
+	workersMu.Unlock()
+	go processPayments(w, paymentQueue)
+}
+
+// Removes up to n workers from the end of the pool; each finishes the
+// payment it holds before exiting. Returns how many were removed.
+func stopWorkers(n, keep int) int {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	removed := 0
+	for ; removed < n && len(workers) > keep; removed++ {
+		w := workers[len(workers)-1]
+		workers = workers[:len(workers)-1]
+		close(w.leave)
+	}
+	return removed
+}
+
+// Retires every worker (aborting in-flight processor calls, which are
+// requeued) and starts a fresh one in each slot
+func restartWorkers() {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	for i, old := range workers {
+		old.stop()
+		w := newWorker(old.ID)
+		workers[i] = w
+		go processPayments(w, paymentQueue)
+	}
+}
+
+// Derives the context for one payment: done when either the submitting
+// request or the worker ends
+func (w *worker) bind(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(w.ctx, cancel)
+	return ctx, func() { stop(); cancel() }
+}
+
+// Retired by the watchdog
+func (w *worker) retired() bool {
+	return w.ctx.Err() != nil
+}
+
+// Records a state transition ("idle", "forwarding:default", "backoff", ...)
+func (w *worker) setState(state, correlationId string) {
+	w.mu.Lock()
+	w.state = state
+	w.current = correlationId
+	w.since = time.Now()
+	w.mu.Unlock()
+}
+
+func (w *worker) snapshot() workerSnapshot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return workerSnapshot{
+		ID:             w.ID,
+		State:          w.state,
+		CurrentPayment: w.current,
+		StateSeconds:   time.Since(w.since).Seconds(),
+		Processed:      w.processed.Load(),
+		Retries:        w.retries.Load(),
+		Fallbacks:      w.fallbacks.Load(),
+		Failures:       w.failures.Load(),
+	}
+}
+
+func workerSnapshots() []workerSnapshot {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	snapshots := make([]workerSnapshot, len(workers))
+	for i, w := range workers {
+		snapshots[i] = w.snapshot()
+	}
+	return snapshots
+}
+
+func workerCount() int {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	return len(workers)
+}